@@ -27,6 +27,11 @@ type Identity struct {
 	Subject     *pb.SubjectReference
 }
 
+// ContextWithIdentity returns a copy of ctx carrying id as the authenticated identity.
+func ContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
 func IdentityFromContext(ctx context.Context) (*Identity, error) {
 	id, ok := ctx.Value(identityKey).(*Identity)
 	if !ok {
@@ -80,7 +85,7 @@ func TLSAuth(ctx context.Context) (context.Context, error) {
 			Info("Client certificate unusable.")
 		return ctx, nil
 	}
-	return context.WithValue(ctx, identityKey, &Identity{
+	return ContextWithIdentity(ctx, &Identity{
 		DisplayName: userName,
 		Subject:     subject,
 	}), nil
@@ -0,0 +1,43 @@
+package authz
+
+import (
+	"context"
+
+	pb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/hxtk/yggdrasil/common/authn"
+)
+
+// CheckPermission reports whether the authenticated caller has a permission on a resource.
+//
+// This is intended for authorization decisions which depend on the state of
+// the resource being operated upon and therefore cannot be made by the
+// interceptor from the request alone. If the request was authorized by
+// the interceptor, the decision is made at least as fresh as the ZedToken
+// embedded in the context.
+func CheckPermission(ctx context.Context, client pb.PermissionsServiceClient, resource *pb.ObjectReference, permission string) (bool, error) {
+	identity, err := authn.IdentityFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	req := &pb.CheckPermissionRequest{
+		Resource:   resource,
+		Permission: permission,
+		Subject:    identity.Subject,
+	}
+	if token, err := ZedTokenFromContext(ctx); err == nil {
+		req.Consistency = &pb.Consistency{
+			Requirement: &pb.Consistency_AtLeastAsFresh{
+				AtLeastAsFresh: token,
+			},
+		}
+	}
+
+	decision, err := client.CheckPermission(ctx, req)
+	if err != nil {
+		return false, err
+	}
+
+	return decision.GetPermissionship() == pb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION, nil
+}
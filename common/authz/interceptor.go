@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -56,8 +58,9 @@ type Registrar interface {
 // [2]: https://docs.authzed.com/
 // [3]: https://research.google/pubs/pub48190/
 type ResourceAuthorizer struct {
-	authzClient    pb.PermissionsServiceClient
-	rpcPermissions map[string]*v1alpha1.PermissionsRule
+	authzClient     pb.PermissionsServiceClient
+	rpcPermissions  map[string]*v1alpha1.PermissionsRule
+	allowedServices map[string]bool
 }
 
 var _ Registrar = new(ResourceAuthorizer)
@@ -75,6 +78,30 @@ func (ra *ResourceAuthorizer) RegisterPermission(rpc string, perm *v1alpha1.Perm
 	ra.rpcPermissions[rpc] = perm
 }
 
+// AllowService exempts every rpc of a service from authorization.
+//
+// This is intended for infrastructure services such as server reflection,
+// whose methods have no permission annotations and operate on no resource.
+// Callers of an allowed service must still be authenticated. Like
+// RegisterPermission, this method is not thread-safe.
+func (ra *ResourceAuthorizer) AllowService(service string) {
+	if ra.allowedServices == nil {
+		ra.allowedServices = make(map[string]bool)
+	}
+
+	ra.allowedServices[service] = true
+}
+
+// allowed reports whether method, in the form "/package.Service/Method",
+// belongs to an allowed service.
+func (ra *ResourceAuthorizer) allowed(method string) bool {
+	service := strings.TrimPrefix(method, "/")
+	if i := strings.LastIndex(service, "/"); i >= 0 {
+		service = service[:i]
+	}
+	return ra.allowedServices[service]
+}
+
 // UnaryServerInterceptor returns an interceptor for checking authorization.
 //
 // Authorization checks are tied to a particular moment in time in order to
@@ -93,45 +120,147 @@ func (ra *ResourceAuthorizer) RegisterPermission(rpc string, perm *v1alpha1.Perm
 // [1]: https://docs.authzed.com/reference/api-consistency
 func (ra *ResourceAuthorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		identity, err := authn.IdentityFromContext(ctx)
-		if err != nil {
-			return nil, status.Error(codes.Unauthenticated, "No client identity found.")
+		if ra.allowed(info.FullMethod) {
+			return handler(ctx, req)
 		}
 
-		perms, ok := ra.rpcPermissions[info.FullMethod]
-		if !ok {
-			return nil, status.Error(codes.Internal, "Could not determine required permissions.")
+		ctx, err := ra.authorize(ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
 		}
 
-		msg, ok := req.(proto.Message)
-		if !ok {
-			return nil, status.Errorf(codes.Internal, "Message was of type %T; expected proto.Message", msg)
-		}
+		return handler(ctx, req)
+	}
+}
 
-		name, err := getResourceName(msg.ProtoReflect())
-		if err != nil {
-			return nil, err
+// StreamServerInterceptor returns an interceptor for checking authorization of streaming RPCs.
+//
+// Authorization is checked against every message received from the client
+// which identifies an operand resource in the same way as the request of a
+// unary RPC, so that a client cannot name one resource in its first message
+// and another in a later one. The first message is always checked; later
+// messages which identify no resource continue under the authorization of
+// those before them. No messages may be sent to the client before the first
+// authorization succeeds. Once it does, its ZedToken is embedded in the
+// stream's context as described for UnaryServerInterceptor.
+func (ra *ResourceAuthorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if ra.allowed(info.FullMethod) {
+			return handler(srv, ss)
 		}
 
-		decision, err := ra.authzClient.CheckPermission(ctx, &pb.CheckPermissionRequest{
-			Resource: &pb.ObjectReference{
-				ObjectType: perms.GetResourceType(),
-				ObjectId:   name,
-			},
-			Permission: perms.GetPermission(),
-			Subject:    identity.Subject,
+		return handler(srv, &authorizedStream{
+			ServerStream: ss,
+			ra:           ra,
+			method:       info.FullMethod,
 		})
+	}
+}
 
-		if err != nil {
-			return nil, status.Error(codes.Unavailable, "Permission check could not be processed.")
-		}
+// authorizedStream is a grpc.ServerStream which authorizes the messages it receives.
+type authorizedStream struct {
+	grpc.ServerStream
+
+	ra     *ResourceAuthorizer
+	method string
 
-		if decision.GetPermissionship() != pb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION {
-			return nil, status.Error(codes.PermissionDenied, "User does not have permission to perform this action.")
+	// mu guards ctx, since messages may be received and sent concurrently.
+	mu sync.Mutex
+
+	// ctx is the context of the first authorization, or nil if no message
+	// has been authorized yet.
+	ctx context.Context
+}
+
+func (s *authorizedStream) authorized() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx
+}
+
+func (s *authorizedStream) Context() context.Context {
+	if ctx := s.authorized(); ctx != nil {
+		return ctx
+	}
+	return s.ServerStream.Context()
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	// Messages which identify no resource, such as heartbeats, continue
+	// under the authorization of the stream's earlier messages.
+	if s.authorized() != nil {
+		if msg, ok := m.(proto.Message); ok {
+			if name, err := getResourceName(msg.ProtoReflect()); err == nil && name == "" {
+				return nil
+			}
 		}
+	}
+
+	ctx, err := s.ra.authorize(s.ServerStream.Context(), s.method, m)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx = ctx
+	}
+	return nil
+}
+
+func (s *authorizedStream) SendMsg(m interface{}) error {
+	if s.authorized() == nil {
+		return status.Error(codes.PermissionDenied, "Request has not been authorized.")
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// authorize checks that the caller may invoke method with req, returning a
+// context carrying the ZedToken at which the decision was made.
+func (ra *ResourceAuthorizer) authorize(ctx context.Context, method string, req interface{}) (context.Context, error) {
+	identity, err := authn.IdentityFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "No client identity found.")
+	}
+
+	perms, ok := ra.rpcPermissions[method]
+	if !ok {
+		return nil, status.Error(codes.Internal, "Could not determine required permissions.")
+	}
+
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "Message was of type %T; expected proto.Message", msg)
+	}
 
-		return handler(context.WithValue(ctx, zedTokenKey, decision.CheckedAt), req)
+	name, err := getResourceName(msg.ProtoReflect())
+	if err != nil {
+		return nil, err
 	}
+
+	decision, err := ra.authzClient.CheckPermission(ctx, &pb.CheckPermissionRequest{
+		Resource: &pb.ObjectReference{
+			ObjectType: perms.GetResourceType(),
+			ObjectId:   name,
+		},
+		Permission: perms.GetPermission(),
+		Subject:    identity.Subject,
+	})
+
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Permission check could not be processed.")
+	}
+
+	if decision.GetPermissionship() != pb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION {
+		return nil, status.Error(codes.PermissionDenied, "User does not have permission to perform this action.")
+	}
+
+	return context.WithValue(ctx, zedTokenKey, decision.CheckedAt), nil
 }
 
 type namer interface {
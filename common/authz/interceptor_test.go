@@ -1,9 +1,19 @@
 package authz
 
 import (
+	"context"
+	"io"
+	"reflect"
 	"testing"
 
+	pb "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/hxtk/yggdrasil/common/authn"
+	"github.com/hxtk/yggdrasil/common/authz/v1alpha1"
 )
 
 func TestGetResourceName(t *testing.T) {
@@ -52,3 +62,154 @@ func TestGetResourceName(t *testing.T) {
 		}
 	}
 }
+
+// fakePermissions grants every permission on the resources it names.
+type fakePermissions struct {
+	pb.PermissionsServiceClient
+
+	granted map[string]bool
+	checked []string
+}
+
+func (f *fakePermissions) CheckPermission(ctx context.Context, req *pb.CheckPermissionRequest, opts ...grpc.CallOption) (*pb.CheckPermissionResponse, error) {
+	f.checked = append(f.checked, req.GetResource().GetObjectId())
+	permissionship := pb.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION
+	if f.granted[req.GetResource().GetObjectId()] {
+		permissionship = pb.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+	return &pb.CheckPermissionResponse{
+		CheckedAt:      &pb.ZedToken{Token: "token"},
+		Permissionship: permissionship,
+	}, nil
+}
+
+// fakeStream is a grpc.ServerStream which receives the given messages.
+type fakeStream struct {
+	grpc.ServerStream
+
+	ctx  context.Context
+	msgs []proto.Message
+	sent int
+}
+
+func (f *fakeStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeStream) RecvMsg(m interface{}) error {
+	if len(f.msgs) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), f.msgs[0])
+	f.msgs = f.msgs[1:]
+	return nil
+}
+
+func (f *fakeStream) SendMsg(m interface{}) error {
+	f.sent++
+	return nil
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		msgs    []proto.Message
+		code    codes.Code
+		checked []string
+	}{
+		{
+			name: "Every message is authorized",
+			msgs: []proto.Message{
+				&GetBookRequest{Name: "books/1"},
+				&GetBookRequest{Name: "books/2"},
+			},
+			checked: []string{"books/1", "books/2"},
+		},
+		{
+			name: "Later message names unauthorized resource",
+			msgs: []proto.Message{
+				&GetBookRequest{Name: "books/1"},
+				&GetBookRequest{Name: "books/3"},
+			},
+			code:    codes.PermissionDenied,
+			checked: []string{"books/1", "books/3"},
+		},
+		{
+			name: "Later message names no resource",
+			msgs: []proto.Message{
+				&GetBookRequest{Name: "books/1"},
+				&GetBookRequest{},
+			},
+			checked: []string{"books/1"},
+		},
+		{
+			name: "First message names no resource",
+			msgs: []proto.Message{
+				&GetBookRequest{},
+			},
+			code:    codes.PermissionDenied,
+			checked: []string{""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			perms := &fakePermissions{granted: map[string]bool{"books/1": true, "books/2": true}}
+			ra := &ResourceAuthorizer{authzClient: perms}
+			ra.RegisterPermission("/test.Library/WatchBooks", &v1alpha1.PermissionsRule{ResourceType: "books", Permission: "read"})
+
+			ctx := authn.ContextWithIdentity(context.Background(), &authn.Identity{
+				Subject: &pb.SubjectReference{Object: &pb.ObjectReference{ObjectType: "users", ObjectId: "alice"}},
+			})
+			ss := &fakeStream{ctx: ctx, msgs: tc.msgs}
+			info := &grpc.StreamServerInfo{FullMethod: "/test.Library/WatchBooks"}
+			err := ra.StreamServerInterceptor()(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+				for {
+					var req GetBookRequest
+					if err := stream.RecvMsg(&req); err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := stream.SendMsg(&Book{}); err != nil {
+						return err
+					}
+				}
+			})
+			if status.Code(err) != tc.code {
+				t.Errorf("Expected %v; got %v", tc.code, err)
+			}
+			if !reflect.DeepEqual(perms.checked, tc.checked) {
+				t.Errorf("Expected checks of %q; got %q", tc.checked, perms.checked)
+			}
+		})
+	}
+}
+
+func TestAllowService(t *testing.T) {
+	ra := new(ResourceAuthorizer)
+	ra.AllowService("grpc.reflection.v1.ServerReflection")
+
+	info := &grpc.StreamServerInfo{FullMethod: "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"}
+	ss := &fakeStream{ctx: context.Background(), msgs: []proto.Message{&ListBooksRequest{}}}
+	err := ra.StreamServerInterceptor()(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		var req ListBooksRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		return stream.SendMsg(&ListBooksResponse{})
+	})
+	if err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	info.FullMethod = "/test.Library/WatchBooks"
+	ss = &fakeStream{ctx: context.Background(), msgs: []proto.Message{&ListBooksRequest{}}}
+	err = ra.StreamServerInterceptor()(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		var req ListBooksRequest
+		return stream.RecvMsg(&req)
+	})
+	if err == nil {
+		t.Errorf("Expected error for method of service which is not allowed")
+	}
+}
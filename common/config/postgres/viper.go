@@ -11,7 +11,26 @@ import (
 	"github.com/spf13/viper"
 )
 
+// FromViper opens a database configured by the `postgres` key of v, applying
+// schema migrations from `postgres.schema` if it is set.
 func FromViper(v *viper.Viper) (*sql.DB, error) {
+	dsn := DSN(v)
+	if v.IsSet("postgres.schema") {
+		m, err := migrate.New(v.GetString("postgres.schema"), dsn)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+			return nil, err
+		}
+	}
+
+	return sql.Open("postgres", dsn)
+}
+
+// DSN returns the connection string of the database configured by the
+// `postgres` key of v.
+func DSN(v *viper.Viper) string {
 	postgresURL := &url.URL{
 		Scheme: "postgres",
 	}
@@ -53,16 +72,5 @@ func FromViper(v *viper.Viper) (*sql.DB, error) {
 	}
 
 	postgresURL.RawQuery = values.Encode()
-	dsn := postgresURL.String()
-	if v.IsSet("postgres.schema") {
-		m, err := migrate.New(v.GetString("postgres.schema"), dsn)
-		if err != nil {
-			return nil, err
-		}
-		if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-			return nil, err
-		}
-	}
-
-	return sql.Open("postgres", dsn)
+	return postgresURL.String()
 }
@@ -91,10 +91,19 @@ func New() *Server {
 			grpc_ctxtags.StreamServerInterceptor(),
 			grpc_logrus.StreamServerInterceptor(logrusEntry),
 			grpc_prometheus.StreamServerInterceptor,
+			grpc_auth.StreamServerInterceptor(authn.TLSAuth),
+			resourceAuthz.StreamServerInterceptor(),
 			grpc_validator.StreamServerInterceptor(),
 		),
 	)
 	reflection.Register(grpcServer)
+	// Reflection describes only the services which are served, and has no
+	// resource on which to check permissions.
+	for service := range grpcServer.GetServiceInfo() {
+		if strings.HasPrefix(service, "grpc.reflection.") {
+			resourceAuthz.AllowService(service)
+		}
+	}
 
 	//gwMux := runtime.NewServeMux()
 	mux := http.NewServeMux()
@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 Peter Sanders
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/agent/pkg/agent"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var cfgFile string
+
+// rootCmd represents the base command when called without any subcommands
+var rootCmd = &cobra.Command{
+	Use:   "toolproxy-agent",
+	Short: "Run commands on this host on behalf of the tool proxy",
+	Long: `Connect to the tool proxy as a registered agent and run the commands
+targeted at it, streaming back their output and results.
+
+The agent authenticates with its TLS client certificate, whose principal
+must be the one with which the agent was registered. On SIGTERM or SIGINT,
+the agent disconnects and terminates the commands it is running, which the
+tool proxy marks as LOST.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+		if err != nil {
+			log.WithError(err).Fatal("Error reading TLS Config")
+		}
+		if tlsConfig == nil {
+			log.Fatal("Agents must authenticate to the tool proxy with TLS.")
+		}
+
+		conn, err := grpc.Dial(
+			viper.GetString("addr"),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		if err != nil {
+			log.WithError(err).Fatal("Error connecting to tool proxy.")
+		}
+		defer conn.Close()
+
+		a := agent.New(pb.NewToolProxyClient(conn), "agents/"+viper.GetString("agent.id"))
+		a.Capacity = viper.GetInt("agent.capacity")
+		a.HeartbeatInterval = viper.GetDuration("agent.heartbeat_interval")
+		a.KillGracePeriod = viper.GetDuration("agent.kill_grace_period")
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		log.WithField("agent", a.Name).Info("Agent started.")
+		a.Run(ctx)
+		log.Info("Agent shut down.")
+	},
+}
+
+// Execute adds all child commands to the root command and sets flags appropriately.
+// This is called by main.main(). It only needs to happen once to the rootCmd.
+func Execute() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func init() {
+	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", cfgFile, "Path to configuration file.")
+}
+
+// initConfig reads in config file and ENV variables if set.
+func initConfig() {
+	if cfgFile != "" {
+		// Use config file from the flag.
+		viper.SetConfigFile(cfgFile)
+	} else {
+		// Find home directory.
+		home, err := homedir.Dir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Search config in home directory with name "agent.yaml" (without extension).
+		viper.AddConfigPath(home)
+		viper.AddConfigPath("/etc/toolproxy")
+		viper.SetConfigName("agent")
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		viper.SetDefault("agent.id", hostname)
+	}
+	viper.AutomaticEnv() // read in environment variables that match
+	viper.SetConfigType("yaml")
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	}
+}
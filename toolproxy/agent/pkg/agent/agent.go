@@ -0,0 +1,411 @@
+// Package agent runs commands on a remote host on behalf of the tool proxy.
+//
+// An agent holds a single bidirectional stream to the tool proxy, over which
+// it is assigned commands and streams back their output and results. The
+// tool proxy records everything; the agent keeps no state of its own, so
+// commands which are running when the stream is lost are terminated, and
+// the tool proxy marks them as LOST.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/hxtk/yggdrasil/toolproxy/inputs"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const (
+	defaultCapacity          = 1
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultKillGracePeriod   = 10 * time.Second
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Agent connects to the tool proxy as a registered agent and runs the
+// commands assigned to it.
+type Agent struct {
+	Client pb.ToolProxyClient
+
+	// Name is the resource name of the agent, e.g., `agents/db-host-1`.
+	Name string
+
+	// Capacity is the maximum number of commands the agent runs at once. If
+	// it is zero, commands are run one at a time.
+	Capacity int
+
+	// HeartbeatInterval is how often the agent records that it is alive. It
+	// must be well within the tool proxy's lease duration. If it is zero, a
+	// default of ten seconds is used.
+	HeartbeatInterval time.Duration
+
+	// KillGracePeriod is how long a command which has been sent SIGTERM has
+	// to exit before it is sent SIGKILL. If it is zero, a default of ten
+	// seconds is used.
+	KillGracePeriod time.Duration
+
+	mu      sync.Mutex
+	running map[string]*process
+}
+
+// New returns an agent with the given resource name which connects to the
+// tool proxy using client.
+func New(client pb.ToolProxyClient, name string) *Agent {
+	return &Agent{
+		Client: client,
+		Name:   name,
+	}
+}
+
+func (a *Agent) capacity() int {
+	if a.Capacity > 0 {
+		return a.Capacity
+	}
+	return defaultCapacity
+}
+
+func (a *Agent) heartbeatInterval() time.Duration {
+	if a.HeartbeatInterval > 0 {
+		return a.HeartbeatInterval
+	}
+	return defaultHeartbeatInterval
+}
+
+func (a *Agent) killGracePeriod() time.Duration {
+	if a.KillGracePeriod > 0 {
+		return a.KillGracePeriod
+	}
+	return defaultKillGracePeriod
+}
+
+// Run connects to the tool proxy and runs the commands assigned to the agent
+// until ctx is done, reconnecting with exponential backoff whenever the
+// connection is lost.
+func (a *Agent) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).Errorln("Connection to tool proxy lost.")
+
+		// A connection which lasted a while was healthy, so the next
+		// failure starts a new backoff sequence.
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// serve runs the commands assigned to the agent over a single connection
+// until it ends. Commands which are still running then are terminated,
+// since their results can no longer be reported.
+func (a *Agent) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	stream, err := a.Client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sendMu sync.Mutex
+	send := func(m *pb.AgentMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(m)
+	}
+
+	err = send(&pb.AgentMessage{
+		Message: &pb.AgentMessage_Hello{Hello: &pb.AgentHello{
+			Name:     a.Name,
+			Capacity: int32(a.capacity()),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	log.WithField("agent", a.Name).Infoln("Connected to tool proxy.")
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.heartbeat(ctx, send)
+	}()
+
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return errors.New("stream closed by tool proxy")
+		} else if err != nil {
+			return err
+		}
+
+		switch msg := m.GetMessage().(type) {
+		case *pb.ServerMessage_Assignment:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.execute(ctx, send, msg.Assignment)
+			}()
+		case *pb.ServerMessage_Cancellation:
+			a.mu.Lock()
+			p, ok := a.running[msg.Cancellation.GetCommand()]
+			a.mu.Unlock()
+			if ok {
+				p.terminate(pb.Status_CANCELED, a.killGracePeriod())
+			}
+		}
+	}
+}
+
+// heartbeat periodically records that the agent is alive until ctx is done.
+func (a *Agent) heartbeat(ctx context.Context, send func(*pb.AgentMessage) error) {
+	ticker := time.NewTicker(a.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := send(&pb.AgentMessage{
+				Message: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.AgentHeartbeat{}},
+			})
+			if err != nil {
+				log.WithError(err).Errorln("Error sending heartbeat.")
+			}
+		}
+	}
+}
+
+// execute runs an assigned command, sending its output as it is written and
+// its result once it exits. The command is terminated if it is canceled,
+// times out, or ctx is done.
+//
+// Commands always run in their own process group so that, if they are
+// terminated, any processes they start are terminated with them.
+func (a *Agent) execute(ctx context.Context, send func(*pb.AgentMessage) error, asg *pb.CommandAssignment) {
+	name := asg.GetCommand()
+	logger := log.WithField("command", name)
+	result := &pb.CommandResult{Command: name, Status: pb.Status_SUCCESS}
+
+	cmd, cleanup, err := command(asg)
+	if err == nil {
+		defer cleanup()
+		cmd.Stdout = &outputWriter{command: name, stream: pb.Stream_STDOUT, send: send}
+		cmd.Stderr = &outputWriter{command: name, stream: pb.Stream_STDERR, send: send}
+		err = cmd.Start()
+	}
+	if err != nil {
+		logger.WithError(err).Errorln("Error starting command.")
+		result.Status = pb.Status_ERROR
+		result.StartError = err.Error()
+		if err = send(&pb.AgentMessage{Message: &pb.AgentMessage_Result{Result: result}}); err != nil {
+			logger.WithError(err).Errorln("Error sending command result.")
+		}
+		return
+	}
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	a.register(name, p)
+	defer a.unregister(name)
+
+	if timeout := asg.GetTimeout().AsDuration(); asg.GetTimeout() != nil && timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			p.terminate(pb.Status_TIMED_OUT, a.killGracePeriod())
+		})
+		defer timer.Stop()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.terminate(pb.Status_CANCELED, a.killGracePeriod())
+		case <-p.done:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(p.done)
+
+	if reason := p.terminatedReason(); reason != pb.Status_UNDEFINED {
+		result.Status = reason
+	} else if err != nil {
+		result.Status = pb.Status_ERROR
+	}
+	setExitStatus(result, cmd.ProcessState)
+
+	if err = send(&pb.AgentMessage{Message: &pb.AgentMessage_Result{Result: result}}); err != nil {
+		logger.WithError(err).Errorln("Error sending command result.")
+	}
+}
+
+// command returns the process which runs an assigned command, and a function
+// which removes its input files once it has finished. The command's
+// environment variables are added to those of the agent.
+func command(asg *pb.CommandAssignment) (*exec.Cmd, func(), error) {
+	if len(asg.GetArgv()) == 0 {
+		return nil, nil, fmt.Errorf("command has no argv")
+	}
+
+	argv, cleanup, err := inputs.Materialize(asg.GetArgv(), asg.GetInputs(), nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("writing input files: %v", err)
+	}
+
+	// #nosec G204 The purpose of this program is to launch arbitrary processes
+	// in a way that can be monitored and audited more easily than an interactive
+	// shell.
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if stdin := asg.GetInputs().GetStdin(); len(stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if len(asg.GetEnv()) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range asg.GetEnv() {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	return cmd, cleanup, nil
+}
+
+// setExitStatus records how a command which ended in state exited.
+func setExitStatus(r *pb.CommandResult, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		r.Signal = unix.SignalName(ws.Signal())
+	} else {
+		r.ExitCode = wrapperspb.Int32(int32(state.ExitCode()))
+	}
+
+	r.ResourceUsage = &pb.ResourceUsage{
+		UserCpuTime:   durationpb.New(state.UserTime()),
+		SystemCpuTime: durationpb.New(state.SystemTime()),
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// On Linux, the maximum resident set size is in kilobytes.
+		r.ResourceUsage.MaxRssBytes = ru.Maxrss * 1024
+	}
+}
+
+// outputWriter sends output written by a command to the tool proxy.
+type outputWriter struct {
+	command string
+	stream  pb.Stream
+	send    func(*pb.AgentMessage) error
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	err := w.send(&pb.AgentMessage{
+		Message: &pb.AgentMessage_Output{Output: &pb.AgentOutput{
+			Command: w.command,
+			Stream:  w.stream,
+			Data:    append([]byte(nil), p...),
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// process is a command being run by the agent.
+type process struct {
+	cmd *exec.Cmd
+
+	// done is closed once the command has exited.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// reason is CANCELED or TIMED_OUT if the command has been terminated.
+	reason pb.Status
+}
+
+// terminate sends SIGTERM to the command's process group and, if it has not
+// exited after grace, SIGKILL. The reason the command was terminated is
+// recorded; if it has already been terminated, terminate has no effect.
+func (p *process) terminate(reason pb.Status, grace time.Duration) {
+	p.mu.Lock()
+	if p.reason != pb.Status_UNDEFINED {
+		p.mu.Unlock()
+		return
+	}
+	p.reason = reason
+	p.mu.Unlock()
+
+	p.signal(syscall.SIGTERM)
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-p.done:
+		case <-timer.C:
+			p.signal(syscall.SIGKILL)
+		}
+	}()
+}
+
+// terminatedReason returns the reason the command was terminated, or
+// UNDEFINED if it was not.
+func (p *process) terminatedReason() pb.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reason
+}
+
+func (p *process) signal(sig syscall.Signal) {
+	// A negative PID signals every process in the group.
+	pid := -p.cmd.Process.Pid
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		log.WithError(err).WithField("pid", pid).Errorln("Error signalling command.")
+	}
+}
+
+func (a *Agent) register(name string, p *process) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running == nil {
+		a.running = make(map[string]*process)
+	}
+	a.running[name] = p
+}
+
+func (a *Agent) unregister(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, name)
+}
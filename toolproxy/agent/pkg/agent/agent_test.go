@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// recorder collects the messages sent by an agent.
+type recorder struct {
+	mu       sync.Mutex
+	messages []*pb.AgentMessage
+}
+
+func (r *recorder) send(m *pb.AgentMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+// result returns the last message sent, which must be a result.
+func (r *recorder) result(t *testing.T) *pb.CommandResult {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.messages) == 0 {
+		t.Fatalf("Expected result; got no messages")
+	}
+	res := r.messages[len(r.messages)-1].GetResult()
+	if res == nil {
+		t.Fatalf("Expected result; got %v", r.messages[len(r.messages)-1])
+	}
+	return res
+}
+
+func TestExecute(t *testing.T) {
+	t.Run("Run command to completion", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		a.execute(context.Background(), r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/bin/echo", "hello"},
+		})
+
+		var stdout []byte
+		for _, m := range r.messages {
+			if out := m.GetOutput(); out != nil && out.GetStream() == pb.Stream_STDOUT {
+				stdout = append(stdout, out.GetData()...)
+			}
+		}
+		if string(stdout) != "hello\n" {
+			t.Errorf("Expected output %q; got %q", "hello\n", stdout)
+		}
+
+		res := r.result(t)
+		if res.GetCommand() != "commands/1" || res.GetStatus() != pb.Status_SUCCESS {
+			t.Errorf("Expected commands/1 to succeed; got %v", res)
+		}
+		if res.GetExitCode() == nil || res.GetExitCode().GetValue() != 0 {
+			t.Errorf("Expected exit code 0; got %v", res.GetExitCode())
+		}
+		if res.GetResourceUsage() == nil {
+			t.Errorf("Expected resource usage")
+		}
+	})
+
+	t.Run("Give command its inputs", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		a.execute(context.Background(), r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/bin/cat", "-", "{inputs.fix.sql}"},
+			Inputs: &pb.CommandInputs{
+				Stdin: []byte("stdin\n"),
+				Files: []*pb.InputFile{{Name: "fix.sql", Content: []byte("file\n")}},
+			},
+		})
+
+		var stdout []byte
+		for _, m := range r.messages {
+			if out := m.GetOutput(); out != nil && out.GetStream() == pb.Stream_STDOUT {
+				stdout = append(stdout, out.GetData()...)
+			}
+		}
+		if string(stdout) != "stdin\nfile\n" {
+			t.Errorf("Expected stdin and input file; got %q", stdout)
+		}
+		if res := r.result(t); res.GetStatus() != pb.Status_SUCCESS {
+			t.Errorf("Expected commands/1 to succeed; got %v", res)
+		}
+	})
+
+	t.Run("Set environment variables", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		a.execute(context.Background(), r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/bin/sh", "-c", "echo $PGDATABASE"},
+			Env:     map[string]string{"PGDATABASE": "orders"},
+		})
+
+		var stdout []byte
+		for _, m := range r.messages {
+			if out := m.GetOutput(); out != nil && out.GetStream() == pb.Stream_STDOUT {
+				stdout = append(stdout, out.GetData()...)
+			}
+		}
+		if string(stdout) != "orders\n" {
+			t.Errorf("Expected environment variable; got %q", stdout)
+		}
+	})
+
+	t.Run("Record failure to start", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		a.execute(context.Background(), r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/nonexistent"},
+		})
+
+		res := r.result(t)
+		if res.GetStatus() != pb.Status_ERROR || res.GetStartError() == "" {
+			t.Errorf("Expected start error; got %v", res)
+		}
+	})
+
+	t.Run("Terminate command which times out", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		a.execute(context.Background(), r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/bin/sleep", "10"},
+			Timeout: durationpb.New(50 * time.Millisecond),
+		})
+
+		res := r.result(t)
+		if res.GetStatus() != pb.Status_TIMED_OUT || res.GetSignal() != "SIGTERM" {
+			t.Errorf("Expected command to time out with SIGTERM; got %v", res)
+		}
+	})
+
+	t.Run("Terminate command when connection is lost", func(t *testing.T) {
+		var r recorder
+		a := &Agent{}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		a.execute(ctx, r.send, &pb.CommandAssignment{
+			Command: "commands/1",
+			Argv:    []string{"/bin/sleep", "10"},
+		})
+
+		if res := r.result(t); res.GetStatus() != pb.Status_CANCELED {
+			t.Errorf("Expected command to be canceled; got %v", res)
+		}
+	})
+}
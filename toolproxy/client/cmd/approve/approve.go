@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package approve
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+)
+
+const description = `Approve a command that has been submitted by another user.
+
+A command may not be approved by its issuer. Once enough distinct users
+have approved a command and none have denied it, the command is marked as
+ready and may be run.
+
+Editing a command deletes all of its approvals, so a command must be
+approved again after any change.
+
+If the catalog declares a dry run for the command's tool, the command is
+previewed when it is submitted or edited. A command whose preview failed
+may not run unless an approver passes --override-preview.
+`
+
+func NewCmdApprove() *cobra.Command {
+	var comment string
+	var overridePreview bool
+	cmd := &cobra.Command{
+		Use:   "approve NAME",
+		Short: "Approve a submitted command",
+		Long:  description,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.Approve(context.Background(), args[0], comment, overridePreview)
+		},
+	}
+	cmd.Flags().StringVarP(&comment, "comment", "m", "", "Justification for the approval.")
+	cmd.Flags().BoolVar(&overridePreview, "override-preview", false, "Allow the command to run although its preview failed.")
+	return cmd
+}
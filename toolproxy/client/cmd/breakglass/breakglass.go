@@ -0,0 +1,57 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package breakglass
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+)
+
+const description = `Run a submitted command immediately, without the approvals it requires.
+
+Break-glass is for emergencies which cannot wait for approval. It requires
+the breakglass permission on the command and a justification. Every audit
+sink is notified at once, and the command has an open post-incident review
+until another user signs it off with "signoff".
+
+The command is queued to run and returned without waiting for it to finish.
+`
+
+func NewCmdBreakGlass() *cobra.Command {
+	var justification string
+	cmd := &cobra.Command{
+		Use:   "breakglass NAME",
+		Short: "Run a submitted command without approval in an emergency",
+		Long:  description,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.BreakGlass(context.Background(), args[0], justification)
+		},
+	}
+	cmd.Flags().StringVarP(&justification, "justification", "m", "", "Why the command cannot wait for approval.")
+	return cmd
+}
@@ -16,31 +16,42 @@ limitations under the License.
 package cancel
 
 import (
-	"fmt"
+	"context"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
 )
 
-const description = `Cancel a staged command that has not been executed.
+const description = `Cancel a command that has not completed.
 
-This can be done as the issuer of a command to revoke it if there was
-an error while issuing it, or for a properly permissioned user to
-explicitly deny a command to be run.
+A command which has not been run is marked as canceled and may no longer
+be run. A command which is running is terminated along with any processes
+it started: it is sent SIGTERM and, if it has not exited after a grace
+period, SIGKILL. This works regardless of which server is running it.
 
-This does not remove the command from the audit history, but it does
-mark it as deleted and prevent it from being scheduled for execution.
+This does not remove the command from the audit history, which records
+who canceled it and when.
 
-Commands that are already running or have already completed cannot be
-canceled.
+Commands that have already completed cannot be canceled.
 `
 
 func NewCmdCancel() *cobra.Command {
 	return &cobra.Command{
-		Use:   "cancel",
-		Short: "Cancel a staged command that has not been executed",
+		Use:   "cancel NAME",
+		Short: "Cancel a command that has not completed",
 		Long:  description,
+		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println("history called")
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.Cancel(context.Background(), args[0])
 		},
 	}
 }
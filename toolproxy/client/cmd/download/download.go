@@ -0,0 +1,61 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package download
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+)
+
+const description = `Download an artifact collected from a command.
+
+NAME is the resource name of the artifact, e.g.,
+commands/1/artifacts/dump.sql, as shown by the output of a command which
+declared artifacts with run --artifact.
+
+By default the artifact is written to a file in the current directory
+named after the path from which it was collected; an existing file is not
+overwritten. The content is checked against the artifact's SHA-256 digest,
+and the file is removed if it does not match.
+`
+
+func NewCmdDownload() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "download NAME",
+		Short: "Download an artifact collected from a command",
+		Long:  description,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.Download(context.Background(), args[0], output)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write the artifact to this file, or `-` to write it to standard output.")
+
+	return cmd
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+)
+
+const description = `List the commands awaiting review.
+
+The queue holds the commands which ran, have finished and have not been
+reviewed, sampled according to the server's sampling policy. It may be
+narrowed with a filter as for listing commands, e.g.,
+--filter 'tool = "tools/restart-deployment"'.
+`
+
+func NewCmdQueue() *cobra.Command {
+	var filter string
+	cmd := &cobra.Command{
+		Use:   "queue",
+		Short: "List the commands awaiting review",
+		Long:  description,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.ReviewQueue(context.Background(), filter)
+		},
+	}
+	cmd.Flags().StringVar(&filter, "filter", "", "An AIP-160 filter narrowing the queue.")
+	return cmd
+}
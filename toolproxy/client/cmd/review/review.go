@@ -0,0 +1,62 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package review
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const description = `Review what happened when a command ran.
+
+The verdict is one of ok, concerning or incident. Only commands which ran
+and have finished may be reviewed, and a command may not be reviewed by
+its issuer. Use "queue" to list the commands awaiting review.
+`
+
+func NewCmdReview() *cobra.Command {
+	var verdict, notes string
+	cmd := &cobra.Command{
+		Use:   "review NAME",
+		Short: "Review a command after it ran",
+		Long:  description,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, ok := pb.Verdict_value[strings.ToUpper(verdict)]
+			if !ok || v == int32(pb.Verdict_VERDICT_UNDEFINED) {
+				log.WithField("verdict", verdict).Fatal("Verdict must be one of ok, concerning or incident.")
+			}
+
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.Review(context.Background(), args[0], pb.Verdict(v), notes)
+		},
+	}
+	cmd.Flags().StringVar(&verdict, "verdict", "", "One of ok, concerning or incident.")
+	cmd.Flags().StringVarP(&notes, "notes", "m", "", "Notes on what happened.")
+	return cmd
+}
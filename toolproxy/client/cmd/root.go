@@ -29,9 +29,17 @@ import (
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/approve"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/breakglass"
 	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/cancel"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/deny"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/download"
 	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/history"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/queue"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/review"
 	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/run"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/signoff"
+	"github.com/hxtk/yggdrasil/toolproxy/client/cmd/unredacted"
 )
 
 var cfgFile string
@@ -63,9 +71,17 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", cfgFile, "Path to configuration file.")
+	rootCmd.AddCommand(approve.NewCmdApprove())
+	rootCmd.AddCommand(breakglass.NewCmdBreakGlass())
 	rootCmd.AddCommand(cancel.NewCmdCancel())
+	rootCmd.AddCommand(deny.NewCmdDeny())
+	rootCmd.AddCommand(download.NewCmdDownload())
 	rootCmd.AddCommand(history.NewCmdHistory())
+	rootCmd.AddCommand(queue.NewCmdQueue())
+	rootCmd.AddCommand(review.NewCmdReview())
 	rootCmd.AddCommand(run.NewCmdRun())
+	rootCmd.AddCommand(signoff.NewCmdSignOff())
+	rootCmd.AddCommand(unredacted.NewCmdUnredacted())
 }
 
 // initConfig reads in config file and ENV variables if set.
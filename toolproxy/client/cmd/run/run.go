@@ -17,6 +17,9 @@ package run
 
 import (
 	"context"
+	"io"
+	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -34,7 +37,14 @@ This application is a tool to generate the needed files
 to quickly create a Cobra application.`
 
 func NewCmdRun() *cobra.Command {
-	return &cobra.Command{
+	var tool string
+	var params map[string]string
+	var opts rpc.RunOptions
+	var at string
+	var stdin string
+	var files map[string]string
+
+	cmd := &cobra.Command{
 		Use:   "run",
 		Short: "Run a command on the remote host",
 		Long:  description,
@@ -43,8 +53,63 @@ func NewCmdRun() *cobra.Command {
 			if err != nil {
 				log.WithError(err).Fatal("Error reading TLS Config")
 			}
+			if at != "" {
+				opts.ScheduleTime, err = time.Parse(time.RFC3339, at)
+				if err != nil {
+					log.WithError(err).Fatal("Malformed --at; expected RFC 3339, e.g., 2006-01-02T15:04:05Z.")
+				}
+			}
+
+			if opts.Stdin, err = readInput(stdin); err != nil {
+				log.WithError(err).Fatal("Error reading --stdin.")
+			}
+			for name, path := range files {
+				if opts.Files == nil {
+					opts.Files = make(map[string][]byte)
+				}
+				if opts.Files[name], err = readInput(path); err != nil {
+					log.WithError(err).WithField("input", name).Fatal("Error reading --input.")
+				}
+			}
+
 			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
-			client.Run(context.Background(), args)
+			if tool != "" {
+				if len(args) > 0 {
+					log.Fatal("Arguments may not be given with --tool.")
+				}
+				client.RunTool(context.Background(), tool, params, opts)
+				return
+			}
+			client.Run(context.Background(), args, opts)
 		},
 	}
+	cmd.Flags().StringVar(&tool, "tool", "", "Run the named tool instead of the given arguments.")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", 0, "Terminate the command if it runs for longer than this. Defaults to the server's maximum.")
+	cmd.Flags().StringVar(&at, "at", "", "Schedule the command to run at this time, in RFC 3339 format, rather than immediately.")
+	cmd.Flags().StringVar(&opts.MaintenanceWindow, "window", "", "Schedule the command to run in the next opening of the named maintenance window.")
+	cmd.Flags().StringVar(&opts.Target, "target", "", "Run the command on an agent, given as `agents/NAME` or a label selector `key=value[,key=value]`.")
+	cmd.Flags().StringArrayVar(&opts.Targets, "targets", nil, "Roll the command out to every agent matching a target, given as for --target. May be given more than once.")
+	cmd.Flags().Int32Var(&opts.Parallelism, "parallelism", 0, "With --targets, run the command on at most this many agents at once. Defaults to all of them.")
+	cmd.Flags().Int32Var(&opts.FailureThreshold, "failure-threshold", 0, "With --targets, halt the rollout once the command has failed on more than this many agents.")
+	cmd.Flags().StringToStringVarP(&params, "param", "p", nil, "A parameter of the tool, as `name=value`. May be given more than once.")
+	cmd.Flags().StringVar(&stdin, "stdin", "", "Feed the contents of this file to the command's standard input, or `-` to feed this program's standard input.")
+	cmd.Flags().StringToStringVar(&files, "input", nil, "Give the command an input file, as `name=path`, whose path replaces `{inputs.name}` in its arguments. May be given more than once.")
+	cmd.Flags().StringArrayVar(&opts.ArtifactPaths, "artifact", nil, "Collect the file at this path, relative to the command's working directory, as an artifact once it exits. May be given more than once.")
+	cmd.Flags().StringToStringVar(&opts.Env, "env", nil, "Set an environment variable of the command, as `NAME=value`. May be given more than once.")
+	cmd.Flags().StringToStringVar(&opts.SecretEnv, "secret-env", nil, "Set an environment variable of the command to the value of a secret held by the server, as `NAME=secret`. May be given more than once.")
+
+	return cmd
+}
+
+// readInput returns the contents of the file at path, or of standard input if
+// path is `-`, or nil if path is empty.
+func readInput(path string) ([]byte, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return io.ReadAll(os.Stdin)
+	default:
+		return os.ReadFile(path)
+	}
 }
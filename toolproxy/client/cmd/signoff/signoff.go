@@ -0,0 +1,53 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package signoff
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
+	"github.com/hxtk/yggdrasil/toolproxy/client/pkg/rpc"
+)
+
+const description = `Sign off the post-incident review of a command run by break-glass.
+
+The command must have finished. Neither its issuer nor the user who broke
+glass may sign off its review, and the reviewer must comment on it.
+`
+
+func NewCmdSignOff() *cobra.Command {
+	var comment string
+	cmd := &cobra.Command{
+		Use:   "signoff NAME",
+		Short: "Sign off the review of a command run by break-glass",
+		Long:  description,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tlsConfig, err := tlsconfig.FromViper(viper.GetViper())
+			if err != nil {
+				log.WithError(err).Fatal("Error reading TLS Config")
+			}
+			client := rpc.New(viper.GetViper().GetString("addr"), tlsConfig)
+			client.SignOff(context.Background(), args[0], comment)
+		},
+	}
+	cmd.Flags().StringVarP(&comment, "comment", "m", "", "Comments on the use of break-glass.")
+	return cmd
+}
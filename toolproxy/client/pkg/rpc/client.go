@@ -2,19 +2,32 @@ package rpc
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/alessio/shellescape"
 	"github.com/grpc-ecosystem/go-grpc-middleware/retry"
+	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
 type Client struct {
-	tp pb.ToolProxyClient
+	tp  pb.ToolProxyClient
+	ops longrunning.OperationsClient
 }
 
 func New(addr string, tlsConfig *tls.Config) *Client {
@@ -30,7 +43,8 @@ func New(addr string, tlsConfig *tls.Config) *Client {
 	}
 
 	return &Client{
-		tp: pb.NewToolProxyClient(conn),
+		tp:  pb.NewToolProxyClient(conn),
+		ops: longrunning.NewOperationsClient(conn),
 	}
 }
 
@@ -47,17 +61,490 @@ func (c *Client) Get(ctx context.Context, name string) {
 	fmt.Println("Started:  ", cmd.GetStartTime().AsTime())
 	fmt.Println("Completed:", cmd.GetEndTime().AsTime())
 	fmt.Println("Status:", cmd.GetStatus().String())
-	fmt.Println("Issuer:", cmd.GetIssuer())
+	if cmd.GetStatusMessage() != "" {
+		fmt.Println(cmd.GetStatusMessage())
+	}
+	fmt.Printf("Issuer: %s (%s)\n", cmd.GetIssuerDisplayName(), cmd.GetIssuer())
+	if cmd.GetCatalogEntry() != "" {
+		fmt.Println("Permitted by:", cmd.GetCatalogEntry())
+	}
+	if cmd.GetExecutionProfile() != "" {
+		fmt.Println("Profile:", cmd.GetExecutionProfile())
+	}
+	if cmd.GetScheduleTime() != nil {
+		fmt.Printf("Scheduled: %v (expires %v)\n", cmd.GetScheduleTime().AsTime(), cmd.GetExpireTime().AsTime())
+	}
+	if cmd.GetMaintenanceWindow() != "" {
+		fmt.Println("Maintenance window:", cmd.GetMaintenanceWindow())
+	}
+	if cmd.GetTarget() != "" {
+		fmt.Println("Target:", cmd.GetTarget())
+	}
+	if len(cmd.GetTargets()) > 0 {
+		fmt.Println("Targets:", strings.Join(cmd.GetTargets(), "; "))
+		if cmd.GetParallelism() > 0 {
+			fmt.Println("Parallelism:", cmd.GetParallelism())
+		}
+		fmt.Println("Failure threshold:", cmd.GetFailureThreshold())
+	}
+	if cmd.GetExecutor() != "" {
+		fmt.Printf("Executor: %s (last seen %v)\n", cmd.GetExecutor(), cmd.GetHeartbeatTime().AsTime())
+	}
+	if cmd.GetTimeout() != nil {
+		fmt.Println("Timeout:", cmd.GetTimeout().AsDuration())
+	}
+	if in := cmd.GetInputs(); in != nil {
+		if len(in.GetStdin()) > 0 {
+			fmt.Printf("Stdin: %d bytes, sha256 %s\n", len(in.GetStdin()), in.GetStdinSha256())
+		}
+		for _, f := range in.GetFiles() {
+			fmt.Printf("Input %s: %d bytes, sha256 %s\n", f.GetName(), len(f.GetContent()), f.GetSha256())
+		}
+	}
+	names := make([]string, 0, len(cmd.GetEnv()))
+	for name := range cmd.GetEnv() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Env: %s=%s\n", name, cmd.GetEnv()[name])
+	}
+	for _, v := range cmd.GetSecretEnv() {
+		fmt.Printf("Env: %s from secret %s\n", v.GetName(), v.GetSecret())
+	}
+	if cmd.GetCancelTime() != nil {
+		fmt.Printf("Canceled: %v by %s (%s)\n", cmd.GetCancelTime().AsTime(), cmd.GetCancellerDisplayName(), cmd.GetCanceller())
+	}
+	if cmd.GetStartError() != "" {
+		fmt.Println("Failed to start:", cmd.GetStartError())
+	}
+	if cmd.GetExitCode() != nil {
+		fmt.Println("Exit code:", cmd.GetExitCode().GetValue())
+	}
+	if cmd.GetSignal() != "" {
+		fmt.Println("Killed by signal:", cmd.GetSignal())
+	}
+	if usage := cmd.GetResourceUsage(); usage != nil {
+		fmt.Printf(
+			"CPU time: %v user, %v system\n",
+			usage.GetUserCpuTime().AsDuration(),
+			usage.GetSystemCpuTime().AsDuration(),
+		)
+		fmt.Printf("Max RSS: %d MiB\n", usage.GetMaxRssBytes()>>20)
+	}
+	if len(cmd.GetRedactions()) > 0 {
+		fmt.Println("Redacted from output:", strings.Join(cmd.GetRedactions(), ", "))
+	}
+	if bg := cmd.GetBreakGlass(); bg != nil {
+		fmt.Printf("Break-glass: %v by %s (%s): %s\n", bg.GetCreateTime().AsTime(), bg.GetUserDisplayName(), bg.GetUser(), bg.GetJustification())
+		if bg.GetReviewState() == pb.BreakGlassReviewState_REVIEW_SIGNED_OFF {
+			fmt.Printf("Review signed off: %v by %s (%s): %s\n", bg.GetReviewTime().AsTime(), bg.GetReviewerDisplayName(), bg.GetReviewer(), bg.GetReviewComment())
+		} else {
+			fmt.Println("Review: open")
+		}
+	}
+	if preview := cmd.GetPreview(); preview != nil {
+		fmt.Println()
+		printPreview(preview)
+	}
+	if len(cmd.GetTargets()) > 0 {
+		fmt.Println()
+		c.printExecutions(ctx, name)
+	}
+	if len(cmd.GetArtifactPaths()) > 0 {
+		fmt.Println()
+		c.printArtifacts(ctx, name)
+	}
+}
+
+// printPreview prints the dry run of a command and its output, so that
+// approvers may see what the command would do.
+func printPreview(preview *pb.Preview) {
+	fmt.Println("Preview:", shellescape.QuoteCommand(preview.GetArgv()))
+	fmt.Println("Preview status:", preview.GetState())
+	if preview.GetError() != "" {
+		fmt.Println("Preview failed:", preview.GetError())
+	}
+	if preview.GetOverrideTime() != nil {
+		fmt.Printf("Overridden: %v by %s (%s)\n", preview.GetOverrideTime().AsTime(), preview.GetOverriderDisplayName(), preview.GetOverrider())
+	}
+	if len(preview.GetStdOut()) > 0 {
+		fmt.Println()
+		os.Stdout.Write(preview.GetStdOut())
+	}
+	if len(preview.GetStdErr()) > 0 {
+		fmt.Println()
+		os.Stdout.Write(preview.GetStdErr())
+	}
+}
+
+// printExecutions prints the status of each execution of a rollout.
+func (c *Client) printExecutions(ctx context.Context, name string) {
+	var token string
+	for {
+		res, err := c.tp.ListExecutions(ctx, &pb.ListExecutionsRequest{
+			Parent:    name,
+			PageToken: token,
+			PageSize:  100,
+		})
+		if err != nil {
+			fmt.Println("Could not list executions:", err)
+			return
+		}
+
+		for _, e := range res.GetExecutions() {
+			fmt.Printf("%s: %s", e.GetAgent(), e.GetStatus())
+			if e.GetExitCode() != nil {
+				fmt.Printf(" (exit code %d)", e.GetExitCode().GetValue())
+			} else if e.GetSignal() != "" {
+				fmt.Printf(" (killed by %s)", e.GetSignal())
+			}
+			fmt.Println()
+		}
+
+		if token = res.GetNextPageToken(); token == "" {
+			return
+		}
+	}
+}
+
+// printArtifacts prints the artifacts collected from a command.
+func (c *Client) printArtifacts(ctx context.Context, name string) {
+	var token string
+	for {
+		res, err := c.tp.ListArtifacts(ctx, &pb.ListArtifactsRequest{
+			Parent:    name,
+			PageToken: token,
+			PageSize:  100,
+		})
+		if err != nil {
+			fmt.Println("Could not list artifacts:", err)
+			return
+		}
+
+		for _, a := range res.GetArtifacts() {
+			if a.GetError() != "" {
+				fmt.Printf("%s: not collected: %s\n", a.GetName(), a.GetError())
+				continue
+			}
+			fmt.Printf("%s: %d bytes, %s, sha256 %s\n", a.GetName(), a.GetSizeBytes(), a.GetContentType(), a.GetSha256())
+		}
+
+		if token = res.GetNextPageToken(); token == "" {
+			return
+		}
+	}
+}
+
+// Download writes the content of an artifact to the file at path, or to
+// standard output if path is `-`. If path is empty, the file is named after
+// the artifact's path and written to the current directory. The content is
+// checked against the artifact's digest, and the file is removed if it does
+// not match.
+func (c *Client) Download(ctx context.Context, name string, path string) {
+	if err := c.download(ctx, name, path); err != nil {
+		fmt.Println("Could not download artifact:", err)
+	}
+}
+
+func (c *Client) download(ctx context.Context, name string, path string) (err error) {
+	stream, err := c.tp.DownloadArtifact(ctx, &pb.DownloadArtifactRequest{Name: name})
+	if err != nil {
+		return err
+	}
+
+	chunk, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	artifact := chunk.GetArtifact()
+	if path == "" {
+		path = filepath.Base(artifact.GetPath())
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+			}
+		}()
+		out = f
+	}
+
+	digest := sha256.New()
+	w := io.MultiWriter(out, digest)
+	for {
+		if _, err := w.Write(chunk.GetData()); err != nil {
+			return err
+		}
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != artifact.GetSha256() {
+		return fmt.Errorf("sha256 of content is %s; expected %s", sum, artifact.GetSha256())
+	}
+	if path != "-" {
+		fmt.Printf("Downloaded %s to %s (%d bytes)\n", artifact.GetName(), path, artifact.GetSizeBytes())
+	}
+	return nil
+}
+
+// Unredacted prints the output of a command as it was written, before
+// anything was redacted from it.
+func (c *Client) Unredacted(ctx context.Context, name string) {
+	output, err := c.tp.GetUnredactedOutput(ctx, &pb.GetUnredactedOutputRequest{Name: name})
+	if err != nil {
+		fmt.Println("Could not get unredacted output:", err)
+		return
+	}
+	os.Stdout.Write(output.GetStdOut())
+	os.Stderr.Write(output.GetStdErr())
+}
+
+// Cancel cancels a command which has not completed. If it is running, it is
+// terminated.
+func (c *Client) Cancel(ctx context.Context, name string) {
+	cmd, err := c.tp.CancelCommand(ctx, &pb.CancelCommandRequest{Name: name})
+	if err != nil {
+		fmt.Println("Could not cancel command:", err)
+		return
+	}
+
+	fmt.Printf("Canceled: %s (%s)\n", cmd.GetName(), cmd.GetStatus())
+}
+
+// BreakGlass queues a submitted command to run immediately without the
+// approvals it requires.
+func (c *Client) BreakGlass(ctx context.Context, name string, justification string) {
+	cmd, err := c.tp.BreakGlassCommand(ctx, &pb.BreakGlassCommandRequest{
+		Name:          name,
+		Justification: justification,
+	})
+	if err != nil {
+		fmt.Println("Could not break glass:", err)
+		return
+	}
+
+	fmt.Printf("Broke glass: %s (%s)\n", cmd.GetName(), cmd.GetStatus())
+	fmt.Println("A post-incident review is now required.")
+}
+
+// SignOff signs off the post-incident review of a command run by
+// break-glass.
+func (c *Client) SignOff(ctx context.Context, name string, comment string) {
+	cmd, err := c.tp.SignOffBreakGlass(ctx, &pb.SignOffBreakGlassRequest{
+		Name:    name,
+		Comment: comment,
+	})
+	if err != nil {
+		fmt.Println("Could not sign off review:", err)
+		return
+	}
+
+	fmt.Println("Signed off:", cmd.GetName())
+}
+
+// Review records a reviewer's verdict on a command after it ran.
+func (c *Client) Review(ctx context.Context, name string, verdict pb.Verdict, notes string) {
+	review, err := c.tp.CreateReview(ctx, &pb.CreateReviewRequest{
+		Parent: name,
+		Review: &pb.Review{
+			Verdict: verdict,
+			Notes:   notes,
+		},
+	})
+	if err != nil {
+		fmt.Println("Could not review command:", err)
+		return
+	}
+
+	fmt.Printf("Reviewed: %s (%s)\n", review.GetName(), review.GetVerdict())
+}
+
+// ReviewQueue prints the commands awaiting review which match filter.
+func (c *Client) ReviewQueue(ctx context.Context, filter string) {
+	var token string
+	for {
+		res, err := c.tp.ListReviewQueue(ctx, &pb.ListReviewQueueRequest{
+			PageToken: token,
+			PageSize:  100,
+			Filter:    filter,
+		})
+		if err != nil {
+			fmt.Println("Could not list review queue:", err)
+			return
+		}
+
+		for _, cmd := range res.GetCommands() {
+			fmt.Printf("%s: %s %s\n", cmd.GetName(), cmd.GetStatus(), shellescape.QuoteCommand(cmd.GetArgv()))
+		}
+
+		if token = res.GetNextPageToken(); token == "" {
+			return
+		}
+	}
+}
+
+func (c *Client) Approve(ctx context.Context, name string, comment string, overridePreview bool) {
+	approval, err := c.tp.ApproveCommand(ctx, &pb.ApproveCommandRequest{
+		Name:            name,
+		Comment:         comment,
+		OverridePreview: overridePreview,
+	})
+	if err != nil {
+		fmt.Println("Could not approve command:", err)
+		return
+	}
+
+	fmt.Println("Approved:", approval.GetName())
+	if approval.GetOverridePreview() {
+		fmt.Println("The failed preview was overridden.")
+	}
+}
+
+func (c *Client) Deny(ctx context.Context, name string, comment string) {
+	approval, err := c.tp.DenyCommand(ctx, &pb.DenyCommandRequest{
+		Name:    name,
+		Comment: comment,
+	})
+	if err != nil {
+		fmt.Println("Could not deny command:", err)
+		return
+	}
+
+	fmt.Println("Denied:", approval.GetName())
+}
+
+// RunOptions control when and for how long a command may run.
+type RunOptions struct {
+	// Timeout is how long the command may run. If it is zero, the server's
+	// maximum timeout is used.
+	Timeout time.Duration
+
+	// ScheduleTime is when the command should run. If it is zero, the
+	// command is run immediately unless MaintenanceWindow is set.
+	ScheduleTime time.Time
+
+	// MaintenanceWindow is the ID of a maintenance window in which the
+	// command should run.
+	MaintenanceWindow string
+
+	// Target is the resource name of the agent on which the command should
+	// run, or a label selector matching the agents on which it may run. If
+	// it is empty, the command runs on the server.
+	Target string
+
+	// Targets are the agents on which the command should run once each, in
+	// the same form as Target. If any are given, Target must be empty.
+	Targets []string
+
+	// Parallelism is the maximum number of agents on which the command runs
+	// at once. If it is zero, it runs on all of them at once.
+	Parallelism int32
+
+	// FailureThreshold is the number of agents on which the command may fail
+	// before the rollout is halted.
+	FailureThreshold int32
+
+	// Stdin is the standard input of the command.
+	Stdin []byte
+
+	// Files are the input files of the command, by name. An element of argv
+	// refers to the path of a file as `{inputs.NAME}`.
+	Files map[string][]byte
+
+	// ArtifactPaths are the files, relative to the command's working
+	// directory, collected as artifacts once it exits.
+	ArtifactPaths []string
+
+	// Env are environment variables set for the command.
+	Env map[string]string
+
+	// SecretEnv are environment variables set for the command to the values
+	// of secrets held by the server, by the names of the variables. Only the
+	// names of the secrets are sent.
+	SecretEnv map[string]string
+}
+
+// Run runs argv.
+func (c *Client) Run(ctx context.Context, argv []string, opts RunOptions) {
+	c.run(ctx, opts.command(&pb.Command{
+		Argv:        argv,
+		Description: "",
+		Status:      pb.Status_READY,
+	}))
+}
+
+// RunTool runs a command rendered by the server from a tool and the values
+// of its parameters.
+func (c *Client) RunTool(ctx context.Context, tool string, params map[string]string, opts RunOptions) {
+	c.run(ctx, opts.command(&pb.Command{
+		Tool:       "tools/" + tool,
+		Parameters: params,
+		Status:     pb.Status_READY,
+	}))
 }
 
-func (c *Client) Run(ctx context.Context, argv []string) {
+// command sets the fields of cmd controlled by o and returns it.
+func (o RunOptions) command(cmd *pb.Command) *pb.Command {
+	cmd.Timeout = durationOrNil(o.Timeout)
+	if !o.ScheduleTime.IsZero() {
+		cmd.ScheduleTime = timestamppb.New(o.ScheduleTime)
+	}
+	if o.MaintenanceWindow != "" {
+		cmd.MaintenanceWindow = "maintenanceWindows/" + o.MaintenanceWindow
+	}
+	cmd.Target = o.Target
+	cmd.Targets = o.Targets
+	cmd.Parallelism = o.Parallelism
+	cmd.FailureThreshold = o.FailureThreshold
+	cmd.ArtifactPaths = o.ArtifactPaths
+	cmd.Env = o.Env
+	vars := make([]string, 0, len(o.SecretEnv))
+	for name := range o.SecretEnv {
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+	for _, name := range vars {
+		cmd.SecretEnv = append(cmd.SecretEnv, &pb.SecretEnvVar{Name: name, Secret: o.SecretEnv[name]})
+	}
+	if len(o.Stdin) > 0 || len(o.Files) > 0 {
+		cmd.Inputs = &pb.CommandInputs{Stdin: o.Stdin}
+		names := make([]string, 0, len(o.Files))
+		for name := range o.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd.Inputs.Files = append(cmd.Inputs.Files, &pb.InputFile{Name: name, Content: o.Files[name]})
+		}
+	}
+	return cmd
+}
+
+func durationOrNil(d time.Duration) *durationpb.Duration {
+	if d == 0 {
+		return nil
+	}
+	return durationpb.New(d)
+}
+
+func (c *Client) run(ctx context.Context, command *pb.Command) {
 	cmd, err := c.tp.CreateCommand(ctx,
 		&pb.CreateCommandRequest{
-			Command: &pb.Command{
-				Argv:        argv,
-				Description: "",
-				Status:      pb.Status_READY,
-			},
+			Command: command,
 		},
 	)
 	if err != nil {
@@ -65,10 +552,111 @@ func (c *Client) Run(ctx context.Context, argv []string) {
 		return
 	}
 
-	cmd, err = c.tp.RunCommand(ctx, &pb.RunCommandRequest{Name: cmd.GetName()})
+	if cmd.GetScheduleTime() != nil {
+		fmt.Printf(
+			"Command %s is scheduled to run at %v and expires at %v.\n",
+			cmd.GetName(),
+			cmd.GetScheduleTime().AsTime(),
+			cmd.GetExpireTime().AsTime(),
+		)
+		if cmd.GetStatus() != pb.Status_READY {
+			fmt.Println("It must be approved before then.")
+		}
+		return
+	}
+
+	if cmd.GetStatus() != pb.Status_READY {
+		fmt.Println("Command must be approved before it can be run:", cmd.GetName())
+		return
+	}
+
+	op, err := c.tp.StartCommand(ctx, &pb.StartCommandRequest{Name: cmd.GetName()})
+	if err != nil {
+		fmt.Println("Error running command:", err)
+		return
+	}
+
+	// The operation is waited on while the output is streamed.
+	result := make(chan *pb.Command, 1)
+	go func() {
+		cmd, err := c.wait(ctx, op)
+		if err != nil {
+			fmt.Println("Error running command:", err)
+		}
+		result <- cmd
+	}()
+
+	err = c.streamOutput(ctx, cmd.GetName())
+	if err != nil {
+		fmt.Println("Error streaming command output:", err)
+
+		cmd = <-result
+		os.Stdout.Write(cmd.GetStdOut())
+		os.Stderr.Write(cmd.GetStdErr())
+		return
+	}
+	if finished := <-result; len(finished.GetRedactions()) > 0 {
+		fmt.Println("Redacted from output:", strings.Join(finished.GetRedactions(), ", "))
+	}
+
+	// The output of a rollout is recorded separately for each agent.
+	if len(command.GetTargets()) > 0 {
+		c.printExecutions(ctx, cmd.GetName())
+	}
+	if len(command.GetArtifactPaths()) > 0 {
+		c.printArtifacts(ctx, cmd.GetName())
+	}
+}
+
+// waitInterval is how long each request waits on an operation. It is short
+// enough that requests are not cut off by proxies with idle timeouts.
+const waitInterval = 30 * time.Second
+
+// wait waits for the operation of a command to be done and returns the
+// finished command.
+func (c *Client) wait(ctx context.Context, op *longrunning.Operation) (*pb.Command, error) {
+	var err error
+	for !op.GetDone() {
+		op, err = c.ops.WaitOperation(ctx, &longrunning.WaitOperationRequest{
+			Name:    op.GetName(),
+			Timeout: durationpb.New(waitInterval),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if op.GetError() != nil {
+		return nil, status.ErrorProto(op.GetError())
+	}
+	var cmd pb.Command
+	if err := op.GetResponse().UnmarshalTo(&cmd); err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// streamOutput copies the output of a command to the corresponding local
+// streams as it is written, returning once the command has completed.
+func (c *Client) streamOutput(ctx context.Context, name string) error {
+	stream, err := c.tp.StreamCommandOutput(ctx, &pb.StreamCommandOutputRequest{Name: name})
 	if err != nil {
-		fmt.Println("Error running command: ", err)
+		return err
 	}
 
-	fmt.Print(string(cmd.GetStdOut()))
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch chunk.GetStream() {
+		case pb.Stream_STDOUT:
+			os.Stdout.Write(chunk.GetData())
+		case pb.Stream_STDERR:
+			os.Stderr.Write(chunk.GetData())
+		}
+	}
 }
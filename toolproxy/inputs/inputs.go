@@ -0,0 +1,149 @@
+// Package inputs materializes the input files of a command: they are written
+// to a temporary directory private to the command, and references to them in
+// its argv are replaced with their paths. The same directory may serve as the
+// working directory of a command which leaves artifacts to be collected.
+//
+// It is shared by the tool proxy's own executors and by agents, so that a
+// command is given its inputs in the same way wherever it runs.
+package inputs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Reference returns the reference to the input file with the given name by
+// which an element of argv refers to its path.
+func Reference(name string) string {
+	return "{inputs." + name + "}"
+}
+
+// Digest returns the hex-encoded SHA-256 digest of data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Check returns an error if the name of an input file is invalid or is given
+// more than once, or if argv refers to an input file which is not given.
+func Check(argv []string, in *pb.CommandInputs) error {
+	names := make(map[string]struct{})
+	for _, f := range in.GetFiles() {
+		if !namePattern.MatchString(f.GetName()) {
+			return fmt.Errorf("invalid input file name %q", f.GetName())
+		}
+		if _, ok := names[f.GetName()]; ok {
+			return fmt.Errorf("input file %q is given more than once", f.GetName())
+		}
+		names[f.GetName()] = struct{}{}
+	}
+
+	for _, arg := range argv {
+		for rest := arg; ; {
+			i := strings.Index(rest, "{inputs.")
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len("{inputs."):]
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				break
+			}
+			if _, ok := names[rest[:end]]; !ok {
+				return fmt.Errorf("argv refers to input file %q, which is not given", rest[:end])
+			}
+			rest = rest[end+1:]
+		}
+	}
+	return nil
+}
+
+// Materialize writes the input files of in to a new temporary directory and
+// returns argv with references to them replaced with their paths, and a
+// function which removes the directory once the command has finished.
+//
+// The directory and files may be read only by their owner. If uid or gid is
+// not nil, they are owned by that user or group, so that a command which runs
+// as another user may read them.
+func Materialize(argv []string, in *pb.CommandInputs, uid, gid *uint32) ([]string, func(), error) {
+	expanded, _, cleanup, err := materialize(argv, in, uid, gid, false)
+	return expanded, cleanup, err
+}
+
+// Workdir is like Materialize, but creates the directory even if there are no
+// input files and returns its path, so that the command may run in it and
+// leave files there to be collected once it exits. If uid or gid is not nil,
+// the command may also write to it.
+func Workdir(argv []string, in *pb.CommandInputs, uid, gid *uint32) ([]string, string, func(), error) {
+	return materialize(argv, in, uid, gid, true)
+}
+
+func materialize(argv []string, in *pb.CommandInputs, uid, gid *uint32, workdir bool) ([]string, string, func(), error) {
+	if len(in.GetFiles()) == 0 && !workdir {
+		return argv, "", func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "toolproxy-inputs-")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(dir)
+	}
+
+	owner, group := -1, -1
+	if uid != nil {
+		owner = int(*uid)
+	}
+	if gid != nil {
+		group = int(*gid)
+	}
+
+	var replacements []string
+	for _, f := range in.GetFiles() {
+		// Names are checked when the command is created, but the tool
+		// proxy is not trusted blindly not to escape the directory.
+		if !namePattern.MatchString(f.GetName()) {
+			cleanup()
+			return nil, "", nil, fmt.Errorf("invalid input file name %q", f.GetName())
+		}
+
+		path := filepath.Join(dir, f.GetName())
+		if err := os.WriteFile(path, f.GetContent(), 0600); err != nil {
+			cleanup()
+			return nil, "", nil, err
+		}
+		if owner >= 0 || group >= 0 {
+			if err := os.Chown(path, owner, group); err != nil {
+				cleanup()
+				return nil, "", nil, err
+			}
+		}
+		replacements = append(replacements, Reference(f.GetName()), path)
+	}
+	if owner >= 0 || group >= 0 {
+		if err := os.Chown(dir, owner, group); err != nil {
+			cleanup()
+			return nil, "", nil, err
+		}
+	}
+
+	if len(replacements) == 0 {
+		return argv, dir, cleanup, nil
+	}
+	r := strings.NewReplacer(replacements...)
+	expanded := make([]string, len(argv))
+	for i, arg := range argv {
+		expanded[i] = r.Replace(arg)
+	}
+	return expanded, dir, cleanup, nil
+}
@@ -0,0 +1,105 @@
+package inputs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		name   string
+		argv   []string
+		inputs *pb.CommandInputs
+		ok     bool
+	}{
+		{
+			name: "No inputs",
+			argv: []string{"/usr/bin/psql"},
+			ok:   true,
+		},
+		{
+			name:   "Reference to input file",
+			argv:   []string{"/usr/bin/kubectl", "apply", "--filename={inputs.patch.yaml}"},
+			inputs: &pb.CommandInputs{Files: []*pb.InputFile{{Name: "patch.yaml"}}},
+			ok:     true,
+		},
+		{
+			name: "Reference to missing input file",
+			argv: []string{"/usr/bin/kubectl", "apply", "-f", "{inputs.patch.yaml}"},
+		},
+		{
+			name:   "Invalid name",
+			inputs: &pb.CommandInputs{Files: []*pb.InputFile{{Name: "../passwd"}}},
+		},
+		{
+			name:   "Duplicate name",
+			inputs: &pb.CommandInputs{Files: []*pb.InputFile{{Name: "a"}, {Name: "a"}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Check(tc.argv, tc.inputs)
+			if tc.ok && err != nil {
+				t.Errorf("Expected success; got error: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	argv, cleanup, err := Materialize(
+		[]string{"/usr/bin/patch", "--input={inputs.fix.patch}", "{inputs.fix}"},
+		&pb.CommandInputs{Files: []*pb.InputFile{
+			{Name: "fix.patch", Content: []byte("patch")},
+			{Name: "fix", Content: []byte("file")},
+		}},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	dir := filepath.Dir(argv[2])
+	if argv[1] != "--input="+filepath.Join(dir, "fix.patch") {
+		t.Errorf("Bad argv: %v", argv)
+	}
+	data, err := os.ReadFile(argv[2])
+	if err != nil || string(data) != "file" {
+		t.Errorf("Expected content %q; got %q, %v", "file", data, err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected private input directory; got %v, %v", info, err)
+	}
+
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected input directory to be removed; got %v", err)
+	}
+}
+
+func TestWorkdir(t *testing.T) {
+	argv, dir, cleanup, err := Workdir([]string{"/usr/bin/pg_dump", "-f", "dump.sql"}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(argv) != 3 || argv[2] != "dump.sql" {
+		t.Errorf("Expected argv to be unchanged; got %v", argv)
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected private working directory; got %v, %v", info, err)
+	}
+
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected working directory to be removed; got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/postgres"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+)
+
+// verifyAuditCmd verifies the audit log directly against the database, so
+// that it may be checked without trusting a running server.
+var verifyAuditCmd = &cobra.Command{
+	Use:   "verify-audit",
+	Short: "Verify the integrity of the audit log",
+	Long: `Verify that no event has been removed from or modified in the audit log
+since it was recorded, using the key configured by audit.verification_key
+to check its signed checkpoints.
+
+Every problem found is printed, and the command exits with a non-zero
+status if there are any.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		key := loadVerificationKey()
+		if key == nil {
+			log.Fatal("No audit verification key is configured.")
+		}
+
+		db, err := postgres.FromViper(viper.GetViper())
+		if err != nil {
+			log.WithError(err).Fatal("Error opening database.")
+		}
+
+		report, err := audit.Verify(context.Background(), db, key)
+		if err != nil {
+			log.WithError(err).Fatal("Error reading audit log.")
+		}
+
+		fmt.Printf("Events: %d\n", report.Events)
+		fmt.Printf("Checkpoints: %d\n", report.Checkpoints)
+		if report.LastCheckpoint > 0 {
+			fmt.Printf(
+				"Last checkpoint: event %d at %s\n",
+				report.LastCheckpoint,
+				report.LastCheckpointTime.Format(time.RFC3339),
+			)
+		}
+		if unanchored := report.Events - report.LastCheckpoint; unanchored > 0 {
+			fmt.Printf("Events after the last checkpoint: %d\n", unanchored)
+		}
+		for _, p := range report.Problems {
+			fmt.Printf("Problem at event %d: %s\n", p.Sequence, p.Description)
+		}
+
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("The audit log is intact.")
+	},
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/hxtk/yggdrasil/common/config/postgres"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+)
+
+// executorCmd runs only an executor, so that commands may be run on
+// dedicated replicas which are scaled separately from the API.
+var executorCmd = &cobra.Command{
+	Use:   "executor",
+	Short: "Run queued commands without serving the API",
+	Long: `Run commands which have been queued by RunCommand on any replica.
+
+Any number of executors may share a database; each command is run by
+exactly one of them. On SIGTERM or SIGINT, the executor stops claiming
+commands and exits once those it is running have finished.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := postgres.FromViper(viper.GetViper())
+		if err != nil {
+			log.WithError(err).Fatal("Error opening database.")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		log.Info("Executor started.")
+		exec := newExecutor(db, loadCatalog())
+		go exec.Listen(ctx, listen(executor.RunChannel, executor.CancelChannel).Notify)
+		exec.Run(ctx)
+		log.Info("Executor shut down.")
+	},
+}
@@ -22,18 +22,35 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	authzed "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/lib/pq"
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/hxtk/yggdrasil/common/config/postgres"
 	"github.com/hxtk/yggdrasil/common/config/tlsconfig"
 	"github.com/hxtk/yggdrasil/common/server"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/secrets"
 	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/rpc"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
 var cfgFiles []string
@@ -60,7 +77,81 @@ to quickly create a Cobra application.`,
 		if err != nil {
 			log.WithError(err).Fatal("Error opening database.")
 		}
+		toolCatalog := loadCatalog()
+
 		rpcServer := rpc.New(db)
+		rpcServer.RequiredApprovals = viper.GetInt("approvals.required")
+		rpcServer.MaxTimeout = viper.GetDuration("commands.max_timeout")
+		rpcServer.ScheduleTolerance = viper.GetDuration("commands.schedule_tolerance")
+		rpcServer.Catalog = toolCatalog
+		rpcServer.ReviewSampling = loadReviewSampling()
+		if viper.IsSet("spicedb.addr") {
+			conn, err := grpc.Dial(
+				viper.GetString("spicedb.addr"),
+				grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+				grpc.WithPerRPCCredentials(bearerToken(viper.GetString("spicedb.token"))),
+			)
+			if err != nil {
+				log.WithError(err).Fatal("Error connecting to SpiceDB.")
+			}
+			rpcServer.Authz = authzed.NewPermissionsServiceClient(conn)
+		}
+
+		// RunCommand and WatchCommands learn of changes to commands from
+		// the audit log, whichever replica made them.
+		go rpcServer.HandleChanges(context.Background(), listen(audit.Channel).Notify)
+
+		// Commands whose executor stops responding are marked as lost,
+		// whether or not this replica runs an executor.
+		reconciler := executor.NewReconciler(db)
+		reconciler.LeaseDuration = viper.GetDuration("executor.lease_duration")
+		reconciler.Interval = viper.GetDuration("executor.reconcile_interval")
+		reconciler.LostWindow = viper.GetDuration("executor.lost_window")
+		go reconciler.Run(context.Background())
+
+		// Agents may connect to any replica, so every replica dispatches
+		// commands, but only those with the executor enabled run them
+		// locally.
+		exec := newExecutor(db, toolCatalog)
+		rpcServer.Executor = exec
+		rpcServer.Sealer = exec.Sealer
+		go exec.Listen(context.Background(), listen(executor.RunChannel, executor.CancelChannel).Notify)
+		if viper.GetBool("executor.enabled") {
+			go exec.Run(context.Background())
+		}
+
+		// Checkpoints anchor the audit log against rewrites by anyone with
+		// access to the database but not to the signing key.
+		if viper.IsSet("audit.signing_key") {
+			key, err := audit.LoadSigningKey(viper.GetString("audit.signing_key"))
+			if err != nil {
+				log.WithError(err).Fatal("Error loading audit signing key.")
+			}
+			checkpointer := &audit.Checkpointer{DB: db, Key: key}
+			checkpointer.Interval = viper.GetDuration("audit.checkpoint_interval")
+			go checkpointer.Run(context.Background())
+		}
+		rpcServer.AuditKey = loadVerificationKey()
+
+		// Page tokens issued by one replica must be accepted by the others,
+		// so they share a key; without one, each replica generates its own.
+		if viper.IsSet("pagination.token_key") {
+			key, err := os.ReadFile(viper.GetString("pagination.token_key"))
+			if err != nil {
+				log.WithError(err).Fatal("Error loading page token key.")
+			}
+			rpcServer.PageTokenKey = key
+		}
+
+		// Every replica exports audit events from the outbox; each event is
+		// exported by one of them at a time. The use of break-glass wakes
+		// the exporter of the replica on which it happened.
+		exporter := &audit.Exporter{DB: db, Sinks: loadSinks()}
+		exporter.PollInterval = viper.GetDuration("audit.export_interval")
+		exporter.BatchSize = viper.GetInt("audit.export_batch_size")
+		rpcServer.Exporter = exporter
+		go exporter.Run(context.Background())
+
 		s.Register(rpcServer)
 		log.Info("Registration complete.")
 
@@ -72,6 +163,158 @@ to quickly create a Cobra application.`,
 	},
 }
 
+// loadCatalog returns the tool catalog configured by `catalog.file`, or nil if
+// there is none.
+func loadCatalog() *catalog.Catalog {
+	if !viper.IsSet("catalog.file") {
+		return nil
+	}
+
+	path := viper.GetString("catalog.file")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), path)
+	}
+	c, err := catalog.FromFile(path)
+	if err != nil {
+		log.WithError(err).WithField("file", path).Fatal("Error loading tool catalog.")
+	}
+	return c
+}
+
+// loadReviewSampling returns the review sampling policy configured by
+// `reviews.sampling`, a map from command status to the fraction of finished
+// commands with that status which are queued for review, or nil if there is
+// none.
+func loadReviewSampling() map[pb.Status]float64 {
+	if !viper.IsSet("reviews.sampling") {
+		return nil
+	}
+
+	sampling := map[pb.Status]float64{}
+	for name := range viper.GetStringMap("reviews.sampling") {
+		s, ok := pb.Status_value[strings.ToUpper(name)]
+		if !ok || s == int32(pb.Status_UNDEFINED) {
+			log.WithField("status", name).Fatal("Unknown status in review sampling policy.")
+		}
+		fraction := viper.GetFloat64("reviews.sampling." + name)
+		if fraction < 0 || fraction > 1 {
+			log.WithField("status", name).Fatal("Review sampling fraction must be between 0 and 1.")
+		}
+		sampling[pb.Status(s)] = fraction
+	}
+	return sampling
+}
+
+// loadVerificationKey returns the audit verification key configured by
+// `audit.verification_key`, or nil if there is none.
+func loadVerificationKey() ed25519.PublicKey {
+	if !viper.IsSet("audit.verification_key") {
+		return nil
+	}
+
+	key, err := audit.LoadVerificationKey(viper.GetString("audit.verification_key"))
+	if err != nil {
+		log.WithError(err).Fatal("Error loading audit verification key.")
+	}
+	return key
+}
+
+// loadSinks returns the audit sinks configured by `audit.sinks`.
+func loadSinks() []audit.Sink {
+	if !viper.IsSet("audit.sinks") {
+		return nil
+	}
+
+	sinks, err := audit.SinksFromViper(viper.Sub("audit"))
+	if err != nil {
+		log.WithError(err).Fatal("Error loading audit sinks.")
+	}
+	return sinks
+}
+
+// newExecutor returns an executor configured by the `executor` and `sandbox`
+// keys which runs the commands queued in db.
+func newExecutor(db *sql.DB, toolCatalog *catalog.Catalog) *executor.Executor {
+	e := executor.New(db)
+	e.ID = viper.GetString("executor.id")
+	e.Catalog = toolCatalog
+	e.Concurrency = viper.GetInt("executor.concurrency")
+	e.HeartbeatInterval = viper.GetDuration("executor.heartbeat_interval")
+	e.PollInterval = viper.GetDuration("executor.poll_interval")
+	e.KillGracePeriod = viper.GetDuration("commands.kill_grace_period")
+	e.MaxArtifactBytes = viper.GetInt64("commands.max_artifact_bytes")
+
+	if viper.IsSet("sandbox") {
+		var err error
+		e.Profiles, err = sandbox.FromViper(viper.Sub("sandbox"))
+		if err != nil {
+			log.WithError(err).Fatal("Error loading execution profiles.")
+		}
+	}
+	if viper.IsSet("secrets") {
+		var err error
+		e.Secrets, err = secrets.FromViper(viper.Sub("secrets"))
+		if err != nil {
+			log.WithError(err).Fatal("Error loading secrets.")
+		}
+	}
+	if viper.IsSet("redaction") {
+		var err error
+		e.Redactor, err = redact.FromViper(viper.Sub("redaction"))
+		if err != nil {
+			log.WithError(err).Fatal("Error loading redaction rules.")
+		}
+	}
+	// The original output of commands is retained only if it can be
+	// encrypted.
+	if viper.IsSet("redaction.retention_key") {
+		var err error
+		e.Sealer, err = redact.LoadSealer(viper.GetString("redaction.retention_key"))
+		if err != nil {
+			log.WithError(err).Fatal("Error loading redaction retention key.")
+		}
+	}
+	if toolCatalog != nil {
+		for _, entry := range toolCatalog.Entries() {
+			if entry.Profile == "" {
+				continue
+			}
+			if p, err := e.Profiles.Get(entry.Profile); err != nil || p == nil {
+				log.WithField("entry", entry.Name).WithField("profile", entry.Profile).Fatal("Tool catalog references undefined execution profile.")
+			}
+		}
+	}
+
+	return e
+}
+
+// listen returns a listener for notifications on the given channels of the
+// configured database.
+func listen(channels ...string) *pq.Listener {
+	listener := pq.NewListener(postgres.DSN(viper.GetViper()), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WithError(err).Errorln("Error listening for notifications.")
+		}
+	})
+	for _, c := range channels {
+		if err := listener.Listen(c); err != nil {
+			log.WithError(err).WithField("channel", c).Fatal("Error listening for notifications.")
+		}
+	}
+	return listener
+}
+
+// bearerToken authenticates to SpiceDB with a preshared key.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -85,6 +328,9 @@ func init() {
 	rootCmd.PersistentFlags().StringSliceVarP(&cfgFiles, "config", "c", cfgFiles, "Configuration file. If specified more than once, subsequent files will be merged into the first.")
 
 	cobra.OnInitialize(initConfig)
+
+	rootCmd.AddCommand(executorCmd)
+	rootCmd.AddCommand(verifyAuditCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -114,6 +360,7 @@ func initConfig() {
 		viper.SetConfigName("toolproxy")
 	}
 
+	viper.SetDefault("executor.enabled", true)
 	viper.AutomaticEnv() // read in environment variables that match
 	viper.SetConfigType("yaml")
 
@@ -21,8 +21,16 @@ THE SOFTWARE.
 */
 package main
 
-import "github.com/hxtk/yggdrasil/toolproxy/server/cmd"
+import (
+	"github.com/hxtk/yggdrasil/toolproxy/server/cmd"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+)
 
 func main() {
+	// Commands run in a sandbox are started by re-executing this binary.
+	if sandbox.IsInit() {
+		sandbox.Init()
+	}
+
 	cmd.Execute()
 }
@@ -0,0 +1,156 @@
+// Package artifacts collects the files which a command declares as its
+// artifacts from its working directory once it exits.
+//
+// An artifact is identified within its command by its path, with every
+// character which may not appear in a resource ID replaced; paths are checked
+// when the command is created so that no two of them have the same ID.
+package artifacts
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hxtk/yggdrasil/toolproxy/inputs"
+)
+
+// ID returns the ID of the artifact collected from the given path.
+func ID(path string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '_' || r == '-':
+			return r
+		}
+		return '-'
+	}, path)
+}
+
+// Check returns an error if a path is not a clean relative path within the
+// working directory, or if two paths have the same ID.
+func Check(paths []string) error {
+	ids := make(map[string]string)
+	for _, path := range paths {
+		if err := checkPath(path); err != nil {
+			return err
+		}
+		id := ID(path)
+		if other, ok := ids[id]; ok {
+			return fmt.Errorf("artifact paths %q and %q have the same ID %q", other, path, id)
+		}
+		ids[id] = path
+	}
+	return nil
+}
+
+func checkPath(path string) error {
+	if path == "" || filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("artifact path %q is not a clean relative path", path)
+	}
+	if path == ".." || strings.HasPrefix(path, "../") {
+		return fmt.Errorf("artifact path %q is not within the working directory", path)
+	}
+	return nil
+}
+
+// Artifact is a file collected from the working directory of a command.
+type Artifact struct {
+	ID          string
+	Path        string
+	Content     []byte
+	SHA256      string
+	ContentType string
+
+	// Error is why the file could not be collected, if it could not, in
+	// which case it has no content.
+	Error string
+}
+
+// Collect reads the file at path within dir, which must be a regular file of
+// at most maxBytes. If it cannot be read, the returned artifact records why.
+//
+// The command may have replaced any part of the path with a symbolic link, so
+// links are not followed: the command must not be able to read, by way of its
+// artifacts, files which it could not read itself. Each part of the path is
+// opened relative to the directory containing it, so that a process left
+// running by the command cannot replace a directory with a link between the
+// check and the open.
+func Collect(dir, path string, maxBytes int64) *Artifact {
+	a := &Artifact{ID: ID(path), Path: path}
+	content, err := read(dir, path, maxBytes)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+
+	a.Content = content
+	a.SHA256 = inputs.Digest(content)
+	a.ContentType = mime.TypeByExtension(filepath.Ext(path))
+	if a.ContentType == "" {
+		a.ContentType = http.DetectContentType(content)
+	}
+	return a
+}
+
+func read(dir, path string, maxBytes int64) ([]byte, error) {
+	if err := checkPath(path); err != nil {
+		return nil, err
+	}
+
+	// The working directory was created by the executor, so it may be opened
+	// by its path.
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		flags := unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		if i < len(names)-1 {
+			flags |= unix.O_DIRECTORY
+		} else {
+			flags |= unix.O_NONBLOCK
+		}
+		next, err := unix.Openat(fd, name, flags, 0)
+		unix.Close(fd)
+		switch {
+		case err == unix.ENOENT:
+			return nil, fmt.Errorf("file was not created")
+		case err != nil && i < len(names)-1 && (err == unix.ELOOP || err == unix.ENOTDIR):
+			return nil, fmt.Errorf("%s is not a directory", strings.Join(names[:i+1], "/"))
+		case err != nil:
+			return nil, fmt.Errorf("opening file: %v", err)
+		}
+		fd = next
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("file is not a regular file")
+	}
+	if info.Size() > maxBytes {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxBytes)
+	}
+
+	// The file may still be growing if the command left a process running.
+	content, err := io.ReadAll(io.LimitReader(f, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxBytes {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxBytes)
+	}
+	return content, nil
+}
@@ -0,0 +1,90 @@
+package artifacts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestID(t *testing.T) {
+	if id := ID("reports/heap dump.hprof"); id != "reports-heap-dump.hprof" {
+		t.Errorf("Expected ID %q; got %q", "reports-heap-dump.hprof", id)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check([]string{"dump.sql", "reports/summary.txt"}); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+	for _, paths := range [][]string{
+		{""},
+		{"/etc/passwd"},
+		{"../dump.sql"},
+		{"reports/../dump.sql"},
+		{"reports/"},
+		{"a/b", "a-b"},
+	} {
+		if err := Check(paths); err == nil {
+			t.Errorf("Expected error for %q", paths)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "reports"), 0700); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "reports", "summary.txt"), []byte("summary"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dump"), []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Error creating link: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatalf("Error creating link: %v", err)
+	}
+	if err := os.Symlink("reports", filepath.Join(dir, "alias")); err != nil {
+		t.Fatalf("Error creating link: %v", err)
+	}
+
+	t.Run("Collect file", func(t *testing.T) {
+		a := Collect(dir, "reports/summary.txt", 1024)
+		if a.Error != "" || string(a.Content) != "summary" || a.ID != "reports-summary.txt" {
+			t.Fatalf("Bad artifact: %+v", a)
+		}
+		if a.SHA256 != "761b7ad8ad439b2855fcbb611331c646ef0870b0631247bba3f3025cb6df5a53" {
+			t.Errorf("Bad digest: %q", a.SHA256)
+		}
+		if a.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("Expected content type %q; got %q", "text/plain; charset=utf-8", a.ContentType)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		path string
+	}{
+		{"Missing file", "missing.txt"},
+		{"Directory", "reports"},
+		{"Too large", "dump"},
+		{"Symbolic link", "link"},
+		{"Linked directory", "escape/secret"},
+		{"Linked directory within working directory", "alias/summary.txt"},
+		{"File as directory", "dump/summary.txt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := Collect(dir, tc.path, 8)
+			if a.Error == "" || a.Content != nil {
+				t.Errorf("Expected error; got %+v", a)
+			}
+		})
+	}
+}
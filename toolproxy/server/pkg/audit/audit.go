@@ -0,0 +1,156 @@
+// Package audit implements the tamper-evident audit log of the tool proxy.
+//
+// Every action taken on a command is appended to the audit log as an event.
+// Events form a hash chain: the hash of each event covers the hash of the
+// event before it, its own sequence number and its content, so an event
+// cannot be modified, removed or reordered without changing the hash of
+// every event after it.
+//
+// A chain alone does not stop someone with write access to the database from
+// rewriting it from the point of a modification onward. The tool proxy
+// therefore periodically signs the hash of the latest event with an ed25519
+// key which is not stored in the database. Each such checkpoint anchors every
+// event before it. Events after the last checkpoint can still be removed
+// without detection, so verification reports how many events are anchored.
+//
+// Each event is also queued in an outbox when it is appended, from which an
+// Exporter delivers it at least once to external sinks: JSON-lines files,
+// syslog receivers and webhooks, and published on Channel, by which every
+// replica of the tool proxy learns of every change to a command.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// SystemActorType and SystemActorID identify the tool proxy itself as the
+// actor of events which no user took, e.g., a command finishing.
+const (
+	SystemActorType = "system"
+	SystemActorID   = "toolproxy"
+)
+
+// Channel is the Postgres notification channel on which the sequence number
+// and command ID of each event are published, separated by a space, when the
+// transaction which appended it commits.
+const Channel = "toolproxy_audit"
+
+// ParseNotification returns the sequence number and command ID of the event
+// published with the given payload on Channel.
+func ParseNotification(payload string) (seq int64, commandID int64, err error) {
+	if _, err = fmt.Sscanf(payload, "%d %d", &seq, &commandID); err != nil {
+		return 0, 0, fmt.Errorf("malformed audit notification %q: %v", payload, err)
+	}
+	return seq, commandID, nil
+}
+
+// Event is an action taken on a command.
+type Event struct {
+	// Sequence is the position of the event in the audit log, starting
+	// from 1. It is assigned when the event is appended.
+	Sequence int64
+
+	// CommandID is the ID of the command on which the action was taken.
+	CommandID int64
+
+	// Action is the action which was taken.
+	Action pb.Action
+
+	// ActorType, ActorID and ActorDisplayName identify who took the action.
+	ActorType        string
+	ActorID          string
+	ActorDisplayName string
+
+	// Detail is any content of the action which is not otherwise recorded,
+	// e.g., the argv of a created command or the final status of a finished
+	// one.
+	Detail string
+
+	// Time is the time at which the action was taken. It is recorded with
+	// microsecond precision.
+	Time time.Time
+
+	// Hash is the hash of the event. It is assigned when the event is
+	// appended.
+	Hash []byte
+}
+
+// content returns the encoding of the event over which it is hashed, less
+// its sequence number.
+func (e *Event) content() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, e.CommandID)
+	binary.Write(&b, binary.BigEndian, int32(e.Action))
+	for _, s := range []string{e.ActorType, e.ActorID, e.ActorDisplayName, e.Detail} {
+		binary.Write(&b, binary.BigEndian, uint32(len(s)))
+		b.WriteString(s)
+	}
+	binary.Write(&b, binary.BigEndian, e.Time.UnixMicro())
+	return b.Bytes()
+}
+
+// chain returns the hash of the event given the hash of the event before it.
+func (e *Event) chain(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	binary.Write(h, binary.BigEndian, e.Sequence)
+	h.Write(e.content())
+	return h.Sum(nil)
+}
+
+// genesis is the hash which precedes the first event.
+var genesis = make([]byte, sha256.Size)
+
+// AppendQuery appends an event to the audit log and queues it in the outbox
+// for export. It is exported for the use of tests which mock the database.
+//
+// The hash is computed by the database so that the head of the chain can be
+// advanced in a single statement. It must be computed as in Event.chain.
+const AppendQuery = `
+	WITH head AS (
+		UPDATE audit_head
+		SET (seq, hash) = (seq + 1, sha256(hash || int8send(seq + 1) || $1))
+		RETURNING seq, hash
+	), event AS (
+		INSERT INTO audit_events ("seq", "command_id", "action", "actor_type", "actor_id", "actor_display_name", "detail", "event_time", "hash")
+		SELECT seq, $2, $3, $4, $5, $6, $7, $8, hash FROM head
+		RETURNING seq
+	)
+	INSERT INTO audit_outbox ("seq")
+	SELECT seq FROM event;
+`
+
+// Execer is implemented by both *sql.DB and *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Append appends an event to the audit log.
+//
+// It should be executed in the same transaction as the action itself so that
+// no action goes unaudited. Appending an event locks the head of the audit
+// log until the transaction ends.
+func Append(ctx context.Context, db Execer, e Event) error {
+	e.Time = e.Time.Truncate(time.Microsecond)
+	_, err := db.ExecContext(
+		ctx,
+		AppendQuery,
+		e.content(),
+		e.CommandID,
+		e.Action,
+		e.ActorType,
+		e.ActorID,
+		e.ActorDisplayName,
+		e.Detail,
+		e.Time,
+	)
+	return err
+}
@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var eventColumnNames = []string{
+	"seq", "command_id", "action", "actor_type", "actor_id", "actor_display_name", "detail", "event_time", "hash",
+}
+
+// testLog returns a chain of n events.
+func testLog(n int) []Event {
+	var events []Event
+	prev := genesis
+	for i := 1; i <= n; i++ {
+		e := Event{
+			Sequence:  int64(i),
+			CommandID: 1,
+			Action:    pb.Action_ACTION_CREATE,
+			ActorType: "users",
+			ActorID:   "alice",
+			Detail:    `["/usr/bin/uptime"]`,
+			Time:      time.Unix(int64(i), 0),
+		}
+		e.Hash = e.chain(prev)
+		prev = e.Hash
+		events = append(events, e)
+	}
+	return events
+}
+
+func eventRows(events []Event) *sqlmock.Rows {
+	rows := sqlmock.NewRows(eventColumnNames)
+	for _, e := range events {
+		rows.AddRow(e.Sequence, e.CommandID, e.Action, e.ActorType, e.ActorID, e.ActorDisplayName, e.Detail, e.Time, e.Hash)
+	}
+	return rows
+}
+
+func checkpointRows(key ed25519.PrivateKey, events ...Event) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"seq", "hash", "signature", "create_time"})
+	for _, e := range events {
+		rows.AddRow(e.Sequence, e.Hash, ed25519.Sign(key, checkpointMessage(e.Sequence, e.Hash)), time.Time{})
+	}
+	return rows
+}
+
+func TestAppend(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	e := testLog(1)[0]
+	mock.ExpectExec(AppendQuery).WithArgs(
+		e.content(),
+		e.CommandID,
+		e.Action,
+		e.ActorType,
+		e.ActorID,
+		e.ActorDisplayName,
+		e.Detail,
+		e.Time,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The time is recorded with the precision with which it is hashed.
+	e.Time = e.Time.Add(time.Nanosecond)
+	if err := Append(context.Background(), db, e); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	seq, commandID, err := ParseNotification("42 7")
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if seq != 42 || commandID != 7 {
+		t.Errorf("Expected event 42 of command 7; got event %d of command %d", seq, commandID)
+	}
+
+	for _, payload := range []string{"", "42", "x 7"} {
+		if _, _, err := ParseNotification(payload); err == nil {
+			t.Errorf("Expected error for %q", payload)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	modified := testLog(4)
+	modified[1].ActorID = "mallory"
+
+	rewritten := testLog(4)
+	rewritten[1].ActorID = "mallory"
+	for i := 1; i < len(rewritten); i++ {
+		rewritten[i].Hash = rewritten[i].chain(rewritten[i-1].Hash)
+	}
+
+	testCases := []struct {
+		name        string
+		events      []Event
+		checkpoints *sqlmock.Rows
+		head        Event
+		problems    []string
+		last        int64
+	}{
+		{
+			name:        "Intact log",
+			events:      testLog(4),
+			checkpoints: checkpointRows(key, testLog(4)[2]),
+			head:        testLog(4)[3],
+			last:        3,
+		},
+		{
+			name:        "Modified event",
+			events:      modified,
+			checkpoints: checkpointRows(key),
+			head:        modified[3],
+			problems:    []string{"Event 2 has been modified"},
+		},
+		{
+			name:        "Rewritten log",
+			events:      rewritten,
+			checkpoints: checkpointRows(key, testLog(4)[2]),
+			head:        rewritten[3],
+			problems:    []string{"does not match its checkpoint"},
+		},
+		{
+			name:        "Removed event",
+			events:      append(testLog(4)[:1], testLog(4)[2:]...),
+			checkpoints: checkpointRows(key),
+			head:        testLog(4)[3],
+			problems:    []string{"Events 2 through 2 are missing"},
+		},
+		{
+			name:        "Truncated log",
+			events:      testLog(2),
+			checkpoints: checkpointRows(key, testLog(4)[3]),
+			head:        testLog(2)[1],
+			problems:    []string{"truncated before it"},
+		},
+		{
+			name:        "Forged checkpoint",
+			events:      testLog(4),
+			checkpoints: checkpointRows(otherKey, testLog(4)[3]),
+			head:        testLog(4)[3],
+			problems:    []string{"invalid signature"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			mock.ExpectQuery(listCheckpointsQuery).WillReturnRows(tc.checkpoints)
+			mock.ExpectQuery(headQuery).WillReturnRows(
+				sqlmock.NewRows([]string{"seq", "hash"}).AddRow(tc.head.Sequence, tc.head.Hash),
+			)
+			mock.ExpectQuery(listEventsQuery).WithArgs(tc.head.Sequence).WillReturnRows(eventRows(tc.events))
+
+			report, err := Verify(context.Background(), db, pub)
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			if len(report.Problems) != len(tc.problems) {
+				t.Fatalf("Expected %d problems; got %v", len(tc.problems), report.Problems)
+			}
+			for i, p := range tc.problems {
+				if !strings.Contains(report.Problems[i].Description, p) {
+					t.Errorf("Expected problem %q; got %q", p, report.Problems[i].Description)
+				}
+			}
+			if report.LastCheckpoint != tc.last {
+				t.Errorf("Expected last checkpoint %d; got %d", tc.last, report.LastCheckpoint)
+			}
+
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	head := testLog(3)[2]
+	mock.ExpectQuery(headQuery).WillReturnRows(
+		sqlmock.NewRows([]string{"seq", "hash"}).AddRow(head.Sequence, head.Hash),
+	)
+	mock.ExpectExec(insertCheckpointQuery).WithArgs(
+		head.Sequence,
+		head.Hash,
+		ed25519.Sign(key, checkpointMessage(head.Sequence, head.Hash)),
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c := &Checkpointer{DB: db, Key: key}
+	if err := c.Checkpoint(context.Background()); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
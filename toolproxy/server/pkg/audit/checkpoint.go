@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpointDomain separates checkpoint signatures from any other use of the
+// audit key.
+const checkpointDomain = "toolproxy audit checkpoint\x00"
+
+// checkpointMessage returns the message which is signed to checkpoint the
+// event with the given sequence number and hash.
+func checkpointMessage(seq int64, hash []byte) []byte {
+	msg := make([]byte, len(checkpointDomain)+8, len(checkpointDomain)+8+len(hash))
+	copy(msg, checkpointDomain)
+	binary.BigEndian.PutUint64(msg[len(checkpointDomain):], uint64(seq))
+	return append(msg, hash...)
+}
+
+// Checkpointer periodically signs the head of the audit log.
+type Checkpointer struct {
+	// DB is the database in which the audit log is stored.
+	DB *sql.DB
+
+	// Key signs checkpoints. Its public key verifies them.
+	Key ed25519.PrivateKey
+
+	// Interval is how often to checkpoint the audit log. If it is zero, the
+	// audit log is checkpointed every five minutes.
+	Interval time.Duration
+}
+
+func (c *Checkpointer) interval() time.Duration {
+	if c.Interval == 0 {
+		return 5 * time.Minute
+	}
+	return c.Interval
+}
+
+// Run checkpoints the audit log every interval until ctx is canceled.
+func (c *Checkpointer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval())
+	defer ticker.Stop()
+
+	for {
+		if err := c.Checkpoint(ctx); err != nil {
+			log.WithError(err).Errorln("Error checkpointing audit log.")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+const headQuery = `
+	SELECT seq, hash FROM audit_head;
+`
+
+const insertCheckpointQuery = `
+	INSERT INTO audit_checkpoints ("seq", "hash", "signature", "create_time")
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT DO NOTHING;
+`
+
+// Checkpoint signs the head of the audit log, unless the audit log is empty
+// or the head has already been checkpointed.
+func (c *Checkpointer) Checkpoint(ctx context.Context) error {
+	var seq int64
+	var hash []byte
+	if err := c.DB.QueryRowContext(ctx, headQuery).Scan(&seq, &hash); err != nil {
+		return err
+	}
+	if seq == 0 {
+		return nil
+	}
+
+	signature := ed25519.Sign(c.Key, checkpointMessage(seq, hash))
+	res, err := c.DB.ExecContext(ctx, insertCheckpointQuery, seq, hash, signature, time.Now())
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		log.WithField("sequence", seq).Infoln("Checkpointed audit log.")
+	}
+	return nil
+}
+
+// LoadSigningKey reads a PEM-encoded PKCS #8 ed25519 private key.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+}
+
+// LoadVerificationKey reads a PEM-encoded PKIX ed25519 public key.
+func LoadVerificationKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ed25519.PublicKey); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 public key", path)
+}
+
+// readPEM returns the contents of the first PEM block of the given type in
+// the file at path.
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no %s found", path, blockType)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
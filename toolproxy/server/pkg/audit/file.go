@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink appends events to a file as JSON lines, rotating it when it grows
+// too large. Rotated files are renamed with the suffixes `.1`, `.2`, etc.,
+// from newest to oldest.
+type FileSink struct {
+	// Path is the path of the file.
+	Path string
+
+	// MaxBytes is the size beyond which the file is rotated. If it is zero,
+	// the file is rotated at 100 MiB.
+	MaxBytes int64
+
+	// MaxBackups is the number of rotated files which are kept. If it is
+	// zero, five are kept.
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (s *FileSink) maxBytes() int64 {
+	if s.MaxBytes == 0 {
+		return 100 << 20
+	}
+	return s.MaxBytes
+}
+
+func (s *FileSink) maxBackups() int {
+	if s.MaxBackups == 0 {
+		return 5
+	}
+	return s.MaxBackups
+}
+
+// Send implements Sink for FileSink. The file is synced before it returns.
+func (s *FileSink) Send(ctx context.Context, e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes() {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// open opens the file for appending.
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the file and its backups, discarding the oldest, and opens
+// a new file in its place.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if err := os.Remove(s.backup(s.maxBackups())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := s.maxBackups() - 1; i > 0; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.Path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.Path, i)
+}
+
+// Close implements Sink for FileSink.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
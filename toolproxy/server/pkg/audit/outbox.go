@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exporter delivers the events queued in the outbox to every sink.
+//
+// Events are queued in the same transaction in which they are appended, so
+// none is lost if the server stops before exporting it. Any number of
+// exporters may share a database; each batch of events is exported by one
+// of them at a time, in order of sequence number within the batch.
+type Exporter struct {
+	// DB is the database in which the audit log is stored.
+	DB *sql.DB
+
+	// Sinks receive the exported events. If there are none, events are
+	// removed from the outbox without being exported.
+	Sinks []Sink
+
+	// PollInterval is how often the outbox is checked for events, and how
+	// long to wait before retrying an event which could not be delivered.
+	// If it is zero, the outbox is checked every ten seconds.
+	PollInterval time.Duration
+
+	// BatchSize is the greatest number of events exported in a transaction.
+	// If it is zero, a hundred are.
+	BatchSize int
+
+	wakeOnce sync.Once
+	wake     chan struct{}
+}
+
+func (x *Exporter) pollInterval() time.Duration {
+	if x.PollInterval == 0 {
+		return 10 * time.Second
+	}
+	return x.PollInterval
+}
+
+func (x *Exporter) batchSize() int {
+	if x.BatchSize == 0 {
+		return 100
+	}
+	return x.BatchSize
+}
+
+// Wake causes Run to check the outbox immediately rather than at the next
+// poll, so that an urgent event, e.g., the use of break-glass, reaches the
+// sinks without delay. It does not block.
+func (x *Exporter) Wake() {
+	select {
+	case x.wakeup() <- struct{}{}:
+	default:
+	}
+}
+
+func (x *Exporter) wakeup() chan struct{} {
+	x.wakeOnce.Do(func() {
+		x.wake = make(chan struct{}, 1)
+	})
+	return x.wake
+}
+
+// Run exports events until ctx is canceled, and then closes the sinks.
+func (x *Exporter) Run(ctx context.Context) error {
+	defer func() {
+		for _, s := range x.Sinks {
+			if err := s.Close(); err != nil {
+				log.WithError(err).WithField("sink", s).Errorln("Error closing audit sink.")
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(x.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		// A full batch suggests that more events are waiting.
+		n, err := x.Export(ctx)
+		if err != nil {
+			log.WithError(err).Errorln("Error exporting audit events.")
+		} else if n == x.batchSize() {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-x.wakeup():
+		}
+	}
+}
+
+const claimOutboxQuery = `
+	SELECT e.seq, e.command_id, e.action, e.actor_type, e.actor_id, e.actor_display_name, e.detail, e.event_time, e.hash
+	FROM audit_outbox o
+	JOIN audit_events e ON e.seq = o.seq
+	ORDER BY o.seq
+	LIMIT $1
+	FOR UPDATE OF o SKIP LOCKED;
+`
+
+const deleteOutboxQuery = `
+	DELETE FROM audit_outbox
+	WHERE seq = ANY($1);
+`
+
+const failOutboxQuery = `
+	UPDATE audit_outbox
+	SET (attempts, last_error) = (attempts + 1, $2)
+	WHERE seq = $1;
+`
+
+// Export delivers a batch of events from the outbox to every sink and
+// returns the number which were delivered.
+//
+// Delivery stops at the first event which any sink fails to accept, so that
+// events are not delivered out of order; that event is retried from the
+// first sink by a later call.
+func (x *Exporter) Export(ctx context.Context) (int, error) {
+	tx, err := x.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, claimOutboxQuery, x.batchSize())
+	if err != nil {
+		return 0, err
+	}
+	var events []*Event
+	for rows.Next() {
+		e := &Event{}
+		if err := rows.Scan(
+			&e.Sequence,
+			&e.CommandID,
+			&e.Action,
+			&e.ActorType,
+			&e.ActorID,
+			&e.ActorDisplayName,
+			&e.Detail,
+			&e.Time,
+			&e.Hash,
+		); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var delivered []int64
+	var sendErr error
+	for _, e := range events {
+		if sendErr = x.send(ctx, e); sendErr != nil {
+			if _, err := tx.ExecContext(ctx, failOutboxQuery, e.Sequence, sendErr.Error()); err != nil {
+				return 0, err
+			}
+			break
+		}
+		delivered = append(delivered, e.Sequence)
+	}
+
+	if len(delivered) > 0 {
+		if _, err := tx.ExecContext(ctx, deleteOutboxQuery, pq.Array(delivered)); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(delivered), sendErr
+}
+
+// send delivers an event to every sink.
+func (x *Exporter) send(ctx context.Context, e *Event) error {
+	for _, s := range x.Sinks {
+		if err := s.Send(ctx, e); err != nil {
+			return fmt.Errorf("sink %v: event %d: %w", s, e.Sequence, err)
+		}
+	}
+	return nil
+}
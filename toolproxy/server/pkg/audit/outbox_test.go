@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// fakeSink records the events sent to it and fails on the given sequence.
+type fakeSink struct {
+	failOn int64
+	sent   []int64
+}
+
+func (s *fakeSink) Send(ctx context.Context, e *Event) error {
+	if e.Sequence == s.failOn {
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, e.Sequence)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	t.Run("Deliver batch to every sink", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOutboxQuery).WithArgs(100).WillReturnRows(eventRows(testLog(3)))
+		mock.ExpectExec(deleteOutboxQuery).WithArgs(pq.Array([]int64{1, 2, 3})).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectCommit()
+
+		a, b := &fakeSink{}, &fakeSink{}
+		x := &Exporter{DB: db, Sinks: []Sink{a, b}}
+		n, err := x.Export(context.Background())
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+		if n != 3 || len(a.sent) != 3 || len(b.sent) != 3 {
+			t.Errorf("Expected 3 events delivered to each sink; got %d, %v, %v", n, a.sent, b.sent)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Stop at first failed delivery", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOutboxQuery).WithArgs(100).WillReturnRows(eventRows(testLog(3)))
+		mock.ExpectExec(failOutboxQuery).WithArgs(2, "sink fake: event 2: unavailable").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(deleteOutboxQuery).WithArgs(pq.Array([]int64{1})).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		a := &fakeSink{}
+		x := &Exporter{DB: db, Sinks: []Sink{a, named{Sink: &fakeSink{failOn: 2}, name: "fake"}}}
+		n, err := x.Export(context.Background())
+		if err == nil {
+			t.Errorf("Expected error from failed delivery")
+		}
+		if n != 1 {
+			t.Errorf("Expected 1 event delivered; got %d", n)
+		}
+
+		// The event is retried from the first sink, which may receive it
+		// more than once.
+		if len(a.sent) != 2 {
+			t.Errorf("Expected first sink to receive events 1 and 2; got %v", a.sent)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestExporterWake(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// The outbox is checked once when the exporter starts and again when
+	// it is woken, long before it would next be polled.
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimOutboxQuery).WithArgs(100).WillReturnRows(eventRows(nil))
+		mock.ExpectCommit()
+	}
+
+	x := &Exporter{DB: db, PollInterval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		x.Run(ctx)
+		close(done)
+	}()
+
+	// Waking an exporter which is already due to check the outbox does not
+	// block.
+	x.Wake()
+	x.Wake()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
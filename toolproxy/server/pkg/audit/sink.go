@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Sink receives the events of the audit log as they are exported from the
+// outbox.
+//
+// Delivery is at least once: an event may be sent to a sink again if it, or
+// any other sink, failed to accept it or if the server stopped before the
+// outbox recorded its delivery. Receivers may use the sequence number of an
+// event to discard duplicates.
+type Sink interface {
+	// Send delivers an event. It returns nil only once the event has been
+	// accepted by the sink's destination.
+	Send(ctx context.Context, e *Event) error
+
+	// Close releases any resources held by the sink.
+	Close() error
+}
+
+// record is the form in which an event is exported.
+type record struct {
+	Sequence         int64     `json:"sequence"`
+	Command          string    `json:"command"`
+	Action           string    `json:"action"`
+	Actor            string    `json:"actor"`
+	ActorDisplayName string    `json:"actor_display_name,omitempty"`
+	Detail           string    `json:"detail,omitempty"`
+	Time             time.Time `json:"time"`
+	Hash             string    `json:"hash"`
+}
+
+// MarshalJSON encodes the event in the form in which it is exported.
+func (e *Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(record{
+		Sequence:         e.Sequence,
+		Command:          e.command(),
+		Action:           e.Action.String(),
+		Actor:            e.ActorType + ":" + e.ActorID,
+		ActorDisplayName: e.ActorDisplayName,
+		Detail:           e.Detail,
+		Time:             e.Time.UTC(),
+		Hash:             hex.EncodeToString(e.Hash),
+	})
+}
+
+// command returns the resource name of the command on which the action was
+// taken.
+func (e *Event) command() string {
+	return "commands/" + strconv.FormatInt(e.CommandID, 10)
+}
+
+// SinkConfig configures a sink. Only the fields of its type are used.
+type SinkConfig struct {
+	// Name identifies the sink in logs. If it is empty, the type is used.
+	Name string `mapstructure:"name"`
+
+	// Type is one of `file`, `syslog` or `webhook`.
+	Type string `mapstructure:"type"`
+
+	// Path, MaxBytes and MaxBackups configure a FileSink.
+	Path       string `mapstructure:"path"`
+	MaxBytes   int64  `mapstructure:"max_bytes"`
+	MaxBackups int    `mapstructure:"max_backups"`
+
+	// Network, Address, Facility and AppName configure a SyslogSink.
+	Network  string `mapstructure:"network"`
+	Address  string `mapstructure:"address"`
+	Facility string `mapstructure:"facility"`
+	AppName  string `mapstructure:"app_name"`
+
+	// URL, Headers, Source and Timeout configure a WebhookSink.
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	Source  string            `mapstructure:"source"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+}
+
+// NewSinks returns the sinks described by configs.
+func NewSinks(configs []SinkConfig) ([]Sink, error) {
+	var sinks []Sink
+	names := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("audit: duplicate sink %q", c.Name)
+		}
+		names[c.Name] = true
+
+		s, err := newSink(c)
+		if err != nil {
+			return nil, fmt.Errorf("audit: sink %q: %v", c.Name, err)
+		}
+		sinks = append(sinks, named{Sink: s, name: c.Name})
+	}
+	return sinks, nil
+}
+
+func newSink(c SinkConfig) (Sink, error) {
+	switch c.Type {
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("path is required")
+		}
+		return &FileSink{Path: c.Path, MaxBytes: c.MaxBytes, MaxBackups: c.MaxBackups}, nil
+	case "syslog":
+		if c.Address == "" {
+			return nil, fmt.Errorf("address is required")
+		}
+		facility, err := parseFacility(c.Facility)
+		if err != nil {
+			return nil, err
+		}
+		return &SyslogSink{Network: c.Network, Address: c.Address, Facility: facility, AppName: c.AppName}, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &WebhookSink{URL: c.URL, Headers: c.Headers, Source: c.Source, Timeout: c.Timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// named is a sink with the name by which it was configured.
+type named struct {
+	Sink
+	name string
+}
+
+func (n named) String() string {
+	return n.name
+}
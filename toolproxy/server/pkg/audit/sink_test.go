@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	s := &FileSink{Path: path, MaxBytes: 1, MaxBackups: 2}
+	defer s.Close()
+
+	// Each event exceeds MaxBytes, so the file is rotated before every event
+	// but the first.
+	for _, e := range testLog(4) {
+		e := e
+		if err := s.Send(context.Background(), &e); err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+	}
+
+	for suffix, seq := range map[string]int64{"": 4, ".1": 3, ".2": 2} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", path+suffix, err)
+		}
+		var r record
+		if err := json.Unmarshal(data, &r); err != nil {
+			t.Fatalf("Error decoding %q: %v", data, err)
+		}
+		if r.Sequence != seq || r.Command != "commands/1" || r.Action != "ACTION_CREATE" || r.Actor != "users:alice" {
+			t.Errorf("Expected event %d in %q; got %+v", seq, path+suffix, r)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only %d backups to be kept", s.MaxBackups)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	e := testLog(1)[0]
+
+	t.Run("Send over TCP", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+		received := make(chan string)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				close(received)
+				return
+			}
+			defer conn.Close()
+
+			// Messages are framed by octet counting.
+			r := bufio.NewReader(conn)
+			n, err := r.ReadString(' ')
+			if err != nil {
+				close(received)
+				return
+			}
+			length, _ := strconv.Atoi(strings.TrimSpace(n))
+			msg := make([]byte, length)
+			io.ReadFull(r, msg)
+			received <- string(msg)
+		}()
+
+		s := &SyslogSink{Network: "tcp", Address: l.Addr().String(), Facility: facilities["audit"]}
+		defer s.Close()
+		if err := s.Send(context.Background(), &e); err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		msg := <-received
+		if !strings.HasPrefix(msg, "<109>1 1970-01-01T00:00:01.000000Z ") {
+			t.Errorf("Bad syslog header: %q", msg)
+		}
+		if !strings.Contains(msg, " toolproxy ") || !strings.Contains(msg, " ACTION_CREATE - {") {
+			t.Errorf("Bad syslog message: %q", msg)
+		}
+	})
+
+	t.Run("Send over UDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer conn.Close()
+
+		s := &SyslogSink{Network: "udp", Address: conn.LocalAddr().String(), Facility: facilities["local0"], AppName: "proxy"}
+		defer s.Close()
+		if err := s.Send(context.Background(), &e); err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		buf := make([]byte, 4096)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error receiving: %v", err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, "<133>1 ") || !strings.Contains(msg, " proxy ") || !strings.HasSuffix(msg, "}") {
+			t.Errorf("Bad syslog message: %q", msg)
+		}
+	})
+}
+
+func TestWebhookSink(t *testing.T) {
+	type request struct {
+		header http.Header
+		event  cloudEvent
+		data   record
+	}
+	requests := make(chan request, 2)
+	statuses := make(chan int, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			cloudEvent
+			Data record `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests <- request{header: r.Header, event: body.cloudEvent, data: body.Data}
+		w.WriteHeader(<-statuses)
+	}))
+	defer srv.Close()
+
+	s := &WebhookSink{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer token"}}
+	e := testLog(2)[1]
+	statuses <- http.StatusAccepted
+	if err := s.Send(context.Background(), &e); err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	r := <-requests
+	if !strings.HasPrefix(r.header.Get("Content-Type"), "application/cloudevents+json") || r.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("Bad headers: %v", r.header)
+	}
+	if r.event.SpecVersion != "1.0" || r.event.ID != "2" || r.event.Source != "/toolproxy" || r.event.Subject != "commands/1" {
+		t.Errorf("Bad CloudEvent: %+v", r.event)
+	}
+	if r.event.Type != "io.github.hxtk.toolproxy.audit.v1.create" || r.data.Sequence != 2 {
+		t.Errorf("Bad CloudEvent: %+v with data %+v", r.event, r.data)
+	}
+
+	statuses <- http.StatusServiceUnavailable
+	if err := s.Send(context.Background(), &e); err == nil {
+		t.Errorf("Expected error from failed delivery")
+	}
+}
+
+func TestNewSinks(t *testing.T) {
+	testCases := []struct {
+		name    string
+		configs []SinkConfig
+		ok      bool
+	}{
+		{
+			name: "Valid sinks",
+			configs: []SinkConfig{
+				{Type: "file", Path: "/var/log/toolproxy/audit.jsonl"},
+				{Name: "siem", Type: "syslog", Address: "siem:514", Facility: "local3"},
+				{Type: "webhook", URL: "https://example.com/audit"},
+			},
+			ok: true,
+		},
+		{
+			name:    "Unknown type",
+			configs: []SinkConfig{{Type: "kafka"}},
+		},
+		{
+			name:    "Unknown facility",
+			configs: []SinkConfig{{Type: "syslog", Address: "siem:514", Facility: "local9"}},
+		},
+		{
+			name:    "Duplicate name",
+			configs: []SinkConfig{{Type: "webhook", URL: "https://a"}, {Type: "webhook", URL: "https://b"}},
+		},
+		{
+			name:    "Missing path",
+			configs: []SinkConfig{{Type: "file"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sinks, err := NewSinks(tc.configs)
+			if tc.ok && (err != nil || len(sinks) != len(tc.configs)) {
+				t.Errorf("Expected %d sinks; got %v, %v", len(tc.configs), sinks, err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// facilities are the syslog facilities by their names in RFC 5424.
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "audit": 13, "alert": 14, "clock": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// parseFacility returns the syslog facility with the given name. If name is
+// empty, the `audit` facility is used.
+func parseFacility(name string) (int, error) {
+	if name == "" {
+		return facilities["audit"], nil
+	}
+	f, ok := facilities[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return f, nil
+}
+
+// severityNotice is the syslog severity of every event.
+const severityNotice = 5
+
+// SyslogSink sends events to a syslog receiver as RFC 5424 messages whose
+// MSGID is the action and whose MSG is the event encoded as JSON.
+//
+// Over TCP, messages are framed by octet counting as in RFC 6587. Over UDP,
+// each message is sent in its own datagram as in RFC 5426; UDP offers no
+// acknowledgement, so an event is considered delivered once it is sent.
+type SyslogSink struct {
+	// Network is `tcp` or `udp`. If it is empty, `tcp` is used.
+	Network string
+
+	// Address is the host and port of the receiver.
+	Address string
+
+	// Facility is the syslog facility of every message.
+	Facility int
+
+	// AppName is the APP-NAME of every message. If it is empty, `toolproxy`
+	// is used.
+	AppName string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *SyslogSink) network() string {
+	if s.Network == "" {
+		return "tcp"
+	}
+	return s.Network
+}
+
+func (s *SyslogSink) appName() string {
+	if s.AppName == "" {
+		return "toolproxy"
+	}
+	return s.AppName
+}
+
+// format returns the RFC 5424 message for an event.
+func (s *SyslogSink) format(e *Event) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	header := fmt.Sprintf(
+		"<%d>1 %s %s %s %d %s - ",
+		s.Facility*8+severityNotice,
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname,
+		s.appName(),
+		os.Getpid(),
+		e.Action.String(),
+	)
+	return append([]byte(header), data...), nil
+}
+
+// Send implements Sink for SyslogSink.
+func (s *SyslogSink) Send(ctx context.Context, e *Event) error {
+	msg, err := s.format(e)
+	if err != nil {
+		return err
+	}
+	if s.network() != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		var d net.Dialer
+		s.conn, err = d.DialContext(ctx, s.network(), s.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	s.conn.SetWriteDeadline(deadline)
+	if _, err := s.conn.Write(msg); err != nil {
+		// The stream may have been left with a partial message, so it is
+		// discarded and a new connection is made on the next attempt.
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close implements Sink for SyslogSink.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Problem is a gap in or modification of the audit log.
+type Problem struct {
+	// Sequence is the sequence number of the event or checkpoint at which
+	// the problem was detected.
+	Sequence int64
+
+	// Description describes the problem.
+	Description string
+}
+
+// Report is the result of verifying the audit log.
+type Report struct {
+	// Events is the number of events in the audit log.
+	Events int64
+
+	// Checkpoints is the number of checkpoints in the audit log.
+	Checkpoints int64
+
+	// LastCheckpoint is the sequence number of the last event anchored by a
+	// valid checkpoint, and LastCheckpointTime is the time at which it was
+	// signed. Events after it could have been removed without detection.
+	LastCheckpoint     int64
+	LastCheckpointTime time.Time
+
+	// Problems are the problems which were detected, in order of sequence
+	// number. The audit log is intact if there are none.
+	Problems []Problem
+}
+
+func (r *Report) problem(seq int64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Sequence: seq, Description: fmt.Sprintf(format, args...)})
+}
+
+const listEventsQuery = `
+	SELECT seq, command_id, action, actor_type, actor_id, actor_display_name, detail, event_time, hash
+	FROM audit_events
+	WHERE seq <= $1
+	ORDER BY seq;
+`
+
+const listCheckpointsQuery = `
+	SELECT seq, hash, signature, create_time
+	FROM audit_checkpoints
+	ORDER BY seq;
+`
+
+// checkpoint is a signed checkpoint of the audit log.
+type checkpoint struct {
+	hash       []byte
+	createTime time.Time
+}
+
+// Verify checks that the audit log is an unbroken chain of events and that
+// it agrees with every checkpoint signed by the private key of pub.
+//
+// An error is returned only if the audit log could not be read. Any gap or
+// modification which is detected is reported as a problem, and verification
+// continues past it so that every problem is reported.
+func Verify(ctx context.Context, db *sql.DB, pub ed25519.PublicKey) (*Report, error) {
+	// Checkpoints are read before the head, which only advances, so every
+	// valid checkpoint must be of an event up to the head.
+	report := &Report{}
+	checkpoints, err := verifyCheckpoints(ctx, db, pub, report)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every event up to the head was committed before the head was read, so
+	// no event in that range may be missing.
+	var head int64
+	var headHash []byte
+	if err := db.QueryRowContext(ctx, headQuery).Scan(&head, &headHash); err != nil {
+		return nil, err
+	}
+	for seq := range checkpoints {
+		if seq > head {
+			report.problem(seq, "Event %d was checkpointed, but the audit log has been truncated before it.", seq)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, listEventsQuery, head)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var last int64
+	prev := genesis
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(
+			&e.Sequence,
+			&e.CommandID,
+			&e.Action,
+			&e.ActorType,
+			&e.ActorID,
+			&e.ActorDisplayName,
+			&e.Detail,
+			&e.Time,
+			&e.Hash,
+		); err != nil {
+			return nil, err
+		}
+		report.Events++
+
+		hash := e.chain(prev)
+		if e.Sequence != last+1 {
+			report.problem(last+1, "Events %d through %d are missing.", last+1, e.Sequence-1)
+		} else if !bytes.Equal(hash, e.Hash) {
+			report.problem(e.Sequence, "Event %d has been modified, or an event before it has.", e.Sequence)
+		}
+
+		if c, ok := checkpoints[e.Sequence]; ok {
+			if bytes.Equal(c.hash, hash) {
+				report.LastCheckpoint = e.Sequence
+				report.LastCheckpointTime = c.createTime
+			} else {
+				report.problem(e.Sequence, "The audit log up to event %d does not match its checkpoint.", e.Sequence)
+			}
+		}
+
+		last = e.Sequence
+		prev = e.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if last < head {
+		report.problem(last+1, "Events %d through %d are missing.", last+1, head)
+	} else if !bytes.Equal(prev, headHash) {
+		report.problem(head, "Event %d does not match the head of the audit log.", head)
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Sequence < report.Problems[j].Sequence
+	})
+	return report, nil
+}
+
+// verifyCheckpoints returns the checkpoints with valid signatures by their
+// sequence numbers, and reports those without.
+func verifyCheckpoints(ctx context.Context, db *sql.DB, pub ed25519.PublicKey, report *Report) (map[int64]checkpoint, error) {
+	rows, err := db.QueryContext(ctx, listCheckpointsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := map[int64]checkpoint{}
+	for rows.Next() {
+		var seq int64
+		var c checkpoint
+		var signature []byte
+		if err := rows.Scan(&seq, &c.hash, &signature, &c.createTime); err != nil {
+			return nil, err
+		}
+		report.Checkpoints++
+
+		if !ed25519.Verify(pub, checkpointMessage(seq, c.hash), signature) {
+			report.problem(seq, "The checkpoint of event %d has an invalid signature.", seq)
+			continue
+		}
+		checkpoints[seq] = c
+	}
+	return checkpoints, rows.Err()
+}
@@ -0,0 +1,14 @@
+package audit
+
+import (
+	"github.com/spf13/viper"
+)
+
+// SinksFromViper loads sinks from the `sinks` key of v.
+func SinksFromViper(v *viper.Viper) ([]Sink, error) {
+	var configs []SinkConfig
+	if err := v.UnmarshalKey("sinks", &configs); err != nil {
+		return nil, err
+	}
+	return NewSinks(configs)
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudEventTypePrefix prefixes the CloudEvents type of every event, which
+// ends with the action, e.g., `io.github.hxtk.toolproxy.audit.v1.create`.
+const cloudEventTypePrefix = "io.github.hxtk.toolproxy.audit.v1."
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            *Event    `json:"data"`
+}
+
+// WebhookSink posts events to an HTTP endpoint as CloudEvents in the
+// structured JSON format. The ID of each CloudEvent is the sequence number
+// of the event, so receivers may discard duplicates by source and ID.
+type WebhookSink struct {
+	// URL is the endpoint to which events are posted. An event is delivered
+	// when the endpoint responds with a 2xx status.
+	URL string
+
+	// Headers are added to every request, e.g., for authorization.
+	Headers map[string]string
+
+	// Source is the CloudEvents source of every event. If it is empty,
+	// `/toolproxy` is used.
+	Source string
+
+	// Timeout bounds each request. If it is zero, requests time out after
+	// ten seconds.
+	Timeout time.Duration
+
+	// Client sends requests. If it is nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (s *WebhookSink) source() string {
+	if s.Source == "" {
+		return "/toolproxy"
+	}
+	return s.Source
+}
+
+func (s *WebhookSink) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return s.Timeout
+}
+
+func (s *WebhookSink) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// Send implements Sink for WebhookSink.
+func (s *WebhookSink) Send(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              strconv.FormatInt(e.Sequence, 10),
+		Source:          s.source(),
+		Type:            cloudEventTypePrefix + strings.ToLower(strings.TrimPrefix(e.Action.String(), "ACTION_")),
+		Subject:         e.command(),
+		Time:            e.Time.UTC(),
+		DataContentType: "application/json",
+		Data:            e,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=UTF-8")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %s", res.Status)
+	}
+	return nil
+}
+
+// Close implements Sink for WebhookSink.
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,390 @@
+// Package catalog implements the allowlist of tools which may be run by the tool proxy.
+//
+// A catalog consists of entries, each of which permits a single binary to be
+// run with a restricted set of arguments. A command is permitted if its argv
+// matches at least one entry.
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Flag is a flag which may be passed to a tool.
+type Flag struct {
+	// Name is the flag as it appears in argv, e.g., `--namespace` or `-n`.
+	Name string
+
+	// Value is a regular expression which the value of the flag must match
+	// in its entirety. If it is empty, the flag does not take a value.
+	//
+	// Values may be given either in the same argument as the flag, as in
+	// `--namespace=default`, or in the following argument.
+	Value string
+}
+
+// Entry is a tool which may be run and the arguments with which it may be run.
+type Entry struct {
+	// Name uniquely identifies the entry. It is recorded on each command
+	// permitted by this entry.
+	Name string
+
+	// Path is the absolute path of the binary. The first element of argv
+	// must be exactly equal to it.
+	Path string
+
+	// Subcommands are the sequences of leading arguments with which the tool
+	// may be run, e.g., `["rollout", "restart"]`. If there are none, the tool
+	// may be run without a subcommand; otherwise argv must continue with one
+	// of them.
+	Subcommands [][]string
+
+	// Flags are the flags which may be passed to the tool.
+	Flags []Flag
+
+	// Args are regular expressions, each of which a positional argument may
+	// match in its entirety. If there are none, positional arguments other
+	// than the subcommand are not permitted.
+	Args []string
+
+	// Profile is the name of the execution profile with which commands
+	// permitted by this entry are run. If it is empty, the server's default
+	// profile is used.
+	Profile string
+
+	// Env are the names of the environment variables which commands
+	// permitted by this entry may set, whether to values or to secrets. They
+	// may set no others, since variables such as `LD_PRELOAD` or `PYTHONPATH`
+	// would let them run code which the catalog does not permit.
+	Env []string
+
+	// DryRun is how the tool is run to preview what a command would do
+	// without doing it. If it is nil, commands permitted by this entry are
+	// not previewed.
+	DryRun *DryRun `mapstructure:"dry_run"`
+
+	flags map[string]*regexp.Regexp
+	args  []*regexp.Regexp
+}
+
+// DryRun transforms the argv of a command into that of a dry run of it, e.g.,
+// `kubectl apply` into `kubectl apply --dry-run=server`, or `terraform apply`
+// into `terraform plan`.
+//
+// The argv of a dry run is derived by the server from a command which the
+// catalog permits, so it is not itself checked against the catalog.
+type DryRun struct {
+	// Subcommand replaces the subcommand with which the command was run,
+	// e.g., `["plan"]` for `terraform apply` or `["diff", "upgrade"]` for
+	// `helm upgrade`. If it is empty, the subcommand is kept.
+	Subcommand []string
+
+	// Args are inserted immediately after the subcommand, or after the
+	// path of the tool if it has no subcommands, e.g., `["--dry-run=server"]`.
+	Args []string
+
+	// RemoveFlags are flags of the entry which are removed from the command,
+	// along with their values, because the dry run does not accept them,
+	// e.g., `-auto-approve`.
+	RemoveFlags []string `mapstructure:"remove_flags"`
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Catalog is a set of entries against which commands are checked.
+type Catalog struct {
+	entries []*Entry
+}
+
+// New returns a Catalog of the given entries.
+//
+// An error is returned if any entry is malformed: entries must have unique,
+// non-empty names and absolute paths, and all regular expressions must compile.
+func New(entries []Entry) (*Catalog, error) {
+	c := &Catalog{}
+	names := make(map[string]struct{})
+	for i := range entries {
+		e := entries[i]
+		if e.Name == "" {
+			return nil, fmt.Errorf("catalog: entry %d has no name", i)
+		}
+		if _, ok := names[e.Name]; ok {
+			return nil, fmt.Errorf("catalog: duplicate entry %q", e.Name)
+		}
+		names[e.Name] = struct{}{}
+
+		if !filepath.IsAbs(e.Path) {
+			return nil, fmt.Errorf("catalog: entry %q: path %q is not absolute", e.Name, e.Path)
+		}
+
+		e.flags = make(map[string]*regexp.Regexp)
+		for _, f := range e.Flags {
+			if !strings.HasPrefix(f.Name, "-") {
+				return nil, fmt.Errorf("catalog: entry %q: flag %q must begin with `-`", e.Name, f.Name)
+			}
+
+			var re *regexp.Regexp
+			if f.Value != "" {
+				var err error
+				re, err = compile(f.Value)
+				if err != nil {
+					return nil, fmt.Errorf("catalog: entry %q: flag %q: %v", e.Name, f.Name, err)
+				}
+			}
+			e.flags[f.Name] = re
+		}
+
+		for _, a := range e.Args {
+			re, err := compile(a)
+			if err != nil {
+				return nil, fmt.Errorf("catalog: entry %q: %v", e.Name, err)
+			}
+			e.args = append(e.args, re)
+		}
+
+		for _, name := range e.Env {
+			if !envNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("catalog: entry %q: invalid environment variable name %q", e.Name, name)
+			}
+		}
+
+		if err := e.checkDryRun(); err != nil {
+			return nil, fmt.Errorf("catalog: entry %q: dry run: %v", e.Name, err)
+		}
+
+		c.entries = append(c.entries, &e)
+	}
+
+	return c, nil
+}
+
+// checkDryRun returns an error if the dry run of e, if any, is malformed.
+func (e *Entry) checkDryRun() error {
+	if e.DryRun == nil {
+		return nil
+	}
+	if len(e.DryRun.Subcommand) == 0 && len(e.DryRun.Args) == 0 {
+		return fmt.Errorf("a subcommand or arguments are required")
+	}
+	if len(e.DryRun.Subcommand) > 0 && len(e.Subcommands) == 0 {
+		return fmt.Errorf("the tool has no subcommands to replace")
+	}
+	for _, name := range e.DryRun.RemoveFlags {
+		if _, ok := e.flags[name]; !ok {
+			return fmt.Errorf("flag %q is not a flag of the entry", name)
+		}
+	}
+	return nil
+}
+
+// Entry returns the entry with the given name, or nil if there is none.
+func (c *Catalog) Entry(name string) *Entry {
+	for _, e := range c.entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// AllowsEnv reports whether commands permitted by e may set the environment
+// variable with the given name.
+func (e *Entry) AllowsEnv(name string) bool {
+	for _, n := range e.Env {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Entries returns the entries of the catalog.
+func (c *Catalog) Entries() []*Entry {
+	return c.entries
+}
+
+// compile compiles a regular expression which must match an entire string.
+func compile(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Match returns the first entry which permits argv.
+//
+// If no entry permits argv, the error explains why, suitable for displaying
+// to the user who issued the command.
+func (c *Catalog) Match(argv []string) (*Entry, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("no command was given")
+	}
+
+	var reasons []string
+	for _, e := range c.entries {
+		if e.Path != argv[0] {
+			continue
+		}
+
+		err := e.match(argv[1:])
+		if err == nil {
+			return e, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("entry %q: %v", e.Name, err))
+	}
+
+	if len(reasons) == 0 {
+		return nil, fmt.Errorf("%q is not in the tool catalog; tools must be given by absolute path", argv[0])
+	}
+
+	return nil, fmt.Errorf("%s", strings.Join(reasons, "; "))
+}
+
+// match returns nil if e permits the given arguments.
+func (e *Entry) match(args []string) error {
+	if len(e.Subcommands) > 0 {
+		n := e.subcommand(args)
+		if n < 0 {
+			if len(args) == 0 {
+				return fmt.Errorf("a subcommand is required")
+			}
+			return fmt.Errorf("subcommand %q is not allowed", args[0])
+		}
+		args = args[n:]
+	}
+
+	positional := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !positional && arg == "--" {
+			positional = true
+			continue
+		}
+
+		if positional || arg == "-" || !strings.HasPrefix(arg, "-") {
+			if !e.matchArg(arg) {
+				return fmt.Errorf("argument %q is not allowed", arg)
+			}
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		re, ok := e.flags[name]
+		if !ok {
+			return fmt.Errorf("flag %q is not allowed", name)
+		}
+
+		if re == nil {
+			if hasValue {
+				return fmt.Errorf("flag %q does not take a value", name)
+			}
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				return fmt.Errorf("flag %q requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if !re.MatchString(value) {
+			return fmt.Errorf("value %q is not allowed for flag %q", value, name)
+		}
+	}
+
+	return nil
+}
+
+// subcommand returns the length of the longest allowed subcommand with which
+// args begins, or -1 if there is none.
+func (e *Entry) subcommand(args []string) int {
+	longest := -1
+	for _, sc := range e.Subcommands {
+		if len(sc) > len(args) || len(sc) <= longest {
+			continue
+		}
+
+		ok := true
+		for i := range sc {
+			if sc[i] != args[i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			longest = len(sc)
+		}
+	}
+	return longest
+}
+
+// DryRunArgv returns the argv of the dry run of a command which e permits, or
+// nil if e has no dry run.
+func (e *Entry) DryRunArgv(argv []string) []string {
+	if e.DryRun == nil || len(argv) == 0 {
+		return nil
+	}
+
+	args := argv[1:]
+	var subcommand []string
+	if len(e.Subcommands) > 0 {
+		n := e.subcommand(args)
+		if n < 0 {
+			return nil
+		}
+		subcommand, args = args[:n], args[n:]
+	}
+	if len(e.DryRun.Subcommand) > 0 {
+		subcommand = e.DryRun.Subcommand
+	}
+
+	dryRun := append([]string{argv[0]}, subcommand...)
+	dryRun = append(dryRun, e.DryRun.Args...)
+	return append(dryRun, e.removeFlags(args)...)
+}
+
+// removeFlags returns args, which e permits, without the flags which its dry
+// run removes or their values.
+func (e *Entry) removeFlags(args []string) []string {
+	remove := make(map[string]struct{}, len(e.DryRun.RemoveFlags))
+	for _, name := range e.DryRun.RemoveFlags {
+		remove[name] = struct{}{}
+	}
+
+	var kept []string
+	positional := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if positional || arg == "-" || !strings.HasPrefix(arg, "-") {
+			kept = append(kept, arg)
+			continue
+		}
+		if arg == "--" {
+			positional = true
+			kept = append(kept, arg)
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(arg, "=")
+		if _, ok := remove[name]; !ok {
+			kept = append(kept, arg)
+			continue
+		}
+		// The value of a removed flag given in the following argument is
+		// removed with it.
+		if e.flags[name] != nil && !hasValue {
+			i++
+		}
+	}
+	return kept
+}
+
+func (e *Entry) matchArg(arg string) bool {
+	for _, re := range e.args {
+		if re.MatchString(arg) {
+			return true
+		}
+	}
+	return false
+}
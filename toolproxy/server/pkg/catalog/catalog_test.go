@@ -0,0 +1,277 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	c, err := New([]Entry{
+		{
+			Name:        "kubectl-rollout",
+			Path:        "/usr/bin/kubectl",
+			Subcommands: [][]string{{"rollout", "restart"}, {"rollout", "status"}},
+			Flags: []Flag{
+				{Name: "--namespace", Value: "[a-z0-9-]+"},
+				{Name: "-n", Value: "[a-z0-9-]+"},
+				{Name: "--watch"},
+			},
+			Args: []string{"deployment/[a-z0-9-]+"},
+		},
+		{
+			Name: "uptime",
+			Path: "/usr/bin/uptime",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+
+	testCases := []struct {
+		name  string
+		argv  []string
+		entry string
+		err   string
+	}{
+		{
+			name:  "Subcommand with argument",
+			argv:  []string{"/usr/bin/kubectl", "rollout", "restart", "deployment/web"},
+			entry: "kubectl-rollout",
+		},
+		{
+			name:  "Flag value in same argument",
+			argv:  []string{"/usr/bin/kubectl", "rollout", "status", "--namespace=prod", "deployment/web"},
+			entry: "kubectl-rollout",
+		},
+		{
+			name:  "Flag value in next argument",
+			argv:  []string{"/usr/bin/kubectl", "rollout", "status", "-n", "prod", "--watch", "deployment/web"},
+			entry: "kubectl-rollout",
+		},
+		{
+			name:  "No arguments",
+			argv:  []string{"/usr/bin/uptime"},
+			entry: "uptime",
+		},
+		{
+			name: "Empty argv",
+			argv: nil,
+			err:  "no command",
+		},
+		{
+			name: "Relative path",
+			argv: []string{"kubectl", "rollout", "restart", "deployment/web"},
+			err:  "not in the tool catalog",
+		},
+		{
+			name: "Unknown subcommand",
+			argv: []string{"/usr/bin/kubectl", "delete", "deployment/web"},
+			err:  `subcommand "delete" is not allowed`,
+		},
+		{
+			name: "Missing subcommand",
+			argv: []string{"/usr/bin/kubectl"},
+			err:  "a subcommand is required",
+		},
+		{
+			name: "Unknown flag",
+			argv: []string{"/usr/bin/kubectl", "rollout", "restart", "--kubeconfig=/tmp/x", "deployment/web"},
+			err:  `flag "--kubeconfig" is not allowed`,
+		},
+		{
+			name: "Bad flag value",
+			argv: []string{"/usr/bin/kubectl", "rollout", "restart", "-n", "Prod;rm", "deployment/web"},
+			err:  `value "Prod;rm" is not allowed for flag "-n"`,
+		},
+		{
+			name: "Missing flag value",
+			argv: []string{"/usr/bin/kubectl", "rollout", "restart", "deployment/web", "-n"},
+			err:  `flag "-n" requires a value`,
+		},
+		{
+			name: "Value for boolean flag",
+			argv: []string{"/usr/bin/kubectl", "rollout", "status", "--watch=false", "deployment/web"},
+			err:  `flag "--watch" does not take a value`,
+		},
+		{
+			name: "Argument must match entirely",
+			argv: []string{"/usr/bin/kubectl", "rollout", "restart", "deployment/web/../x"},
+			err:  `argument "deployment/web/../x" is not allowed`,
+		},
+		{
+			name: "Flags after separator are arguments",
+			argv: []string{"/usr/bin/kubectl", "rollout", "restart", "--", "--watch"},
+			err:  `argument "--watch" is not allowed`,
+		},
+		{
+			name: "Arguments to tool without arguments",
+			argv: []string{"/usr/bin/uptime", "-p"},
+			err:  `flag "-p" is not allowed`,
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			entry, err := c.Match(v.argv)
+			if v.err != "" {
+				if err == nil {
+					t.Fatalf("Expected error containing %q; got entry %q", v.err, entry.Name)
+				}
+				if !strings.Contains(err.Error(), v.err) {
+					t.Errorf("Expected error containing %q; got %q", v.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			if entry.Name != v.entry {
+				t.Errorf("Expected entry %q; got %q", v.entry, entry.Name)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name    string
+		entries []Entry
+		err     string
+	}{
+		{
+			name:    "Missing name",
+			entries: []Entry{{Path: "/bin/true"}},
+			err:     "has no name",
+		},
+		{
+			name:    "Duplicate name",
+			entries: []Entry{{Name: "true", Path: "/bin/true"}, {Name: "true", Path: "/usr/bin/true"}},
+			err:     "duplicate entry",
+		},
+		{
+			name:    "Relative path",
+			entries: []Entry{{Name: "true", Path: "true"}},
+			err:     "is not absolute",
+		},
+		{
+			name:    "Malformed flag",
+			entries: []Entry{{Name: "true", Path: "/bin/true", Flags: []Flag{{Name: "verbose"}}}},
+			err:     "must begin with",
+		},
+		{
+			name:    "Malformed regular expression",
+			entries: []Entry{{Name: "true", Path: "/bin/true", Args: []string{"("}}},
+			err:     "missing closing",
+		},
+		{
+			name:    "Malformed environment variable name",
+			entries: []Entry{{Name: "true", Path: "/bin/true", Env: []string{"A=B"}}},
+			err:     "invalid environment variable name",
+		},
+		{
+			name:    "Empty dry run",
+			entries: []Entry{{Name: "true", Path: "/bin/true", DryRun: &DryRun{}}},
+			err:     "subcommand or arguments are required",
+		},
+		{
+			name:    "Dry run subcommand without subcommands",
+			entries: []Entry{{Name: "true", Path: "/bin/true", DryRun: &DryRun{Subcommand: []string{"plan"}}}},
+			err:     "no subcommands",
+		},
+		{
+			name: "Dry run removes unknown flag",
+			entries: []Entry{{
+				Name:   "true",
+				Path:   "/bin/true",
+				DryRun: &DryRun{Args: []string{"--check"}, RemoveFlags: []string{"--force"}},
+			}},
+			err: "not a flag of the entry",
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			_, err := New(v.entries)
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("Expected error containing %q; got %v", v.err, err)
+			}
+		})
+	}
+}
+
+func TestDryRunArgv(t *testing.T) {
+	c, err := New([]Entry{
+		{
+			Name:        "kubectl-apply",
+			Path:        "/usr/bin/kubectl",
+			Subcommands: [][]string{{"apply"}},
+			Flags:       []Flag{{Name: "-f", Value: ".*"}},
+			DryRun:      &DryRun{Args: []string{"--dry-run=server"}},
+		},
+		{
+			Name:        "terraform-apply",
+			Path:        "/usr/bin/terraform",
+			Subcommands: [][]string{{"apply"}},
+			Flags:       []Flag{{Name: "-auto-approve"}, {Name: "-var", Value: ".*"}},
+			Args:        []string{".*"},
+			DryRun:      &DryRun{Subcommand: []string{"plan"}, RemoveFlags: []string{"-auto-approve"}},
+		},
+		{
+			Name:        "helm-upgrade",
+			Path:        "/usr/bin/helm",
+			Subcommands: [][]string{{"upgrade"}},
+			Flags:       []Flag{{Name: "--namespace", Value: "[a-z-]+"}, {Name: "--timeout", Value: "[0-9]+[ms]"}, {Name: "--atomic"}},
+			Args:        []string{".*"},
+			DryRun:      &DryRun{Subcommand: []string{"diff", "upgrade"}, RemoveFlags: []string{"--atomic", "--timeout"}},
+		},
+		{
+			Name: "uptime",
+			Path: "/usr/bin/uptime",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		argv []string
+		want []string
+	}{
+		{
+			name: "Arguments inserted after subcommand",
+			argv: []string{"/usr/bin/kubectl", "apply", "-f", "deploy.yaml"},
+			want: []string{"/usr/bin/kubectl", "apply", "--dry-run=server", "-f", "deploy.yaml"},
+		},
+		{
+			name: "Subcommand replaced and flag removed",
+			argv: []string{"/usr/bin/terraform", "apply", "-auto-approve", "-var", "x=1", "--", "-auto-approve"},
+			want: []string{"/usr/bin/terraform", "plan", "-var", "x=1", "--", "-auto-approve"},
+		},
+		{
+			name: "Removed flag values removed",
+			argv: []string{"/usr/bin/helm", "upgrade", "--timeout", "5m", "--atomic", "--namespace", "prod", "web", "./chart", "--timeout=10m"},
+			want: []string{"/usr/bin/helm", "diff", "upgrade", "--namespace", "prod", "web", "./chart"},
+		},
+		{
+			name: "No dry run",
+			argv: []string{"/usr/bin/uptime"},
+			want: nil,
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			entry, err := c.Match(v.argv)
+			if err != nil {
+				t.Fatalf("Expected argv to be permitted; got error: %v", err)
+			}
+
+			got := entry.DryRunArgv(v.argv)
+			if strings.Join(got, " ") != strings.Join(v.want, " ") || (got == nil) != (v.want == nil) {
+				t.Errorf("Expected dry run %q; got %q", v.want, got)
+			}
+		})
+	}
+}
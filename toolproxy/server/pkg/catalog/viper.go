@@ -0,0 +1,24 @@
+package catalog
+
+import (
+	"github.com/spf13/viper"
+)
+
+// FromViper loads a catalog from the `tools` key of v.
+func FromViper(v *viper.Viper) (*Catalog, error) {
+	var entries []Entry
+	if err := v.UnmarshalKey("tools", &entries); err != nil {
+		return nil, err
+	}
+	return New(entries)
+}
+
+// FromFile loads a catalog from a configuration file in any format supported by viper.
+func FromFile(path string) (*Catalog, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return FromViper(v)
+}
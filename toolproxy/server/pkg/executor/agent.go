@@ -0,0 +1,389 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const disconnectedMessage = "The connection to the agent running the command was lost. The command may or may not have completed."
+
+// AgentStream is the tool proxy's side of an agent's connection.
+type AgentStream interface {
+	Context() context.Context
+	Send(*pb.ServerMessage) error
+	Recv() (*pb.AgentMessage, error)
+}
+
+const claimForAgentQuery = `
+	UPDATE commands
+	SET (status, start_time, executor, heartbeat_time) = ($1, $2, $3, $2)
+	WHERE id = (
+		SELECT id
+		FROM commands
+		WHERE status = $4
+			AND (schedule_time IS NULL AND run_request_time IS NOT NULL OR schedule_time <= $2)
+			AND (expire_time IS NULL OR expire_time > $2)
+			AND (target_agent = $3 OR target_selector <@ $5::jsonb)
+		ORDER BY COALESCE(schedule_time, run_request_time)
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, argv, catalog_entry, timeout_ms, inputs, artifact_paths, env, secret_env;
+`
+
+const agentSeenQuery = `
+	UPDATE agents
+	SET last_seen_time = $2
+	WHERE agent_id = $1;
+`
+
+const agentHeartbeatQuery = `
+	UPDATE commands
+	SET heartbeat_time = $2
+	WHERE executor = $1 AND status = $3;
+`
+
+const loseAgentCommandsQuery = `
+	UPDATE commands
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE status = $4 AND id = ANY($5)
+	RETURNING id;
+`
+
+// ServeAgent claims commands targeted at the agent with the given resource
+// name and labels, and the executions of rollouts on it, and sends them to
+// the agent over stream to run, until the stream ends. The agent runs at
+// most capacity commands at once.
+//
+// Commands and executions which the agent is running when the stream ends
+// are marked as LOST, since their results can no longer be received.
+func (e *Executor) ServeAgent(name string, labels map[string]string, capacity int, stream AgentStream) error {
+	var id string
+	if err := urn.Parse(name).Scan(nil, &id); err != nil {
+		return fmt.Errorf("malformed agent name %q", name)
+	}
+	if capacity <= 0 {
+		return errors.New("agent capacity must be positive")
+	}
+	selector, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+
+	s := &session{
+		e:       e,
+		agent:   name,
+		agentID: id,
+		stream:  stream,
+		slots:   make(chan struct{}, capacity),
+		running: make(map[string]*remoteProcess),
+	}
+	defer s.close()
+
+	ctx := stream.Context()
+	s.seen(ctx, time.Now())
+
+	wake, unsubscribe := e.subscribe()
+	defer unsubscribe()
+
+	received := make(chan error, 1)
+	go func() {
+		received <- s.receive(ctx)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-received:
+			return err
+		case s.slots <- struct{}{}:
+		}
+
+		j, err := e.claim(ctx, claimForAgentQuery, name, string(selector))
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).WithField("agent", name).Errorln("Error claiming command.")
+		}
+		if j == nil && err == nil {
+			j, err = e.claimExecution(ctx, id)
+			if err != nil && ctx.Err() == nil {
+				log.WithError(err).WithField("agent", name).Errorln("Error claiming execution.")
+			}
+		}
+		if j != nil {
+			if err = s.assign(ctx, j); err != nil {
+				return err
+			}
+			continue
+		}
+		<-s.slots
+
+		timer := time.NewTimer(e.pollInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case err := <-received:
+			timer.Stop()
+			return err
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// session is an agent's connection to this executor.
+type session struct {
+	e       *Executor
+	agent   string
+	agentID string
+	stream  AgentStream
+
+	// slots holds a value for each command the agent is running.
+	slots chan struct{}
+
+	// sendMu serializes sends, which may be made by cancellations.
+	sendMu sync.Mutex
+
+	mu sync.Mutex
+
+	// running is keyed by the resource name of each command or execution.
+	running map[string]*remoteProcess
+}
+
+// remoteProcess is a command or execution being run by an agent.
+type remoteProcess struct {
+	s    *session
+	id   int64
+	name string
+
+	// agentID is set if the process is the execution of a rollout.
+	agentID string
+
+	stdout, stderr *outputWriter
+}
+
+// terminate asks the agent to terminate the command. The agent applies its
+// own grace period.
+func (p *remoteProcess) terminate(reason pb.Status, grace time.Duration) {
+	err := p.s.send(&pb.ServerMessage{
+		Message: &pb.ServerMessage_Cancellation{
+			Cancellation: &pb.CommandCancellation{Command: p.name},
+		},
+	})
+	if err != nil {
+		log.WithError(err).WithField("command", p.id).Errorln("Error sending cancellation to agent.")
+	}
+}
+
+func (s *session) send(m *pb.ServerMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.Send(m)
+}
+
+// assign sends a claimed command or execution to the agent.
+func (s *session) assign(ctx context.Context, j *job) error {
+	name := commandName(j.id)
+	if j.agentID != "" {
+		name = executionName(j.id, j.agentID)
+	}
+	p := &remoteProcess{
+		s:       s,
+		id:      j.id,
+		name:    name,
+		agentID: j.agentID,
+	}
+	p.stdout, p.stderr = s.e.outputWriters(j)
+	s.mu.Lock()
+	s.running[name] = p
+	s.mu.Unlock()
+	s.e.register(j.id, p)
+
+	var timeout *durationpb.Duration
+	if j.timeout > 0 {
+		timeout = durationpb.New(j.timeout)
+	}
+	err := s.send(&pb.ServerMessage{
+		Message: &pb.ServerMessage_Assignment{
+			Assignment: &pb.CommandAssignment{
+				Command: name,
+				Argv:    j.argv,
+				Timeout: timeout,
+				Inputs:  j.inputs,
+				Env:     j.env,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The command may have been canceled between when it was claimed and
+	// when it was registered, in which case we missed the notification.
+	s.e.checkCanceled(ctx, j.id)
+	return nil
+}
+
+// receive handles messages from the agent until the stream ends.
+func (s *session) receive(ctx context.Context) error {
+	for {
+		m, err := s.stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch msg := m.GetMessage().(type) {
+		case *pb.AgentMessage_Heartbeat:
+			s.heartbeat(ctx, time.Now())
+		case *pb.AgentMessage_Output:
+			if p := s.process(msg.Output.GetCommand()); p != nil {
+				w := p.stdout
+				if msg.Output.GetStream() == pb.Stream_STDERR {
+					w = p.stderr
+				}
+				w.Write(msg.Output.GetData())
+			}
+		case *pb.AgentMessage_Result:
+			s.finish(ctx, msg.Result)
+		}
+	}
+}
+
+// process returns the command or execution with the given resource name if
+// it is being run by the agent, or nil.
+func (s *session) process(name string) *remoteProcess {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.running[name]
+	if !ok {
+		log.WithField("agent", s.agent).WithField("command", name).Errorln("Agent sent message for command it is not running.")
+		return nil
+	}
+	return p
+}
+
+// finish records the result of a command or execution run by the agent.
+func (s *session) finish(ctx context.Context, r *pb.CommandResult) {
+	p := s.process(r.GetCommand())
+	if p == nil {
+		return
+	}
+
+	cmdStatus := r.GetStatus()
+	switch cmdStatus {
+	case pb.Status_SUCCESS, pb.Status_ERROR, pb.Status_CANCELED, pb.Status_TIMED_OUT:
+	default:
+		log.WithField("agent", s.agent).WithField("status", cmdStatus).Errorln("Agent sent invalid command status.")
+		cmdStatus = pb.Status_ERROR
+	}
+
+	var err error
+	if p.agentID != "" {
+		err = s.e.finishExecution(ctx, p.id, p.agentID, cmdStatus, p.stdout, p.stderr, resultExitStatus(r))
+	} else {
+		err = s.e.finish(ctx, p.id, cmdStatus, p.stdout, p.stderr, resultExitStatus(r))
+	}
+	if err != nil {
+		log.WithError(err).WithField("command", p.name).Errorln("Error recording command result.")
+	}
+
+	s.mu.Lock()
+	delete(s.running, p.name)
+	s.mu.Unlock()
+	s.e.unregister(p.id, p)
+	<-s.slots
+}
+
+// heartbeat records that the agent and the commands and executions it is
+// running are alive.
+func (s *session) heartbeat(ctx context.Context, t time.Time) {
+	s.seen(ctx, t)
+	_, err := s.e.DB.ExecContext(ctx, agentHeartbeatQuery, s.agent, t, pb.Status_RUNNING)
+	if err != nil {
+		log.WithError(err).WithField("agent", s.agent).Errorln("Error recording heartbeat.")
+	}
+	_, err = s.e.DB.ExecContext(ctx, executionHeartbeatQuery, s.agentID, t, pb.Status_RUNNING)
+	if err != nil {
+		log.WithError(err).WithField("agent", s.agent).Errorln("Error recording execution heartbeat.")
+	}
+}
+
+func (s *session) seen(ctx context.Context, t time.Time) {
+	if _, err := s.e.DB.ExecContext(ctx, agentSeenQuery, s.agentID, t); err != nil {
+		log.WithError(err).WithField("agent", s.agent).Errorln("Error recording agent last seen time.")
+	}
+}
+
+// close marks the commands and executions the agent is running as LOST.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.running) == 0 {
+		return
+	}
+
+	var commands, executions []int64
+	for _, p := range s.running {
+		// The output is not recorded with the command, but it may still
+		// be read from its chunks.
+		p.stdout.Flush()
+		p.stderr.Flush()
+		if p.agentID != "" {
+			executions = append(executions, p.id)
+		} else {
+			commands = append(commands, p.id)
+		}
+		s.e.unregister(p.id, p)
+	}
+	s.running = nil
+
+	ctx := context.Background()
+	now := time.Now()
+	if len(commands) > 0 {
+		err := finalize(ctx, s.e.DB, loseAgentCommandsQuery, pb.Status_LOST, now, disconnectedMessage, pb.Status_RUNNING, pq.Array(commands))
+		if err != nil {
+			log.WithError(err).WithField("agent", s.agent).Errorln("Error recording lost commands.")
+		}
+	}
+	if len(executions) > 0 {
+		err := loseExecutions(ctx, s.e.DB, loseAgentExecutionsQuery, now, disconnectedMessage, s.agentID, pb.Status_RUNNING, pq.Array(executions))
+		if err != nil {
+			log.WithError(err).WithField("agent", s.agent).Errorln("Error recording lost executions.")
+		}
+	}
+}
+
+// resultExitStatus returns the exit status reported by an agent.
+func resultExitStatus(r *pb.CommandResult) exitStatus {
+	var exit exitStatus
+	if r.GetExitCode() != nil {
+		exit.exitCode = sql.NullInt32{Int32: r.GetExitCode().GetValue(), Valid: true}
+	}
+	exit.signal = sql.NullString{String: r.GetSignal(), Valid: r.GetSignal() != ""}
+	exit.startError = sql.NullString{String: r.GetStartError(), Valid: r.GetStartError() != ""}
+	if usage := r.GetResourceUsage(); usage != nil {
+		exit.userCPU = sql.NullInt64{Int64: usage.GetUserCpuTime().AsDuration().Microseconds(), Valid: true}
+		exit.systemCPU = sql.NullInt64{Int64: usage.GetSystemCpuTime().AsDuration().Microseconds(), Valid: true}
+		exit.maxRSS = sql.NullInt64{Int64: usage.GetMaxRssBytes(), Valid: true}
+	}
+	return exit
+}
+
+func commandName(id int64) string {
+	return "commands/" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,352 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// fakeAgentStream is an agent connection driven by a test. Closing recv ends
+// the stream.
+type fakeAgentStream struct {
+	ctx  context.Context
+	recv chan *pb.AgentMessage
+	sent chan *pb.ServerMessage
+}
+
+func newFakeAgentStream() *fakeAgentStream {
+	return &fakeAgentStream{
+		ctx:  context.Background(),
+		recv: make(chan *pb.AgentMessage),
+		sent: make(chan *pb.ServerMessage),
+	}
+}
+
+func (s *fakeAgentStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeAgentStream) Send(m *pb.ServerMessage) error {
+	s.sent <- m
+	return nil
+}
+
+func (s *fakeAgentStream) Recv() (*pb.AgentMessage, error) {
+	m, ok := <-s.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+// awaitExpectations waits for the expectations of mock to be met by
+// concurrent code.
+func awaitExpectations(t *testing.T, mock sqlmock.Sqlmock) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for mock.ExpectationsWereMet() != nil {
+		select {
+		case <-deadline:
+			t.Fatalf("Failed expectation: %v", mock.ExpectationsWereMet())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestServeAgent(t *testing.T) {
+	t.Run("Run command on agent", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		// Results are received concurrently with further claims.
+		mock.MatchExpectationsInOrder(false)
+
+		mock.ExpectExec(agentSeenQuery).WithArgs("db-host-1", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WithArgs(
+			pb.Status_RUNNING,
+			sqlmock.AnyArg(),
+			"agents/db-host-1",
+			pb.Status_READY,
+			`{"role":"database"}`,
+		).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+				AddRow(1, pq.Array([]string{"/bin/echo", "hello"}), nil, 60000, nil, nil, nil, nil),
+		)
+		expectStart(mock, 1)
+		mock.ExpectCommit()
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+		)
+		mock.ExpectExec(agentSeenQuery).WithArgs("db-host-1", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(agentHeartbeatQuery).WithArgs("agents/db-host-1", sqlmock.AnyArg(), pb.Status_RUNNING).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(executionHeartbeatQuery).WithArgs("db-host-1", sqlmock.AnyArg(), pb.Status_RUNNING).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertChunkQuery).WithArgs(
+			1,
+			pb.Stream_STDOUT,
+			[]byte("hello\n"),
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectBegin()
+		mock.ExpectExec(finishCommandQuery).WithArgs(
+			1,
+			pb.Status_SUCCESS,
+			sqlmock.AnyArg(),
+			[]byte("hello\n"),
+			[]byte(nil),
+			sql.NullInt32{Int32: 0, Valid: true},
+			sql.NullString{},
+			sql.NullString{},
+			sqlmock.AnyArg(),
+			sqlmock.AnyArg(),
+			sqlmock.AnyArg(),
+			pb.Status_RUNNING,
+			nil,
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFinish(mock, 1, pb.Status_SUCCESS)
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+		mock.ExpectQuery(claimExecutionQuery).WillReturnError(sql.ErrNoRows)
+
+		e := &Executor{DB: db, PollInterval: time.Hour}
+		stream := newFakeAgentStream()
+		done := make(chan error)
+		go func() {
+			done <- e.ServeAgent("agents/db-host-1", map[string]string{"role": "database"}, 1, stream)
+		}()
+
+		assignment := (<-stream.sent).GetAssignment()
+		if assignment.GetCommand() != "commands/1" {
+			t.Errorf("Expected assignment of commands/1; got %q", assignment.GetCommand())
+		}
+		if len(assignment.GetArgv()) != 2 || assignment.GetArgv()[0] != "/bin/echo" {
+			t.Errorf("Expected argv [/bin/echo hello]; got %v", assignment.GetArgv())
+		}
+		if assignment.GetTimeout().AsDuration() != time.Minute {
+			t.Errorf("Expected timeout of 1m; got %v", assignment.GetTimeout().AsDuration())
+		}
+
+		stream.recv <- &pb.AgentMessage{
+			Message: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.AgentHeartbeat{}},
+		}
+		stream.recv <- &pb.AgentMessage{
+			Message: &pb.AgentMessage_Output{Output: &pb.AgentOutput{
+				Command: "commands/1",
+				Stream:  pb.Stream_STDOUT,
+				Data:    []byte("hello\n"),
+			}},
+		}
+		stream.recv <- &pb.AgentMessage{
+			Message: &pb.AgentMessage_Result{Result: &pb.CommandResult{
+				Command:  "commands/1",
+				Status:   pb.Status_SUCCESS,
+				ExitCode: wrapperspb.Int32(0),
+			}},
+		}
+
+		awaitExpectations(t, mock)
+		close(stream.recv)
+		if err := <-done; err != io.EOF {
+			t.Errorf("Expected io.EOF; got %v", err)
+		}
+	})
+
+	t.Run("Mark running commands lost on disconnect", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectExec(agentSeenQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+				AddRow(1, pq.Array([]string{"/bin/sleep", "60"}), nil, nil, nil, nil, nil, nil),
+		)
+		expectStart(mock, 1)
+		mock.ExpectCommit()
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+		)
+		mock.ExpectBegin()
+		mock.ExpectQuery(loseAgentCommandsQuery).WithArgs(
+			pb.Status_LOST,
+			sqlmock.AnyArg(),
+			disconnectedMessage,
+			pb.Status_RUNNING,
+			sqlmock.AnyArg(),
+		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		expectFinish(mock, 1, pb.Status_LOST)
+		mock.ExpectCommit()
+
+		e := &Executor{DB: db, PollInterval: time.Hour}
+		stream := newFakeAgentStream()
+		done := make(chan error)
+		go func() {
+			done <- e.ServeAgent("agents/db-host-1", nil, 1, stream)
+		}()
+
+		<-stream.sent
+		close(stream.recv)
+		if err := <-done; err != io.EOF {
+			t.Errorf("Expected io.EOF; got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+		if ids := e.runningIDs(); len(ids) != 0 {
+			t.Errorf("Expected no running commands; got %v", ids)
+		}
+	})
+
+	t.Run("Run execution of rollout on agent", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		// The result is recorded concurrently with further claims.
+		mock.MatchExpectationsInOrder(false)
+
+		mock.ExpectExec(agentSeenQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+		mock.ExpectQuery(claimExecutionQuery).WithArgs(
+			pb.Status_RUNNING,
+			sqlmock.AnyArg(),
+			"db-host-1",
+			pb.Status_READY,
+		).WillReturnRows(
+			sqlmock.NewRows([]string{"command_id", "argv", "catalog_entry", "timeout_ms", "inputs", "env"}).
+				AddRow(1, pq.Array([]string{"/bin/true"}), nil, nil, nil, nil),
+		)
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+		)
+		mock.ExpectExec(finishExecutionQuery).WithArgs(
+			1,
+			"db-host-1",
+			pb.Status_SUCCESS,
+			sqlmock.AnyArg(),
+			[]byte(nil),
+			[]byte(nil),
+			sql.NullInt32{Int32: 0, Valid: true},
+			sql.NullString{},
+			sql.NullString{},
+			sqlmock.AnyArg(),
+			sqlmock.AnyArg(),
+			sqlmock.AnyArg(),
+			pb.Status_RUNNING,
+			nil,
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(nil, nil, false),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+			executionCountRows(map[pb.Status]int{pb.Status_SUCCESS: 1, pb.Status_RUNNING: 1}),
+		)
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+		mock.ExpectQuery(claimExecutionQuery).WillReturnError(sql.ErrNoRows)
+
+		e := &Executor{DB: db, PollInterval: time.Hour}
+		stream := newFakeAgentStream()
+		done := make(chan error)
+		go func() {
+			done <- e.ServeAgent("agents/db-host-1", nil, 1, stream)
+		}()
+
+		assignment := (<-stream.sent).GetAssignment()
+		if assignment.GetCommand() != "commands/1/executions/db-host-1" {
+			t.Errorf("Expected assignment of commands/1/executions/db-host-1; got %q", assignment.GetCommand())
+		}
+
+		stream.recv <- &pb.AgentMessage{
+			Message: &pb.AgentMessage_Result{Result: &pb.CommandResult{
+				Command:  "commands/1/executions/db-host-1",
+				Status:   pb.Status_SUCCESS,
+				ExitCode: wrapperspb.Int32(0),
+			}},
+		}
+
+		awaitExpectations(t, mock)
+		close(stream.recv)
+		<-done
+	})
+
+	t.Run("Forward cancellation to agent", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectExec(agentSeenQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+				AddRow(1, pq.Array([]string{"/bin/sleep", "60"}), nil, nil, nil, nil, nil, nil),
+		)
+		expectStart(mock, 1)
+		mock.ExpectCommit()
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(true),
+		)
+
+		e := &Executor{DB: db, PollInterval: time.Hour}
+		stream := newFakeAgentStream()
+		done := make(chan error)
+		go func() {
+			done <- e.ServeAgent("agents/db-host-1", nil, 1, stream)
+		}()
+
+		if (<-stream.sent).GetAssignment() == nil {
+			t.Fatalf("Expected assignment")
+		}
+		cancellation := (<-stream.sent).GetCancellation()
+		if cancellation.GetCommand() != "commands/1" {
+			t.Errorf("Expected cancellation of commands/1; got %v", cancellation)
+		}
+
+		// The agent reports the result of the canceled command.
+		mock.ExpectBegin()
+		mock.ExpectExec(finishCommandQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFinish(mock, 1, pb.Status_CANCELED)
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimForAgentQuery).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+		mock.ExpectQuery(claimExecutionQuery).WillReturnError(sql.ErrNoRows)
+		stream.recv <- &pb.AgentMessage{
+			Message: &pb.AgentMessage_Result{Result: &pb.CommandResult{
+				Command: "commands/1",
+				Status:  pb.Status_CANCELED,
+				Signal:  "SIGTERM",
+			}},
+		}
+
+		awaitExpectations(t, mock)
+		close(stream.recv)
+		<-done
+	})
+}
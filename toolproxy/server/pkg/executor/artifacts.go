@@ -0,0 +1,48 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/artifacts"
+)
+
+const insertArtifactQuery = `
+	INSERT INTO artifacts ("command_id", "artifact_id", "path", "content", "size_bytes", "sha256", "content_type", "error", "create_time")
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT DO NOTHING;
+`
+
+// collectArtifacts records the files at paths within dir, the working
+// directory of the command with the given ID, as its artifacts. It should be
+// called once the command has exited and before its result is recorded, so
+// that its artifacts may be downloaded as soon as it is seen to have
+// finished.
+//
+// Files which cannot be collected are recorded with the reason, so that it is
+// clear why an artifact has no content.
+func (e *Executor) collectArtifacts(ctx context.Context, id int64, dir string, paths []string) {
+	now := time.Now()
+	for _, path := range paths {
+		a := artifacts.Collect(dir, path, e.maxArtifactBytes())
+		_, err := e.DB.ExecContext(
+			ctx,
+			insertArtifactQuery,
+			id,
+			a.ID,
+			a.Path,
+			a.Content,
+			len(a.Content),
+			sql.NullString{String: a.SHA256, Valid: a.SHA256 != ""},
+			sql.NullString{String: a.ContentType, Valid: a.ContentType != ""},
+			sql.NullString{String: a.Error, Valid: a.Error != ""},
+			now,
+		)
+		if err != nil {
+			log.WithError(err).WithField("command", id).WithField("path", path).Errorln("Error recording artifact.")
+		}
+	}
+}
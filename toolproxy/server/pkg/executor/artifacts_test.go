@@ -0,0 +1,60 @@
+package executor
+
+import (
+	"database/sql"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+	)
+	mock.ExpectExec(insertArtifactQuery).WithArgs(
+		1,
+		"out-dump.sql",
+		"out/dump.sql",
+		[]byte("dump\n"),
+		5,
+		sql.NullString{String: "71766c401d73e854443bd032bec52e54f0e527bfa81dcd0e8db0f1eca3cf035e", Valid: true},
+		sqlmock.AnyArg(),
+		sql.NullString{},
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertArtifactQuery).WithArgs(
+		1,
+		"missing",
+		"missing",
+		[]byte(nil),
+		0,
+		sql.NullString{},
+		sql.NullString{},
+		sql.NullString{String: "file was not created", Valid: true},
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(finishCommandQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFinish(mock, 1, pb.Status_SUCCESS)
+	mock.ExpectCommit()
+
+	// The command runs in its own working directory, in which it leaves
+	// its artifacts.
+	e := &Executor{DB: db}
+	e.execute(&job{
+		id:            1,
+		argv:          []string{"/bin/sh", "-c", "mkdir out && echo dump > out/dump.sql"},
+		artifactPaths: []string{"out/dump.sql", "missing"},
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
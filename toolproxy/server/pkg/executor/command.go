@@ -0,0 +1,192 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/hxtk/yggdrasil/toolproxy/inputs"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const setProfileQuery = `
+	UPDATE commands
+	SET (execution_profile, execution_profile_spec) = ($2, $3)
+	WHERE id = $1;
+`
+
+// command returns the process which runs a claimed command, having recorded
+// the execution profile with which it is run, and a function which removes
+// its input files once it has finished.
+//
+// A command which declares artifacts runs in a temporary working directory,
+// which holds its input files, instead of that of its profile. Its
+// environment variables, including the values of the secrets to which it
+// refers, are added to those it would otherwise have, but those set by its
+// profile take precedence.
+//
+// The profile is that of the catalog entry which permitted the command, if
+// any, or else the default profile. If there is neither, the command
+// runs with the privileges of the server.
+//
+// Commands always run in their own process group so that, if they are
+// canceled or time out, any processes they start are terminated with them.
+func (e *Executor) command(ctx context.Context, j *job) (*sandbox.Cmd, func(), error) {
+	if len(j.argv) == 0 {
+		return nil, nil, fmt.Errorf("command has no argv")
+	}
+
+	var profileName string
+	if e.Catalog != nil && j.catalogEntry != "" {
+		if entry := e.Catalog.Entry(j.catalogEntry); entry != nil {
+			profileName = entry.Profile
+		}
+	}
+
+	profile, err := e.Profiles.Get(profileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env, err := e.environ(j)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if profile == nil {
+		argv, dir, cleanup, err := materialize(j, nil, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("writing input files: %v", err)
+		}
+
+		// #nosec G204 The purpose of this program is to launch arbitrary processes
+		// in a way that can be monitored and audited more easily than an interactive
+		// shell.
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Stdin = stdin(j)
+		cmd.Dir = dir
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		return &sandbox.Cmd{Cmd: cmd}, cleanup, nil
+	}
+
+	spec, err := profile.JSON()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The command must not run unless the restrictions applied to it have
+	// been recorded. Its dry run is run with the same restrictions, which
+	// are recorded when the command itself runs.
+	if !j.preview {
+		_, err = e.DB.ExecContext(ctx, setProfileQuery, j.id, profile.Name, spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("recording execution profile: %v", err)
+		}
+	}
+
+	// The input files must be readable by the user as which the command
+	// runs.
+	argv, dir, cleanup, err := materialize(j, profile.UID, profile.GID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("writing input files: %v", err)
+	}
+
+	cmd, err := profile.Command(argv)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Stdin = stdin(j)
+	// Where a variable is given more than once, the last value is used.
+	cmd.Env = append(env, cmd.Env...)
+	if dir != "" {
+		cmd.Dir = dir
+	}
+	return cmd, cleanup, nil
+}
+
+// materialize writes the input files of a claimed command and returns its
+// argv referring to them, and its working directory if it declares artifacts.
+func materialize(j *job, uid, gid *uint32) ([]string, string, func(), error) {
+	if len(j.artifactPaths) > 0 {
+		return inputs.Workdir(j.argv, j.inputs, uid, gid)
+	}
+	argv, cleanup, err := inputs.Materialize(j.argv, j.inputs, uid, gid)
+	return argv, "", cleanup, err
+}
+
+// stdin returns the standard input of a claimed command, or nil if it is
+// empty.
+func stdin(j *job) io.Reader {
+	if len(j.inputs.GetStdin()) == 0 {
+		return nil
+	}
+	return bytes.NewReader(j.inputs.GetStdin())
+}
+
+// unmarshalInputs decodes the inputs of a command as they are stored, or
+// returns nil if it has none.
+func unmarshalInputs(data []byte) (*pb.CommandInputs, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var in pb.CommandInputs
+	if err := protojson.Unmarshal(data, &in); err != nil {
+		return nil, fmt.Errorf("decoding inputs: %v", err)
+	}
+	return &in, nil
+}
+
+// exitStatus describes how a command ended, as it is recorded in the
+// database.
+type exitStatus struct {
+	exitCode   sql.NullInt32
+	signal     sql.NullString
+	startError sql.NullString
+
+	// userCPU and systemCPU are in microseconds.
+	userCPU   sql.NullInt64
+	systemCPU sql.NullInt64
+	maxRSS    sql.NullInt64
+}
+
+// newExitStatus returns the exit status of a command which could not be
+// started because of startErr or, if it is nil, which ended in state.
+func newExitStatus(state *os.ProcessState, startErr error) exitStatus {
+	var res exitStatus
+	if startErr != nil {
+		res.startError = sql.NullString{String: startErr.Error(), Valid: true}
+		return res
+	}
+	if state == nil {
+		return res
+	}
+
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		res.signal = sql.NullString{String: unix.SignalName(ws.Signal()), Valid: true}
+	} else {
+		res.exitCode = sql.NullInt32{Int32: int32(state.ExitCode()), Valid: true}
+	}
+
+	res.userCPU = sql.NullInt64{Int64: state.UserTime().Microseconds(), Valid: true}
+	res.systemCPU = sql.NullInt64{Int64: state.SystemTime().Microseconds(), Valid: true}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// On Linux, the maximum resident set size is in kilobytes.
+		res.maxRSS = sql.NullInt64{Int64: ru.Maxrss * 1024, Valid: true}
+	}
+
+	return res
+}
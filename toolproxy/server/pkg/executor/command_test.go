@@ -0,0 +1,215 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/secrets"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCommand(t *testing.T) {
+	c, err := catalog.New([]catalog.Entry{
+		{Name: "uptime", Path: "/usr/bin/uptime", Profile: "admin"},
+		{Name: "true", Path: "/bin/true"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+
+	profiles, err := sandbox.NewProfiles("restricted", []sandbox.Profile{
+		{Name: "restricted"},
+		{Name: "admin"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating profiles: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		job     *job
+		profile string
+	}{
+		{
+			name:    "Profile of catalog entry",
+			job:     &job{id: 1, argv: []string{"/usr/bin/uptime"}, catalogEntry: "uptime"},
+			profile: "admin",
+		},
+		{
+			name:    "Default profile",
+			job:     &job{id: 1, argv: []string{"/bin/true"}, catalogEntry: "true"},
+			profile: "restricted",
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			mock.ExpectExec(setProfileQuery).WithArgs(
+				1,
+				v.profile,
+				sqlmock.AnyArg(),
+			).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			e := &Executor{DB: db, Catalog: c, Profiles: profiles}
+			cmd, cleanup, err := e.command(context.Background(), v.job)
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			defer cleanup()
+
+			if cmd.Path != "/proc/self/exe" {
+				t.Errorf("Expected command to run in sandbox; got path %q", cmd.Path)
+			}
+
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+
+	t.Run("No profiles", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		e := &Executor{DB: db}
+		cmd, cleanup, err := e.command(context.Background(), &job{id: 1, argv: []string{"/bin/true"}})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		defer cleanup()
+
+		if cmd.Path != "/bin/true" {
+			t.Errorf("Expected command to run directly; got path %q", cmd.Path)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestNewExitStatus(t *testing.T) {
+	t.Run("Exit code", func(t *testing.T) {
+		cmd := exec.Command("/bin/sh", "-c", "exit 3")
+		_ = cmd.Run()
+
+		res := newExitStatus(cmd.ProcessState, nil)
+		if res.exitCode != (sql.NullInt32{Int32: 3, Valid: true}) {
+			t.Errorf("Expected exit code 3; got %v", res.exitCode)
+		}
+		if res.signal.Valid || res.startError.Valid {
+			t.Errorf("Expected no signal or start error; got %v, %v", res.signal, res.startError)
+		}
+		if !res.userCPU.Valid || !res.systemCPU.Valid || !res.maxRSS.Valid || res.maxRSS.Int64 <= 0 {
+			t.Errorf("Expected resource usage; got %+v", res)
+		}
+	})
+
+	t.Run("Signal", func(t *testing.T) {
+		cmd := exec.Command("/bin/sh", "-c", "kill -KILL $$")
+		_ = cmd.Run()
+
+		res := newExitStatus(cmd.ProcessState, nil)
+		if res.signal != (sql.NullString{String: "SIGKILL", Valid: true}) {
+			t.Errorf("Expected SIGKILL; got %v", res.signal)
+		}
+		if res.exitCode.Valid {
+			t.Errorf("Expected no exit code; got %v", res.exitCode)
+		}
+	})
+
+	t.Run("Start error", func(t *testing.T) {
+		cmd := exec.Command("/nonexistent/binary")
+		err := cmd.Start()
+
+		res := newExitStatus(cmd.ProcessState, err)
+		if !res.startError.Valid || !strings.Contains(res.startError.String, "/nonexistent/binary") {
+			t.Errorf("Expected start error; got %v", res.startError)
+		}
+		if res.exitCode.Valid || res.userCPU.Valid {
+			t.Errorf("Expected no exit status; got %+v", res)
+		}
+	})
+
+	t.Run("Inputs", func(t *testing.T) {
+		e := &Executor{}
+		cmd, cleanup, err := e.command(context.Background(), &job{
+			id:   1,
+			argv: []string{"/bin/cat", "-", "{inputs.fix.sql}"},
+			inputs: &pb.CommandInputs{
+				Stdin: []byte("stdin\n"),
+				Files: []*pb.InputFile{{Name: "fix.sql", Content: []byte("file\n")}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Error running command: %v", err)
+		}
+		if string(out) != "stdin\nfile\n" {
+			t.Errorf("Expected stdin and input file; got %q", out)
+		}
+
+		cleanup()
+		if _, err := os.Stat(cmd.Args[2]); !os.IsNotExist(err) {
+			t.Errorf("Expected input file to be removed; got %v", err)
+		}
+	})
+	t.Run("Environment", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "pg-password"), []byte("hunter2\n"), 0600); err != nil {
+			t.Fatalf("Error writing secret: %v", err)
+		}
+
+		e := &Executor{Secrets: &secrets.Store{Dir: dir}}
+		cmd, cleanup, err := e.command(context.Background(), &job{
+			id:        1,
+			argv:      []string{"/bin/sh", "-c", "echo $PGDATABASE:$PGPASSWORD"},
+			env:       map[string]string{"PGDATABASE": "orders"},
+			secretEnv: []secretRef{{Name: "PGPASSWORD", Secret: "pg-password"}},
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		defer cleanup()
+
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Error running command: %v", err)
+		}
+		if string(out) != "orders:hunter2\n" {
+			t.Errorf("Expected environment variables; got %q", out)
+		}
+	})
+
+	t.Run("Missing secret", func(t *testing.T) {
+		e := &Executor{Secrets: &secrets.Store{Dir: t.TempDir()}}
+		_, _, err := e.command(context.Background(), &job{
+			id:        1,
+			argv:      []string{"/bin/true"},
+			secretEnv: []secretRef{{Name: "PGPASSWORD", Secret: "pg-password"}},
+		})
+		if err == nil || !strings.Contains(err.Error(), "PGPASSWORD") {
+			t.Errorf("Expected error naming the variable; got %v", err)
+		}
+	})
+}
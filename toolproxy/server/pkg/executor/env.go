@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// secretRef is a reference to a secret set as an environment variable of a
+// command, as it is stored.
+type secretRef struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// unmarshalEnv decodes the environment variables of a command and its
+// references to secrets as they are stored.
+func unmarshalEnv(env, secretEnv []byte) (map[string]string, []secretRef, error) {
+	var vars map[string]string
+	if len(env) > 0 {
+		if err := json.Unmarshal(env, &vars); err != nil {
+			return nil, nil, fmt.Errorf("decoding env: %v", err)
+		}
+	}
+
+	var refs []secretRef
+	if len(secretEnv) > 0 {
+		if err := json.Unmarshal(secretEnv, &refs); err != nil {
+			return nil, nil, fmt.Errorf("decoding secret env: %v", err)
+		}
+	}
+	return vars, refs, nil
+}
+
+// environ returns the environment variables of a claimed command as
+// `NAME=value` pairs sorted by name, having read the values of its secrets
+// into j.secrets.
+func (e *Executor) environ(j *job) ([]string, error) {
+	env := make([]string, 0, len(j.env)+len(j.secretEnv))
+	for k, v := range j.env {
+		env = append(env, k+"="+v)
+	}
+	for _, ref := range j.secretEnv {
+		value, err := e.Secrets.Get(ref.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %v", ref.Name, err)
+		}
+		// The value would be truncated when the command is executed.
+		if strings.IndexByte(string(value), 0) >= 0 {
+			return nil, fmt.Errorf("resolving %s: secret %q contains a NUL byte", ref.Name, ref.Secret)
+		}
+		env = append(env, ref.Name+"="+string(value))
+		if j.secrets == nil {
+			j.secrets = make(map[string][]byte)
+		}
+		j.secrets[ref.Secret] = value
+	}
+	sort.Strings(env)
+	return env, nil
+}
@@ -0,0 +1,639 @@
+// Package executor runs commands which have been queued to run.
+//
+// RunCommand only marks a command as requested to run. Executors, which may
+// run in the same process as the API or in dedicated replicas, claim such
+// commands from the database, run them, and record their results. Claims use
+// `FOR UPDATE SKIP LOCKED`, so any number of executors may share a database
+// and each command is run by exactly one of them.
+//
+// Commands which target an agent are instead claimed on behalf of that agent
+// while it is connected, and sent to it to run; see ServeAgent. Commands
+// which have many targets are rollouts, which run as a separate execution on
+// each agent their targets match.
+//
+// Executors are woken by notifications on RunChannel and terminate commands
+// when notified on CancelChannel. Scheduled commands are found by polling, so
+// they start within the poll interval of their schedule time. When a command
+// starts or finishes, the change is appended to the audit log, whose
+// notifications wake callers waiting for it.
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/secrets"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// PostgreSQL notification channels. The payload of each notification is the
+// ID of a command.
+const (
+	// RunChannel is notified when a command is requested to run or its
+	// preview is to be run.
+	RunChannel = "toolproxy_run"
+
+	// CancelChannel is notified when a running command is canceled.
+	CancelChannel = "toolproxy_cancel"
+)
+
+const (
+	defaultConcurrency       = 4
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultPollInterval      = 30 * time.Second
+	defaultKillGracePeriod   = 10 * time.Second
+	defaultMaxArtifactBytes  = 16 << 20
+)
+
+// Executor runs queued commands.
+type Executor struct {
+	DB *sql.DB
+
+	// ID identifies the executor on the commands it runs. If it is empty, the
+	// hostname and process ID are used.
+	ID string
+
+	// Catalog is used to find the execution profile of commands which were
+	// permitted by a catalog entry. It may be nil.
+	Catalog *catalog.Catalog
+
+	// Profiles are the execution profiles with which commands are run. If it
+	// is nil, commands run with the privileges of the server.
+	Profiles *sandbox.Profiles
+
+	// Secrets resolves the secrets set as environment variables of commands.
+	// If it is nil, commands which refer to secrets fail to start.
+	Secrets *secrets.Store
+
+	// Redactor redacts the output of commands before it is stored, along
+	// with the values of the secrets given to them. If it is nil, the
+	// built-in rules are applied.
+	Redactor *redact.Redactor
+
+	// Sealer encrypts the original output of commands from which anything
+	// was redacted, so that it may be retained. If it is nil, the original
+	// output is discarded.
+	Sealer *redact.Sealer
+
+	// Concurrency is the maximum number of commands run at once. If it is
+	// zero, a default of four is used.
+	Concurrency int
+
+	// HeartbeatInterval is how often the executor records that each command
+	// it is running is still running. If it is zero, a default of ten seconds
+	// is used.
+	HeartbeatInterval time.Duration
+
+	// PollInterval is how often the executor checks for queued commands if it
+	// is not notified of any. If it is zero, a default of thirty seconds is
+	// used.
+	PollInterval time.Duration
+
+	// KillGracePeriod is how long a command is given to exit after SIGTERM
+	// before it is sent SIGKILL. If it is zero, a default of ten seconds is
+	// used.
+	KillGracePeriod time.Duration
+
+	// MaxArtifactBytes is the size of the largest artifact collected from a
+	// command. Larger files are recorded as artifacts without their content.
+	// If it is zero, a default of 16 MiB is used.
+	MaxArtifactBytes int64
+
+	mu      sync.Mutex
+	running map[int64]map[terminator]struct{}
+	wakers  map[chan struct{}]struct{}
+}
+
+// terminator is a command being run by or on behalf of this executor.
+type terminator interface {
+	// terminate stops the command for the given reason, allowing it grace
+	// to exit.
+	terminate(reason pb.Status, grace time.Duration)
+}
+
+// New returns an executor which runs the commands queued in db.
+func New(db *sql.DB) *Executor {
+	return &Executor{
+		DB: db,
+	}
+}
+
+func (e *Executor) id() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func (e *Executor) concurrency() int {
+	if e.Concurrency > 0 {
+		return e.Concurrency
+	}
+	return defaultConcurrency
+}
+
+func (e *Executor) heartbeatInterval() time.Duration {
+	if e.HeartbeatInterval > 0 {
+		return e.HeartbeatInterval
+	}
+	return defaultHeartbeatInterval
+}
+
+func (e *Executor) pollInterval() time.Duration {
+	if e.PollInterval > 0 {
+		return e.PollInterval
+	}
+	return defaultPollInterval
+}
+
+func (e *Executor) killGracePeriod() time.Duration {
+	if e.KillGracePeriod > 0 {
+		return e.KillGracePeriod
+	}
+	return defaultKillGracePeriod
+}
+
+func (e *Executor) maxArtifactBytes() int64 {
+	if e.MaxArtifactBytes > 0 {
+		return e.MaxArtifactBytes
+	}
+	return defaultMaxArtifactBytes
+}
+
+// Run claims and runs queued commands until ctx is done, and then waits for
+// the commands it is running to finish. Listen must be running for Run to be
+// woken when commands are queued; otherwise it polls.
+//
+// Commands left running by a previous executor with the same ID are first
+// marked as LOST, since it must have stopped without finishing them, and its
+// previews are run again.
+func (e *Executor) Run(ctx context.Context) {
+	wake, unsubscribe := e.subscribe()
+	defer unsubscribe()
+
+	id := e.id()
+	if err := e.recover(ctx, id); err != nil {
+		log.WithError(err).Errorln("Error recovering commands from previous run.")
+	}
+	if err := e.requeuePreviews(ctx, id); err != nil {
+		log.WithError(err).Errorln("Error requeueing previews from previous run.")
+	}
+
+	slots := make(chan struct{}, e.concurrency())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case slots <- struct{}{}:
+		}
+
+		j, err := e.claim(ctx, claimQuery, id, pb.PreviewState_PREVIEW_SUCCEEDED)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Errorln("Error claiming command.")
+		}
+		if j == nil {
+			j, err = e.claimPreview(ctx, id)
+			if err != nil && ctx.Err() == nil {
+				log.WithError(err).Errorln("Error claiming preview.")
+			}
+		}
+		if j != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if j.preview {
+					e.preview(j)
+				} else {
+					e.execute(j)
+				}
+			}()
+
+			// There may be more queued commands.
+			continue
+		}
+		<-slots
+
+		// Rollouts are run by agents, so starting one does not use a slot.
+		started, err := e.startRollout(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Errorln("Error starting rollout.")
+		}
+		if started {
+			continue
+		}
+
+		if !e.sleep(ctx, wake) {
+			return
+		}
+	}
+}
+
+// sleep waits until the executor is woken or the poll interval elapses. It
+// returns false if ctx is done first.
+func (e *Executor) sleep(ctx context.Context, wake <-chan struct{}) bool {
+	timer := time.NewTimer(e.pollInterval())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-wake:
+	case <-timer.C:
+	}
+	return true
+}
+
+// subscribe returns a channel which receives a value when commands may have
+// been queued, and a function which must be called once it is no longer
+// used.
+func (e *Executor) subscribe() (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.wakers == nil {
+		e.wakers = make(map[chan struct{}]struct{})
+	}
+	e.wakers[c] = struct{}{}
+
+	return c, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.wakers, c)
+	}
+}
+
+// wake wakes everything claiming commands for this executor.
+func (e *Executor) wake() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for c := range e.wakers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Listen wakes the executor when commands are queued and terminates commands
+// when they are canceled, until ctx is done. Canceled rollouts are advanced,
+// so that their executions which have not started are canceled.
+//
+// notify must deliver notifications on RunChannel and CancelChannel, e.g.,
+// from a pq.Listener. A nil notification indicates that notifications may
+// have been missed.
+func (e *Executor) Listen(ctx context.Context, notify <-chan *pq.Notification) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notify:
+			if n == nil || n.Channel == RunChannel {
+				e.wake()
+			}
+
+			if n == nil {
+				for _, id := range e.runningIDs() {
+					e.checkCanceled(ctx, id)
+				}
+				continue
+			}
+
+			if n.Channel != CancelChannel {
+				continue
+			}
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				log.WithError(err).WithField("payload", n.Extra).Errorln("Malformed cancellation.")
+				continue
+			}
+			e.checkCanceled(ctx, id)
+			if err = advance(ctx, e.DB, id); err != nil {
+				log.WithError(err).WithField("command", id).Errorln("Error advancing canceled rollout.")
+			}
+		}
+	}
+}
+
+// job is a command claimed by an executor.
+type job struct {
+	id           int64
+	argv         []string
+	catalogEntry string
+
+	// agentID is set if the job is the execution of a rollout on that agent.
+	agentID string
+
+	// timeout is zero if the command may run indefinitely.
+	timeout time.Duration
+
+	inputs *pb.CommandInputs
+
+	// artifactPaths are the files collected from the command's working
+	// directory once it exits.
+	artifactPaths []string
+
+	// env are the command's environment variables and secretEnv its
+	// references to secrets set as environment variables.
+	env       map[string]string
+	secretEnv []secretRef
+
+	// secrets are the values of the secrets in secretEnv, by name, once
+	// they have been resolved, so that they may be redacted from the
+	// command's output. They are never stored.
+	secrets map[string][]byte
+
+	// preview is set if the job is the dry run of the command rather than
+	// the command itself, in which case argv is that of the dry run and
+	// startTime is when the dry run was claimed.
+	preview   bool
+	startTime time.Time
+}
+
+const claimQuery = `
+	UPDATE commands
+	SET (status, start_time, executor, heartbeat_time) = ($1, $2, $3, $2)
+	WHERE id = (
+		SELECT id
+		FROM commands
+		WHERE status = $4
+			AND (schedule_time IS NULL AND run_request_time IS NOT NULL OR schedule_time <= $2)
+			AND (expire_time IS NULL OR expire_time > $2)
+			AND target_agent IS NULL AND target_selector IS NULL AND targets IS NULL
+			AND (preview_state IS NULL OR preview_state = $5 OR preview_override_time IS NOT NULL OR break_glass_time IS NOT NULL)
+		ORDER BY COALESCE(schedule_time, run_request_time)
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, argv, catalog_entry, timeout_ms, inputs, artifact_paths, env, secret_env;
+`
+
+// claim marks the command selected by query which has been queued the
+// longest as running on the executor with the given ID and returns it, or nil
+// if none is queued. The parameters of query are RUNNING, the current time,
+// id, READY, and args.
+//
+// Scheduled commands are queued from their schedule time until they expire,
+// whether or not RunCommand was called. Commands with a preview are queued
+// only once it has succeeded or been overridden, or if they were run by
+// break-glass.
+func (e *Executor) claim(ctx context.Context, query string, id string, args ...interface{}) (*job, error) {
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	args = append([]interface{}{pb.Status_RUNNING, now, id, pb.Status_READY}, args...)
+	j, err := scanJob(tx.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = recordStart(ctx, tx, j.id, now); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// scanJob reads a claimed job from row, whose columns are those returned by
+// claimQuery.
+func scanJob(row *sql.Row) (*job, error) {
+	var j job
+	var catalogEntry sql.NullString
+	var timeout sql.NullInt64
+	var inputs, env, secretEnv []byte
+	err := row.Scan(
+		&j.id,
+		pq.Array(&j.argv),
+		&catalogEntry,
+		&timeout,
+		&inputs,
+		pq.Array(&j.artifactPaths),
+		&env,
+		&secretEnv,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if j.inputs, err = unmarshalInputs(inputs); err != nil {
+		return nil, err
+	}
+	if j.env, j.secretEnv, err = unmarshalEnv(env, secretEnv); err != nil {
+		return nil, err
+	}
+
+	j.catalogEntry = catalogEntry.String
+	j.timeout = time.Duration(timeout.Int64) * time.Millisecond
+	return &j, nil
+}
+
+const heartbeatQuery = `
+	UPDATE commands
+	SET heartbeat_time = $2
+	WHERE id = $1;
+`
+
+const finishCommandQuery = `
+	UPDATE commands
+	SET (status, end_time, std_out, std_err, exit_code, signal, start_error, user_cpu_us, system_cpu_us, max_rss_bytes, redactions) =
+		($2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $13)
+	WHERE id = $1 AND status = $12;
+`
+
+const insertUnredactedOutputQuery = `
+	INSERT INTO unredacted_output ("command_id", "std_out", "std_err", "create_time")
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT DO NOTHING;
+`
+
+const notifyQuery = `SELECT pg_notify($1, $2);`
+
+// execute runs a claimed command and records its result.
+//
+// The command runs to completion even if the executor is stopped, so that it
+// is never left running without its output being recorded.
+func (e *Executor) execute(j *job) {
+	ctx := context.Background()
+	logger := log.WithField("command", j.id)
+
+	cmdStatus := pb.Status_SUCCESS
+	terminated := pb.Status_UNDEFINED
+	var state *os.ProcessState
+	cmd, cleanup, err := e.command(ctx, j)
+	stdout, stderr := e.outputWriters(j)
+	startErr := err
+	if err == nil {
+		defer cleanup()
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		startErr = cmd.Start()
+		if startErr == nil {
+			stop := e.heartbeat(j.id)
+			terminated, err = e.wait(j.id, cmd, j.timeout)
+			stop()
+			state = cmd.ProcessState
+			if len(j.artifactPaths) > 0 {
+				e.collectArtifacts(ctx, j.id, cmd.Dir, j.artifactPaths)
+			}
+		}
+	}
+	if startErr != nil {
+		logger.WithError(startErr).Errorln("Error starting command.")
+		err = startErr
+		fmt.Fprintf(stderr, "toolproxy: %v\n", err)
+	}
+
+	if terminated != pb.Status_UNDEFINED {
+		cmdStatus = terminated
+	} else if err != nil {
+		cmdStatus = pb.Status_ERROR
+	}
+
+	if err = e.finish(ctx, j.id, cmdStatus, stdout, stderr, newExitStatus(state, startErr)); err != nil {
+		logger.WithError(err).Errorln("Error recording command result.")
+	}
+}
+
+// heartbeat periodically records that the command with the given ID is
+// still running until the returned function is called.
+func (e *Executor) heartbeat(id int64) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(e.heartbeatInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				if _, err := e.DB.Exec(heartbeatQuery, id, t); err != nil {
+					log.WithError(err).WithField("command", id).Errorln("Error recording heartbeat.")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// finish records the result of a command, and its original output if
+// anything was redacted from it and it is retained.
+//
+// If the command has been marked as LOST, e.g., because the executor could
+// not record heartbeats for longer than the lease duration, its status is
+// final and the result is not recorded.
+func (e *Executor) finish(ctx context.Context, id int64, s pb.Status, stdout, stderr *outputWriter, exit exitStatus) error {
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stdout.Flush()
+	stderr.Flush()
+	redacted := redactions(stdout, stderr)
+	now := time.Now()
+	res, err := tx.ExecContext(
+		ctx,
+		finishCommandQuery,
+		id,
+		s,
+		now,
+		stdout.Bytes(),
+		stderr.Bytes(),
+		exit.exitCode,
+		exit.signal,
+		exit.startError,
+		exit.userCPU,
+		exit.systemCPU,
+		exit.maxRSS,
+		pb.Status_RUNNING,
+		redacted,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("command %d is no longer running", id)
+	}
+
+	if err = recordFinish(ctx, tx, id, s, now); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// The result is recorded even if the original output cannot be.
+	if redacted != nil && stdout.raw != nil {
+		if err = e.retain(ctx, id, stdout, stderr, now); err != nil {
+			log.WithError(err).WithField("command", id).Errorln("Error retaining unredacted output.")
+		}
+	}
+	return nil
+}
+
+// retain records the original output of a command, encrypted.
+func (e *Executor) retain(ctx context.Context, id int64, stdout, stderr *outputWriter, now time.Time) error {
+	name := commandName(id)
+	sealedOut, err := e.Sealer.Seal(name, pb.Stream_STDOUT, stdout.raw.Bytes())
+	if err != nil {
+		return err
+	}
+	sealedErr, err := e.Sealer.Seal(name, pb.Stream_STDERR, stderr.raw.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = e.DB.ExecContext(ctx, insertUnredactedOutputQuery, id, sealedOut, sealedErr, now)
+	return err
+}
+
+// recordStart appends the start of the command with the given ID to the audit
+// log. It should be executed in the same transaction in which the command is
+// claimed.
+func recordStart(ctx context.Context, tx *sql.Tx, id int64, now time.Time) error {
+	return audit.Append(ctx, tx, audit.Event{
+		CommandID: id,
+		Action:    pb.Action_ACTION_START,
+		ActorType: audit.SystemActorType,
+		ActorID:   audit.SystemActorID,
+		Time:      now,
+	})
+}
+
+// recordFinish appends the finish of the command with the given ID to the
+// audit log. It should be executed in the same transaction in which the
+// command's final status is recorded.
+func recordFinish(ctx context.Context, tx *sql.Tx, id int64, s pb.Status, now time.Time) error {
+	return audit.Append(ctx, tx, audit.Event{
+		CommandID: id,
+		Action:    pb.Action_ACTION_FINISH,
+		ActorType: audit.SystemActorType,
+		ActorID:   audit.SystemActorID,
+		Detail:    s.String(),
+		Time:      now,
+	})
+}
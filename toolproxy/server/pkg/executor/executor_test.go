@@ -0,0 +1,245 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// expectFinish expects the finish of the command with the given ID to be
+// appended to the audit log.
+func expectFinish(mock sqlmock.Sqlmock, id int64, s pb.Status) {
+	mock.ExpectExec(audit.AppendQuery).WithArgs(
+		sqlmock.AnyArg(),
+		id,
+		pb.Action_ACTION_FINISH,
+		audit.SystemActorType,
+		audit.SystemActorID,
+		"",
+		s.String(),
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectStart expects the start of the command with the given ID to be
+// appended to the audit log.
+func expectStart(mock sqlmock.Sqlmock, id int64) {
+	mock.ExpectExec(audit.AppendQuery).WithArgs(
+		sqlmock.AnyArg(),
+		id,
+		pb.Action_ACTION_START,
+		audit.SystemActorType,
+		audit.SystemActorID,
+		"",
+		"",
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestClaim(t *testing.T) {
+	t.Run("Claim queued command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimQuery).WithArgs(
+			pb.Status_RUNNING,
+			sqlmock.AnyArg(),
+			"executor-1",
+			pb.Status_READY,
+			pb.PreviewState_PREVIEW_SUCCEEDED,
+		).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+				AddRow(1, pq.Array([]string{"/bin/true"}), "true", 60000, `{"stdin":"Zml4Cg=="}`, pq.Array([]string{"dump.sql"}),
+					`{"PGDATABASE":"orders"}`, `[{"name":"PGPASSWORD","secret":"pg-password"}]`),
+		)
+		expectStart(mock, 1)
+		mock.ExpectCommit()
+
+		e := &Executor{DB: db}
+		j, err := e.claim(context.Background(), claimQuery, "executor-1", pb.PreviewState_PREVIEW_SUCCEEDED)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if j.id != 1 || j.catalogEntry != "true" || j.timeout != time.Minute || string(j.inputs.GetStdin()) != "fix\n" || len(j.artifactPaths) != 1 {
+			t.Errorf("Bad job: %+v", j)
+		}
+		if j.env["PGDATABASE"] != "orders" || len(j.secretEnv) != 1 || j.secretEnv[0] != (secretRef{Name: "PGPASSWORD", Secret: "pg-password"}) {
+			t.Errorf("Bad environment: %v, %v", j.env, j.secretEnv)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("No queued command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimQuery).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		e := &Executor{DB: db}
+		j, err := e.claim(context.Background(), claimQuery, "executor-1", pb.PreviewState_PREVIEW_SUCCEEDED)
+		if err != nil || j != nil {
+			t.Errorf("Expected no job; got %+v, %v", j, err)
+		}
+	})
+}
+
+func TestExecute(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+	)
+	mock.ExpectExec(insertChunkQuery).WithArgs(
+		1,
+		pb.Stream_STDOUT,
+		[]byte("hello\n"),
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(finishCommandQuery).WithArgs(
+		1,
+		pb.Status_SUCCESS,
+		sqlmock.AnyArg(),
+		[]byte("hello\n"),
+		[]byte(nil),
+		sql.NullInt32{Int32: 0, Valid: true},
+		sql.NullString{},
+		sql.NullString{},
+		sqlmock.AnyArg(),
+		sqlmock.AnyArg(),
+		sqlmock.AnyArg(),
+		pb.Status_RUNNING,
+		nil,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFinish(mock, 1, pb.Status_SUCCESS)
+	mock.ExpectCommit()
+
+	e := &Executor{DB: db}
+	e.execute(&job{id: 1, argv: []string{"/bin/echo", "hello"}})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// The command is run concurrently with further claims.
+	mock.MatchExpectationsInOrder(false)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(loseClaimedQuery).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectCommit()
+	mock.ExpectExec(requeuePreviewsQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Nothing is queued until the executor is notified.
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	mock.ExpectQuery(claimPreviewQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimRolloutQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimQuery).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+			AddRow(1, pq.Array([]string{"/bin/true"}), nil, nil, nil, nil, nil, nil),
+	)
+	expectStart(mock, 1)
+	mock.ExpectCommit()
+	mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+	)
+	mock.ExpectBegin()
+	mock.ExpectExec(finishCommandQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectFinish(mock, 1, pb.Status_SUCCESS)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	mock.ExpectQuery(claimPreviewQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimRolloutQuery).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	e := &Executor{DB: db, ID: "executor-1", PollInterval: time.Hour}
+	go e.Listen(ctx, notify)
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	// Run must be waiting to be woken before it is notified.
+	for {
+		e.mu.Lock()
+		waiting := len(e.wakers) > 0
+		e.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	notify <- &pq.Notification{Channel: RunChannel, Extra: "1"}
+
+	deadline := time.After(5 * time.Second)
+	for mock.ExpectationsWereMet() != nil {
+		select {
+		case <-deadline:
+			t.Fatalf("Failed expectation: %v", mock.ExpectationsWereMet())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	<-done
+}
+
+func TestFinishLostCommand(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(finishCommandQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	e := &Executor{DB: db}
+	stdout, stderr := e.outputWriters(&job{id: 1})
+	err = e.finish(context.Background(), 1, pb.Status_SUCCESS, stdout, stderr, exitStatus{})
+	if err == nil {
+		t.Errorf("Expected error recording result of lost command")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package executor
+
+import (
+	"bytes"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const insertChunkQuery = `
+	INSERT INTO output_chunks ("command_id", "stream", "data", "write_time")
+	VALUES ($1, $2, $3, $4);
+`
+
+const insertExecutionChunkQuery = `
+	INSERT INTO output_chunks ("command_id", "stream", "data", "write_time", "agent_id")
+	VALUES ($1, $2, $3, $4, $5);
+`
+
+// outputWriter redacts what is written to one of a command's output streams
+// and persists it a line at a time as output chunks, so that the output may
+// be followed while the command runs.
+//
+// The complete redacted output is also buffered so that it may be saved with
+// the command when it finishes, as is the original output if it is to be
+// retained.
+type outputWriter struct {
+	chunks   *chunkWriter
+	redacted *redact.Writer
+
+	// raw is the original output. It is nil unless the original output is
+	// retained.
+	raw *bytes.Buffer
+}
+
+// newOutputWriter returns an outputWriter which redacts the output of the
+// command or execution of a job with r. The original output is buffered if
+// retain is set.
+func newOutputWriter(db *sql.DB, j *job, stream pb.Stream, r *redact.Redactor, retain bool) *outputWriter {
+	w := &outputWriter{
+		chunks: &chunkWriter{db: db, commandID: j.id, agentID: j.agentID, stream: stream},
+	}
+	w.redacted = r.NewWriter(w.chunks)
+	if retain {
+		w.raw = new(bytes.Buffer)
+	}
+	return w
+}
+
+// outputWriters returns the writers of the standard output and standard error
+// of a job. The job's secrets must have been resolved.
+func (e *Executor) outputWriters(j *job) (stdout, stderr *outputWriter) {
+	r := e.redactor(j)
+	// The original output of executions of rollouts is not retained.
+	retain := e.Sealer != nil && j.agentID == ""
+	return newOutputWriter(e.DB, j, pb.Stream_STDOUT, r, retain), newOutputWriter(e.DB, j, pb.Stream_STDERR, r, retain)
+}
+
+// redactor returns the redactor of the output of a job, which redacts the
+// values of its secrets. The job's secrets must have been resolved.
+func (e *Executor) redactor(j *job) *redact.Redactor {
+	r := e.Redactor
+	if r == nil {
+		r = redact.Default()
+	}
+	if len(j.secrets) > 0 {
+		r = r.WithSecrets(j.secrets)
+	}
+	return r
+}
+
+// Write implements io.Writer for *outputWriter.
+func (w *outputWriter) Write(p []byte) (int, error) {
+	if w.raw != nil {
+		w.raw.Write(p)
+	}
+	return w.redacted.Write(p)
+}
+
+// Flush persists any incomplete line. It must be called once the command
+// has exited.
+func (w *outputWriter) Flush() {
+	w.redacted.Flush()
+}
+
+// Bytes returns everything which has been persisted.
+func (w *outputWriter) Bytes() []byte {
+	return w.chunks.buf.Bytes()
+}
+
+// redactions returns the sorted names of the redaction rules which matched
+// the output of either writer, to be stored, or nil if none did.
+func redactions(stdout, stderr *outputWriter) interface{} {
+	fired := make(map[string]struct{})
+	for _, v := range append(stdout.redacted.Fired(), stderr.redacted.Fired()...) {
+		fired[v] = struct{}{}
+	}
+	if len(fired) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(fired))
+	for v := range fired {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	return pq.Array(names)
+}
+
+// chunkWriter persists each write to one of a command's output streams as an
+// output chunk, and buffers it.
+type chunkWriter struct {
+	db        *sql.DB
+	commandID int64
+	stream    pb.Stream
+	buf       bytes.Buffer
+
+	// agentID is the agent running the execution which writes the output,
+	// if the command is a rollout.
+	agentID string
+}
+
+// Write implements io.Writer for *chunkWriter.
+//
+// Errors persisting a chunk are logged rather than returned, because failing
+// the write would close the pipe and kill the command.
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	var err error
+	if w.agentID == "" {
+		_, err = w.db.Exec(insertChunkQuery, w.commandID, w.stream, p, time.Now())
+	} else {
+		_, err = w.db.Exec(insertExecutionChunkQuery, w.commandID, w.stream, p, time.Now(), w.agentID)
+	}
+	if err != nil {
+		log.WithError(err).WithField("command", w.commandID).Errorln("Error persisting output chunk.")
+	}
+	return len(p), nil
+}
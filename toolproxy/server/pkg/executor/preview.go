@@ -0,0 +1,219 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// claimPreviewQuery claims the pending preview of a command which has not
+// been run or deleted. Its columns are those of claimQuery, but argv is that
+// of the dry run.
+const claimPreviewQuery = `
+	UPDATE commands
+	SET (preview_state, preview_start_time, preview_executor) = ($1, $2, $3)
+	WHERE id = (
+		SELECT id
+		FROM commands
+		WHERE preview_state = $4 AND status IN ($5, $6)
+		ORDER BY create_time
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, preview_argv, catalog_entry, timeout_ms, inputs, artifact_paths, env, secret_env;
+`
+
+// claimPreview marks the preview which has been pending the longest as
+// running on the executor with the given ID and returns its dry run, or nil
+// if none is pending.
+func (e *Executor) claimPreview(ctx context.Context, id string) (*job, error) {
+	// The start time identifies the claim when the result is recorded, so
+	// it must survive the round trip through the database unchanged.
+	now := time.Now().Truncate(time.Microsecond)
+	j, err := scanJob(e.DB.QueryRowContext(
+		ctx,
+		claimPreviewQuery,
+		pb.PreviewState_PREVIEW_RUNNING,
+		now,
+		id,
+		pb.PreviewState_PREVIEW_PENDING,
+		pb.Status_SUBMITTED,
+		pb.Status_READY,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	j.preview = true
+	j.startTime = now
+	return j, nil
+}
+
+// previewWriter redacts what is written to one of the output streams of a
+// dry run and buffers it. Unlike the output of commands, the output of dry
+// runs is not followed while they run and the original is not retained.
+type previewWriter struct {
+	buf      bytes.Buffer
+	redacted *redact.Writer
+}
+
+func newPreviewWriter(r *redact.Redactor) *previewWriter {
+	w := &previewWriter{}
+	w.redacted = r.NewWriter(&w.buf)
+	return w
+}
+
+// Write implements io.Writer for *previewWriter.
+func (w *previewWriter) Write(p []byte) (int, error) {
+	return w.redacted.Write(p)
+}
+
+// Bytes returns the redacted output. The writer may not be written to
+// afterwards.
+func (w *previewWriter) Bytes() []byte {
+	w.redacted.Flush()
+	return w.buf.Bytes()
+}
+
+// preview runs the claimed dry run of a command and records its result.
+//
+// The dry run is run as the command itself would be, with the same inputs,
+// environment, secrets and execution profile, except that its artifacts are
+// not collected.
+func (e *Executor) preview(j *job) {
+	ctx := context.Background()
+	logger := log.WithField("command", j.id)
+
+	terminated := pb.Status_UNDEFINED
+	var state *os.ProcessState
+	cmd, cleanup, err := e.command(ctx, j)
+	r := e.redactor(j)
+	stdout, stderr := newPreviewWriter(r), newPreviewWriter(r)
+	startErr := err
+	if err == nil {
+		defer cleanup()
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		startErr = cmd.Start()
+		if startErr == nil {
+			terminated, _ = e.wait(j.id, cmd, j.timeout)
+			state = cmd.ProcessState
+		}
+	}
+	if startErr != nil {
+		logger.WithError(startErr).Errorln("Error starting preview.")
+	}
+
+	exit := newExitStatus(state, startErr)
+	previewState := pb.PreviewState_PREVIEW_FAILED
+	var failure string
+	switch {
+	case startErr != nil:
+		failure = startErr.Error()
+	case terminated != pb.Status_UNDEFINED:
+		failure = "dry run " + strings.ToLower(strings.ReplaceAll(terminated.String(), "_", " "))
+	case exit.signal.Valid:
+		failure = "dry run killed by " + exit.signal.String
+	case exit.exitCode.Int32 != 0:
+		failure = fmt.Sprintf("dry run exited with status %d", exit.exitCode.Int32)
+	default:
+		previewState = pb.PreviewState_PREVIEW_SUCCEEDED
+	}
+
+	err = e.finishPreview(ctx, j, previewState, stdout.Bytes(), stderr.Bytes(), exit.exitCode, failure)
+	if err != nil {
+		logger.WithError(err).Errorln("Error recording preview result.")
+	}
+}
+
+const finishPreviewQuery = `
+	UPDATE commands
+	SET (preview_state, preview_end_time, preview_std_out, preview_std_err, preview_exit_code, preview_error) = ($2, $3, $4, $5, $6, $7)
+	WHERE id = $1 AND preview_state = $8 AND preview_start_time = $9;
+`
+
+// finishPreview records the result of the dry run of a command.
+//
+// If the command was edited while its dry run ran, its preview is pending
+// again and the result, which is of the command as it was, is discarded.
+func (e *Executor) finishPreview(ctx context.Context, j *job, s pb.PreviewState, stdout, stderr []byte, exitCode sql.NullInt32, failure string) error {
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.ExecContext(
+		ctx,
+		finishPreviewQuery,
+		j.id,
+		s,
+		now,
+		stdout,
+		stderr,
+		exitCode,
+		sql.NullString{String: failure, Valid: failure != ""},
+		pb.PreviewState_PREVIEW_RUNNING,
+		j.startTime,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		log.WithField("command", j.id).Infoln("Command changed while it was previewed; discarding preview.")
+		return nil
+	}
+
+	err = audit.Append(ctx, tx, audit.Event{
+		CommandID: j.id,
+		Action:    pb.Action_ACTION_PREVIEW,
+		ActorType: audit.SystemActorType,
+		ActorID:   audit.SystemActorID,
+		Detail:    s.String(),
+		Time:      now,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A scheduled command which was held for its preview may now run. The
+	// notification is delivered when the transaction commits.
+	if s == pb.PreviewState_PREVIEW_SUCCEEDED {
+		_, err = tx.ExecContext(ctx, notifyQuery, RunChannel, strconv.FormatInt(j.id, 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const requeuePreviewsQuery = `
+	UPDATE commands
+	SET (preview_state, preview_start_time, preview_executor) = ($1, NULL, NULL)
+	WHERE preview_state = $2 AND preview_executor = $3;
+`
+
+// requeuePreviews marks the previews which were running on the executor
+// with the given ID as pending, so that they are run again. Like recover, it
+// must only be called before the executor claims any previews.
+func (e *Executor) requeuePreviews(ctx context.Context, id string) error {
+	_, err := e.DB.ExecContext(ctx, requeuePreviewsQuery, pb.PreviewState_PREVIEW_PENDING, pb.PreviewState_PREVIEW_RUNNING, id)
+	return err
+}
@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// expectPreview expects the preview of the command with the given ID to be
+// appended to the audit log.
+func expectPreview(mock sqlmock.Sqlmock, id int64, s pb.PreviewState) {
+	mock.ExpectExec(audit.AppendQuery).WithArgs(
+		sqlmock.AnyArg(),
+		id,
+		pb.Action_ACTION_PREVIEW,
+		audit.SystemActorType,
+		audit.SystemActorID,
+		"",
+		s.String(),
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestClaimPreview(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(claimPreviewQuery).WithArgs(
+		pb.PreviewState_PREVIEW_RUNNING,
+		sqlmock.AnyArg(),
+		"executor-1",
+		pb.PreviewState_PREVIEW_PENDING,
+		pb.Status_SUBMITTED,
+		pb.Status_READY,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "preview_argv", "catalog_entry", "timeout_ms", "inputs", "artifact_paths", "env", "secret_env"}).
+			AddRow(1, pq.Array([]string{"/usr/bin/kubectl", "apply", "--dry-run=server"}), "kubectl-apply", nil, nil, nil, nil, nil),
+	)
+
+	e := &Executor{DB: db}
+	j, err := e.claimPreview(context.Background(), "executor-1")
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	if !j.preview || j.startTime.IsZero() || j.argv[2] != "--dry-run=server" {
+		t.Errorf("Bad preview job: %+v", j)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	testCases := []struct {
+		name     string
+		argv     []string
+		started  bool
+		state    pb.PreviewState
+		stdout   []byte
+		exitCode sql.NullInt32
+		failure  interface{}
+	}{
+		{
+			name:     "Dry run succeeds",
+			argv:     []string{"/bin/echo", "deployment/web configured (server dry run)"},
+			started:  true,
+			state:    pb.PreviewState_PREVIEW_SUCCEEDED,
+			stdout:   []byte("deployment/web configured (server dry run)\n"),
+			exitCode: sql.NullInt32{Int32: 0, Valid: true},
+			failure:  sql.NullString{},
+		},
+		{
+			name:     "Dry run exits with non-zero status",
+			argv:     []string{"/bin/false"},
+			started:  true,
+			state:    pb.PreviewState_PREVIEW_FAILED,
+			exitCode: sql.NullInt32{Int32: 1, Valid: true},
+			failure:  sql.NullString{String: "dry run exited with status 1", Valid: true},
+		},
+		{
+			name:    "Dry run cannot start",
+			argv:    []string{"/nonexistent"},
+			state:   pb.PreviewState_PREVIEW_FAILED,
+			failure: sqlmock.AnyArg(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.started {
+				mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+					sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+				)
+			}
+			mock.ExpectBegin()
+			j := &job{id: 1, argv: tc.argv, preview: true}
+			mock.ExpectExec(finishPreviewQuery).WithArgs(
+				1,
+				tc.state,
+				sqlmock.AnyArg(),
+				tc.stdout,
+				[]byte(nil),
+				tc.exitCode,
+				tc.failure,
+				pb.PreviewState_PREVIEW_RUNNING,
+				j.startTime,
+			).WillReturnResult(sqlmock.NewResult(0, 1))
+			expectPreview(mock, 1, tc.state)
+			if tc.state == pb.PreviewState_PREVIEW_SUCCEEDED {
+				mock.ExpectExec(notifyQuery).WithArgs(RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectCommit()
+
+			e := &Executor{DB: db}
+			e.preview(j)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
+
+func TestFinishEditedPreview(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// The command was edited while its dry run ran, so nothing is recorded.
+	mock.ExpectBegin()
+	mock.ExpectExec(finishPreviewQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	e := &Executor{DB: db}
+	err = e.finishPreview(context.Background(), &job{id: 1, preview: true}, pb.PreviewState_PREVIEW_SUCCEEDED, nil, nil, sql.NullInt32{}, "")
+	if err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
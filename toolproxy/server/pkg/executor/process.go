@@ -0,0 +1,176 @@
+package executor
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// process is a command being run by this executor.
+type process struct {
+	cmd *sandbox.Cmd
+
+	// group is true if the command runs in its own process group.
+	group bool
+
+	// done is closed once the command has exited.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// reason is CANCELED or TIMED_OUT if the command has been terminated.
+	reason pb.Status
+}
+
+// terminate sends SIGTERM to the command and, if it has not exited after
+// grace, SIGKILL. The reason the command was terminated is recorded; if it
+// has already been terminated, terminate has no effect.
+func (p *process) terminate(reason pb.Status, grace time.Duration) {
+	p.mu.Lock()
+	if p.reason != pb.Status_UNDEFINED {
+		p.mu.Unlock()
+		return
+	}
+	p.reason = reason
+	p.mu.Unlock()
+
+	p.signal(syscall.SIGTERM)
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-p.done:
+		case <-timer.C:
+			p.signal(syscall.SIGKILL)
+		}
+	}()
+}
+
+// terminatedReason returns the reason the command was terminated, or
+// UNDEFINED if it was not.
+func (p *process) terminatedReason() pb.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reason
+}
+
+func (p *process) signal(sig syscall.Signal) {
+	pid := p.cmd.Process.Pid
+	if p.group {
+		// A negative PID signals every process in the group.
+		pid = -pid
+	}
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		log.WithError(err).WithField("pid", pid).Errorln("Error signalling command.")
+	}
+}
+
+// register records that the command with the given ID is being run by p.
+// The executions of a rollout each register with the ID of their command.
+func (e *Executor) register(id int64, p terminator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running == nil {
+		e.running = make(map[int64]map[terminator]struct{})
+	}
+	if e.running[id] == nil {
+		e.running[id] = make(map[terminator]struct{})
+	}
+	e.running[id][p] = struct{}{}
+}
+
+func (e *Executor) unregister(id int64, p terminator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.running[id], p)
+	if len(e.running[id]) == 0 {
+		delete(e.running, id)
+	}
+}
+
+// runningIDs returns the IDs of the commands being run by this executor.
+func (e *Executor) runningIDs() []int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]int64, 0, len(e.running))
+	for id := range e.running {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+const cancelRequestedQuery = `
+	SELECT cancel_time IS NOT NULL
+	FROM commands
+	WHERE id = $1;
+`
+
+// checkCanceled terminates the command with the given ID, or each of its
+// executions, if it is being run by this executor and its cancellation has
+// been requested.
+func (e *Executor) checkCanceled(ctx context.Context, id int64) {
+	e.mu.Lock()
+	running := make([]terminator, 0, len(e.running[id]))
+	for p := range e.running[id] {
+		running = append(running, p)
+	}
+	e.mu.Unlock()
+	if len(running) == 0 {
+		return
+	}
+
+	var canceled bool
+	err := e.DB.QueryRowContext(ctx, cancelRequestedQuery, id).Scan(&canceled)
+	if err != nil {
+		log.WithError(err).WithField("command", id).Errorln("Error checking for cancellation.")
+		return
+	}
+	if canceled {
+		for _, p := range running {
+			p.terminate(pb.Status_CANCELED, e.killGracePeriod())
+		}
+	}
+}
+
+// wait waits for cmd, which has been started to run the command with the
+// given ID, to exit. It is terminated if its cancellation is requested or it
+// runs for longer than timeout, in which case the returned status is CANCELED
+// or TIMED_OUT respectively; otherwise it is UNDEFINED. If timeout is zero,
+// the command may run indefinitely.
+//
+// Once the command has exited, any process it left running in its process
+// group is killed, so that nothing it started can change its working
+// directory while its artifacts are collected.
+func (e *Executor) wait(id int64, cmd *sandbox.Cmd, timeout time.Duration) (pb.Status, error) {
+	p := &process{
+		cmd:   cmd,
+		group: cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid,
+		done:  make(chan struct{}),
+	}
+	e.register(id, p)
+	defer e.unregister(id, p)
+
+	// The command may have been canceled between when it was claimed and
+	// when it was registered, in which case we missed the notification.
+	e.checkCanceled(context.Background(), id)
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			p.terminate(pb.Status_TIMED_OUT, e.killGracePeriod())
+		})
+		defer timer.Stop()
+	}
+
+	err := cmd.Wait()
+	close(p.done)
+	if p.group {
+		p.signal(syscall.SIGKILL)
+	}
+	return p.terminatedReason(), err
+}
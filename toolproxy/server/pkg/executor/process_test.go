@@ -0,0 +1,193 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/sandbox"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// startGroup starts a shell script in its own process group.
+func startGroup(t *testing.T, script string) *sandbox.Cmd {
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting command: %v", err)
+	}
+	return &sandbox.Cmd{Cmd: cmd}
+}
+
+func TestWait(t *testing.T) {
+	t.Run("Command times out", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+		)
+
+		e := &Executor{DB: db, KillGracePeriod: time.Second}
+		cmd := startGroup(t, "sleep 60 & wait")
+		reason, err := e.wait(1, cmd, 100*time.Millisecond)
+		if err == nil {
+			t.Errorf("Expected terminated command to fail")
+		}
+
+		if reason != pb.Status_TIMED_OUT {
+			t.Errorf("Expected %v; got %v", pb.Status_TIMED_OUT, reason)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Cancellation before registration is not missed", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(true),
+		)
+
+		e := &Executor{DB: db, KillGracePeriod: time.Second}
+		cmd := startGroup(t, "sleep 60")
+		reason, _ := e.wait(1, cmd, 0)
+		if reason != pb.Status_CANCELED {
+			t.Errorf("Expected %v; got %v", pb.Status_CANCELED, reason)
+		}
+	})
+
+	t.Run("Processes left running are killed", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+		mock.ExpectQuery(cancelRequestedQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"canceled"}).AddRow(false),
+		)
+
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		e := &Executor{DB: db, KillGracePeriod: time.Second}
+		cmd := startGroup(t, "sleep 60 </dev/null >/dev/null 2>&1 & echo $! >"+pidFile)
+		if _, err := e.wait(1, cmd, 0); err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		content, err := os.ReadFile(pidFile)
+		if err != nil {
+			t.Fatalf("Error reading PID: %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			t.Fatalf("Bad PID %q: %v", content, err)
+		}
+
+		// The killed process may remain a zombie until it is reaped by
+		// its new parent.
+		deadline := time.Now().Add(time.Second)
+		for {
+			stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+			if err != nil || strings.Contains(string(stat), ") Z ") {
+				break
+			}
+			if time.Now().After(deadline) {
+				syscall.Kill(pid, syscall.SIGKILL)
+				t.Fatalf("Expected process left running to be killed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestTerminate(t *testing.T) {
+	t.Run("SIGKILL after grace period", func(t *testing.T) {
+		// The shell ignores SIGTERM, so only SIGKILL stops it.
+		cmd := startGroup(t, `trap "" TERM; while :; do sleep 0.1; done`)
+		p := &process{cmd: cmd, group: true, done: make(chan struct{})}
+
+		// Give the shell time to install its trap.
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		p.terminate(pb.Status_CANCELED, 200*time.Millisecond)
+		err := cmd.Wait()
+		close(p.done)
+
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGKILL {
+			t.Errorf("Expected command to be killed; got %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("Expected SIGKILL after grace period; got it after %v", elapsed)
+		}
+	})
+
+	t.Run("First reason is kept", func(t *testing.T) {
+		cmd := startGroup(t, "sleep 60")
+		p := &process{cmd: cmd, group: true, done: make(chan struct{})}
+		p.terminate(pb.Status_TIMED_OUT, time.Second)
+		p.terminate(pb.Status_CANCELED, time.Second)
+		cmd.Wait()
+		close(p.done)
+
+		if got := p.terminatedReason(); got != pb.Status_TIMED_OUT {
+			t.Errorf("Expected %v; got %v", pb.Status_TIMED_OUT, got)
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+	// Every canceled command is advanced in case it is a rollout.
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	mock.ExpectQuery(cancelRequestedQuery).WithArgs(2).WillReturnRows(
+		sqlmock.NewRows([]string{"canceled"}).AddRow(true),
+	)
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockRolloutQuery).WithArgs(2, pb.Status_RUNNING).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	e := &Executor{DB: db, KillGracePeriod: time.Second}
+	cmd := startGroup(t, "sleep 60")
+	p := &process{cmd: cmd, group: true, done: make(chan struct{})}
+	e.register(2, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := make(chan *pq.Notification)
+	go e.Listen(ctx, notify)
+
+	// Notifications for commands run by other replicas are ignored.
+	notify <- &pq.Notification{Channel: CancelChannel, Extra: "1"}
+	notify <- &pq.Notification{Channel: CancelChannel, Extra: "2"}
+
+	cmd.Wait()
+	close(p.done)
+
+	if got := p.terminatedReason(); got != pb.Status_CANCELED {
+		t.Errorf("Expected %v; got %v", pb.Status_CANCELED, got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
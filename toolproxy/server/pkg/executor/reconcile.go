@@ -0,0 +1,256 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const (
+	defaultLeaseDuration     = time.Minute
+	defaultReconcileInterval = time.Minute
+	defaultLostWindow        = 24 * time.Hour
+)
+
+const (
+	expiredMessage   = "The executor running the command stopped recording that it was running. The command may or may not have completed."
+	restartedMessage = "The executor running the command restarted before the command finished. The command may or may not have completed."
+	missedMessage    = "The command was not started before its scheduled time expired."
+)
+
+var lostCommands = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "toolproxy_lost_commands",
+	Help: "The number of commands and executions of rollouts lost within the reconciler's lost window, whose outcome is unknown because the executor or agent running them stopped responding.",
+})
+
+var openBreakGlassReviews = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "toolproxy_break_glass_reviews_open",
+	Help: "The number of commands run by break-glass whose post-incident review has not been signed off.",
+})
+
+// Reconciler marks commands as LOST when the executor running them has
+// stopped recording heartbeats, e.g., because it crashed, so that they do
+// not remain RUNNING forever. It also marks scheduled commands as EXPIRED
+// when they were not started in time, so that they are never run late.
+type Reconciler struct {
+	DB *sql.DB
+
+	// LeaseDuration is how long after its last heartbeat a running command
+	// is considered lost. It should be several times the heartbeat interval
+	// of every executor. If it is zero, a default of one minute is used.
+	LeaseDuration time.Duration
+
+	// Interval is how often the reconciler checks for lost and expired
+	// commands. If it is zero, a default of one minute is used.
+	Interval time.Duration
+
+	// LostWindow is how long after it was lost a command or execution is
+	// counted as lost, so that the count falls back to zero once no more
+	// are lost. If it is zero, a default of one day is used.
+	LostWindow time.Duration
+}
+
+// NewReconciler returns a reconciler for the commands in db.
+func NewReconciler(db *sql.DB) *Reconciler {
+	return &Reconciler{
+		DB: db,
+	}
+}
+
+func (r *Reconciler) leaseDuration() time.Duration {
+	if r.LeaseDuration > 0 {
+		return r.LeaseDuration
+	}
+	return defaultLeaseDuration
+}
+
+func (r *Reconciler) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return defaultReconcileInterval
+}
+
+func (r *Reconciler) lostWindow() time.Duration {
+	if r.LostWindow > 0 {
+		return r.LostWindow
+	}
+	return defaultLostWindow
+}
+
+// Run reconciles immediately and then periodically until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+	for {
+		if err := r.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			log.WithError(err).Errorln("Error reconciling running commands.")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+const loseExpiredQuery = `
+	UPDATE commands
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE status = $4 AND COALESCE(heartbeat_time, start_time) < $5 AND targets IS NULL
+	RETURNING id;
+`
+
+const expireQuery = `
+	UPDATE commands
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE status IN ($4, $5) AND expire_time <= $2
+	RETURNING id;
+`
+
+const runningRolloutsQuery = `
+	SELECT id
+	FROM commands
+	WHERE status = $1 AND targets IS NOT NULL;
+`
+
+const countLostQuery = `
+	SELECT
+		(SELECT count(*) FROM commands WHERE status = $1 AND end_time >= $2) +
+		(SELECT count(*) FROM executions WHERE status = $1 AND end_time >= $2);
+`
+
+const countOpenReviewsQuery = `
+	SELECT count(*)
+	FROM commands
+	WHERE break_glass_time IS NOT NULL AND break_glass_review_time IS NULL;
+`
+
+// Reconcile marks running commands and executions whose lease has expired
+// as LOST and commands which were not started before they expired as
+// EXPIRED, advances running rollouts, and updates the counts of commands
+// and executions lost within the lost window and of open break-glass
+// reviews.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	now := time.Now()
+	err := finalize(ctx, r.DB, loseExpiredQuery, pb.Status_LOST, now, expiredMessage, pb.Status_RUNNING, now.Add(-r.leaseDuration()))
+	if err != nil {
+		return err
+	}
+
+	err = loseExecutions(ctx, r.DB, loseExpiredExecutionsQuery, now, expiredMessage, pb.Status_RUNNING, now.Add(-r.leaseDuration()))
+	if err != nil {
+		return err
+	}
+	if err = r.advanceRollouts(ctx); err != nil {
+		return err
+	}
+
+	err = finalize(ctx, r.DB, expireQuery, pb.Status_EXPIRED, now, missedMessage, pb.Status_SUBMITTED, pb.Status_READY)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	err = r.DB.QueryRowContext(ctx, countLostQuery, pb.Status_LOST, now.Add(-r.lostWindow())).Scan(&count)
+	if err != nil {
+		return err
+	}
+	lostCommands.Set(float64(count))
+
+	err = r.DB.QueryRowContext(ctx, countOpenReviewsQuery).Scan(&count)
+	if err != nil {
+		return err
+	}
+	openBreakGlassReviews.Set(float64(count))
+	return nil
+}
+
+const loseClaimedQuery = `
+	UPDATE commands
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE status = $4 AND executor = $5 AND targets IS NULL
+	RETURNING id;
+`
+
+// recover marks commands which were running on the executor with the given
+// ID as LOST. It must only be called before the executor claims any
+// commands, when any such command was claimed by a previous process with
+// the same ID which can no longer be running it.
+func (e *Executor) recover(ctx context.Context, id string) error {
+	return finalize(ctx, e.DB, loseClaimedQuery, pb.Status_LOST, time.Now(), restartedMessage, pb.Status_RUNNING, id)
+}
+
+// finalize moves the commands selected by query to the terminal status s
+// with the given status message, and records their finish. The
+// parameters of query are s, now, message and args.
+func finalize(ctx context.Context, db *sql.DB, query string, s pb.Status, now time.Time, message string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, append([]interface{}{s, now, message}, args...)...)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		log.WithField("command", id).WithField("status", s).Warnln("Command finalized without running to completion.")
+		if err = recordFinish(ctx, tx, id, s, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// advanceRollouts advances every running rollout, in case an executor
+// stopped before it could do so, e.g., after recording an execution's result.
+func (r *Reconciler) advanceRollouts(ctx context.Context) error {
+	rows, err := r.DB.QueryContext(ctx, runningRolloutsQuery, pb.Status_RUNNING)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := advance(ctx, r.DB, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"context"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestReconcile(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(loseExpiredQuery).WithArgs(
+		pb.Status_LOST,
+		sqlmock.AnyArg(),
+		expiredMessage,
+		pb.Status_RUNNING,
+		sqlmock.AnyArg(),
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	expectFinish(mock, 1, pb.Status_LOST)
+	expectFinish(mock, 2, pb.Status_LOST)
+	mock.ExpectCommit()
+	mock.ExpectQuery(loseExpiredExecutionsQuery).WithArgs(
+		pb.Status_LOST,
+		sqlmock.AnyArg(),
+		expiredMessage,
+		pb.Status_RUNNING,
+		sqlmock.AnyArg(),
+	).WillReturnRows(sqlmock.NewRows([]string{"command_id"}))
+	mock.ExpectQuery(runningRolloutsQuery).WithArgs(pb.Status_RUNNING).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(expireQuery).WithArgs(
+		pb.Status_EXPIRED,
+		sqlmock.AnyArg(),
+		missedMessage,
+		pb.Status_SUBMITTED,
+		pb.Status_READY,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	expectFinish(mock, 3, pb.Status_EXPIRED)
+	mock.ExpectCommit()
+	mock.ExpectQuery(countLostQuery).WithArgs(pb.Status_LOST, sqlmock.AnyArg()).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(3),
+	)
+	mock.ExpectQuery(countOpenReviewsQuery).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(2),
+	)
+
+	r := NewReconciler(db)
+	if err := r.Reconcile(context.Background()); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+
+	if got := testutil.ToFloat64(lostCommands); got != 3 {
+		t.Errorf("Expected 3 lost commands; got %v", got)
+	}
+	if got := testutil.ToFloat64(openBreakGlassReviews); got != 2 {
+		t.Errorf("Expected 2 open break-glass reviews; got %v", got)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(loseClaimedQuery).WithArgs(
+		pb.Status_LOST,
+		sqlmock.AnyArg(),
+		restartedMessage,
+		pb.Status_RUNNING,
+		"executor-1",
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectFinish(mock, 1, pb.Status_LOST)
+	mock.ExpectCommit()
+
+	e := New(db)
+	if err := e.recover(context.Background(), "executor-1"); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// A rollout is a command with targets, which runs once on each agent they
+// match as a separate execution. An executor claims the command when it is
+// queued, as for any other command, and creates its executions. From then
+// on, the rollout is advanced whenever one of its executions finishes: more
+// executions are made ready for their agents to claim, up to the rollout's
+// parallelism, until every execution has finished or more have failed than
+// the rollout's failure threshold allows, and the status of the command is
+// then recorded from the results of its executions.
+
+const (
+	noAgentsMessage        = "No registered agent matched the targets of the rollout."
+	haltedMessage          = "The rollout was halted because too many executions failed."
+	canceledRolloutMessage = "The rollout was canceled before the execution started."
+)
+
+const claimRolloutQuery = `
+	UPDATE commands
+	SET (status, start_time, executor) = ($1, $2, $3)
+	WHERE id = (
+		SELECT id
+		FROM commands
+		WHERE status = $4
+			AND (schedule_time IS NULL AND run_request_time IS NOT NULL OR schedule_time <= $2)
+			AND (expire_time IS NULL OR expire_time > $2)
+			AND targets IS NOT NULL
+		ORDER BY COALESCE(schedule_time, run_request_time)
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, target_agents, target_selectors;
+`
+
+const createExecutionsQuery = `
+	INSERT INTO executions ("command_id", "agent_id", "status", "create_time")
+	SELECT $1, agent_id, $4, $5
+	FROM agents
+	WHERE 'agents/' || agent_id = ANY($2)
+		OR EXISTS (
+			SELECT 1
+			FROM jsonb_array_elements($3::jsonb) AS selector
+			WHERE labels @> selector.value
+		);
+`
+
+// startRollout claims the queued rollout which has been queued the longest,
+// creates an execution of it for each agent its targets match, and starts
+// the first of them. It returns false if no rollout is queued.
+func (e *Executor) startRollout(ctx context.Context) (bool, error) {
+	tx, err := e.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var id int64
+	var agents []string
+	var selectors []byte
+	err = tx.QueryRowContext(ctx, claimRolloutQuery, pb.Status_RUNNING, now, e.id(), pb.Status_READY).
+		Scan(&id, pq.Array(&agents), &selectors)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, createExecutionsQuery, id, pq.Array(agents), selectors, pb.Status_SUBMITTED, now)
+	if err != nil {
+		return false, err
+	}
+	if err = recordStart(ctx, tx, id, now); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.WithField("command", id).Infoln("Rollout started.")
+	return true, advance(ctx, e.DB, id)
+}
+
+const lockRolloutQuery = `
+	SELECT parallelism, failure_threshold, cancel_time IS NOT NULL
+	FROM commands
+	WHERE id = $1 AND status = $2 AND targets IS NOT NULL
+	FOR UPDATE;
+`
+
+const countExecutionsQuery = `
+	SELECT status, count(*)
+	FROM executions
+	WHERE command_id = $1
+	GROUP BY status;
+`
+
+const haltExecutionsQuery = `
+	UPDATE executions
+	SET (status, end_time, status_message) = ($2, $3, $4)
+	WHERE command_id = $1 AND status IN ($5, $6);
+`
+
+const startExecutionsQuery = `
+	UPDATE executions
+	SET status = $2
+	WHERE command_id = $1 AND agent_id IN (
+		SELECT agent_id
+		FROM executions
+		WHERE command_id = $1 AND status = $3
+		ORDER BY agent_id
+		LIMIT $4
+	);
+`
+
+const finishRolloutQuery = `
+	UPDATE commands
+	SET (status, end_time, status_message) = ($2, $3, $4)
+	WHERE id = $1;
+`
+
+// advance moves the running rollout with the given ID forward. If it has
+// been canceled, or more of its executions have failed than its failure
+// threshold allows, executions which have not started are CANCELED.
+// Otherwise, as many executions are made ready as its parallelism allows.
+// Once no execution remains to be run, the result of the rollout is
+// recorded and those waiting for it are notified.
+//
+// Calls are serialized by locking the command, and advance has no effect if
+// the command is not a running rollout, so it may be called whenever a
+// rollout may have changed.
+func advance(ctx context.Context, db *sql.DB, id int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parallelism, threshold sql.NullInt32
+	var canceled bool
+	err = tx.QueryRowContext(ctx, lockRolloutQuery, id, pb.Status_RUNNING).Scan(&parallelism, &threshold, &canceled)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	counts, err := countExecutions(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	halted := counts.failed() > int(threshold.Int32)
+	if canceled || halted {
+		message := haltedMessage
+		if canceled {
+			message = canceledRolloutMessage
+		}
+		_, err = tx.ExecContext(ctx, haltExecutionsQuery, id, pb.Status_CANCELED, now, message, pb.Status_SUBMITTED, pb.Status_READY)
+		if err != nil {
+			return err
+		}
+		counts[pb.Status_CANCELED] += counts[pb.Status_SUBMITTED] + counts[pb.Status_READY]
+		counts[pb.Status_SUBMITTED] = 0
+		counts[pb.Status_READY] = 0
+	} else if pending := counts[pb.Status_SUBMITTED]; pending > 0 {
+		n := pending
+		if p := int(parallelism.Int32); p > 0 && p-counts[pb.Status_READY]-counts[pb.Status_RUNNING] < n {
+			n = p - counts[pb.Status_READY] - counts[pb.Status_RUNNING]
+		}
+		if n > 0 {
+			_, err = tx.ExecContext(ctx, startExecutionsQuery, id, pb.Status_READY, pb.Status_SUBMITTED, n)
+			if err != nil {
+				return err
+			}
+			counts[pb.Status_SUBMITTED] -= n
+			counts[pb.Status_READY] += n
+
+			// The notification wakes the agents' sessions.
+			_, err = tx.ExecContext(ctx, notifyQuery, RunChannel, strconv.FormatInt(id, 10))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if counts[pb.Status_SUBMITTED]+counts[pb.Status_READY]+counts[pb.Status_RUNNING] == 0 {
+		s, message := counts.result(canceled, halted)
+		if _, err = tx.ExecContext(ctx, finishRolloutQuery, id, s, now, sql.NullString{String: message, Valid: message != ""}); err != nil {
+			return err
+		}
+		if err = recordFinish(ctx, tx, id, s, now); err != nil {
+			return err
+		}
+		log.WithField("command", id).WithField("status", s).Infoln("Rollout finished.")
+	}
+
+	return tx.Commit()
+}
+
+// executionCounts is the number of executions of a rollout with each status.
+type executionCounts map[pb.Status]int
+
+func countExecutions(ctx context.Context, tx *sql.Tx, id int64) (executionCounts, error) {
+	rows, err := tx.QueryContext(ctx, countExecutionsQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(executionCounts)
+	for rows.Next() {
+		var s pb.Status
+		var n int
+		if err := rows.Scan(&s, &n); err != nil {
+			return nil, err
+		}
+		counts[s] = n
+	}
+	return counts, rows.Err()
+}
+
+// failed returns the number of executions which did not succeed of their
+// own accord.
+func (c executionCounts) failed() int {
+	return c[pb.Status_ERROR] + c[pb.Status_TIMED_OUT] + c[pb.Status_LOST]
+}
+
+func (c executionCounts) total() int {
+	var n int
+	for _, v := range c {
+		n += v
+	}
+	return n
+}
+
+// result returns the status of a finished rollout and the reason for it.
+func (c executionCounts) result(canceled, halted bool) (pb.Status, string) {
+	switch {
+	case c.total() == 0:
+		return pb.Status_ERROR, noAgentsMessage
+	case canceled:
+		return pb.Status_CANCELED, fmt.Sprintf("The rollout was canceled after %d of %d executions succeeded.", c[pb.Status_SUCCESS], c.total())
+	case halted:
+		return pb.Status_ERROR, fmt.Sprintf("The rollout was halted after %d of %d executions failed.", c.failed(), c.total())
+	case c[pb.Status_SUCCESS] < c.total():
+		return pb.Status_ERROR, fmt.Sprintf("%d of %d executions failed.", c.total()-c[pb.Status_SUCCESS], c.total())
+	}
+	return pb.Status_SUCCESS, ""
+}
+
+const finishExecutionQuery = `
+	UPDATE executions
+	SET (status, end_time, std_out, std_err, exit_code, signal, start_error, user_cpu_us, system_cpu_us, max_rss_bytes, redactions) =
+		($3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $14)
+	WHERE command_id = $1 AND agent_id = $2 AND status = $13;
+`
+
+// finishExecution records the result of the execution of the rollout with
+// the given ID on the given agent, and advances the rollout.
+func (e *Executor) finishExecution(ctx context.Context, id int64, agentID string, s pb.Status, stdout, stderr *outputWriter, exit exitStatus) error {
+	stdout.Flush()
+	stderr.Flush()
+	res, err := e.DB.ExecContext(
+		ctx,
+		finishExecutionQuery,
+		id,
+		agentID,
+		s,
+		time.Now(),
+		stdout.Bytes(),
+		stderr.Bytes(),
+		exit.exitCode,
+		exit.signal,
+		exit.startError,
+		exit.userCPU,
+		exit.systemCPU,
+		exit.maxRSS,
+		pb.Status_RUNNING,
+		redactions(stdout, stderr),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("execution of command %d on agent %s is no longer running", id, agentID)
+	}
+
+	return advance(ctx, e.DB, id)
+}
+
+func executionName(id int64, agentID string) string {
+	return commandName(id) + "/executions/" + agentID
+}
+
+const claimExecutionQuery = `
+	UPDATE executions AS e
+	SET (status, start_time, heartbeat_time) = ($1, $2, $2)
+	FROM commands AS c
+	WHERE c.id = e.command_id AND (e.command_id, e.agent_id) = (
+		SELECT command_id, agent_id
+		FROM executions
+		WHERE agent_id = $3 AND status = $4
+		ORDER BY create_time
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING e.command_id, c.argv, c.catalog_entry, c.timeout_ms, c.inputs, c.env;
+`
+
+// claimExecution marks the ready execution on the agent with the given ID
+// which has been ready the longest as running and returns it, or nil if
+// none is ready.
+func (e *Executor) claimExecution(ctx context.Context, agentID string) (*job, error) {
+	var j job
+	var catalogEntry sql.NullString
+	var timeout sql.NullInt64
+	var inputs, env []byte
+	err := e.DB.QueryRowContext(ctx, claimExecutionQuery, pb.Status_RUNNING, time.Now(), agentID, pb.Status_READY).
+		Scan(&j.id, pq.Array(&j.argv), &catalogEntry, &timeout, &inputs, &env)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if j.inputs, err = unmarshalInputs(inputs); err != nil {
+		return nil, err
+	}
+	if j.env, _, err = unmarshalEnv(env, nil); err != nil {
+		return nil, err
+	}
+
+	j.agentID = agentID
+	j.catalogEntry = catalogEntry.String
+	j.timeout = time.Duration(timeout.Int64) * time.Millisecond
+	return &j, nil
+}
+
+const executionHeartbeatQuery = `
+	UPDATE executions
+	SET heartbeat_time = $2
+	WHERE agent_id = $1 AND status = $3;
+`
+
+const loseAgentExecutionsQuery = `
+	UPDATE executions
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE agent_id = $4 AND status = $5 AND command_id = ANY($6)
+	RETURNING command_id;
+`
+
+const loseExpiredExecutionsQuery = `
+	UPDATE executions
+	SET (status, end_time, status_message) = ($1, $2, $3)
+	WHERE status = $4 AND COALESCE(heartbeat_time, start_time) < $5
+	RETURNING command_id;
+`
+
+// loseExecutions marks the executions selected by query as LOST with the
+// given status message, and advances their rollouts. The parameters of query
+// are LOST, now, message and args.
+func loseExecutions(ctx context.Context, db *sql.DB, query string, now time.Time, message string, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query, append([]interface{}{pb.Status_LOST, now, message}, args...)...)
+	if err != nil {
+		return err
+	}
+	ids := make(map[int64]struct{})
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids[id] = struct{}{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id := range ids {
+		log.WithField("command", id).Warnln("Execution lost without running to completion.")
+		if err := advance(ctx, db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package executor
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// executionCountRows returns the result of countExecutionsQuery.
+func executionCountRows(counts map[pb.Status]int) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"status", "count"})
+	for s, n := range counts {
+		rows.AddRow(s, n)
+	}
+	return rows
+}
+
+func TestAdvance(t *testing.T) {
+	t.Run("Start executions up to parallelism", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(2, nil, false),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+			executionCountRows(map[pb.Status]int{pb.Status_SUBMITTED: 5, pb.Status_RUNNING: 1}),
+		)
+		mock.ExpectExec(startExecutionsQuery).WithArgs(1, pb.Status_READY, pb.Status_SUBMITTED, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(notifyQuery).WithArgs(RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Halt after failure threshold", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(1, 1, false),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+			executionCountRows(map[pb.Status]int{pb.Status_SUBMITTED: 2, pb.Status_ERROR: 1, pb.Status_LOST: 1, pb.Status_SUCCESS: 1}),
+		)
+		mock.ExpectExec(haltExecutionsQuery).WithArgs(
+			1,
+			pb.Status_CANCELED,
+			sqlmock.AnyArg(),
+			haltedMessage,
+			pb.Status_SUBMITTED,
+			pb.Status_READY,
+		).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(finishRolloutQuery).WithArgs(
+			1,
+			pb.Status_ERROR,
+			sqlmock.AnyArg(),
+			sql.NullString{String: "The rollout was halted after 2 of 5 executions failed.", Valid: true},
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFinish(mock, 1, pb.Status_ERROR)
+		mock.ExpectCommit()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Wait for running executions of canceled rollout", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(nil, nil, true),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+			executionCountRows(map[pb.Status]int{pb.Status_READY: 1, pb.Status_RUNNING: 1}),
+		)
+		mock.ExpectExec(haltExecutionsQuery).WithArgs(
+			1,
+			pb.Status_CANCELED,
+			sqlmock.AnyArg(),
+			canceledRolloutMessage,
+			pb.Status_SUBMITTED,
+			pb.Status_READY,
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Finish successful rollout", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(nil, nil, false),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+			executionCountRows(map[pb.Status]int{pb.Status_SUCCESS: 3}),
+		)
+		mock.ExpectExec(finishRolloutQuery).WithArgs(1, pb.Status_SUCCESS, sqlmock.AnyArg(), sql.NullString{}).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFinish(mock, 1, pb.Status_SUCCESS)
+		mock.ExpectCommit()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail rollout which matched no agents", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+			sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(nil, nil, false),
+		)
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(executionCountRows(nil))
+		mock.ExpectExec(finishRolloutQuery).WithArgs(
+			1,
+			pb.Status_ERROR,
+			sqlmock.AnyArg(),
+			sql.NullString{String: noAgentsMessage, Valid: true},
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectFinish(mock, 1, pb.Status_ERROR)
+		mock.ExpectCommit()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Ignore commands which are not running rollouts", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := advance(context.Background(), db, 1); err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestStartRollout(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	selectors := []byte(`[{"role":"database"}]`)
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimRolloutQuery).WithArgs(
+		pb.Status_RUNNING,
+		sqlmock.AnyArg(),
+		"executor-1",
+		pb.Status_READY,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "target_agents", "target_selectors"}).
+			AddRow(1, pq.Array([]string{"agents/web-host-1"}), selectors),
+	)
+	mock.ExpectExec(createExecutionsQuery).WithArgs(
+		1,
+		pq.Array([]string{"agents/web-host-1"}),
+		selectors,
+		pb.Status_SUBMITTED,
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(0, 3))
+	expectStart(mock, 1)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockRolloutQuery).WithArgs(1, pb.Status_RUNNING).WillReturnRows(
+		sqlmock.NewRows([]string{"parallelism", "failure_threshold", "canceled"}).AddRow(nil, nil, false),
+	)
+	mock.ExpectQuery(countExecutionsQuery).WithArgs(1).WillReturnRows(
+		executionCountRows(map[pb.Status]int{pb.Status_SUBMITTED: 3}),
+	)
+	mock.ExpectExec(startExecutionsQuery).WithArgs(1, pb.Status_READY, pb.Status_SUBMITTED, 3).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(notifyQuery).WithArgs(RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	e := &Executor{DB: db, ID: "executor-1"}
+	started, err := e.startRollout(context.Background())
+	if err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+	if !started {
+		t.Errorf("Expected rollout to start")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+// Package redact removes secrets from the output of commands before it is
+// stored.
+//
+// Output is redacted a line at a time by a Writer. Each line is matched
+// against the exact values of the secrets given to the command and against
+// the rules of a Redactor: regular expressions, including built-in rules for
+// well-known token formats. Each match is replaced by `[REDACTED:NAME]`,
+// where NAME is the name of the rule which matched, and the names of the
+// rules which matched are recorded.
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// MaxLineBytes is the length of the longest line held back until it is
+// complete. Longer lines are redacted in pieces of this length, so a match
+// which spans two pieces is missed.
+const MaxLineBytes = 64 << 10
+
+// MinSecretLineBytes is the length of the shortest line of a secret which
+// spans lines that is redacted on its own. Shorter lines, such as the
+// closing brace of a JSON credential, would redact every occurrence of
+// common text.
+const MinSecretLineBytes = 8
+
+// SecretPrefix prefixes the name of a secret to form the name of the rule
+// which matches its value.
+const SecretPrefix = "secret:"
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Rule matches text to be redacted.
+type Rule struct {
+	// Name identifies the rule in the text which replaces its matches.
+	Name string
+
+	// Pattern matches the text to be redacted. If it has a capturing group,
+	// only the text matched by the first group is replaced.
+	Pattern *regexp.Regexp
+
+	// End, if it is set, extends each match of Pattern through the next
+	// match of End, which may be on a later line. Until End matches, every
+	// line is redacted whole.
+	End *regexp.Regexp
+}
+
+// Builtin returns the built-in rules, which match private keys, JSON web
+// tokens, and AWS access keys.
+func Builtin() []Rule {
+	return []Rule{
+		{
+			Name:    "pem-private-key",
+			Pattern: regexp.MustCompile(`-----BEGIN[A-Z ]* PRIVATE KEY-----`),
+			End:     regexp.MustCompile(`-----END[A-Z ]* PRIVATE KEY-----`),
+		},
+		{
+			Name:    "jwt",
+			Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		},
+		{
+			Name:    "aws-access-key-id",
+			Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`),
+		},
+		{
+			Name:    "aws-secret-access-key",
+			Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`),
+		},
+	}
+}
+
+// Redactor redacts output according to its rules.
+type Redactor struct {
+	rules   []Rule
+	secrets []secret
+}
+
+// secret is the value of a secret, or one line of it, and the name of the
+// rule which matches it.
+type secret struct {
+	name  string
+	value []byte
+}
+
+// New returns a redactor which applies the given rules in order. It returns an
+// error if a rule is unnamed, is named the same as another, or has a pattern
+// which matches the empty string, which would redact nothing.
+func New(rules []Rule) (*Redactor, error) {
+	names := make(map[string]struct{})
+	for _, rule := range rules {
+		if !namePattern.MatchString(rule.Name) {
+			return nil, fmt.Errorf("invalid rule name %q", rule.Name)
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, fmt.Errorf("rule %q is defined more than once", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		if rule.Pattern == nil || rule.Pattern.MatchString("") {
+			return nil, fmt.Errorf("rule %q: pattern must not match the empty string", rule.Name)
+		}
+		if rule.End != nil && rule.End.MatchString("") {
+			return nil, fmt.Errorf("rule %q: end must not match the empty string", rule.Name)
+		}
+	}
+	return &Redactor{rules: rules}, nil
+}
+
+// Default returns a redactor which applies the built-in rules.
+func Default() *Redactor {
+	return &Redactor{rules: Builtin()}
+}
+
+// WithSecrets returns a redactor which also redacts the values of the given
+// secrets, by name, ahead of its rules. Each line of a value which spans
+// lines is redacted wherever it appears, unless it is shorter than
+// MinSecretLineBytes once surrounding whitespace is removed. A value on a
+// single line is redacted whatever its length.
+func (r *Redactor) WithSecrets(secrets map[string][]byte) *Redactor {
+	res := &Redactor{rules: r.rules}
+	for name, value := range secrets {
+		lines := bytes.Split(value, []byte("\n"))
+		for _, line := range lines {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(lines) > 1 {
+				line = bytes.TrimSpace(line)
+				if len(line) < MinSecretLineBytes {
+					continue
+				}
+			}
+			if len(line) > 0 {
+				res.secrets = append(res.secrets, secret{name: SecretPrefix + name, value: line})
+			}
+		}
+	}
+	// A value which contains another is redacted whole.
+	sort.Slice(res.secrets, func(i, j int) bool {
+		return len(res.secrets[i].value) > len(res.secrets[j].value)
+	})
+	return res
+}
+
+// NewWriter returns a Writer which writes to w what is written to it, once
+// redacted.
+func (r *Redactor) NewWriter(w io.Writer) *Writer {
+	return &Writer{r: r, w: w, fired: make(map[string]struct{})}
+}
+
+// Writer redacts what is written to it a line at a time.
+//
+// Each write is passed on as a single write of the complete lines it
+// finishes, once redacted; the rest is held until its line is complete or
+// Flush is called.
+type Writer struct {
+	r       *Redactor
+	w       io.Writer
+	pending []byte
+	fired   map[string]struct{}
+
+	// block is the rule spanning lines whose end has not been matched.
+	block *Rule
+}
+
+// Write implements io.Writer for *Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	n := bytes.LastIndexAny(w.pending, "\r\n") + 1
+	if len(w.pending)-n >= MaxLineBytes {
+		n = len(w.pending)
+	}
+	if n == 0 {
+		return len(p), nil
+	}
+
+	err := w.emit(w.pending[:n])
+	w.pending = w.pending[:copy(w.pending, w.pending[n:])]
+	return len(p), err
+}
+
+// Flush redacts and writes any incomplete line.
+func (w *Writer) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.emit(w.pending)
+	w.pending = w.pending[:0]
+	return err
+}
+
+// Fired returns the sorted names of the rules which have matched.
+func (w *Writer) Fired() []string {
+	res := make([]string, 0, len(w.fired))
+	for name := range w.fired {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// emit redacts and writes each line of data.
+func (w *Writer) emit(data []byte) error {
+	var out []byte
+	for len(data) > 0 {
+		n := bytes.IndexAny(data, "\r\n") + 1
+		if n == 0 {
+			n = len(data)
+		}
+		out = append(out, w.line(data[:n])...)
+		data = data[n:]
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(out)
+	return err
+}
+
+// line returns a line, including its terminator, once redacted.
+func (w *Writer) line(l []byte) []byte {
+	body := bytes.TrimRight(l, "\r\n")
+	term := l[len(body):]
+
+	if w.block != nil {
+		loc := w.block.End.FindIndex(body)
+		if loc == nil {
+			return nil
+		}
+		w.block = nil
+		body = body[loc[1]:]
+		if len(body) == 0 {
+			return nil
+		}
+	}
+
+	for _, s := range w.r.secrets {
+		if bytes.Contains(body, s.value) {
+			w.fired[s.name] = struct{}{}
+			body = bytes.ReplaceAll(body, s.value, placeholder(s.name))
+		}
+	}
+	for i := range w.r.rules {
+		body = w.replace(&w.r.rules[i], body)
+		// The rest of the line is within the block, and has been
+		// removed.
+		if w.block != nil {
+			break
+		}
+	}
+	res := make([]byte, 0, len(body)+len(term))
+	res = append(res, body...)
+	return append(res, term...)
+}
+
+// replace returns body with each match of rule replaced.
+func (w *Writer) replace(rule *Rule, body []byte) []byte {
+	var res []byte
+	for len(body) > 0 {
+		loc := rule.Pattern.FindSubmatchIndex(body)
+		if loc == nil {
+			break
+		}
+		start, end := loc[0], loc[1]
+		if len(loc) >= 4 && loc[2] >= 0 {
+			start, end = loc[2], loc[3]
+		}
+		if rule.End != nil {
+			e := rule.End.FindIndex(body[loc[1]:])
+			if e == nil {
+				w.block = rule
+				end = len(body)
+			} else {
+				end = loc[1] + e[1]
+			}
+		}
+		if end == start {
+			// The pattern, or its capturing group, matched the empty
+			// string here, which redacts nothing.
+			n := loc[1]
+			if n == 0 {
+				n = 1
+			}
+			res = append(res, body[:n]...)
+			body = body[n:]
+			continue
+		}
+
+		w.fired[rule.Name] = struct{}{}
+		res = append(res, body[:start]...)
+		res = append(res, placeholder(rule.Name)...)
+		body = body[end:]
+	}
+	return append(res, body...)
+}
+
+func placeholder(name string) []byte {
+	return []byte("[REDACTED:" + name + "]")
+}
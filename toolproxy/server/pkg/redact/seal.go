@@ -0,0 +1,79 @@
+package redact
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// KeySize is the size of the key of a Sealer, in bytes.
+const KeySize = 32
+
+// Sealer encrypts the original output of commands, so that it may be retained
+// without being readable by anyone with access to the database but not to the
+// key.
+//
+// Output is encrypted with AES-256-GCM. Each stream is bound to the command
+// and stream from which it came, so that it cannot be passed off as the output
+// of another.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer returns a Sealer which encrypts with the given key of KeySize
+// bytes.
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key is %d bytes; expected %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// LoadSealer returns a Sealer which encrypts with the key in the file at path.
+func LoadSealer(path string) (*Sealer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSealer(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Seal encrypts output written to a stream of the command with the given
+// resource name.
+func (s *Sealer) Seal(name string, stream pb.Stream, output []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(output)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, output, label(name, stream)), nil
+}
+
+// Open decrypts output sealed by Seal for the same command and stream.
+func (s *Sealer) Open(name string, stream pb.Stream, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed output is truncated")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, label(name, stream))
+}
+
+func label(name string, stream pb.Stream) []byte {
+	return []byte(name + ":" + stream.String())
+}
@@ -0,0 +1,40 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestSealer(t *testing.T) {
+	s, err := NewSealer(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	sealed, err := s.Seal("commands/1", pb.Stream_STDOUT, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("hunter2")) {
+		t.Errorf("Sealed output contains plaintext: %q", sealed)
+	}
+
+	output, err := s.Open("commands/1", pb.Stream_STDOUT, sealed)
+	if err != nil || string(output) != "hunter2" {
+		t.Errorf("Expected %q; got %q, %v", "hunter2", output, err)
+	}
+
+	// Output may not be passed off as that of another command or stream.
+	if _, err = s.Open("commands/2", pb.Stream_STDOUT, sealed); err == nil {
+		t.Errorf("Expected error opening output of another command")
+	}
+	if _, err = s.Open("commands/1", pb.Stream_STDERR, sealed); err == nil {
+		t.Errorf("Expected error opening output of another stream")
+	}
+
+	if _, err = NewSealer([]byte("short")); err == nil {
+		t.Errorf("Expected error for short key")
+	}
+}
@@ -0,0 +1,45 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+// rule is a rule given in the configuration.
+type rule struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+	End     string `mapstructure:"end"`
+}
+
+// FromViper loads a redactor from the `builtin` and `rules` keys of v. The
+// built-in rules are applied first unless `builtin` is false. Each of the
+// rules has a `name`, a `pattern`, and optionally an `end`.
+func FromViper(v *viper.Viper) (*Redactor, error) {
+	var rules []Rule
+	if !v.IsSet("builtin") || v.GetBool("builtin") {
+		rules = Builtin()
+	}
+
+	var configured []rule
+	if err := v.UnmarshalKey("rules", &configured); err != nil {
+		return nil, err
+	}
+	for _, r := range configured {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+		rule := Rule{Name: r.Name, Pattern: pattern}
+		if r.End != "" {
+			if rule.End, err = regexp.Compile(r.End); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return New(rules)
+}
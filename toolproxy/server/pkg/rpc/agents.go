@@ -0,0 +1,476 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z]([a-z0-9._/-]{0,61}[a-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?$`)
+)
+
+// parseAgentName returns the agent ID from an agent resource name.
+func parseAgentName(name string) (string, error) {
+	var collection, id string
+	u := urn.Parse(name)
+	if len(u.Parts) != 2 {
+		return "", fmt.Errorf("malformed agent name %q", name)
+	}
+	if err := u.Scan(&collection, &id); err != nil {
+		return "", err
+	}
+	if collection != "agents" || !toolIDPattern.MatchString(id) {
+		return "", fmt.Errorf("malformed agent name %q", name)
+	}
+	return id, nil
+}
+
+// validateLabels checks that every label key and value is well-formed.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("malformed label key %q", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("malformed value for label %q", k)
+		}
+	}
+	return nil
+}
+
+// parseSelector parses a label selector of the form `key=value[,key=value]`.
+func parseSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, term := range strings.Split(selector, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(term), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed selector term %q", term)
+		}
+		if _, ok := labels[k]; ok {
+			return nil, fmt.Errorf("duplicate selector key %q", k)
+		}
+		labels[k] = v
+	}
+	if err := validateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// resolveTarget returns the resource name of the agent a command targets and
+// the labels it selects agents by, in the form in which they are stored.
+// Neither is valid if the command runs on the tool proxy's own executors.
+func (s *Server) resolveTarget(ctx context.Context, target string) (sql.NullString, interface{}, error) {
+	if target == "" {
+		return sql.NullString{}, nil, nil
+	}
+
+	if strings.HasPrefix(target, "agents/") {
+		id, err := parseAgentName(target)
+		if err != nil {
+			return sql.NullString{}, nil, status.Errorf(codes.InvalidArgument, "Malformed agent name.")
+		}
+		_, err = s.getAgent(ctx, s.DB, id)
+		if status.Code(err) == codes.NotFound {
+			return sql.NullString{}, nil, status.Errorf(codes.InvalidArgument, "Target agent not found.")
+		} else if err != nil {
+			return sql.NullString{}, nil, err
+		}
+		return sql.NullString{String: target, Valid: true}, nil, nil
+	}
+
+	labels, err := parseSelector(target)
+	if err != nil {
+		return sql.NullString{}, nil, status.Errorf(codes.InvalidArgument, "Invalid target: %v.", err)
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return sql.NullString{}, nil, status.Errorf(codes.InvalidArgument, "Invalid target.")
+	}
+	return sql.NullString{}, data, nil
+}
+
+// validatePrincipal checks that p is of the form `object_type:object_id`.
+func validatePrincipal(p string) error {
+	t, id, ok := strings.Cut(p, ":")
+	if !ok || t == "" || id == "" {
+		return fmt.Errorf("principal must be of the form object_type:object_id")
+	}
+	return nil
+}
+
+// unmarshalLabels decodes stored agent labels.
+func unmarshalLabels(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+const getAgentQuery = `
+	SELECT description, labels, principal, create_time, update_time, last_seen_time
+	FROM agents
+	WHERE agent_id = $1;
+`
+
+// GetAgent implements ToolProxy for Server.
+func (s *Server) GetAgent(ctx context.Context, r *pb.GetAgentRequest) (*pb.Agent, error) {
+	id, err := parseAgentName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed agent name.")
+	}
+
+	return s.getAgent(ctx, s.DB, id)
+}
+
+// getAgent reads the agent with the given ID using q.
+func (s *Server) getAgent(ctx context.Context, q queryer, id string) (*pb.Agent, error) {
+	var description sql.NullString
+	var labels []byte
+	var principal string
+	var createTime, updateTime, lastSeenTime sql.NullTime
+	err := q.QueryRowContext(ctx, getAgentQuery, id).Scan(
+		&description,
+		&labels,
+		&principal,
+		&createTime,
+		&updateTime,
+		&lastSeenTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Agent not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting agent from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	labelMap, err := unmarshalLabels(labels)
+	if err != nil {
+		log.WithError(err).Errorln("Error decoding agent labels.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	return &pb.Agent{
+		Name:         "agents/" + id,
+		Description:  unwrapstring(description),
+		Labels:       labelMap,
+		Principal:    principal,
+		CreateTime:   timestamp(createTime),
+		UpdateTime:   timestamp(updateTime),
+		LastSeenTime: timestamp(lastSeenTime),
+	}, nil
+}
+
+const createAgentQuery = `
+	INSERT INTO agents ("agent_id", "description", "labels", "principal", "create_time", "update_time")
+	VALUES ($1, $2, $3, $4, $5, $5);
+`
+
+// CreateAgent implements ToolProxy for Server.
+func (s *Server) CreateAgent(ctx context.Context, r *pb.CreateAgentRequest) (*pb.Agent, error) {
+	if !toolIDPattern.MatchString(r.GetAgentId()) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed agent ID.")
+	}
+
+	a := r.GetAgent()
+	if err := validateLabels(a.GetLabels()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid labels: %v.", err)
+	}
+	if err := validatePrincipal(a.GetPrincipal()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid principal: %v.", err)
+	}
+
+	labels, err := json.Marshal(a.GetLabels())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid labels.")
+	}
+
+	createTime := time.Now()
+	_, err = s.DB.ExecContext(
+		ctx,
+		createAgentQuery,
+		r.GetAgentId(),
+		a.GetDescription(),
+		labels,
+		a.GetPrincipal(),
+		createTime,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return nil, status.Errorf(codes.AlreadyExists, "Agent already exists.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error saving agent to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.Agent{
+		Name:        "agents/" + r.GetAgentId(),
+		Description: a.GetDescription(),
+		Labels:      a.GetLabels(),
+		Principal:   a.GetPrincipal(),
+		CreateTime:  timestamppb.New(createTime),
+		UpdateTime:  timestamppb.New(createTime),
+	}, nil
+}
+
+const updateAgentQuery = `
+	UPDATE agents
+	SET (description, labels, principal, update_time) = ($2, $3, $4, $5)
+	WHERE agent_id = $1;
+`
+
+// UpdateAgent implements ToolProxy for Server.
+func (s *Server) UpdateAgent(ctx context.Context, r *pb.UpdateAgentRequest) (*pb.Agent, error) {
+	id, err := parseAgentName(r.GetAgent().GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed agent name.")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	a, err := s.getAgent(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := r.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"description", "labels", "principal"}
+	}
+	for _, v := range paths {
+		switch v {
+		case "description":
+			a.Description = r.GetAgent().GetDescription()
+		case "labels":
+			a.Labels = r.GetAgent().GetLabels()
+		case "principal":
+			a.Principal = r.GetAgent().GetPrincipal()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Field %q cannot be updated.", v)
+		}
+	}
+
+	if err = validateLabels(a.GetLabels()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid labels: %v.", err)
+	}
+	if err = validatePrincipal(a.GetPrincipal()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid principal: %v.", err)
+	}
+
+	labels, err := json.Marshal(a.GetLabels())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid labels.")
+	}
+
+	updateTime := time.Now()
+	_, err = tx.ExecContext(
+		ctx,
+		updateAgentQuery,
+		id,
+		a.GetDescription(),
+		labels,
+		a.GetPrincipal(),
+		updateTime,
+	)
+	if err != nil {
+		log.WithError(err).Errorln("Error updating agent.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing agent update.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	a.UpdateTime = timestamppb.New(updateTime)
+	return a, nil
+}
+
+const deleteAgentQuery = `
+	DELETE FROM agents
+	WHERE agent_id = $1;
+`
+
+// DeleteAgent implements ToolProxy for Server.
+func (s *Server) DeleteAgent(ctx context.Context, r *pb.DeleteAgentRequest) (*emptypb.Empty, error) {
+	id, err := parseAgentName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed agent name.")
+	}
+
+	res, err := s.DB.ExecContext(ctx, deleteAgentQuery, id)
+	if err != nil {
+		log.WithError(err).Errorln("Error deleting agent.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+	if rows == 0 {
+		return nil, status.Errorf(codes.NotFound, "Agent not found.")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+const listAgentsQuery = `
+	SELECT agent_id, description, labels, principal, create_time, update_time, last_seen_time
+	FROM agents
+	WHERE agent_id > $1
+	ORDER BY agent_id
+	LIMIT $2;
+`
+
+// ListAgents implements ToolProxy for Server.
+func (s *Server) ListAgents(ctx context.Context, r *pb.ListAgentsRequest) (*pb.ListAgentsResponse, error) {
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	after := r.GetPageToken()
+	if after != "" && !toolIDPattern.MatchString(after) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+	}
+
+	// One more agent than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listAgentsQuery, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing agents.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var agents []*pb.Agent
+	for rows.Next() {
+		if len(agents) == limit {
+			more = true
+			break
+		}
+
+		var description sql.NullString
+		var labels []byte
+		var principal string
+		var createTime, updateTime, lastSeenTime sql.NullTime
+		err = rows.Scan(
+			&after,
+			&description,
+			&labels,
+			&principal,
+			&createTime,
+			&updateTime,
+			&lastSeenTime,
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		labelMap, err := unmarshalLabels(labels)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		agents = append(agents, &pb.Agent{
+			Name:         "agents/" + after,
+			Description:  unwrapstring(description),
+			Labels:       labelMap,
+			Principal:    principal,
+			CreateTime:   timestamp(createTime),
+			UpdateTime:   timestamp(updateTime),
+			LastSeenTime: timestamp(lastSeenTime),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing agents.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = after
+	}
+
+	return &pb.ListAgentsResponse{
+		Agents:        agents,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// Connect implements ToolProxy for Server.
+func (s *Server) Connect(stream pb.ToolProxy_ConnectServer) error {
+	ctx := stream.Context()
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	m, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	hello := m.GetHello()
+	if hello == nil {
+		return status.Errorf(codes.InvalidArgument, "The first message must identify the agent.")
+	}
+
+	id, err := parseAgentName(hello.GetName())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Malformed agent name.")
+	}
+	agent, err := s.getAgent(ctx, s.DB, id)
+	if err != nil {
+		return err
+	}
+	if agent.GetPrincipal() != caller.String() {
+		return status.Errorf(codes.PermissionDenied, "The caller may not connect as this agent.")
+	}
+	if hello.GetCapacity() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "Agent capacity must be positive.")
+	}
+
+	if s.Executor == nil {
+		return status.Errorf(codes.Unavailable, "This server does not run commands.")
+	}
+
+	log.WithField("agent", agent.GetName()).Infoln("Agent connected.")
+	err = s.Executor.ServeAgent(agent.GetName(), agent.GetLabels(), int(hello.GetCapacity()), stream)
+	log.WithError(err).WithField("agent", agent.GetName()).Infoln("Agent disconnected.")
+	if err == io.EOF || ctx.Err() != nil {
+		return nil
+	} else if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Unavailable, "Internal server error.")
+}
@@ -0,0 +1,267 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels, err := parseSelector("role=database, region=us-east-1")
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(labels) != 2 || labels["role"] != "database" || labels["region"] != "us-east-1" {
+		t.Errorf("Bad labels: %v", labels)
+	}
+
+	for _, selector := range []string{"role", "role=", "=database", "role=a,role=b", "Role=database"} {
+		if _, err := parseSelector(selector); err == nil {
+			t.Errorf("Expected error parsing %q; got nil", selector)
+		}
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	t.Run("Target agent by name", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getAgentQuery).WithArgs("db-host-1").WillReturnRows(
+			sqlmock.NewRows([]string{"description", "labels", "principal", "create_time", "update_time", "last_seen_time"}).
+				AddRow(nil, []byte(`{}`), "service-accounts:db-host-1", time.Time{}, time.Time{}, nil),
+		)
+
+		s := &Server{DB: db}
+		agent, selector, err := s.resolveTarget(context.Background(), "agents/db-host-1")
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if agent != (sql.NullString{String: "agents/db-host-1", Valid: true}) || selector != nil {
+			t.Errorf("Bad target: %v, %v", agent, selector)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject unknown agent", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getAgentQuery).WithArgs("db-host-1").WillReturnError(sql.ErrNoRows)
+
+		s := &Server{DB: db}
+		_, _, err = s.resolveTarget(context.Background(), "agents/db-host-1")
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+
+	t.Run("Target agents by label", func(t *testing.T) {
+		s := &Server{}
+		agent, selector, err := s.resolveTarget(context.Background(), "role=database")
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if agent.Valid || string(selector.([]byte)) != `{"role":"database"}` {
+			t.Errorf("Bad target: %v, %s", agent, selector)
+		}
+	})
+}
+
+func TestCreateAgent(t *testing.T) {
+	t.Run("Successfully create agent", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectExec(createAgentQuery).WithArgs(
+			"db-host-1",
+			"",
+			[]byte(`{"role":"database"}`),
+			"service-accounts:db-host-1",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		s := &Server{DB: db}
+		res, err := s.CreateAgent(context.Background(), &pb.CreateAgentRequest{
+			Agent: &pb.Agent{
+				Labels:    map[string]string{"role": "database"},
+				Principal: "service-accounts:db-host-1",
+			},
+			AgentId: "db-host-1",
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if res.GetName() != "agents/db-host-1" {
+			t.Errorf("Expected agents/db-host-1; got %v", res.GetName())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject malformed principal", func(t *testing.T) {
+		s := &Server{}
+		_, err := s.CreateAgent(context.Background(), &pb.CreateAgentRequest{
+			Agent:   &pb.Agent{Principal: "db-host-1"},
+			AgentId: "db-host-1",
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+}
+
+// fakeConnectServer is an agent connection which sends the given messages.
+type fakeConnectServer struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages []*pb.AgentMessage
+}
+
+func (s *fakeConnectServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeConnectServer) Send(*pb.ServerMessage) error {
+	return nil
+}
+
+func (s *fakeConnectServer) Recv() (*pb.AgentMessage, error) {
+	if len(s.messages) == 0 {
+		return nil, status.Errorf(codes.Canceled, "Stream closed.")
+	}
+	m := s.messages[0]
+	s.messages = s.messages[1:]
+	return m, nil
+}
+
+func TestConnect(t *testing.T) {
+	hello := &pb.AgentMessage{
+		Message: &pb.AgentMessage_Hello{Hello: &pb.AgentHello{Name: "agents/db-host-1", Capacity: 1}},
+	}
+
+	t.Run("Require hello first", func(t *testing.T) {
+		s := &Server{}
+		err := s.Connect(&fakeConnectServer{
+			ctx: contextWithSubject("service-accounts", "db-host-1"),
+			messages: []*pb.AgentMessage{
+				{Message: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.AgentHeartbeat{}}},
+			},
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+
+	t.Run("Reject other principals", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getAgentQuery).WithArgs("db-host-1").WillReturnRows(
+			sqlmock.NewRows([]string{"description", "labels", "principal", "create_time", "update_time", "last_seen_time"}).
+				AddRow(nil, []byte(`{}`), "service-accounts:db-host-1", time.Time{}, time.Time{}, nil),
+		)
+
+		s := &Server{DB: db}
+		err = s.Connect(&fakeConnectServer{
+			ctx:      contextWithSubject("service-accounts", "web-host-1"),
+			messages: []*pb.AgentMessage{hello},
+		})
+		if status.Convert(err).Code() != codes.PermissionDenied {
+			t.Errorf("Expected grpc status %v; got %v", codes.PermissionDenied, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestListAgents(t *testing.T) {
+	columns := []string{"agent_id", "description", "labels", "principal", "create_time", "update_time", "last_seen_time"}
+	testCases := []struct {
+		name      string
+		pageSize  int32
+		limit     int
+		ids       []string
+		code      codes.Code
+		agents    int
+		nextToken string
+	}{
+		{
+			name:   "Default page size",
+			limit:  defaultPageSize + 1,
+			ids:    []string{"db-host-1"},
+			agents: 1,
+		},
+		{
+			name:      "Another page follows",
+			pageSize:  1,
+			limit:     2,
+			ids:       []string{"db-host-1", "db-host-2"},
+			agents:    1,
+			nextToken: "db-host-1",
+		},
+		{
+			name:     "Negative page size",
+			pageSize: -1,
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.code == codes.OK {
+				rows := sqlmock.NewRows(columns)
+				for _, id := range tc.ids {
+					rows.AddRow(id, nil, []byte(`{"role":"db"}`), "users:"+id, nil, nil, nil)
+				}
+				mock.ExpectQuery(listAgentsQuery).WithArgs("", tc.limit).WillReturnRows(rows)
+			}
+
+			s := &Server{DB: db}
+			res, err := s.ListAgents(context.Background(), &pb.ListAgentsRequest{PageSize: tc.pageSize})
+			if status.Code(err) != tc.code {
+				t.Fatalf("Expected %v; got %v", tc.code, err)
+			}
+
+			if len(res.GetAgents()) != tc.agents {
+				t.Errorf("Expected %d agents; got %d", tc.agents, len(res.GetAgents()))
+			}
+			if res.GetNextPageToken() != tc.nextToken {
+				t.Errorf("Expected next page token %q; got %q", tc.nextToken, res.GetNextPageToken())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
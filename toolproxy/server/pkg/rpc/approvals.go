@@ -0,0 +1,317 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const lockCommandQuery = `
+	SELECT issuer, status, required_approvals
+	FROM commands
+	WHERE id = $1
+	FOR UPDATE;
+`
+
+// upsertApprovalQuery records an approver's decision, replacing any earlier
+// decision of theirs, and returns whether the replaced decision overrode the
+// preview.
+const upsertApprovalQuery = `
+	WITH previous AS (
+		SELECT override_preview
+		FROM approvals
+		WHERE command_id = $1 AND approver = $2
+	)
+	INSERT INTO approvals ("command_id", "approver", "decision", "comment", "create_time", "override_preview")
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (command_id, approver)
+	DO UPDATE SET (decision, comment, create_time, override_preview) = ($3, $4, $5, $6)
+	RETURNING approvals.id, COALESCE((SELECT override_preview FROM previous), false);
+`
+
+const countApprovalsQuery = `
+	SELECT
+		count(*) FILTER (WHERE decision = $2),
+		count(*) FILTER (WHERE decision = $3)
+	FROM approvals
+	WHERE command_id = $1;
+`
+
+const setCommandStatusQuery = `
+	UPDATE commands
+	SET (status, update_time) = ($2, $3)
+	WHERE id = $1;
+`
+
+// overridePreviewQuery records that the failed preview of a command was
+// overridden. It changes no rows unless the preview has failed.
+const overridePreviewQuery = `
+	UPDATE commands
+	SET (preview_overrider, preview_overrider_display_name, preview_override_time) = ($2, $3, $4)
+	WHERE id = $1 AND preview_state = $5;
+`
+
+// withdrawOverrideQuery clears the override of the preview of a command
+// unless an approval of the command still overrides it.
+const withdrawOverrideQuery = `
+	UPDATE commands
+	SET (preview_overrider, preview_overrider_display_name, preview_override_time) = (NULL, NULL, NULL)
+	WHERE id = $1 AND NOT EXISTS (
+		SELECT 1
+		FROM approvals
+		WHERE command_id = $1 AND decision = $2 AND override_preview
+	);
+`
+
+const clearApprovalsQuery = `
+	DELETE FROM approvals
+	WHERE command_id = $1;
+`
+
+// ApproveCommand implements ToolProxy for Server.
+func (s *Server) ApproveCommand(ctx context.Context, r *pb.ApproveCommandRequest) (*pb.Approval, error) {
+	return s.decide(ctx, r.GetName(), pb.Decision_APPROVED, r.GetComment(), r.GetOverridePreview())
+}
+
+// DenyCommand implements ToolProxy for Server.
+func (s *Server) DenyCommand(ctx context.Context, r *pb.DenyCommandRequest) (*pb.Approval, error) {
+	return s.decide(ctx, r.GetName(), pb.Decision_DENIED, r.GetComment(), false)
+}
+
+// decide records the caller's decision on a command and updates the status
+// of the command to reflect the approvals it now has. If overridePreview is
+// set, the command may run although its preview failed. If the caller
+// overrode the preview before, it is no longer overridden unless another
+// approver also overrode it.
+func (s *Server) decide(ctx context.Context, name string, decision pb.Decision, comment string, overridePreview bool) (*pb.Approval, error) {
+	var id int64
+	err := urn.Parse(name).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	approver := caller.String()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	var issuer string
+	var statusID int32
+	var requiredApprovals sql.NullInt32
+	err = tx.QueryRowContext(ctx, lockCommandQuery, id).Scan(&issuer, &statusID, &requiredApprovals)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Command not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting command from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if issuer == approver {
+		return nil, status.Errorf(codes.PermissionDenied, "The issuer of a command may not approve or deny it.")
+	}
+
+	cmdStatus := pb.Status(statusID)
+	if cmdStatus != pb.Status_SUBMITTED && cmdStatus != pb.Status_READY {
+		return nil, status.Errorf(codes.FailedPrecondition, "Only commands which have not been run may be approved or denied.")
+	}
+
+	createTime := time.Now()
+	var approvalID int64
+	var overrode bool
+	err = tx.QueryRowContext(
+		ctx,
+		upsertApprovalQuery,
+		id,
+		approver,
+		decision,
+		comment,
+		createTime,
+		overridePreview,
+	).Scan(&approvalID, &overrode)
+	if err != nil {
+		log.WithError(err).Errorln("Error saving approval to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	action := pb.Action_ACTION_APPROVE
+	if decision == pb.Decision_DENIED {
+		action = pb.Action_ACTION_DENY
+	}
+	if err = recordEvent(ctx, tx, id, action, caller, createTime, comment); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if overridePreview {
+		res, err := tx.ExecContext(
+			ctx,
+			overridePreviewQuery,
+			id,
+			approver,
+			caller.DisplayName,
+			createTime,
+			pb.PreviewState_PREVIEW_FAILED,
+		)
+		if err != nil {
+			log.WithError(err).Errorln("Error overriding preview.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+		if rows, err := res.RowsAffected(); err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		} else if rows == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "Only a preview which has failed may be overridden.")
+		}
+
+		if err = recordEvent(ctx, tx, id, pb.Action_ACTION_OVERRIDE_PREVIEW, caller, createTime, comment); err != nil {
+			log.WithError(err).Errorln("Error recording event.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	if overrode && !overridePreview {
+		_, err = tx.ExecContext(ctx, withdrawOverrideQuery, id, pb.Decision_APPROVED)
+		if err != nil {
+			log.WithError(err).Errorln("Error withdrawing preview override.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	var approvals, denials int
+	err = tx.QueryRowContext(
+		ctx,
+		countApprovalsQuery,
+		id,
+		pb.Decision_APPROVED,
+		pb.Decision_DENIED,
+	).Scan(&approvals, &denials)
+	if err != nil {
+		log.WithError(err).Errorln("Error counting approvals.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	newStatus := pb.Status_SUBMITTED
+	if denials == 0 && approvals >= s.requiredApprovals(requiredApprovals) {
+		newStatus = pb.Status_READY
+	}
+	if newStatus != cmdStatus {
+		_, err = tx.ExecContext(ctx, setCommandStatusQuery, id, newStatus, createTime)
+		if err != nil {
+			log.WithError(err).Errorln("Error updating command status.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing approval.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.Approval{
+		Name:            fmt.Sprintf("commands/%d/approvals/%d", id, approvalID),
+		Approver:        approver,
+		Decision:        decision,
+		Comment:         comment,
+		CreateTime:      timestamppb.New(createTime),
+		OverridePreview: overridePreview,
+	}, nil
+}
+
+const listApprovalsQuery = `
+	SELECT id, approver, decision, comment, create_time, override_preview
+	FROM approvals
+	WHERE command_id = $1 AND id > $2
+	ORDER BY id
+	LIMIT $3;
+`
+
+// ListApprovals implements ToolProxy for Server.
+func (s *Server) ListApprovals(ctx context.Context, r *pb.ListApprovalsRequest) (*pb.ListApprovalsResponse, error) {
+	var commandID int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &commandID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	var after int64
+	if r.GetPageToken() != "" {
+		after, err = strconv.ParseInt(r.GetPageToken(), 10, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+		}
+	}
+
+	// One more approval than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listApprovalsQuery, commandID, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing approvals.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var approvals []*pb.Approval
+	for rows.Next() {
+		if len(approvals) == limit {
+			more = true
+			break
+		}
+
+		var approver string
+		var decision int32
+		var comment sql.NullString
+		var createTime sql.NullTime
+		var overridePreview bool
+		err = rows.Scan(&after, &approver, &decision, &comment, &createTime, &overridePreview)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		approvals = append(approvals, &pb.Approval{
+			Name:            fmt.Sprintf("commands/%d/approvals/%d", commandID, after),
+			Approver:        approver,
+			Decision:        pb.Decision(decision),
+			Comment:         unwrapstring(comment),
+			CreateTime:      timestamp(createTime),
+			OverridePreview: overridePreview,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing approvals.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = strconv.FormatInt(after, 10)
+	}
+
+	return &pb.ListApprovalsResponse{
+		Approvals:     approvals,
+		NextPageToken: nextPageToken,
+	}, nil
+}
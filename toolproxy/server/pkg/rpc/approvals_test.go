@@ -0,0 +1,368 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestApproveCommand(t *testing.T) {
+	t.Run("Approval meeting threshold marks command ready", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WithArgs(
+			1,
+			"users:bob",
+			pb.Decision_APPROVED,
+			"lgtm",
+			sqlmock.AnyArg(),
+			false,
+		).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(7, false))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_APPROVE,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(countApprovalsQuery).WithArgs(
+			1,
+			pb.Decision_APPROVED,
+			pb.Decision_DENIED,
+		).WillReturnRows(sqlmock.NewRows([]string{"approvals", "denials"}).AddRow(2, 0))
+		mock.ExpectExec(setCommandStatusQuery).WithArgs(
+			1,
+			pb.Status_READY,
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 2}
+		approval, err := s.ApproveCommand(contextWithSubject("users", "bob"), &pb.ApproveCommandRequest{
+			Name:    "commands/1",
+			Comment: "lgtm",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if approval.GetName() != "commands/1/approvals/7" {
+			t.Errorf("Expected commands/1/approvals/7; got %v", approval.GetName())
+		}
+
+		if approval.GetApprover() != "users:bob" {
+			t.Errorf("Expected approver users:bob; got %v", approval.GetApprover())
+		}
+
+		if approval.GetDecision() != pb.Decision_APPROVED {
+			t.Errorf("Expected %v; got %v", pb.Decision_APPROVED, approval.GetDecision())
+		}
+	})
+
+	t.Run("Approval below threshold leaves command submitted", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WithArgs(
+			1,
+			"users:bob",
+			pb.Decision_APPROVED,
+			"",
+			sqlmock.AnyArg(),
+			false,
+		).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(7, false))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_APPROVE,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(countApprovalsQuery).WithArgs(
+			1,
+			pb.Decision_APPROVED,
+			pb.Decision_DENIED,
+		).WillReturnRows(sqlmock.NewRows([]string{"approvals", "denials"}).AddRow(1, 0))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 2}
+		_, err = s.ApproveCommand(contextWithSubject("users", "bob"), &pb.ApproveCommandRequest{
+			Name: "commands/1",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Issuer may not approve own command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectRollback()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		approval, err := s.ApproveCommand(contextWithSubject("users", "alice"), &pb.ApproveCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.PermissionDenied {
+			t.Errorf("Expected grpc status %v; got %v", codes.PermissionDenied, status.Convert(err).Code())
+		}
+
+		if approval != nil {
+			t.Errorf("Approval should be nil on error.")
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail to approve completed command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUCCESS, nil),
+		)
+		mock.ExpectRollback()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		_, err = s.ApproveCommand(contextWithSubject("users", "bob"), &pb.ApproveCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail to approve without identity", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		_, err = s.ApproveCommand(context.Background(), &pb.ApproveCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.Unauthenticated {
+			t.Errorf("Expected grpc status %v; got %v", codes.Unauthenticated, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestDenyCommand(t *testing.T) {
+	t.Run("Denial returns ready command to submitted", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_READY, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WithArgs(
+			1,
+			"users:carol",
+			pb.Decision_DENIED,
+			"wrong cluster",
+			sqlmock.AnyArg(),
+			false,
+		).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(8, false))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_DENY,
+			"users",
+			"carol",
+			"carol",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(countApprovalsQuery).WithArgs(
+			1,
+			pb.Decision_APPROVED,
+			pb.Decision_DENIED,
+		).WillReturnRows(sqlmock.NewRows([]string{"approvals", "denials"}).AddRow(2, 1))
+		mock.ExpectExec(setCommandStatusQuery).WithArgs(
+			1,
+			pb.Status_SUBMITTED,
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 2}
+		approval, err := s.DenyCommand(contextWithSubject("users", "carol"), &pb.DenyCommandRequest{
+			Name:    "commands/1",
+			Comment: "wrong cluster",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if approval.GetDecision() != pb.Decision_DENIED {
+			t.Errorf("Expected %v; got %v", pb.Decision_DENIED, approval.GetDecision())
+		}
+	})
+
+	t.Run("Fail persisting denial to database", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WillReturnError(errors.New("database internal error"))
+		mock.ExpectRollback()
+
+		s := &Server{DB: db, RequiredApprovals: 2}
+		_, err = s.DenyCommand(contextWithSubject("users", "carol"), &pb.DenyCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.Unavailable {
+			t.Errorf("Expected grpc status %v; got %v", codes.Unavailable, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestListApprovals(t *testing.T) {
+	columns := []string{"id", "approver", "decision", "comment", "create_time", "override_preview"}
+	testCases := []struct {
+		name      string
+		pageSize  int32
+		limit     int
+		rows      int
+		code      codes.Code
+		approvals int
+		nextToken string
+	}{
+		{
+			name:      "Default page size",
+			limit:     defaultPageSize + 1,
+			rows:      2,
+			approvals: 2,
+		},
+		{
+			name:      "Another page follows",
+			pageSize:  2,
+			limit:     3,
+			rows:      3,
+			approvals: 2,
+			nextToken: "2",
+		},
+		{
+			name:      "Last page is full",
+			pageSize:  2,
+			limit:     3,
+			rows:      2,
+			approvals: 2,
+		},
+		{
+			name:     "Negative page size",
+			pageSize: -1,
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "Page size exceeds maximum",
+			pageSize: maxPageSize + 1,
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.code == codes.OK {
+				rows := sqlmock.NewRows(columns)
+				for i := 1; i <= tc.rows; i++ {
+					rows.AddRow(i, "users:bob", pb.Decision_APPROVED, nil, nil, false)
+				}
+				mock.ExpectQuery(listApprovalsQuery).WithArgs(1, 0, tc.limit).WillReturnRows(rows)
+			}
+
+			s := &Server{DB: db}
+			res, err := s.ListApprovals(context.Background(), &pb.ListApprovalsRequest{
+				Parent:   "commands/1",
+				PageSize: tc.pageSize,
+			})
+			if status.Code(err) != tc.code {
+				t.Fatalf("Expected %v; got %v", tc.code, err)
+			}
+
+			if len(res.GetApprovals()) != tc.approvals {
+				t.Errorf("Expected %d approvals; got %d", tc.approvals, len(res.GetApprovals()))
+			}
+			if res.GetNextPageToken() != tc.nextToken {
+				t.Errorf("Expected next page token %q; got %q", tc.nextToken, res.GetNextPageToken())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/artifacts"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// artifactChunkSize is the greatest amount of content sent in each chunk by
+// DownloadArtifact.
+const artifactChunkSize = 64 << 10
+
+var artifactIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validateArtifactPaths returns an error if the artifact paths of a command
+// are invalid, or if they are declared by a command which runs on agents.
+func validateArtifactPaths(paths []string, target string, targets []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if target != "" || len(targets) > 0 {
+		return status.Errorf(codes.InvalidArgument, "Artifacts may not be declared by commands which run on agents.")
+	}
+	if err := artifacts.Check(paths); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid artifact paths: %v.", err)
+	}
+	return nil
+}
+
+// nullArtifactPaths returns artifact paths in the form in which they are
+// stored.
+func nullArtifactPaths(paths []string) interface{} {
+	if len(paths) == 0 {
+		return nil
+	}
+	return pq.Array(paths)
+}
+
+// parseArtifactName returns the command ID and artifact ID from an artifact
+// resource name.
+func parseArtifactName(name string) (int64, string, error) {
+	var id int64
+	var collection, artifactID string
+	u := urn.Parse(name)
+	if len(u.Parts) != 4 {
+		return 0, "", fmt.Errorf("malformed artifact name %q", name)
+	}
+	if err := u.Scan(nil, &id, &collection, &artifactID); err != nil {
+		return 0, "", err
+	}
+	if collection != "artifacts" || !artifactIDPattern.MatchString(artifactID) {
+		return 0, "", fmt.Errorf("malformed artifact name %q", name)
+	}
+	return id, artifactID, nil
+}
+
+const artifactColumns = `
+	artifact_id, path, size_bytes, sha256, content_type, error, create_time
+`
+
+const listArtifactsQuery = `
+	SELECT` + artifactColumns + `
+	FROM artifacts
+	WHERE command_id = $1 AND artifact_id > $2
+	ORDER BY artifact_id
+	LIMIT $3;
+`
+
+const getArtifactContentQuery = `
+	SELECT` + artifactColumns + `, content
+	FROM artifacts
+	WHERE command_id = $1 AND artifact_id = $2;
+`
+
+// ListArtifacts implements ToolProxy for Server.
+func (s *Server) ListArtifacts(ctx context.Context, r *pb.ListArtifactsRequest) (*pb.ListArtifactsResponse, error) {
+	var id int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	size, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	after := r.GetPageToken()
+	if after != "" && !artifactIDPattern.MatchString(after) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+	}
+
+	// One more artifact than was requested is read to learn whether there
+	// is another page.
+	rows, err := s.DB.QueryContext(ctx, listArtifactsQuery, id, after, size+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing artifacts.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var list []*pb.Artifact
+	var ids []string
+	for rows.Next() {
+		a, err := scanArtifact(id, rows)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+		list = append(list, a)
+		ids = append(ids, path.Base(a.GetName()))
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing artifacts.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if len(list) > size {
+		list = list[:size]
+		nextPageToken = ids[size-1]
+	}
+
+	return &pb.ListArtifactsResponse{
+		Artifacts:     list,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// DownloadArtifact implements ToolProxy for Server.
+func (s *Server) DownloadArtifact(r *pb.DownloadArtifactRequest, stream pb.ToolProxy_DownloadArtifactServer) error {
+	id, artifactID, err := parseArtifactName(r.GetName())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Malformed artifact name.")
+	}
+
+	var content []byte
+	row := s.DB.QueryRowContext(stream.Context(), getArtifactContentQuery, id, artifactID)
+	a, err := scanArtifact(id, row, &content)
+	if err == sql.ErrNoRows {
+		return status.Errorf(codes.NotFound, "Artifact not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting artifact from database.")
+		return status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	if a.GetError() != "" {
+		return status.Errorf(codes.FailedPrecondition, "Artifact was not collected: %s.", a.GetError())
+	}
+
+	// The first chunk is sent even if the artifact is empty, since it
+	// carries the artifact's metadata.
+	chunk := &pb.ArtifactChunk{Artifact: a}
+	for {
+		n := len(content)
+		if n > artifactChunkSize {
+			n = artifactChunkSize
+		}
+		chunk.Data, content = content[:n], content[n:]
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		if len(content) == 0 {
+			return nil
+		}
+		chunk = &pb.ArtifactChunk{}
+	}
+}
+
+// scanArtifact reads an artifact of the command with the given ID from a row
+// of artifactColumns, followed by dest.
+func scanArtifact(id int64, row scanner, dest ...interface{}) (*pb.Artifact, error) {
+	var artifactID, path string
+	var size int64
+	var sha256, contentType, collectErr sql.NullString
+	var createTime sql.NullTime
+	err := row.Scan(append([]interface{}{
+		&artifactID,
+		&path,
+		&size,
+		&sha256,
+		&contentType,
+		&collectErr,
+		&createTime,
+	}, dest...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Artifact{
+		Name:        fmt.Sprintf("commands/%d/artifacts/%s", id, artifactID),
+		Path:        path,
+		SizeBytes:   size,
+		Sha256:      unwrapstring(sha256),
+		ContentType: unwrapstring(contentType),
+		CreateTime:  timestamp(createTime),
+		Error:       unwrapstring(collectErr),
+	}, nil
+}
@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var artifactColumnNames = []string{"artifact_id", "path", "size_bytes", "sha256", "content_type", "error", "create_time"}
+
+type fakeArtifactStream struct {
+	grpc.ServerStream
+
+	ctx    context.Context
+	chunks []*pb.ArtifactChunk
+}
+
+func (f *fakeArtifactStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeArtifactStream) Send(chunk *pb.ArtifactChunk) error {
+	f.chunks = append(f.chunks, chunk)
+	return nil
+}
+
+func TestValidateArtifactPaths(t *testing.T) {
+	if err := validateArtifactPaths([]string{"dump.sql"}, "", nil); err != nil {
+		t.Errorf("Expected success; got error: %v", err)
+	}
+	for _, tc := range []struct {
+		name    string
+		paths   []string
+		target  string
+		targets []string
+	}{
+		{name: "Path outside working directory", paths: []string{"../dump.sql"}},
+		{name: "Command on agent", paths: []string{"dump.sql"}, target: "agents/db-host-1"},
+		{name: "Rollout", paths: []string{"dump.sql"}, targets: []string{"role=database"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateArtifactPaths(tc.paths, tc.target, tc.targets)
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+			}
+		})
+	}
+}
+
+func TestListArtifacts(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(listArtifactsQuery).WithArgs(1, "", 2).WillReturnRows(
+		sqlmock.NewRows(artifactColumnNames).
+			AddRow("dump.sql", "dump.sql", 5, "digest", "application/sql", nil, time.Time{}).
+			AddRow("missing", "missing", 0, nil, nil, "file was not created", time.Time{}),
+	)
+	mock.ExpectQuery(listArtifactsQuery).WithArgs(1, "dump.sql", 2).WillReturnRows(
+		sqlmock.NewRows(artifactColumnNames).
+			AddRow("missing", "missing", 0, nil, nil, "file was not created", time.Time{}),
+	)
+
+	s := &Server{DB: db}
+	req := &pb.ListArtifactsRequest{Parent: "commands/1", PageSize: 1}
+	res, err := s.ListArtifacts(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(res.GetArtifacts()) != 1 || res.GetArtifacts()[0].GetName() != "commands/1/artifacts/dump.sql" || res.GetNextPageToken() != "dump.sql" {
+		t.Fatalf("Expected commands/1/artifacts/dump.sql and a next page; got %v", res)
+	}
+
+	req.PageToken = res.GetNextPageToken()
+	res, err = s.ListArtifacts(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(res.GetArtifacts()) != 1 || res.GetArtifacts()[0].GetError() != "file was not created" || res.GetNextPageToken() != "" {
+		t.Errorf("Expected uncollected artifact on the last page; got %v", res)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestDownloadArtifact(t *testing.T) {
+	columns := append(artifactColumnNames, "content")
+
+	t.Run("Stream content in chunks", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		content := bytes.Repeat([]byte("x"), artifactChunkSize+1)
+		mock.ExpectQuery(getArtifactContentQuery).WithArgs(1, "dump.sql").WillReturnRows(
+			sqlmock.NewRows(columns).AddRow("dump.sql", "dump.sql", len(content), "digest", "application/sql", nil, time.Time{}, content),
+		)
+
+		s := &Server{DB: db}
+		stream := &fakeArtifactStream{ctx: context.Background()}
+		err = s.DownloadArtifact(&pb.DownloadArtifactRequest{Name: "commands/1/artifacts/dump.sql"}, stream)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(stream.chunks) != 2 || stream.chunks[0].GetArtifact().GetSha256() != "digest" || stream.chunks[1].GetArtifact() != nil {
+			t.Fatalf("Expected two chunks with metadata on the first; got %d", len(stream.chunks))
+		}
+		if len(stream.chunks[0].GetData()) != artifactChunkSize || len(stream.chunks[1].GetData()) != 1 {
+			t.Errorf("Bad chunk sizes: %d, %d", len(stream.chunks[0].GetData()), len(stream.chunks[1].GetData()))
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Send metadata of empty artifact", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getArtifactContentQuery).WithArgs(1, "empty").WillReturnRows(
+			sqlmock.NewRows(columns).AddRow("empty", "empty", 0, "digest", "text/plain; charset=utf-8", nil, time.Time{}, []byte{}),
+		)
+
+		s := &Server{DB: db}
+		stream := &fakeArtifactStream{ctx: context.Background()}
+		err = s.DownloadArtifact(&pb.DownloadArtifactRequest{Name: "commands/1/artifacts/empty"}, stream)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(stream.chunks) != 1 || stream.chunks[0].GetArtifact().GetName() != "commands/1/artifacts/empty" {
+			t.Errorf("Expected one chunk with metadata; got %v", stream.chunks)
+		}
+	})
+
+	t.Run("Artifact not collected", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getArtifactContentQuery).WithArgs(1, "missing").WillReturnRows(
+			sqlmock.NewRows(columns).AddRow("missing", "missing", 0, nil, nil, "file was not created", time.Time{}, nil),
+		)
+
+		s := &Server{DB: db}
+		err = s.DownloadArtifact(&pb.DownloadArtifactRequest{Name: "commands/1/artifacts/missing"}, &fakeArtifactStream{ctx: context.Background()})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+	})
+
+	t.Run("Malformed name", func(t *testing.T) {
+		s := &Server{}
+		for _, name := range []string{"commands/1", "commands/1/executions/dump.sql", "commands/1/artifacts/a b"} {
+			err := s.DownloadArtifact(&pb.DownloadArtifactRequest{Name: name}, &fakeArtifactStream{ctx: context.Background()})
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %q; got %v", codes.InvalidArgument, name, status.Convert(err).Code())
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package rpc
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// VerifyAuditLog implements ToolProxy for Server.
+func (s *Server) VerifyAuditLog(ctx context.Context, r *pb.VerifyAuditLogRequest) (*pb.VerifyAuditLogResponse, error) {
+	if s.AuditKey == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "No audit verification key is configured.")
+	}
+
+	report, err := audit.Verify(ctx, s.DB, s.AuditKey)
+	if err != nil {
+		log.WithError(err).Errorln("Error reading audit log.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	if len(report.Problems) > 0 {
+		log.WithField("problems", len(report.Problems)).Warnln("Audit log failed verification.")
+	}
+
+	res := &pb.VerifyAuditLogResponse{
+		EventsVerified:         report.Events,
+		CheckpointsVerified:    report.Checkpoints,
+		LastCheckpointSequence: report.LastCheckpoint,
+	}
+	if report.LastCheckpoint > 0 {
+		res.LastCheckpointTime = timestamppb.New(report.LastCheckpointTime)
+	}
+	for _, p := range report.Problems {
+		res.Problems = append(res.Problems, &pb.AuditProblem{
+			Sequence:    p.Sequence,
+			Description: p.Description,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestVerifyAuditLog(t *testing.T) {
+	t.Run("Report missing events", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Error generating key: %v", err)
+		}
+
+		mock.ExpectQuery("FROM audit_checkpoints").WillReturnRows(
+			sqlmock.NewRows([]string{"seq", "hash", "signature", "create_time"}),
+		)
+		mock.ExpectQuery("FROM audit_head").WillReturnRows(
+			sqlmock.NewRows([]string{"seq", "hash"}).AddRow(2, make([]byte, 32)),
+		)
+		mock.ExpectQuery("FROM audit_events").WithArgs(2).WillReturnRows(
+			sqlmock.NewRows([]string{
+				"seq", "command_id", "action", "actor_type", "actor_id", "actor_display_name", "detail", "event_time", "hash",
+			}),
+		)
+
+		s := &Server{DB: db, AuditKey: pub}
+		res, err := s.VerifyAuditLog(context.Background(), &pb.VerifyAuditLogRequest{})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(res.GetProblems()) != 1 || res.GetProblems()[0].GetSequence() != 1 {
+			t.Errorf("Expected events 1 through 2 to be reported missing; got %v", res.GetProblems())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Require verification key", func(t *testing.T) {
+		s := &Server{}
+		_, err := s.VerifyAuditLog(context.Background(), &pb.VerifyAuditLogRequest{})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+	})
+}
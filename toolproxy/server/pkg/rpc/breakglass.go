@@ -0,0 +1,250 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var breakGlassUses = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "toolproxy_break_glass_total",
+	Help: "The number of commands run by break-glass without the approvals they required.",
+})
+
+var breakGlassSignOffs = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "toolproxy_break_glass_reviews_signed_off_total",
+	Help: "The number of post-incident reviews of commands run by break-glass which have been signed off.",
+})
+
+// breakGlassColumns holds the break-glass columns of a command as they are
+// scanned.
+type breakGlassColumns struct {
+	user                sql.NullString
+	userDisplayName     sql.NullString
+	justification       sql.NullString
+	createTime          sql.NullTime
+	reviewer            sql.NullString
+	reviewerDisplayName sql.NullString
+	reviewComment       sql.NullString
+	reviewTime          sql.NullTime
+}
+
+// proto returns the use of break-glass recorded in the columns, or nil if the
+// command was not run by break-glass.
+func (c *breakGlassColumns) proto() *pb.BreakGlass {
+	if !c.createTime.Valid {
+		return nil
+	}
+
+	reviewState := pb.BreakGlassReviewState_REVIEW_OPEN
+	if c.reviewTime.Valid {
+		reviewState = pb.BreakGlassReviewState_REVIEW_SIGNED_OFF
+	}
+	return &pb.BreakGlass{
+		User:                unwrapstring(c.user),
+		UserDisplayName:     unwrapstring(c.userDisplayName),
+		Justification:       unwrapstring(c.justification),
+		CreateTime:          timestamp(c.createTime),
+		ReviewState:         reviewState,
+		Reviewer:            unwrapstring(c.reviewer),
+		ReviewerDisplayName: unwrapstring(c.reviewerDisplayName),
+		ReviewComment:       unwrapstring(c.reviewComment),
+		ReviewTime:          timestamp(c.reviewTime),
+	}
+}
+
+// breakGlassQuery marks a submitted command as ready and queues it to be run
+// immediately, clearing any schedule so that it is not held until later.
+const breakGlassQuery = `
+	UPDATE commands
+	SET (status, update_time, run_request_time, schedule_time, expire_time,
+		break_glass_user, break_glass_user_display_name, break_glass_justification, break_glass_time) =
+		($2, $3, $3, NULL, NULL, $4, $5, $6, $3)
+	WHERE id = $1;
+`
+
+// BreakGlassCommand implements ToolProxy for Server.
+func (s *Server) BreakGlassCommand(ctx context.Context, r *pb.BreakGlassCommandRequest) (*pb.Command, error) {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	justification := strings.TrimSpace(r.GetJustification())
+	if justification == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A justification is required to break glass.")
+	}
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	var issuer string
+	var statusID int32
+	var requiredApprovals sql.NullInt32
+	err = tx.QueryRowContext(ctx, lockCommandQuery, id).Scan(&issuer, &statusID, &requiredApprovals)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Command not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting command from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	// Commands which are already ready may simply be run.
+	if pb.Status(statusID) != pb.Status_SUBMITTED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Only submitted commands may be run by break-glass.")
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(
+		ctx,
+		breakGlassQuery,
+		id,
+		pb.Status_READY,
+		now,
+		caller.String(),
+		caller.DisplayName,
+		justification,
+	)
+	if err != nil {
+		log.WithError(err).Errorln("Error queueing command in database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_BREAK_GLASS, caller, now, justification); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	// The notification is delivered when the transaction commits.
+	_, err = tx.ExecContext(ctx, notifyQuery, executor.RunChannel, strconv.FormatInt(id, 10))
+	if err != nil {
+		log.WithError(err).Errorln("Error notifying executors.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing break-glass.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	breakGlassUses.Inc()
+	log.WithFields(log.Fields{
+		"name": r.GetName(),
+		"user": caller.String(),
+	}).Warnln("Command run by break-glass.")
+
+	// The event is already in the outbox; waking the exporter delivers it
+	// to every sink now rather than when the outbox is next polled.
+	if s.Exporter != nil {
+		s.Exporter.Wake()
+	}
+
+	return s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+}
+
+const lockBreakGlassQuery = `
+	SELECT issuer, status, break_glass_user, break_glass_time, break_glass_review_time
+	FROM commands
+	WHERE id = $1
+	FOR UPDATE;
+`
+
+const signOffBreakGlassQuery = `
+	UPDATE commands
+	SET (break_glass_reviewer, break_glass_reviewer_display_name, break_glass_review_comment, break_glass_review_time) = ($2, $3, $4, $5)
+	WHERE id = $1;
+`
+
+// SignOffBreakGlass implements ToolProxy for Server.
+func (s *Server) SignOffBreakGlass(ctx context.Context, r *pb.SignOffBreakGlassRequest) (*pb.Command, error) {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	comment := strings.TrimSpace(r.GetComment())
+	if comment == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A comment is required to sign off a review.")
+	}
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reviewer := caller.String()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	var issuer string
+	var statusID int32
+	var user sql.NullString
+	var breakGlassTime, reviewTime sql.NullTime
+	err = tx.QueryRowContext(ctx, lockBreakGlassQuery, id).Scan(&issuer, &statusID, &user, &breakGlassTime, &reviewTime)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Command not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting command from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if !breakGlassTime.Valid {
+		return nil, status.Errorf(codes.FailedPrecondition, "Command was not run by break-glass.")
+	}
+	if reviewTime.Valid {
+		return nil, status.Errorf(codes.FailedPrecondition, "The review of this command has already been signed off.")
+	}
+	if reviewer == issuer || reviewer == user.String {
+		return nil, status.Errorf(codes.PermissionDenied, "The issuer of a command and the user who broke glass may not review it.")
+	}
+	if !isTerminal(pb.Status(statusID)) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Command has not finished.")
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, signOffBreakGlassQuery, id, reviewer, caller.DisplayName, comment, now)
+	if err != nil {
+		log.WithError(err).Errorln("Error saving review to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_SIGN_OFF, caller, now, comment); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing review.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	breakGlassSignOffs.Inc()
+
+	return s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+}
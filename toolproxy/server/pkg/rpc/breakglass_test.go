@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// brokenGlassCommand returns a row of getCommandQuery for a command with the
+// given status which bob ran by break-glass, and whose review carol signed
+// off if reviewed is set.
+func brokenGlassCommand(s pb.Status, reviewed bool) []driver.Value {
+	row := startedCommand(s, nil)
+	row[42], row[43], row[44], row[45] = "users:bob", "bob", "database is down", time.Now()
+	if reviewed {
+		row[46], row[47], row[48], row[49] = "users:carol", "carol", "justified", time.Now()
+	}
+	return row
+}
+
+func TestBreakGlassCommand(t *testing.T) {
+	t.Run("Submitted command is queued and flagged", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectExec(breakGlassQuery).WithArgs(
+			1,
+			pb.Status_READY,
+			sqlmock.AnyArg(),
+			"users:bob",
+			"bob",
+			"database is down",
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_BREAK_GLASS,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(notifyQuery).WithArgs(executor.RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(brokenGlassCommand(pb.Status_READY, false)...))
+
+		uses := testutil.ToFloat64(breakGlassUses)
+		s := &Server{DB: db, Exporter: &audit.Exporter{DB: db}}
+		cmd, err := s.BreakGlassCommand(contextWithSubject("users", "bob"), &pb.BreakGlassCommandRequest{
+			Name:          "commands/1",
+			Justification: " database is down\n",
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if got := cmd.GetBreakGlass(); got.GetUser() != "users:bob" || got.GetReviewState() != pb.BreakGlassReviewState_REVIEW_OPEN {
+			t.Errorf("Expected open break-glass by users:bob; got %v", got)
+		}
+		if got := testutil.ToFloat64(breakGlassUses); got != uses+1 {
+			t.Errorf("Expected %v uses of break-glass; got %v", uses+1, got)
+		}
+	})
+
+	t.Run("Justification is required", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db}
+		_, err = s.BreakGlassCommand(contextWithSubject("users", "bob"), &pb.BreakGlassCommandRequest{
+			Name:          "commands/1",
+			Justification: "  ",
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument; got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Only submitted commands may be run", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUCCESS, nil),
+		)
+		mock.ExpectRollback()
+
+		s := &Server{DB: db}
+		_, err = s.BreakGlassCommand(contextWithSubject("users", "bob"), &pb.BreakGlassCommandRequest{
+			Name:          "commands/1",
+			Justification: "database is down",
+		})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Expected FailedPrecondition; got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestSignOffBreakGlass(t *testing.T) {
+	lockColumns := []string{"issuer", "status", "break_glass_user", "break_glass_time", "break_glass_review_time"}
+
+	t.Run("Reviewer signs off finished command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockBreakGlassQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(lockColumns).AddRow("users:alice", pb.Status_SUCCESS, "users:bob", time.Now(), nil),
+		)
+		mock.ExpectExec(signOffBreakGlassQuery).WithArgs(
+			1,
+			"users:carol",
+			"carol",
+			"justified",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_SIGN_OFF,
+			"users",
+			"carol",
+			"carol",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(brokenGlassCommand(pb.Status_SUCCESS, true)...))
+
+		s := &Server{DB: db}
+		cmd, err := s.SignOffBreakGlass(contextWithSubject("users", "carol"), &pb.SignOffBreakGlassRequest{
+			Name:    "commands/1",
+			Comment: "justified",
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if got := cmd.GetBreakGlass(); got.GetReviewState() != pb.BreakGlassReviewState_REVIEW_SIGNED_OFF || got.GetReviewer() != "users:carol" {
+			t.Errorf("Expected review signed off by users:carol; got %v", got)
+		}
+	})
+
+	testCases := []struct {
+		name   string
+		caller string
+		row    []driver.Value
+		code   codes.Code
+	}{
+		{
+			name:   "User who broke glass may not review",
+			caller: "bob",
+			row:    []driver.Value{"users:alice", pb.Status_SUCCESS, "users:bob", time.Now(), nil},
+			code:   codes.PermissionDenied,
+		},
+		{
+			name:   "Issuer may not review",
+			caller: "alice",
+			row:    []driver.Value{"users:alice", pb.Status_SUCCESS, "users:bob", time.Now(), nil},
+			code:   codes.PermissionDenied,
+		},
+		{
+			name:   "Running command may not be reviewed",
+			caller: "carol",
+			row:    []driver.Value{"users:alice", pb.Status_RUNNING, "users:bob", time.Now(), nil},
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "Command not run by break-glass",
+			caller: "carol",
+			row:    []driver.Value{"users:alice", pb.Status_SUCCESS, nil, nil, nil},
+			code:   codes.FailedPrecondition,
+		},
+		{
+			name:   "Review already signed off",
+			caller: "carol",
+			row:    []driver.Value{"users:alice", pb.Status_SUCCESS, "users:bob", time.Now(), time.Now()},
+			code:   codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockBreakGlassQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(lockColumns).AddRow(tc.row...))
+			mock.ExpectRollback()
+
+			s := &Server{DB: db}
+			_, err = s.SignOffBreakGlass(contextWithSubject("users", tc.caller), &pb.SignOffBreakGlassRequest{
+				Name:    "commands/1",
+				Comment: "justified",
+			})
+			if status.Code(err) != tc.code {
+				t.Errorf("Expected %v; got %v", tc.code, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateBrokenGlassCommand(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// The command is still queued, but may not be edited.
+	mock.ExpectQuery(getCommandQuery).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(brokenGlassCommand(pb.Status_READY, false)...))
+
+	s := &Server{DB: db}
+	_, err = s.UpdateCommand(contextWithSubject("users", "alice"), &pb.UpdateCommandRequest{
+		Name:    "commands/1",
+		Command: &pb.Command{Argv: []string{"/bin/false"}},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition; got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const cancelCommandQuery = `
+	UPDATE commands
+	SET (status, canceller, canceller_display_name, cancel_time, end_time, update_time) = ($2, $3, $4, $5, $5, $5)
+	WHERE id = $1;
+`
+
+const requestCancelQuery = `
+	UPDATE commands
+	SET (canceller, canceller_display_name, cancel_time) = ($2, $3, $4)
+	WHERE id = $1;
+`
+
+const notifyQuery = `SELECT pg_notify($1, $2);`
+
+// CancelCommand implements ToolProxy for Server.
+func (s *Server) CancelCommand(ctx context.Context, r *pb.CancelCommandRequest) (*pb.Command, error) {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	var issuer string
+	var statusID int32
+	var requiredApprovals sql.NullInt32
+	err = tx.QueryRowContext(ctx, lockCommandQuery, id).Scan(&issuer, &statusID, &requiredApprovals)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Command not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting command from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	cancelTime := time.Now()
+	switch pb.Status(statusID) {
+	case pb.Status_CANCELED:
+		// Cancellation is idempotent.
+		return s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+
+	case pb.Status_UNDEFINED, pb.Status_SUBMITTED, pb.Status_READY:
+		_, err = tx.ExecContext(
+			ctx,
+			cancelCommandQuery,
+			id,
+			pb.Status_CANCELED,
+			caller.String(),
+			caller.DisplayName,
+			cancelTime,
+		)
+
+	case pb.Status_RUNNING:
+		_, err = tx.ExecContext(
+			ctx,
+			requestCancelQuery,
+			id,
+			caller.String(),
+			caller.DisplayName,
+			cancelTime,
+		)
+		if err == nil {
+			// The notification is delivered when the transaction commits.
+			_, err = tx.ExecContext(ctx, notifyQuery, executor.CancelChannel, strconv.FormatInt(id, 10))
+		}
+
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "A command cannot be canceled after it has completed.")
+	}
+	if err != nil {
+		log.WithError(err).Errorln("Error canceling command.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_CANCEL, caller, cancelTime, ""); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing cancellation.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+}
+
+// commandTimeout validates the timeout requested for a command and returns it
+// in milliseconds as it is stored. Commands which do not request a timeout
+// are given the server's maximum, if any.
+func (s *Server) commandTimeout(d *durationpb.Duration) (sql.NullInt64, error) {
+	if d == nil {
+		if s.MaxTimeout > 0 {
+			return sql.NullInt64{Int64: s.MaxTimeout.Milliseconds(), Valid: true}, nil
+		}
+		return sql.NullInt64{}, nil
+	}
+
+	if err := d.CheckValid(); err != nil || d.AsDuration() <= 0 {
+		return sql.NullInt64{}, status.Errorf(codes.InvalidArgument, "Timeout must be positive.")
+	}
+	if s.MaxTimeout > 0 && d.AsDuration() > s.MaxTimeout {
+		return sql.NullInt64{}, status.Errorf(codes.InvalidArgument, "Timeout may not exceed %v.", s.MaxTimeout)
+	}
+
+	ms := d.AsDuration().Milliseconds()
+	if ms == 0 {
+		ms = 1
+	}
+	return sql.NullInt64{Int64: ms, Valid: true}, nil
+}
+
+func duration(ms sql.NullInt64) *durationpb.Duration {
+	if !ms.Valid {
+		return nil
+	}
+	return durationpb.New(time.Duration(ms.Int64) * time.Millisecond)
+}
@@ -0,0 +1,192 @@
+package rpc
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCancelCommand(t *testing.T) {
+	argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+	canceled := func(s pb.Status, startTime interface{}) *sqlmock.Rows {
+		return sqlmock.NewRows(commandColumns).AddRow(
+			"users:alice", pq.Array(argv), "description of the command",
+			s, nil, nil,
+			time.Time{}, time.Time{}, nil,
+			startTime, nil, "alice",
+			nil, nil, nil,
+			nil, nil, nil,
+			"users:bob", "bob", time.Time{},
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil,
+			nil, nil, nil, nil,
+		)
+	}
+
+	t.Run("Cancel command which has not been run", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_READY, nil),
+		)
+		mock.ExpectExec(cancelCommandQuery).WithArgs(
+			1,
+			pb.Status_CANCELED,
+			"users:bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_CANCEL,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(canceled(pb.Status_CANCELED, nil))
+
+		s := &Server{DB: db}
+		cmd, err := s.CancelCommand(contextWithSubject("users", "bob"), &pb.CancelCommandRequest{
+			Name: "commands/1",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if cmd.GetStatus() != pb.Status_CANCELED {
+			t.Errorf("Expected %v; got %v", pb.Status_CANCELED, cmd.GetStatus())
+		}
+
+		if cmd.GetCanceller() != "users:bob" {
+			t.Errorf("Expected canceller users:bob; got %v", cmd.GetCanceller())
+		}
+	})
+
+	t.Run("Cancel running command notifies replicas", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_RUNNING, nil),
+		)
+		mock.ExpectExec(requestCancelQuery).WithArgs(
+			1,
+			"users:bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(notifyQuery).WithArgs(executor.CancelChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_CANCEL,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(canceled(pb.Status_RUNNING, time.Time{}))
+
+		s := &Server{DB: db}
+		cmd, err := s.CancelCommand(contextWithSubject("users", "bob"), &pb.CancelCommandRequest{
+			Name: "commands/1",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if cmd.GetCancelTime() == nil {
+			t.Errorf("Expected cancel timestamp; got nil")
+		}
+	})
+
+	t.Run("Fail to cancel completed command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUCCESS, nil),
+		)
+		mock.ExpectRollback()
+
+		s := &Server{DB: db}
+		_, err = s.CancelCommand(contextWithSubject("users", "bob"), &pb.CancelCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestCommandTimeout(t *testing.T) {
+	s := &Server{MaxTimeout: time.Hour}
+
+	tests := []struct {
+		name    string
+		timeout *durationpb.Duration
+		want    sql.NullInt64
+		code    codes.Code
+	}{
+		{"Unset uses maximum", nil, sql.NullInt64{Int64: 3600000, Valid: true}, codes.OK},
+		{"Within maximum", durationpb.New(time.Minute), sql.NullInt64{Int64: 60000, Valid: true}, codes.OK},
+		{"Exceeds maximum", durationpb.New(2 * time.Hour), sql.NullInt64{}, codes.InvalidArgument},
+		{"Negative", durationpb.New(-time.Second), sql.NullInt64{}, codes.InvalidArgument},
+		{"Zero", durationpb.New(0), sql.NullInt64{}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.commandTimeout(tt.timeout)
+			if status.Code(err) != tt.code {
+				t.Errorf("Expected grpc status %v; got %v", tt.code, status.Code(err))
+			}
+			if got != tt.want {
+				t.Errorf("Expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+)
+
+// awaitPollInterval is how often RunCommand and WatchCommands check for
+// changes to commands if they are not notified.
+const awaitPollInterval = 30 * time.Second
+
+// subscribe returns a channel which receives a value whenever the command
+// with the given ID may have finished, and a function which must be called
+// once it is no longer needed.
+func (s *Server) subscribe(id int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiters == nil {
+		s.waiters = make(map[int64]map[chan struct{}]struct{})
+	}
+	if s.waiters[id] == nil {
+		s.waiters[id] = make(map[chan struct{}]struct{})
+	}
+	s.waiters[id][ch] = struct{}{}
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.waiters[id], ch)
+		if len(s.waiters[id]) == 0 {
+			delete(s.waiters, id)
+		}
+	}
+}
+
+// wake signals those waiting for the command with the given ID, or for every
+// command if all is true.
+func (s *Server) wake(id int64, all bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cmdID, chans := range s.waiters {
+		if !all && cmdID != id {
+			continue
+		}
+		for ch := range chans {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// watch returns a channel which receives a value whenever any command may
+// have changed, and a function which must be called once it is no longer
+// needed.
+func (s *Server) watch() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers == nil {
+		s.watchers = make(map[chan struct{}]struct{})
+	}
+	s.watchers[ch] = struct{}{}
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.watchers, ch)
+	}
+}
+
+// broadcast signals every watcher.
+func (s *Server) broadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// HandleChanges wakes RunCommand and WatchCommands calls when events are
+// appended to the audit log and published on audit.Channel, until ctx is
+// done. A command has finished only once its finish has been appended.
+//
+// A nil notification indicates that the connection was lost and notifications
+// may have been missed, in which case every waiting call is woken.
+func (s *Server) HandleChanges(ctx context.Context, notify <-chan *pq.Notification) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notify:
+			if n == nil {
+				s.wake(0, true)
+				s.broadcast()
+				continue
+			}
+
+			_, id, err := audit.ParseNotification(n.Extra)
+			if err != nil {
+				log.WithError(err).Errorln("Malformed audit notification.")
+				continue
+			}
+			s.wake(id, false)
+			s.broadcast()
+		}
+	}
+}
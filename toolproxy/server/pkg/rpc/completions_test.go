@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestRunCommand(t *testing.T) {
+	argv := []string{"/bin/true"}
+	command := func(s pb.Status) *sqlmock.Rows {
+		return sqlmock.NewRows(commandColumns).AddRow(
+			"users:alice", pq.Array(argv), "description of the command",
+			s, nil, nil,
+			time.Time{}, time.Time{}, nil,
+			nil, nil, "alice",
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil,
+			nil, nil, nil, nil,
+		)
+	}
+
+	t.Run("Queue command and wait for it to finish", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(requestRunQuery).WithArgs(
+			1,
+			sqlmock.AnyArg(),
+			pb.Status_READY,
+			pb.PreviewState_PREVIEW_SUCCEEDED,
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_RUN,
+			"users",
+			"alice",
+			"alice",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(notifyQuery).WithArgs(executor.RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(command(pb.Status_READY))
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(command(pb.Status_SUCCESS))
+
+		s := &Server{DB: db}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		notify := make(chan *pq.Notification, 1)
+		go s.HandleChanges(ctx, notify)
+
+		// The executor publishes the command once it has finished, which
+		// must be after RunCommand has begun waiting for it.
+		go func() {
+			for {
+				s.mu.Lock()
+				waiting := len(s.waiters[1]) > 0
+				s.mu.Unlock()
+				if waiting {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			notify <- &pq.Notification{Channel: audit.Channel, Extra: "7 1"}
+		}()
+
+		cmd, err := s.RunCommand(contextWithSubject("users", "alice"), &pb.RunCommandRequest{
+			Name: "commands/1",
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if cmd.GetStatus() != pb.Status_SUCCESS {
+			t.Errorf("Expected %v; got %v", pb.Status_SUCCESS, cmd.GetStatus())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail to run submitted command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(requestRunQuery).WithArgs(
+			1,
+			sqlmock.AnyArg(),
+			pb.Status_READY,
+			pb.PreviewState_PREVIEW_SUCCEEDED,
+		).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(command(pb.Status_SUBMITTED))
+
+		s := &Server{DB: db}
+		_, err = s.RunCommand(contextWithSubject("users", "alice"), &pb.RunCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestHandleChanges(t *testing.T) {
+	s := &Server{}
+	one, unsubscribeOne := s.subscribe(1)
+	defer unsubscribeOne()
+	two, unsubscribeTwo := s.subscribe(2)
+	defer unsubscribeTwo()
+
+	watcher, unwatch := s.watch()
+	defer unwatch()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := make(chan *pq.Notification)
+	go s.HandleChanges(ctx, notify)
+
+	notify <- &pq.Notification{Channel: audit.Channel, Extra: "7 1"}
+	select {
+	case <-one:
+	case <-time.After(time.Second):
+		t.Errorf("Expected waiter for command 1 to be woken")
+	}
+	select {
+	case <-watcher:
+	case <-time.After(time.Second):
+		t.Errorf("Expected watcher to be woken")
+	}
+
+	select {
+	case <-two:
+		t.Errorf("Expected waiter for command 2 not to be woken")
+	default:
+	}
+
+	// A reconnection wakes every waiter.
+	notify <- nil
+	select {
+	case <-two:
+	case <-time.After(time.Second):
+		t.Errorf("Expected waiter for command 2 to be woken")
+	}
+}
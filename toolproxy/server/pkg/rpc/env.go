@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/secrets"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// maxEnvBytes is the greatest total size of the environment variables of a
+// command, excluding the values of secrets.
+const maxEnvBytes = 64 << 10
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretRef is a reference to a secret set as an environment variable of a
+// command, as it is stored.
+type secretRef struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// envPermitted returns whether commands permitted by the named catalog entry
+// may set an environment variable. If the server has no catalog, every
+// command and so every variable is permitted.
+func (s *Server) envPermitted(entry string) func(name string) bool {
+	if s.Catalog == nil {
+		return func(string) bool { return true }
+	}
+	e := s.Catalog.Entry(entry)
+	return func(name string) bool {
+		return e != nil && e.AllowsEnv(name)
+	}
+}
+
+// validateEnv returns an error if the environment variables of a command are
+// invalid or not permitted, or if it refers to secrets but runs on agents.
+//
+// Secrets are not resolved here: they are held only where commands are
+// executed, which need not be where they are created.
+func validateEnv(env map[string]string, secretEnv []*pb.SecretEnvVar, target string, targets []string, permitted func(name string) bool) error {
+	size := 0
+	for k, v := range env {
+		if !envNamePattern.MatchString(k) {
+			return status.Errorf(codes.InvalidArgument, "Invalid environment variable name %q.", k)
+		}
+		if !permitted(k) {
+			return status.Errorf(codes.InvalidArgument, "Environment variable %s is not permitted by the tool catalog.", k)
+		}
+		if strings.IndexByte(v, 0) >= 0 {
+			return status.Errorf(codes.InvalidArgument, "Environment variable %s contains a NUL byte.", k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxEnvBytes {
+		return status.Errorf(codes.InvalidArgument, "Environment may not exceed %d bytes.", maxEnvBytes)
+	}
+
+	if len(secretEnv) == 0 {
+		return nil
+	}
+	if target != "" || len(targets) > 0 {
+		return status.Errorf(codes.InvalidArgument, "Secrets may not be given to commands which run on agents.")
+	}
+	names := make(map[string]struct{})
+	for _, v := range secretEnv {
+		if !envNamePattern.MatchString(v.GetName()) {
+			return status.Errorf(codes.InvalidArgument, "Invalid environment variable name %q.", v.GetName())
+		}
+		if !permitted(v.GetName()) {
+			return status.Errorf(codes.InvalidArgument, "Environment variable %s is not permitted by the tool catalog.", v.GetName())
+		}
+		if _, ok := env[v.GetName()]; ok {
+			return status.Errorf(codes.InvalidArgument, "Environment variable %s is given more than once.", v.GetName())
+		}
+		if _, ok := names[v.GetName()]; ok {
+			return status.Errorf(codes.InvalidArgument, "Environment variable %s is given more than once.", v.GetName())
+		}
+		names[v.GetName()] = struct{}{}
+		if !secrets.ValidName(v.GetSecret()) {
+			return status.Errorf(codes.InvalidArgument, "Invalid secret name %q.", v.GetSecret())
+		}
+	}
+	return nil
+}
+
+// marshalEnv encodes the environment variables of a command and its
+// references to secrets to be stored.
+func marshalEnv(env map[string]string, secretEnv []*pb.SecretEnvVar) (interface{}, interface{}, error) {
+	var envJSON, secretEnvJSON interface{}
+	if len(env) > 0 {
+		data, err := json.Marshal(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		envJSON = data
+	}
+	if len(secretEnv) > 0 {
+		refs := make([]secretRef, len(secretEnv))
+		for i, v := range secretEnv {
+			refs[i] = secretRef{Name: v.GetName(), Secret: v.GetSecret()}
+		}
+		data, err := json.Marshal(refs)
+		if err != nil {
+			return nil, nil, err
+		}
+		secretEnvJSON = data
+	}
+	return envJSON, secretEnvJSON, nil
+}
+
+// unmarshalEnv decodes environment variables and references to secrets
+// stored by marshalEnv.
+func unmarshalEnv(env, secretEnv []byte) (map[string]string, []*pb.SecretEnvVar, error) {
+	var vars map[string]string
+	if len(env) > 0 {
+		if err := json.Unmarshal(env, &vars); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var refs []secretRef
+	if len(secretEnv) > 0 {
+		if err := json.Unmarshal(secretEnv, &refs); err != nil {
+			return nil, nil, err
+		}
+	}
+	var res []*pb.SecretEnvVar
+	for _, ref := range refs {
+		res = append(res, &pb.SecretEnvVar{Name: ref.Name, Secret: ref.Secret})
+	}
+	return vars, res, nil
+}
@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestValidateEnv(t *testing.T) {
+	t.Run("Valid environment", func(t *testing.T) {
+		s := &Server{Catalog: psqlCatalog(t)}
+		err := validateEnv(
+			map[string]string{"PGHOST": "db.example.com"},
+			[]*pb.SecretEnvVar{{Name: "PGPASSWORD", Secret: "postgres-password"}},
+			"",
+			nil,
+			s.envPermitted("psql"),
+		)
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+	})
+
+	t.Run("Reject invalid environment", func(t *testing.T) {
+		s := &Server{Catalog: psqlCatalog(t)}
+		for _, tc := range []struct {
+			desc      string
+			env       map[string]string
+			secretEnv []*pb.SecretEnvVar
+			target    string
+		}{
+			{"bad name", map[string]string{"A=B": ""}, nil, ""},
+			{"NUL byte", map[string]string{"PGHOST": "\x00"}, nil, ""},
+			{"bad secret", nil, []*pb.SecretEnvVar{{Name: "PGPASSWORD", Secret: "../etc/shadow"}}, ""},
+			{"duplicate", map[string]string{"PGPASSWORD": ""}, []*pb.SecretEnvVar{{Name: "PGPASSWORD", Secret: "a"}}, ""},
+			{"agent secret", nil, []*pb.SecretEnvVar{{Name: "PGPASSWORD", Secret: "a"}}, "agents/web-1"},
+			{"not in catalog", map[string]string{"LD_PRELOAD": "/tmp/evil.so"}, nil, ""},
+			{"secret not in catalog", nil, []*pb.SecretEnvVar{{Name: "PYTHONPATH", Secret: "a"}}, ""},
+		} {
+			err := validateEnv(tc.env, tc.secretEnv, tc.target, nil, s.envPermitted("psql"))
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %s; got %v", codes.InvalidArgument, tc.desc, status.Convert(err).Code())
+			}
+		}
+	})
+}
+
+func TestEnvPermitted(t *testing.T) {
+	s := &Server{Catalog: psqlCatalog(t)}
+	if !s.envPermitted("psql")("PGHOST") {
+		t.Errorf("Expected PGHOST to be permitted for psql")
+	}
+	if s.envPermitted("psql")("LD_LIBRARY_PATH") {
+		t.Errorf("Expected LD_LIBRARY_PATH not to be permitted for psql")
+	}
+	if s.envPermitted("unknown")("PGHOST") {
+		t.Errorf("Expected no variable to be permitted for an unknown entry")
+	}
+
+	s = &Server{}
+	if !s.envPermitted("")("LD_LIBRARY_PATH") {
+		t.Errorf("Expected every variable to be permitted without a catalog")
+	}
+}
+
+// psqlCatalog returns a catalog permitting psql to be run with the libpq
+// connection variables.
+func psqlCatalog(t *testing.T) *catalog.Catalog {
+	c, err := catalog.New([]catalog.Entry{{
+		Name: "psql",
+		Path: "/usr/bin/psql",
+		Env:  []string{"PGHOST", "PGPASSWORD"},
+	}})
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+	return c
+}
+
+func TestMarshalEnv(t *testing.T) {
+	envJSON, secretEnvJSON, err := marshalEnv(
+		map[string]string{"PGHOST": "db.example.com"},
+		[]*pb.SecretEnvVar{{Name: "PGPASSWORD", Secret: "postgres-password"}},
+	)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if string(secretEnvJSON.([]byte)) != `[{"name":"PGPASSWORD","secret":"postgres-password"}]` {
+		t.Errorf("Bad secret env: %s", secretEnvJSON)
+	}
+
+	env, secretEnv, err := unmarshalEnv(envJSON.([]byte), secretEnvJSON.([]byte))
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if env["PGHOST"] != "db.example.com" {
+		t.Errorf("Bad env: %v", env)
+	}
+	if len(secretEnv) != 1 || secretEnv[0].GetName() != "PGPASSWORD" || secretEnv[0].GetSecret() != "postgres-password" {
+		t.Errorf("Bad secret env: %v", secretEnv)
+	}
+
+	envJSON, secretEnvJSON, err = marshalEnv(nil, nil)
+	if err != nil || envJSON != nil || secretEnvJSON != nil {
+		t.Errorf("Expected no environment; got %v, %v, %v", envJSON, secretEnvJSON, err)
+	}
+}
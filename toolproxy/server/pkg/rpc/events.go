@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+const insertEventQuery = `
+	INSERT INTO command_events ("command_id", "action", "actor_type", "actor_id", "actor_display_name", "event_time")
+	VALUES ($1, $2, $3, $4, $5, $6);
+`
+
+// recordEvent attributes an action on a command to the actor who took it and
+// appends it to the audit log with the given detail.
+//
+// It should be executed in the same transaction as the action itself so that
+// no action goes unattributed.
+func recordEvent(ctx context.Context, db execer, commandID int64, action pb.Action, actor *principal, eventTime time.Time, detail string) error {
+	_, err := db.ExecContext(
+		ctx,
+		insertEventQuery,
+		commandID,
+		action,
+		actor.Type,
+		actor.ID,
+		actor.DisplayName,
+		eventTime,
+	)
+	if err != nil {
+		return err
+	}
+
+	return audit.Append(ctx, db, audit.Event{
+		CommandID:        commandID,
+		Action:           action,
+		ActorType:        actor.Type,
+		ActorID:          actor.ID,
+		ActorDisplayName: actor.DisplayName,
+		Detail:           detail,
+		Time:             eventTime,
+	})
+}
+
+// argvDetail returns the audit detail of an action which sets a command's
+// argv.
+func argvDetail(argv []string) string {
+	data, err := json.Marshal(argv)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+const listEventsQuery = `
+	SELECT id, action, actor_type, actor_id, actor_display_name, event_time
+	FROM command_events
+	WHERE command_id = $1 AND id > $2
+	ORDER BY id
+	LIMIT $3;
+`
+
+// ListEvents implements ToolProxy for Server.
+func (s *Server) ListEvents(ctx context.Context, r *pb.ListEventsRequest) (*pb.ListEventsResponse, error) {
+	var commandID int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &commandID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	var after int64
+	if r.GetPageToken() != "" {
+		after, err = strconv.ParseInt(r.GetPageToken(), 10, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+		}
+	}
+
+	// One more event than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listEventsQuery, commandID, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing events.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var events []*pb.Event
+	for rows.Next() {
+		if len(events) == limit {
+			more = true
+			break
+		}
+
+		var action int32
+		var actor principal
+		var displayName sql.NullString
+		var eventTime sql.NullTime
+		err = rows.Scan(&after, &action, &actor.Type, &actor.ID, &displayName, &eventTime)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		events = append(events, &pb.Event{
+			Name:             fmt.Sprintf("commands/%d/events/%d", commandID, after),
+			Action:           pb.Action(action),
+			Actor:            actor.String(),
+			ActorDisplayName: unwrapstring(displayName),
+			EventTime:        timestamp(eventTime),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing events.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = strconv.FormatInt(after, 10)
+	}
+
+	return &pb.ListEventsResponse{
+		Events:        events,
+		NextPageToken: nextPageToken,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestListEvents(t *testing.T) {
+	columns := []string{"id", "action", "actor_type", "actor_id", "actor_display_name", "event_time"}
+	testCases := []struct {
+		name      string
+		pageSize  int32
+		limit     int
+		rows      int
+		code      codes.Code
+		events    int
+		nextToken string
+	}{
+		{
+			name:   "Default page size",
+			limit:  defaultPageSize + 1,
+			rows:   1,
+			events: 1,
+		},
+		{
+			name:      "Another page follows",
+			pageSize:  1,
+			limit:     2,
+			rows:      2,
+			events:    1,
+			nextToken: "1",
+		},
+		{
+			name:     "Negative page size",
+			pageSize: -1,
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.code == codes.OK {
+				rows := sqlmock.NewRows(columns)
+				for i := 1; i <= tc.rows; i++ {
+					rows.AddRow(i, pb.Action_ACTION_CREATE, "users", "alice", "alice", nil)
+				}
+				mock.ExpectQuery(listEventsQuery).WithArgs(1, 0, tc.limit).WillReturnRows(rows)
+			}
+
+			s := &Server{DB: db}
+			res, err := s.ListEvents(context.Background(), &pb.ListEventsRequest{
+				Parent:   "commands/1",
+				PageSize: tc.pageSize,
+			})
+			if status.Code(err) != tc.code {
+				t.Fatalf("Expected %v; got %v", tc.code, err)
+			}
+
+			if len(res.GetEvents()) != tc.events {
+				t.Errorf("Expected %d events; got %d", tc.events, len(res.GetEvents()))
+			}
+			if res.GetNextPageToken() != tc.nextToken {
+				t.Errorf("Expected next page token %q; got %q", tc.nextToken, res.GetNextPageToken())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
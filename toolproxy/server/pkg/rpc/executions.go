@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// validateRollout checks the fields of a command which make it a rollout.
+func validateRollout(target string, targets []string, parallelism, failureThreshold int32) error {
+	if target != "" && len(targets) > 0 {
+		return status.Errorf(codes.InvalidArgument, "A command may have a target or targets, but not both.")
+	}
+	if parallelism < 0 {
+		return status.Errorf(codes.InvalidArgument, "Parallelism must not be negative.")
+	}
+	if failureThreshold < 0 {
+		return status.Errorf(codes.InvalidArgument, "Failure threshold must not be negative.")
+	}
+	return nil
+}
+
+// resolveTargets returns the resource names of the agents a rollout targets
+// by name and a JSON array of the label sets by which it selects agents, in
+// the form in which they are stored. Both are nil if the command is not a
+// rollout.
+func (s *Server) resolveTargets(ctx context.Context, targets []string) (interface{}, interface{}, error) {
+	if len(targets) == 0 {
+		return nil, nil, nil
+	}
+
+	agents := []string{}
+	selectors := []json.RawMessage{}
+	for _, target := range targets {
+		if target == "" {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "Targets must not be empty.")
+		}
+		agent, selector, err := s.resolveTarget(ctx, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		if agent.Valid {
+			agents = append(agents, agent.String)
+		} else {
+			selectors = append(selectors, selector.([]byte))
+		}
+	}
+
+	data, err := json.Marshal(selectors)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid targets.")
+	}
+	return pq.Array(agents), data, nil
+}
+
+// nullTargets returns targets in the form in which they are stored.
+func nullTargets(targets []string) interface{} {
+	if len(targets) == 0 {
+		return nil
+	}
+	return pq.Array(targets)
+}
+
+// parseExecutionName returns the command ID and agent ID from an execution
+// resource name.
+func parseExecutionName(name string) (int64, string, error) {
+	var id int64
+	var collection, agentID string
+	u := urn.Parse(name)
+	if len(u.Parts) != 4 {
+		return 0, "", fmt.Errorf("malformed execution name %q", name)
+	}
+	if err := u.Scan(nil, &id, &collection, &agentID); err != nil {
+		return 0, "", err
+	}
+	if collection != "executions" || !toolIDPattern.MatchString(agentID) {
+		return 0, "", fmt.Errorf("malformed execution name %q", name)
+	}
+	return id, agentID, nil
+}
+
+const executionColumns = `
+	agent_id, status, std_out, std_err, create_time, start_time, end_time, heartbeat_time,
+	exit_code, signal, start_error, user_cpu_us, system_cpu_us, max_rss_bytes, status_message, redactions
+`
+
+const getExecutionQuery = `
+	SELECT` + executionColumns + `
+	FROM executions
+	WHERE command_id = $1 AND agent_id = $2;
+`
+
+const listExecutionsQuery = `
+	SELECT` + executionColumns + `
+	FROM executions
+	WHERE command_id = $1 AND agent_id > $2
+	ORDER BY agent_id
+	LIMIT $3;
+`
+
+// GetExecution implements ToolProxy for Server.
+func (s *Server) GetExecution(ctx context.Context, r *pb.GetExecutionRequest) (*pb.Execution, error) {
+	id, agentID, err := parseExecutionName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed execution name.")
+	}
+
+	e, err := scanExecution(id, s.DB.QueryRowContext(ctx, getExecutionQuery, id, agentID))
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Execution not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting execution from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	return e, nil
+}
+
+// ListExecutions implements ToolProxy for Server.
+func (s *Server) ListExecutions(ctx context.Context, r *pb.ListExecutionsRequest) (*pb.ListExecutionsResponse, error) {
+	var id int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	after := r.GetPageToken()
+	if after != "" && !toolIDPattern.MatchString(after) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+	}
+
+	// One more execution than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listExecutionsQuery, id, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing executions.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var executions []*pb.Execution
+	for rows.Next() {
+		if len(executions) == limit {
+			more = true
+			break
+		}
+
+		e, err := scanExecution(id, rows)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+		executions = append(executions, e)
+		after = strings.TrimPrefix(e.GetAgent(), "agents/")
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing executions.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = after
+	}
+
+	return &pb.ListExecutionsResponse{
+		Executions:    executions,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// scanner is a row of a query result.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanExecution reads an execution of the command with the given ID from a
+// row of executionColumns.
+func scanExecution(id int64, row scanner) (*pb.Execution, error) {
+	var agentID string
+	var redactions []string
+	var statusID int32
+	var stdOut, stdErr []byte
+	var createTime, startTime, endTime, heartbeatTime sql.NullTime
+	var exitCodeValue sql.NullInt32
+	var signal, startError, statusMessage sql.NullString
+	var userCPU, systemCPU, maxRSS sql.NullInt64
+	err := row.Scan(
+		&agentID,
+		&statusID,
+		&stdOut,
+		&stdErr,
+		&createTime,
+		&startTime,
+		&endTime,
+		&heartbeatTime,
+		&exitCodeValue,
+		&signal,
+		&startError,
+		&userCPU,
+		&systemCPU,
+		&maxRSS,
+		&statusMessage,
+		pq.Array(&redactions),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Execution{
+		Name:          fmt.Sprintf("commands/%d/executions/%s", id, agentID),
+		Agent:         "agents/" + agentID,
+		Status:        pb.Status(statusID),
+		StdOut:        stdOut,
+		StdErr:        stdErr,
+		CreateTime:    timestamp(createTime),
+		StartTime:     timestamp(startTime),
+		EndTime:       timestamp(endTime),
+		HeartbeatTime: timestamp(heartbeatTime),
+		ExitCode:      exitCode(exitCodeValue),
+		Signal:        unwrapstring(signal),
+		StartError:    unwrapstring(startError),
+		ResourceUsage: resourceUsage(userCPU, systemCPU, maxRSS),
+		StatusMessage: unwrapstring(statusMessage),
+		Redactions:    redactions,
+	}, nil
+}
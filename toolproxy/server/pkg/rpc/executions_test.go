@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var executionColumnNames = []string{
+	"agent_id", "status", "std_out", "std_err", "create_time", "start_time", "end_time", "heartbeat_time",
+	"exit_code", "signal", "start_error", "user_cpu_us", "system_cpu_us", "max_rss_bytes", "status_message", "redactions",
+}
+
+func TestResolveTargets(t *testing.T) {
+	t.Run("Resolve agents and selectors", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getAgentQuery).WithArgs("web-host-1").WillReturnRows(
+			sqlmock.NewRows([]string{"description", "labels", "principal", "create_time", "update_time", "last_seen_time"}).
+				AddRow(nil, []byte(`{}`), "service-accounts:web-host-1", time.Time{}, time.Time{}, nil),
+		)
+
+		s := &Server{DB: db}
+		_, selectors, err := s.resolveTargets(context.Background(), []string{"role=database", "agents/web-host-1", "region=us-east-1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if string(selectors.([]byte)) != `[{"role":"database"},{"region":"us-east-1"}]` {
+			t.Errorf("Bad selectors: %s", selectors)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject target with targets", func(t *testing.T) {
+		err := validateRollout("role=database", []string{"role=web"}, 0, 0)
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+
+	t.Run("Reject negative parallelism", func(t *testing.T) {
+		err := validateRollout("", []string{"role=web"}, -1, 0)
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+}
+
+func TestGetExecution(t *testing.T) {
+	t.Run("Get finished execution", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getExecutionQuery).WithArgs(1, "db-host-1").WillReturnRows(
+			sqlmock.NewRows(executionColumnNames).AddRow(
+				"db-host-1", pb.Status_ERROR, []byte("out"), nil, time.Time{}, time.Time{}, time.Time{}, time.Time{},
+				2, nil, nil, nil, nil, nil, nil, nil,
+			),
+		)
+
+		s := &Server{DB: db}
+		e, err := s.GetExecution(context.Background(), &pb.GetExecutionRequest{Name: "commands/1/executions/db-host-1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if e.GetName() != "commands/1/executions/db-host-1" || e.GetAgent() != "agents/db-host-1" {
+			t.Errorf("Bad execution names: %v", e)
+		}
+		if e.GetStatus() != pb.Status_ERROR || e.GetExitCode().GetValue() != 2 || string(e.GetStdOut()) != "out" {
+			t.Errorf("Bad execution result: %v", e)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject malformed name", func(t *testing.T) {
+		s := &Server{}
+		for _, name := range []string{"commands/1", "commands/1/approvals/db-host-1", "commands/x/executions/db-host-1"} {
+			_, err := s.GetExecution(context.Background(), &pb.GetExecutionRequest{Name: name})
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %q; got %v", codes.InvalidArgument, name, status.Convert(err).Code())
+			}
+		}
+	})
+}
+
+func TestListExecutions(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// One more execution than the page size is read to learn whether there
+	// is another page.
+	mock.ExpectQuery(listExecutionsQuery).WithArgs(1, "", 3).WillReturnRows(
+		sqlmock.NewRows(executionColumnNames).
+			AddRow("db-host-1", pb.Status_SUCCESS, nil, nil, time.Time{}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).
+			AddRow("db-host-2", pb.Status_SUBMITTED, nil, nil, time.Time{}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil).
+			AddRow("db-host-3", pb.Status_SUBMITTED, nil, nil, time.Time{}, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil),
+	)
+
+	s := &Server{DB: db}
+	res, err := s.ListExecutions(context.Background(), &pb.ListExecutionsRequest{Parent: "commands/1", PageSize: 2})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(res.GetExecutions()) != 2 || res.GetExecutions()[1].GetStatus() != pb.Status_SUBMITTED {
+		t.Errorf("Bad executions: %v", res.GetExecutions())
+	}
+	if res.GetNextPageToken() != "db-host-2" {
+		t.Errorf("Expected next page token %q; got %q", "db-host-2", res.GetNextPageToken())
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestListExecutionsPageSize(t *testing.T) {
+	s := &Server{}
+	for _, size := range []int32{-1, maxPageSize + 1} {
+		_, err := s.ListExecutions(context.Background(), &pb.ListExecutionsRequest{Parent: "commands/1", PageSize: size})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected %v for page size %d; got %v", codes.InvalidArgument, size, err)
+		}
+	}
+}
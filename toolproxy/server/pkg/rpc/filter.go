@@ -0,0 +1,189 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// filterField is a field of a command which may be compared in a filter.
+type filterField struct {
+	// column is the SQL expression of the field.
+	column string
+
+	// ordered is whether the field may be compared with `<`, `<=`, `>` and
+	// `>=` as well as `=` and `!=`.
+	ordered bool
+
+	// parse converts a value in a filter to the type of the column.
+	parse func(string) (interface{}, error)
+}
+
+var commandFilterFields = map[string]filterField{
+	"issuer":      {column: "issuer", parse: parseFilterString},
+	"tool":        {column: "tool", parse: parseFilterString},
+	"argv[0]":     {column: "argv[1]", parse: parseFilterString},
+	"status":      {column: "status", parse: parseFilterStatus},
+	"create_time": {column: "create_time", ordered: true, parse: parseFilterTime},
+	"break_glass": {column: "(break_glass_time IS NOT NULL)", parse: parseFilterBool},
+	"break_glass.review_state": {
+		column: fmt.Sprintf(
+			"(CASE WHEN break_glass_time IS NULL THEN %d WHEN break_glass_review_time IS NULL THEN %d ELSE %d END)",
+			pb.BreakGlassReviewState_BREAK_GLASS_REVIEW_STATE_UNSPECIFIED,
+			pb.BreakGlassReviewState_REVIEW_OPEN,
+			pb.BreakGlassReviewState_REVIEW_SIGNED_OFF,
+		),
+		parse: parseFilterReviewState,
+	},
+}
+
+var filterOperators = map[string]string{
+	"=":  "=",
+	"!=": "<>",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+func parseFilterString(v string) (interface{}, error) {
+	return v, nil
+}
+
+func parseFilterStatus(v string) (interface{}, error) {
+	s, ok := pb.Status_value[v]
+	if !ok || s == int32(pb.Status_UNDEFINED) {
+		return nil, fmt.Errorf("unknown status %q", v)
+	}
+	return s, nil
+}
+
+func parseFilterBool(v string) (interface{}, error) {
+	switch v {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return nil, fmt.Errorf("malformed boolean %q", v)
+}
+
+func parseFilterReviewState(v string) (interface{}, error) {
+	s, ok := pb.BreakGlassReviewState_value[v]
+	if !ok || s == int32(pb.BreakGlassReviewState_BREAK_GLASS_REVIEW_STATE_UNSPECIFIED) {
+		return nil, fmt.Errorf("unknown review state %q", v)
+	}
+	return s, nil
+}
+
+func parseFilterTime(v string) (interface{}, error) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return nil, fmt.Errorf("malformed timestamp %q", v)
+	}
+	return t, nil
+}
+
+// compileFilter translates an AIP-160 filter expression over commands into
+// SQL conditions, one per comparison, whose parameters are numbered from
+// first. The filter must be a conjunction of comparisons of a field with a
+// value.
+func compileFilter(filter string, first int) ([]string, []interface{}, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	for len(tokens) > 0 {
+		if len(conditions) > 0 {
+			if tokens[0].quoted || tokens[0].text != "AND" {
+				return nil, nil, fmt.Errorf("expected AND; got %q", tokens[0].text)
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 3 {
+			return nil, nil, fmt.Errorf("incomplete comparison")
+		}
+		name, op, value := tokens[0], tokens[1], tokens[2]
+		tokens = tokens[3:]
+
+		field, ok := commandFilterFields[name.text]
+		if name.quoted || !ok {
+			return nil, nil, fmt.Errorf("unknown field %q", name.text)
+		}
+		sqlOp, ok := filterOperators[op.text]
+		if op.quoted || !ok {
+			return nil, nil, fmt.Errorf("unknown operator %q", op.text)
+		}
+		if !field.ordered && sqlOp != "=" && sqlOp != "<>" {
+			return nil, nil, fmt.Errorf("field %q may only be compared with = and !=", name.text)
+		}
+		arg, err := field.parse(value.text)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// A field which is not set is not equal to any value.
+		cond := fmt.Sprintf("%s %s $%d", field.column, sqlOp, first+len(args))
+		if sqlOp == "<>" {
+			cond = fmt.Sprintf("%s IS DISTINCT FROM $%d", field.column, first+len(args))
+		}
+		conditions = append(conditions, cond)
+		args = append(args, arg)
+	}
+	return conditions, args, nil
+}
+
+// filterToken is a token of a filter expression.
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeFilter splits a filter expression into names, operators and
+// values. Values containing spaces or operators must be quoted with double
+// quotes, within which a backslash escapes the following character.
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	rs := []rune(filter)
+	for i := 0; i < len(rs); {
+		switch c := rs[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(rs) && rs[i] != '"'; i++ {
+				if rs[i] == '\\' && i+1 < len(rs) {
+					i++
+				}
+				b.WriteRune(rs[i])
+			}
+			if i == len(rs) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, filterToken{text: b.String(), quoted: true})
+		case strings.ContainsRune("=!<>", c):
+			j := i + 1
+			if j < len(rs) && rs[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: string(rs[i:j])})
+			i = j
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune(`=!<>"`, rs[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: string(rs[i:j])})
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,42 @@
+package rpc
+
+import (
+	"context"
+
+	authzed "github.com/authzed/authzed-go/proto/authzed/api/v1"
+
+	"github.com/hxtk/yggdrasil/common/authn"
+)
+
+// commandColumns are the columns returned by getCommandQuery.
+var commandColumns = []string{
+	"issuer", "argv", "description",
+	"status", "std_out", "std_err",
+	"create_time", "update_time", "delete_time",
+	"start_time", "end_time", "issuer_display_name",
+	"catalog_entry", "tool", "parameters",
+	"required_approvals", "execution_profile", "timeout_ms",
+	"canceller", "canceller_display_name", "cancel_time",
+	"exit_code", "signal", "start_error",
+	"user_cpu_us", "system_cpu_us", "max_rss_bytes",
+	"executor", "heartbeat_time", "status_message",
+	"schedule_time", "maintenance_window", "expire_time",
+	"target", "targets", "parallelism",
+	"failure_threshold", "inputs", "artifact_paths", "env", "secret_env", "redactions",
+	"break_glass_user", "break_glass_user_display_name", "break_glass_justification", "break_glass_time",
+	"break_glass_reviewer", "break_glass_reviewer_display_name", "break_glass_review_comment", "break_glass_review_time",
+	"preview_argv", "preview_state", "preview_std_out", "preview_std_err", "preview_exit_code", "preview_error", "preview_start_time",
+	"preview_end_time", "preview_overrider", "preview_overrider_display_name", "preview_override_time",
+}
+
+func contextWithSubject(objectType, objectID string) context.Context {
+	return authn.ContextWithIdentity(context.Background(), &authn.Identity{
+		DisplayName: objectID,
+		Subject: &authzed.SubjectReference{
+			Object: &authzed.ObjectReference{
+				ObjectType: objectType,
+				ObjectId:   objectID,
+			},
+		},
+	})
+}
@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	authzed "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/authn"
+	"github.com/hxtk/yggdrasil/common/authz"
+)
+
+// principal is an authenticated user to whom actions are attributed.
+type principal struct {
+	Type        string
+	ID          string
+	DisplayName string
+}
+
+// String returns the principal as a SpiceDB subject, `object_type:object_id`.
+func (p *principal) String() string {
+	return fmt.Sprintf("%s:%s", p.Type, p.ID)
+}
+
+// principalFromContext returns the authenticated caller.
+func principalFromContext(ctx context.Context) (*principal, error) {
+	identity, err := authn.IdentityFromContext(ctx)
+	if err != nil || identity.Subject.GetObject() == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "No client identity found.")
+	}
+
+	object := identity.Subject.GetObject()
+	return &principal{
+		Type:        object.GetObjectType(),
+		ID:          object.GetObjectId(),
+		DisplayName: identity.DisplayName,
+	}, nil
+}
+
+// checkIssuerOrOverride returns nil if the caller may modify the command.
+//
+// The issuer of a command may always modify it. Other users may do so only if
+// they have been granted the `override` permission on the command.
+func (s *Server) checkIssuerOrOverride(ctx context.Context, caller *principal, name string, issuer string) error {
+	if caller.String() == issuer {
+		return nil
+	}
+
+	if s.Authz == nil {
+		return status.Errorf(codes.PermissionDenied, "Only the issuer may modify this command.")
+	}
+
+	ok, err := authz.CheckPermission(ctx, s.Authz, &authzed.ObjectReference{
+		ObjectType: "commands",
+		ObjectId:   name,
+	}, "override")
+	if err != nil {
+		log.WithError(err).Errorln("Error checking override permission.")
+		return status.Errorf(codes.Unavailable, "Permission check could not be processed.")
+	}
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "Only the issuer may modify this command.")
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hxtk/yggdrasil/toolproxy/inputs"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// maxInputBytes is the greatest total size of the standard input and input
+// files of a command.
+const maxInputBytes = 1 << 20
+
+// checkInputs validates the inputs of a command with the given argv and
+// returns them with their digests, or nil if there are none.
+func checkInputs(argv []string, in *pb.CommandInputs) (*pb.CommandInputs, error) {
+	if len(in.GetStdin()) == 0 && len(in.GetFiles()) == 0 {
+		return nil, nil
+	}
+	if err := inputs.Check(argv, in); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid inputs: %v.", err)
+	}
+
+	// Digests are always computed by the server, so that approvers need not
+	// trust the issuer's.
+	in = proto.Clone(in).(*pb.CommandInputs)
+	size := len(in.GetStdin())
+	in.StdinSha256 = ""
+	if len(in.GetStdin()) > 0 {
+		in.StdinSha256 = inputs.Digest(in.GetStdin())
+	}
+	for _, f := range in.GetFiles() {
+		size += len(f.GetContent())
+		f.Sha256 = inputs.Digest(f.GetContent())
+	}
+	if size > maxInputBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Inputs may not exceed %d bytes.", maxInputBytes)
+	}
+	return in, nil
+}
+
+// marshalInputs encodes the inputs of a command to be stored.
+func marshalInputs(in *pb.CommandInputs) (interface{}, error) {
+	if in == nil {
+		return nil, nil
+	}
+	return protojson.Marshal(in)
+}
+
+// unmarshalInputs decodes inputs stored by marshalInputs.
+func unmarshalInputs(data []byte) (*pb.CommandInputs, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var in pb.CommandInputs
+	if err := protojson.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
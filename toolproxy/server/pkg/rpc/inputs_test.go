@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCheckInputs(t *testing.T) {
+	t.Run("Compute digests", func(t *testing.T) {
+		in, err := checkInputs([]string{"/usr/bin/psql", "--file={inputs.fix.sql}"}, &pb.CommandInputs{
+			Stdin:       []byte("stdin"),
+			StdinSha256: "forged",
+			Files:       []*pb.InputFile{{Name: "fix.sql", Content: []byte("")}},
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		// The digest of the issuer is replaced with that of stdin.
+		if in.GetStdinSha256() != "a9a330bd4758ee603e55f811d211391f7fbe27f8ac5a950610cf7a54ba28a4d5" {
+			t.Errorf("Bad stdin digest: %q", in.GetStdinSha256())
+		}
+		// The digest of the empty file.
+		if in.GetFiles()[0].GetSha256() != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+			t.Errorf("Bad file digest: %q", in.GetFiles()[0].GetSha256())
+		}
+	})
+
+	t.Run("No inputs", func(t *testing.T) {
+		in, err := checkInputs([]string{"/bin/true"}, &pb.CommandInputs{})
+		if err != nil || in != nil {
+			t.Errorf("Expected no inputs; got %v, %v", in, err)
+		}
+	})
+
+	t.Run("Reject invalid inputs", func(t *testing.T) {
+		for _, tc := range []struct {
+			argv []string
+			in   *pb.CommandInputs
+		}{
+			{[]string{"/usr/bin/psql", "--file={inputs.fix.sql}"}, &pb.CommandInputs{Stdin: []byte("stdin")}},
+			{[]string{"/bin/cat"}, &pb.CommandInputs{Files: []*pb.InputFile{{Name: "/etc/passwd"}}}},
+			{[]string{"/bin/cat"}, &pb.CommandInputs{Stdin: bytes.Repeat([]byte("a"), maxInputBytes+1)}},
+		} {
+			_, err := checkInputs(tc.argv, tc.in)
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %v; got %v", codes.InvalidArgument, tc.argv, status.Convert(err).Code())
+			}
+		}
+	})
+}
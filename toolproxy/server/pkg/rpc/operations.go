@@ -0,0 +1,373 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/longrunning"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/hxtk/yggdrasil/common/authz"
+	"github.com/hxtk/yggdrasil/common/authz/v1alpha1"
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// maxWaitOperation is the longest WaitOperation waits for an operation to
+// finish, and how long it waits if the request has no timeout. It is short
+// enough that the request is not cut off by proxies with idle timeouts.
+const maxWaitOperation = time.Minute
+
+// startedCondition selects the commands which have been started, and so have
+// an operation. A scheduled command is started by its schedule.
+const startedCondition = "(run_request_time IS NOT NULL OR schedule_time IS NOT NULL)"
+
+const getOperationQuery = `
+	SELECT ` + startedCondition + `
+	FROM commands
+	WHERE id = $1;
+`
+
+// countExecutionsQuery counts the executions of rollouts by outcome. The
+// statuses in which an execution has finished are $2, and those in which it
+// has failed are $3.
+const countExecutionsQuery = `
+	SELECT command_id, count(*), count(*) FILTER (WHERE status = ANY($2)), count(*) FILTER (WHERE status = ANY($3))
+	FROM executions
+	WHERE command_id = ANY($1)
+	GROUP BY command_id;
+`
+
+var (
+	finishedExecutionStatuses = []int64{
+		int64(pb.Status_SUCCESS),
+		int64(pb.Status_ERROR),
+		int64(pb.Status_CANCELED),
+		int64(pb.Status_TIMED_OUT),
+		int64(pb.Status_LOST),
+	}
+	failedExecutionStatuses = []int64{
+		int64(pb.Status_ERROR),
+		int64(pb.Status_CANCELED),
+		int64(pb.Status_TIMED_OUT),
+		int64(pb.Status_LOST),
+	}
+)
+
+// operationsPermissions are the permissions required to call each method of
+// the Operations service. Operations are named `operations/{id}`.
+var operationsPermissions = map[string]*v1alpha1.PermissionsRule{
+	"/google.longrunning.Operations/ListOperations":  {ResourceType: "operations", Permission: "list"},
+	"/google.longrunning.Operations/GetOperation":    {ResourceType: "operations", Permission: "read"},
+	"/google.longrunning.Operations/WaitOperation":   {ResourceType: "operations", Permission: "read"},
+	"/google.longrunning.Operations/CancelOperation": {ResourceType: "operations", Permission: "cancel"},
+	"/google.longrunning.Operations/DeleteOperation": {ResourceType: "operations", Permission: "delete"},
+}
+
+// registerOperationsPermissions registers the permissions of the Operations
+// service, which has no annotations of its own.
+func registerOperationsPermissions(az authz.Registrar) {
+	for rpc, perm := range operationsPermissions {
+		az.RegisterPermission(rpc, perm)
+	}
+}
+
+// parseOperationName returns the ID of the command whose operation has the
+// given name.
+func parseOperationName(name string) (int64, error) {
+	var collection string
+	var id int64
+	u := urn.Parse(name)
+	if err := u.Scan(&collection, &id); err != nil {
+		return 0, err
+	}
+	if collection != "operations" || len(u.Parts) != 2 {
+		return 0, fmt.Errorf("not an operation: %q", name)
+	}
+	return id, nil
+}
+
+// StartCommand implements ToolProxy for Server.
+//
+// The command is queued as by RunCommand, but its operation is returned
+// without waiting for it to finish.
+func (s *Server) StartCommand(ctx context.Context, r *pb.StartCommandRequest) (*longrunning.Operation, error) {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	command, err := s.startCommand(ctx, id, r.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return s.operation(ctx, id, command)
+}
+
+// GetOperation implements longrunning.OperationsServer for Server.
+func (s *Server) GetOperation(ctx context.Context, r *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+	id, err := parseOperationName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed operation name.")
+	}
+
+	command, err := s.getStartedCommand(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.operation(ctx, id, command)
+}
+
+// WaitOperation implements longrunning.OperationsServer for Server.
+//
+// It waits at most maxWaitOperation, after which the operation is returned
+// whether or not it is done.
+func (s *Server) WaitOperation(ctx context.Context, r *longrunning.WaitOperationRequest) (*longrunning.Operation, error) {
+	id, err := parseOperationName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed operation name.")
+	}
+
+	// Wait for the command to finish from before its state is read, so that
+	// the notification cannot be missed.
+	done, unsubscribe := s.subscribe(id)
+	defer unsubscribe()
+
+	command, err := s.getStartedCommand(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, waitTimeout(r.GetTimeout()))
+	defer cancel()
+	command, err = s.awaitCommand(waitCtx, command.GetName(), command, done)
+	if err != nil && ctx.Err() == nil && waitCtx.Err() != nil {
+		// The wait timed out rather than the request, so the operation is
+		// returned as it is now.
+		command, err = s.GetCommand(ctx, &pb.GetCommandRequest{Name: fmt.Sprintf("commands/%d", id)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.operation(ctx, id, command)
+}
+
+// waitTimeout returns how long WaitOperation waits given the timeout of the
+// request.
+func waitTimeout(d *durationpb.Duration) time.Duration {
+	if d == nil || d.AsDuration() <= 0 || d.AsDuration() > maxWaitOperation {
+		return maxWaitOperation
+	}
+	return d.AsDuration()
+}
+
+// CancelOperation implements longrunning.OperationsServer for Server.
+//
+// The command is canceled as by CancelCommand.
+func (s *Server) CancelOperation(ctx context.Context, r *longrunning.CancelOperationRequest) (*emptypb.Empty, error) {
+	id, err := parseOperationName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed operation name.")
+	}
+
+	if _, err := s.getStartedCommand(ctx, id); err != nil {
+		return nil, err
+	}
+	_, err = s.CancelCommand(ctx, &pb.CancelCommandRequest{Name: fmt.Sprintf("commands/%d", id)})
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// DeleteOperation implements longrunning.OperationsServer for Server.
+//
+// Operations are deleted with their commands, so this is not supported.
+func (s *Server) DeleteOperation(ctx context.Context, r *longrunning.DeleteOperationRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Operations are deleted with their commands.")
+}
+
+// ListOperations implements longrunning.OperationsServer for Server.
+//
+// The filter is as for ListCommands, and operations are listed in the order
+// in which their commands were created.
+func (s *Server) ListOperations(ctx context.Context, r *longrunning.ListOperationsRequest) (*longrunning.ListOperationsResponse, error) {
+	if r.GetName() != "" && r.GetName() != "operations" {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed collection name.")
+	}
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+	conditions, args, err := compileFilter(r.GetFilter(), 1)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v.", err)
+	}
+	conditions = append(conditions, startedCondition)
+
+	order, _ := parseCommandOrder("")
+	binding := pageTokenBinding("operations", r.GetFilter())
+	commands, nextPageToken, err := s.listCommands(ctx, conditions, args, order, false, binding, r.GetPageToken(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollouts []int64
+	ids := make([]int64, len(commands))
+	for i, c := range commands {
+		if err := urn.Parse(c.GetName()).Scan(nil, &ids[i]); err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+		if len(c.GetTargets()) > 0 {
+			rollouts = append(rollouts, ids[i])
+		}
+	}
+	progress, err := s.countExecutions(ctx, rollouts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &longrunning.ListOperationsResponse{NextPageToken: nextPageToken}
+	for i, c := range commands {
+		op, err := newOperation(ids[i], c, progress[ids[i]])
+		if err != nil {
+			return nil, err
+		}
+		res.Operations = append(res.Operations, op)
+	}
+	return res, nil
+}
+
+// getStartedCommand returns the command with the given ID if it has been
+// started, and NotFound otherwise.
+func (s *Server) getStartedCommand(ctx context.Context, id int64) (*pb.Command, error) {
+	var started bool
+	err := s.DB.QueryRowContext(ctx, getOperationQuery, id).Scan(&started)
+	if err == sql.ErrNoRows || err == nil && !started {
+		return nil, status.Errorf(codes.NotFound, "Operation not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting operation from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return s.GetCommand(ctx, &pb.GetCommandRequest{Name: fmt.Sprintf("commands/%d", id)})
+}
+
+// operation returns the operation of the command with the given ID.
+func (s *Server) operation(ctx context.Context, id int64, command *pb.Command) (*longrunning.Operation, error) {
+	if len(command.GetTargets()) == 0 {
+		return newOperation(id, command, executionCounts{})
+	}
+
+	progress, err := s.countExecutions(ctx, []int64{id})
+	if err != nil {
+		return nil, err
+	}
+	return newOperation(id, command, progress[id])
+}
+
+// executionCounts is the progress of a rollout.
+type executionCounts struct {
+	total, finished, failed int32
+}
+
+// countExecutions returns the progress of each of the given rollouts.
+func (s *Server) countExecutions(ctx context.Context, ids []int64) (map[int64]executionCounts, error) {
+	counts := make(map[int64]executionCounts)
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	rows, err := s.DB.QueryContext(
+		ctx,
+		countExecutionsQuery,
+		pq.Array(ids),
+		pq.Array(finishedExecutionStatuses),
+		pq.Array(failedExecutionStatuses),
+	)
+	if err != nil {
+		log.WithError(err).Errorln("Error counting executions.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var c executionCounts
+		if err := rows.Scan(&id, &c.total, &c.finished, &c.failed); err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+		counts[id] = c
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error counting executions.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	return counts, nil
+}
+
+// newOperation returns the operation of a command.
+//
+// Once the command has finished, the operation's response is the command,
+// unless it finished without running, in which case the operation's error
+// is as RunCommand would return.
+func newOperation(id int64, command *pb.Command, progress executionCounts) (*longrunning.Operation, error) {
+	metadata, err := anypb.New(&pb.CommandOperationMetadata{
+		Command:            command.GetName(),
+		Status:             command.GetStatus(),
+		StartTime:          command.GetStartTime(),
+		HeartbeatTime:      command.GetHeartbeatTime(),
+		EndTime:            command.GetEndTime(),
+		StatusMessage:      command.GetStatusMessage(),
+		TotalExecutions:    progress.total,
+		FinishedExecutions: progress.finished,
+		FailedExecutions:   progress.failed,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	op := &longrunning.Operation{
+		Name:     fmt.Sprintf("operations/%d", id),
+		Metadata: metadata,
+		Done:     isTerminal(command.GetStatus()),
+	}
+	if !op.Done {
+		return op, nil
+	}
+
+	switch {
+	case command.GetStatus() == pb.Status_CANCELED && command.GetStartTime() == nil:
+		op.Result = &longrunning.Operation_Error{Error: &spb.Status{
+			Code:    int32(codes.Canceled),
+			Message: "Command was canceled.",
+		}}
+	case command.GetStatus() == pb.Status_DELETED:
+		op.Result = &longrunning.Operation_Error{Error: &spb.Status{
+			Code:    int32(codes.FailedPrecondition),
+			Message: "Command was canceled.",
+		}}
+	case command.GetStatus() == pb.Status_EXPIRED:
+		op.Result = &longrunning.Operation_Error{Error: &spb.Status{
+			Code:    int32(codes.FailedPrecondition),
+			Message: "Command expired before it was run.",
+		}}
+	default:
+		response, err := anypb.New(command)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+		op.Result = &longrunning.Operation_Response{Response: response}
+	}
+	return op, nil
+}
@@ -0,0 +1,287 @@
+package rpc
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// startedCommand returns a row of getCommandQuery for a command with the
+// given status and rollout targets.
+func startedCommand(s pb.Status, targets []string) []driver.Value {
+	row := make([]driver.Value, len(commandColumns))
+	row[0], row[1], row[2], row[3] = "users:alice", pq.Array([]string{"/bin/true"}), "", s
+	row[6], row[7] = time.Time{}, time.Time{}
+	if targets != nil {
+		row[34] = pq.Array(targets)
+	}
+	return row
+}
+
+func operationMetadata(t *testing.T, op *longrunning.Operation) *pb.CommandOperationMetadata {
+	t.Helper()
+	var m pb.CommandOperationMetadata
+	if err := op.GetMetadata().UnmarshalTo(&m); err != nil {
+		t.Fatalf("Bad operation metadata: %v", err)
+	}
+	return &m
+}
+
+func TestStartCommand(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(requestRunQuery).WithArgs(1, sqlmock.AnyArg(), pb.Status_READY, pb.PreviewState_PREVIEW_SUCCEEDED).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertEventQuery).WithArgs(
+		1,
+		pb.Action_ACTION_RUN,
+		"users",
+		"alice",
+		"alice",
+		sqlmock.AnyArg(),
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(notifyQuery).WithArgs(executor.RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectQuery(getCommandQuery).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_READY, nil)...))
+
+	s := &Server{DB: db}
+	op, err := s.StartCommand(contextWithSubject("users", "alice"), &pb.StartCommandRequest{Name: "commands/1"})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if op.GetName() != "operations/1" || op.GetDone() {
+		t.Errorf("Expected operations/1 not to be done; got %v", op)
+	}
+	if m := operationMetadata(t, op); m.GetCommand() != "commands/1" || m.GetStatus() != pb.Status_READY {
+		t.Errorf("Bad operation metadata: %v", m)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestGetOperation(t *testing.T) {
+	t.Run("Return finished command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(true))
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_ERROR, nil)...))
+
+		s := &Server{DB: db}
+		op, err := s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: "operations/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		var cmd pb.Command
+		if !op.GetDone() || op.GetResponse().UnmarshalTo(&cmd) != nil || cmd.GetStatus() != pb.Status_ERROR {
+			t.Errorf("Expected finished command as response; got %v", op)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Report progress of rollout", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(true))
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_RUNNING, []string{"env=prod"})...))
+		mock.ExpectQuery(countExecutionsQuery).WithArgs(
+			pq.Array([]int64{1}),
+			pq.Array(finishedExecutionStatuses),
+			pq.Array(failedExecutionStatuses),
+		).WillReturnRows(sqlmock.NewRows([]string{"command_id", "total", "finished", "failed"}).AddRow(1, 5, 3, 1))
+
+		s := &Server{DB: db}
+		op, err := s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: "operations/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		m := operationMetadata(t, op)
+		if op.GetDone() || m.GetTotalExecutions() != 5 || m.GetFinishedExecutions() != 3 || m.GetFailedExecutions() != 1 {
+			t.Errorf("Bad progress of rollout: %v", m)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail command canceled before it ran", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(true))
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_CANCELED, nil)...))
+
+		s := &Server{DB: db}
+		op, err := s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: "operations/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if !op.GetDone() || codes.Code(op.GetError().GetCode()) != codes.Canceled {
+			t.Errorf("Expected canceled operation; got %v", op)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Return command canceled while running", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		row := startedCommand(pb.Status_CANCELED, nil)
+		row[4], row[9], row[22] = []byte("partial output"), time.Now(), "SIGTERM"
+		mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(true))
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(row...))
+
+		s := &Server{DB: db}
+		op, err := s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: "operations/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		var cmd pb.Command
+		if !op.GetDone() || op.GetResponse().UnmarshalTo(&cmd) != nil {
+			t.Fatalf("Expected canceled command as response; got %v", op)
+		}
+		if cmd.GetStatus() != pb.Status_CANCELED || string(cmd.GetStdOut()) != "partial output" || cmd.GetSignal() != "SIGTERM" {
+			t.Errorf("Expected output of canceled command; got %v", &cmd)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Command not started", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(false))
+
+		s := &Server{DB: db}
+		_, err = s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: "operations/1"})
+		if status.Convert(err).Code() != codes.NotFound {
+			t.Errorf("Expected grpc status %v; got %v", codes.NotFound, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Malformed name", func(t *testing.T) {
+		s := &Server{}
+		for _, name := range []string{"commands/1", "operations/x", "operations/1/foo"} {
+			_, err := s.GetOperation(context.Background(), &longrunning.GetOperationRequest{Name: name})
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %q; got %v", codes.InvalidArgument, name, status.Convert(err).Code())
+			}
+		}
+	})
+}
+
+func TestWaitOperation(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(getOperationQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"started"}).AddRow(true))
+	mock.ExpectQuery(getCommandQuery).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_RUNNING, nil)...))
+	mock.ExpectQuery(getCommandQuery).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(startedCommand(pb.Status_RUNNING, nil)...))
+
+	// The command does not finish before the wait times out, so the
+	// operation is returned as it is.
+	s := &Server{DB: db}
+	op, err := s.WaitOperation(context.Background(), &longrunning.WaitOperationRequest{
+		Name:    "operations/1",
+		Timeout: durationpb.New(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if op.GetDone() || operationMetadata(t, op).GetStatus() != pb.Status_RUNNING {
+		t.Errorf("Expected running operation; got %v", op)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestListOperations(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(fmt.Sprintf(
+		listCommandsQuery,
+		viewColumns(false),
+		"status = $1 AND "+startedCondition,
+		"create_time ASC, id ASC",
+		2,
+	)).WithArgs(int32(pb.Status_SUCCESS), defaultPageSize+1).WillReturnRows(
+		sqlmock.NewRows(append([]string{"id"}, commandColumns...)).
+			AddRow(listedCommand(1, time.Time{})...).
+			AddRow(listedCommand(2, time.Time{})...),
+	)
+
+	s := &Server{DB: db}
+	res, err := s.ListOperations(context.Background(), &longrunning.ListOperationsRequest{
+		Name:   "operations",
+		Filter: "status = SUCCESS",
+	})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if len(res.GetOperations()) != 2 || res.GetOperations()[1].GetName() != "operations/2" || !res.GetOperations()[1].GetDone() {
+		t.Errorf("Expected operations 1 and 2 to be done; got %v", res)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// outputPollInterval is how often StreamCommandOutput checks for new output.
+const outputPollInterval = 500 * time.Millisecond
+
+// isTerminal reports whether a command with the given status will never run
+// or produce more output.
+func isTerminal(s pb.Status) bool {
+	switch s {
+	case pb.Status_SUCCESS, pb.Status_ERROR, pb.Status_DELETED, pb.Status_CANCELED, pb.Status_TIMED_OUT, pb.Status_LOST, pb.Status_EXPIRED:
+		return true
+	}
+	return false
+}
+
+const getCommandStatusQuery = `
+	SELECT status
+	FROM commands
+	WHERE id = $1;
+`
+
+const listChunksQuery = `
+	SELECT id, stream, data, write_time
+	FROM output_chunks
+	WHERE command_id = $1 AND agent_id IS NULL AND id > $2
+	ORDER BY id;
+`
+
+// StreamCommandOutput implements ToolProxy for Server.
+func (s *Server) StreamCommandOutput(r *pb.StreamCommandOutputRequest, stream pb.ToolProxy_StreamCommandOutputServer) error {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	ctx := stream.Context()
+	var after int64
+	for {
+		// The status must be read before the output: all output is persisted
+		// before a command is marked as finished, so if the command was already
+		// finished then the output read afterward is complete.
+		var statusID int32
+		err = s.DB.QueryRowContext(ctx, getCommandStatusQuery, id).Scan(&statusID)
+		if err == sql.ErrNoRows {
+			return status.Errorf(codes.NotFound, "Command not found.")
+		} else if err != nil {
+			log.WithError(err).Errorln("Error getting command status.")
+			return status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+
+		after, err = s.sendChunks(ctx, stream, id, after)
+		if err != nil {
+			return err
+		}
+
+		if isTerminal(pb.Status(statusID)) {
+			return nil
+		}
+
+		timer := time.NewTimer(outputPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.Errorf(codes.Canceled, "Request canceled.")
+		case <-timer.C:
+		}
+	}
+}
+
+// sendChunks sends all output of a command after the chunk with ID `after`,
+// returning the ID of the last chunk sent.
+func (s *Server) sendChunks(ctx context.Context, stream pb.ToolProxy_StreamCommandOutputServer, commandID int64, after int64) (int64, error) {
+	rows, err := s.DB.QueryContext(ctx, listChunksQuery, commandID, after)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing output chunks.")
+		return after, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var streamID int32
+		var data []byte
+		var writeTime sql.NullTime
+		if err = rows.Scan(&after, &streamID, &data, &writeTime); err != nil {
+			return after, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		err = stream.Send(&pb.OutputChunk{
+			Stream:    pb.Stream(streamID),
+			Data:      data,
+			WriteTime: timestamp(writeTime),
+		})
+		if err != nil {
+			return after, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error reading output chunks.")
+		return after, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return after, nil
+}
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+type fakeOutputStream struct {
+	grpc.ServerStream
+
+	ctx    context.Context
+	chunks []*pb.OutputChunk
+}
+
+func (f *fakeOutputStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeOutputStream) Send(chunk *pb.OutputChunk) error {
+	f.chunks = append(f.chunks, chunk)
+	return nil
+}
+
+func TestStreamCommandOutput(t *testing.T) {
+	t.Run("Replay output of completed command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getCommandStatusQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"status"}).AddRow(pb.Status_SUCCESS),
+		)
+		mock.ExpectQuery(listChunksQuery).WithArgs(1, 0).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "stream", "data", "write_time"}).
+				AddRow(1, pb.Stream_STDOUT, []byte("foo\n"), time.Time{}).
+				AddRow(2, pb.Stream_STDERR, []byte("bar\n"), time.Time{}),
+		)
+
+		s := &Server{DB: db}
+		stream := &fakeOutputStream{ctx: context.Background()}
+		err = s.StreamCommandOutput(&pb.StreamCommandOutputRequest{Name: "commands/1"}, stream)
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if len(stream.chunks) != 2 {
+			t.Fatalf("Expected 2 chunks; got %d", len(stream.chunks))
+		}
+
+		if stream.chunks[0].GetStream() != pb.Stream_STDOUT || string(stream.chunks[0].GetData()) != "foo\n" {
+			t.Errorf("Unexpected first chunk: %v", stream.chunks[0])
+		}
+
+		if stream.chunks[1].GetStream() != pb.Stream_STDERR || string(stream.chunks[1].GetData()) != "bar\n" {
+			t.Errorf("Unexpected second chunk: %v", stream.chunks[1])
+		}
+	})
+
+	t.Run("Follow output of running command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getCommandStatusQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"status"}).AddRow(pb.Status_RUNNING),
+		)
+		mock.ExpectQuery(listChunksQuery).WithArgs(1, 0).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "stream", "data", "write_time"}).
+				AddRow(3, pb.Stream_STDOUT, []byte("foo\n"), time.Time{}),
+		)
+		mock.ExpectQuery(getCommandStatusQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"status"}).AddRow(pb.Status_ERROR),
+		)
+		mock.ExpectQuery(listChunksQuery).WithArgs(1, 3).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "stream", "data", "write_time"}).
+				AddRow(5, pb.Stream_STDERR, []byte("bar\n"), time.Time{}),
+		)
+
+		s := &Server{DB: db}
+		stream := &fakeOutputStream{ctx: context.Background()}
+		err = s.StreamCommandOutput(&pb.StreamCommandOutputRequest{Name: "commands/1"}, stream)
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if len(stream.chunks) != 2 {
+			t.Errorf("Expected 2 chunks; got %d", len(stream.chunks))
+		}
+	})
+
+	t.Run("Not found command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getCommandStatusQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"status"}),
+		)
+
+		s := &Server{DB: db}
+		stream := &fakeOutputStream{ctx: context.Background()}
+		err = s.StreamCommandOutput(&pb.StreamCommandOutputRequest{Name: "commands/1"}, stream)
+		if status.Convert(err).Code() != codes.NotFound {
+			t.Errorf("Expected grpc status %v; got %v", codes.NotFound, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageSize is the page size of list requests which do not
+	// specify one.
+	defaultPageSize = 50
+
+	// maxPageSize is the greatest page size of a list request.
+	maxPageSize = 1000
+)
+
+// pageSize returns the number of items to return for the requested page
+// size. Every list RPC pages through it, and reads one more item than it
+// returns to learn whether there is another page, so that a last page which
+// happens to be full is not followed by an empty one.
+func pageSize(requested int32) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, errors.New("page size must not be negative")
+	case requested == 0:
+		return defaultPageSize, nil
+	case requested > maxPageSize:
+		return 0, fmt.Errorf("page size must not exceed %d", maxPageSize)
+	}
+	return int(requested), nil
+}
+
+// commandOrder is the order in which commands are listed.
+type commandOrder struct {
+	// field is the ordered field, as named in order_by.
+	field string
+
+	// key is the SQL expression by which commands are ordered before their
+	// IDs. It is empty if commands are ordered by ID alone.
+	key string
+
+	desc bool
+}
+
+var commandOrderKeys = map[string]string{
+	"name":        "",
+	"create_time": "create_time",
+	"update_time": "COALESCE(update_time, create_time)",
+}
+
+// parseCommandOrder parses an AIP-132 order_by of a single field of a
+// command.
+func parseCommandOrder(orderBy string) (commandOrder, error) {
+	parts := strings.Fields(orderBy)
+	if len(parts) == 0 {
+		return commandOrder{field: "create_time", key: commandOrderKeys["create_time"]}, nil
+	}
+	if strings.Contains(orderBy, ",") || len(parts) > 2 {
+		return commandOrder{}, errors.New("commands may only be ordered by a single field")
+	}
+
+	key, ok := commandOrderKeys[parts[0]]
+	if !ok {
+		return commandOrder{}, fmt.Errorf("commands may not be ordered by %q", parts[0])
+	}
+	o := commandOrder{field: parts[0], key: key}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "asc":
+		case "desc":
+			o.desc = true
+		default:
+			return commandOrder{}, fmt.Errorf("unknown direction %q", parts[1])
+		}
+	}
+	return o, nil
+}
+
+// String returns the canonical form of the order.
+func (o commandOrder) String() string {
+	if o.desc {
+		return o.field + " desc"
+	}
+	return o.field
+}
+
+// orderBy returns the SQL ORDER BY expressions of the order.
+func (o commandOrder) orderBy() string {
+	dir := "ASC"
+	if o.desc {
+		dir = "DESC"
+	}
+	if o.key == "" {
+		return "id " + dir
+	}
+	return fmt.Sprintf("%s %s, id %s", o.key, dir, dir)
+}
+
+// after returns the SQL condition selecting the commands after the given
+// position, whose parameters are numbered from first.
+func (o commandOrder) after(p *pageToken, first int) (string, []interface{}) {
+	op := ">"
+	if o.desc {
+		op = "<"
+	}
+	if o.key == "" {
+		return fmt.Sprintf("id %s $%d", op, first), []interface{}{p.ID}
+	}
+	return fmt.Sprintf("(%s, id) %s ($%d, $%d)", o.key, op, first, first+1),
+		[]interface{}{time.UnixMicro(p.Time).UTC(), p.ID}
+}
+
+// pageToken is the position of the last item of a page of results, and the
+// request to which it belongs.
+type pageToken struct {
+	// Binding is a digest of the parameters of the request which determine
+	// which items are listed and in what order.
+	Binding []byte `json:"b"`
+
+	// Time is the ordering key of the last item, in microseconds since the
+	// Unix epoch, if it is ordered by a timestamp.
+	Time int64 `json:"t,omitempty"`
+
+	// ID is the ID of the last item.
+	ID int64 `json:"i"`
+}
+
+// pageTokenBinding returns the binding of page tokens to a request with the
+// given parameters.
+func pageTokenBinding(params ...string) []byte {
+	h := sha256.New()
+	for _, p := range params {
+		h.Write([]byte(strconv.Itoa(len(p))))
+		h.Write([]byte{':'})
+		h.Write([]byte(p))
+	}
+	return h.Sum(nil)[:16]
+}
+
+// encodePageToken returns the opaque form of a page token, which is
+// authenticated with key so that it cannot be forged.
+func encodePageToken(key []byte, p *pageToken) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(data)), nil
+}
+
+// decodePageToken returns the page token encoded by encodePageToken, if it
+// was issued for a request with the given binding.
+func decodePageToken(key []byte, token string, binding []byte) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < sha256.Size {
+		return nil, errors.New("malformed page token")
+	}
+	data, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, errors.New("malformed page token")
+	}
+
+	var p pageToken
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errors.New("malformed page token")
+	}
+	if !hmac.Equal(p.Binding, binding) {
+		return nil, errors.New("page token was issued for a different request")
+	}
+	return &p, nil
+}
+
+// pageTokenKey returns the key with which page tokens are authenticated.
+func (s *Server) pageTokenKey() []byte {
+	if len(s.PageTokenKey) > 0 {
+		return s.PageTokenKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.randomPageTokenKey == nil {
+		s.randomPageTokenKey = make([]byte, 32)
+		if _, err := rand.Read(s.randomPageTokenKey); err != nil {
+			panic(err)
+		}
+	}
+	return s.randomPageTokenKey
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// previewColumns holds the preview columns of a command as they are scanned.
+type previewColumns struct {
+	argv                 []string
+	state                sql.NullInt32
+	stdOut               []byte
+	stdErr               []byte
+	exitCode             sql.NullInt32
+	failure              sql.NullString
+	startTime            sql.NullTime
+	endTime              sql.NullTime
+	overrider            sql.NullString
+	overriderDisplayName sql.NullString
+	overrideTime         sql.NullTime
+}
+
+// proto returns the preview recorded in the columns, or nil if the command
+// has none.
+func (c *previewColumns) proto() *pb.Preview {
+	if !c.state.Valid {
+		return nil
+	}
+	return &pb.Preview{
+		Argv:                 c.argv,
+		State:                pb.PreviewState(c.state.Int32),
+		StdOut:               c.stdOut,
+		StdErr:               c.stdErr,
+		ExitCode:             exitCode(c.exitCode),
+		Error:                unwrapstring(c.failure),
+		StartTime:            timestamp(c.startTime),
+		EndTime:              timestamp(c.endTime),
+		Overrider:            unwrapstring(c.overrider),
+		OverriderDisplayName: unwrapstring(c.overriderDisplayName),
+		OverrideTime:         timestamp(c.overrideTime),
+	}
+}
+
+// previewArgv returns the argv of the dry run of a command with the given
+// argv which was permitted by the named catalog entry, or nil if the command
+// is not previewed.
+//
+// Commands run on agents are not previewed, since their dry runs would run
+// on the tool proxy rather than where the commands run.
+func (s *Server) previewArgv(entry string, argv []string, target string, targets []string) []string {
+	if s.Catalog == nil || entry == "" || target != "" || len(targets) > 0 {
+		return nil
+	}
+	e := s.Catalog.Entry(entry)
+	if e == nil {
+		return nil
+	}
+	return e.DryRunArgv(argv)
+}
+
+// pendingPreview returns the state with which a command with the given dry
+// run argv is created or edited, which is NULL if it is not previewed.
+func pendingPreview(argv []string) (interface{}, sql.NullInt32) {
+	if argv == nil {
+		return nil, sql.NullInt32{}
+	}
+	return pq.Array(argv), sql.NullInt32{Int32: int32(pb.PreviewState_PREVIEW_PENDING), Valid: true}
+}
+
+// newPreview returns the pending preview of a command which has just been
+// created or edited with the given dry run argv, or nil if it is not
+// previewed.
+func newPreview(argv []string) *pb.Preview {
+	if argv == nil {
+		return nil
+	}
+	return &pb.Preview{
+		Argv:  argv,
+		State: pb.PreviewState_PREVIEW_PENDING,
+	}
+}
+
+// checkPreview returns an error if the preview of a command which is ready
+// prevents it from being run.
+func checkPreview(cmd *pb.Command) error {
+	preview := cmd.GetPreview()
+	if preview == nil || preview.GetOverrideTime() != nil || cmd.GetBreakGlass() != nil {
+		return nil
+	}
+
+	switch preview.GetState() {
+	case pb.PreviewState_PREVIEW_PENDING, pb.PreviewState_PREVIEW_RUNNING:
+		return status.Errorf(codes.FailedPrecondition, "The preview of this command has not finished.")
+	case pb.PreviewState_PREVIEW_FAILED:
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"The preview of this command failed. An approver must override it before the command may run.",
+		)
+	}
+	return nil
+}
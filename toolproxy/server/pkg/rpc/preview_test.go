@@ -0,0 +1,298 @@
+package rpc
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// previewedCommand returns a row of getCommandQuery for a ready command whose
+// preview is in the given state, and which carol overrode if overridden is
+// set.
+func previewedCommand(s pb.PreviewState, overridden bool) []driver.Value {
+	row := startedCommand(pb.Status_READY, nil)
+	row[50], row[51] = pq.Array([]string{"/usr/bin/kubectl", "apply", "--dry-run=server"}), s
+	if overridden {
+		row[58], row[59], row[60] = "users:carol", "carol", time.Now()
+	}
+	return row
+}
+
+func TestCreateCommandPreview(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	c, err := catalog.New([]catalog.Entry{{
+		Name:        "kubectl-apply",
+		Path:        "/usr/bin/kubectl",
+		Subcommands: [][]string{{"apply"}},
+		Flags:       []catalog.Flag{{Name: "-f", Value: "[a-z-]+\\.yaml"}},
+		DryRun:      &catalog.DryRun{Args: []string{"--dry-run=server"}},
+	}})
+	if err != nil {
+		t.Fatalf("Error creating catalog: %v", err)
+	}
+
+	argv := []string{"/usr/bin/kubectl", "apply", "-f", "web.yaml"}
+	previewArgv := []string{"/usr/bin/kubectl", "apply", "--dry-run=server", "-f", "web.yaml"}
+	mock.ExpectBegin()
+	mock.ExpectQuery(createCommandQuery).WithArgs(
+		"users:alice",
+		"users",
+		"alice",
+		"alice",
+		pq.Array(argv),
+		"",
+		pb.Status_SUBMITTED,
+		sqlmock.AnyArg(),
+		"kubectl-apply",
+		nil,
+		nil,
+		sql.NullInt32{},
+		sql.NullInt64{},
+		sql.NullTime{},
+		sql.NullString{},
+		sql.NullTime{},
+		sql.NullString{},
+		sql.NullString{},
+		nil,
+		nil,
+		nil,
+		nil,
+		sql.NullInt32{},
+		sql.NullInt32{},
+		nil,
+		nil,
+		nil,
+		nil,
+		pq.Array(previewArgv),
+		sql.NullInt32{Int32: int32(pb.PreviewState_PREVIEW_PENDING), Valid: true},
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(notifyQuery).WithArgs(executor.RunChannel, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	s := &Server{DB: db, Catalog: c}
+	cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+		Command: &pb.Command{Argv: argv},
+	})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+
+	if got := cmd.GetPreview(); got.GetState() != pb.PreviewState_PREVIEW_PENDING || len(got.GetArgv()) != len(previewArgv) {
+		t.Errorf("Expected pending preview of %q; got %v", previewArgv, got)
+	}
+}
+
+func TestStartPreviewedCommand(t *testing.T) {
+	testCases := []struct {
+		name string
+		row  []driver.Value
+		code codes.Code
+	}{
+		{
+			name: "Preview has not finished",
+			row:  previewedCommand(pb.PreviewState_PREVIEW_RUNNING, false),
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "Preview failed",
+			row:  previewedCommand(pb.PreviewState_PREVIEW_FAILED, false),
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "Failed preview was overridden",
+			row:  previewedCommand(pb.PreviewState_PREVIEW_FAILED, true),
+			code: codes.OK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			// Commands whose preview blocks them are never queued; an
+			// overridden command had already been queued.
+			mock.ExpectBegin()
+			mock.ExpectExec(requestRunQuery).WithArgs(1, sqlmock.AnyArg(), pb.Status_READY, pb.PreviewState_PREVIEW_SUCCEEDED).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(commandColumns).AddRow(tc.row...))
+
+			s := &Server{DB: db}
+			_, err = s.startCommand(contextWithSubject("users", "alice"), 1, "commands/1")
+			if status.Code(err) != tc.code {
+				t.Errorf("Expected %v; got %v", tc.code, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
+
+func TestApproveCommandOverridePreview(t *testing.T) {
+	t.Run("Approver overrides failed preview", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WithArgs(
+			1,
+			"users:carol",
+			pb.Decision_APPROVED,
+			"webhook is down; the change is safe",
+			sqlmock.AnyArg(),
+			true,
+		).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(7, false))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(overridePreviewQuery).WithArgs(
+			1,
+			"users:carol",
+			"carol",
+			sqlmock.AnyArg(),
+			pb.PreviewState_PREVIEW_FAILED,
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_OVERRIDE_PREVIEW,
+			"users",
+			"carol",
+			"carol",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(countApprovalsQuery).WithArgs(
+			1,
+			pb.Decision_APPROVED,
+			pb.Decision_DENIED,
+		).WillReturnRows(sqlmock.NewRows([]string{"approvals", "denials"}).AddRow(1, 0))
+		mock.ExpectExec(setCommandStatusQuery).WithArgs(
+			1,
+			pb.Status_READY,
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		approval, err := s.ApproveCommand(contextWithSubject("users", "carol"), &pb.ApproveCommandRequest{
+			Name:            "commands/1",
+			Comment:         "webhook is down; the change is safe",
+			OverridePreview: true,
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if !approval.GetOverridePreview() {
+			t.Errorf("Expected approval to override preview; got %v", approval)
+		}
+	})
+
+	t.Run("Denial withdraws override", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_READY, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WithArgs(
+			1,
+			"users:carol",
+			pb.Decision_DENIED,
+			"",
+			sqlmock.AnyArg(),
+			false,
+		).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(7, true))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(withdrawOverrideQuery).WithArgs(1, pb.Decision_APPROVED).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(countApprovalsQuery).WithArgs(
+			1,
+			pb.Decision_APPROVED,
+			pb.Decision_DENIED,
+		).WillReturnRows(sqlmock.NewRows([]string{"approvals", "denials"}).AddRow(0, 1))
+		mock.ExpectExec(setCommandStatusQuery).WithArgs(
+			1,
+			pb.Status_SUBMITTED,
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		_, err = s.DenyCommand(contextWithSubject("users", "carol"), &pb.DenyCommandRequest{Name: "commands/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Only failed preview may be overridden", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"issuer", "status", "required_approvals"}).AddRow("users:alice", pb.Status_SUBMITTED, nil),
+		)
+		mock.ExpectQuery(upsertApprovalQuery).WillReturnRows(sqlmock.NewRows([]string{"id", "overrode"}).AddRow(7, false))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(overridePreviewQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		_, err = s.ApproveCommand(contextWithSubject("users", "carol"), &pb.ApproveCommandRequest{
+			Name:            "commands/1",
+			OverridePreview: true,
+		})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Expected FailedPrecondition; got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+const getUnredactedOutputQuery = `
+	SELECT u.std_out, u.std_err, c.redactions
+	FROM unredacted_output AS u
+	JOIN commands AS c ON c.id = u.command_id
+	WHERE u.command_id = $1;
+`
+
+// GetUnredactedOutput implements ToolProxy for Server.
+func (s *Server) GetUnredactedOutput(ctx context.Context, r *pb.GetUnredactedOutputRequest) (*pb.UnredactedOutput, error) {
+	var id int64
+	err := urn.Parse(r.GetName()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Sealer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Unredacted output is not retained.")
+	}
+
+	var sealedOut, sealedErr []byte
+	var redactions []string
+	err = s.DB.QueryRowContext(ctx, getUnredactedOutputQuery, id).Scan(&sealedOut, &sealedErr, pq.Array(&redactions))
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "No unredacted output is retained for this command.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting unredacted output.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	name := fmt.Sprintf("commands/%d", id)
+	stdOut, err := s.Sealer.Open(name, pb.Stream_STDOUT, sealedOut)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Errorln("Error decrypting unredacted output.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+	stdErr, err := s.Sealer.Open(name, pb.Stream_STDERR, sealedErr)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Errorln("Error decrypting unredacted output.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	// The output is returned only once the read has been recorded.
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_READ_UNREDACTED, caller, time.Now(), ""); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.UnredactedOutput{
+		Name:       name,
+		StdOut:     stdOut,
+		StdErr:     stdErr,
+		Redactions: redactions,
+	}, nil
+}
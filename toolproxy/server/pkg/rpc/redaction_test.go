@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestGetUnredactedOutput(t *testing.T) {
+	sealer, err := redact.NewSealer(bytes.Repeat([]byte{1}, redact.KeySize))
+	if err != nil {
+		t.Fatalf("Error creating sealer: %v", err)
+	}
+	sealedOut, _ := sealer.Seal("commands/1", pb.Stream_STDOUT, []byte("password: hunter2\n"))
+	sealedErr, _ := sealer.Seal("commands/1", pb.Stream_STDERR, nil)
+
+	t.Run("Read unredacted output", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getUnredactedOutputQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"std_out", "std_err", "redactions"}).
+				AddRow(sealedOut, sealedErr, pq.Array([]string{"secret:pg-password"})),
+		)
+		mock.ExpectBegin()
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_READ_UNREDACTED,
+			"users",
+			"alice",
+			"alice",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, Sealer: sealer}
+		output, err := s.GetUnredactedOutput(contextWithSubject("users", "alice"), &pb.GetUnredactedOutputRequest{Name: "commands/1"})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if string(output.GetStdOut()) != "password: hunter2\n" || len(output.GetStdErr()) != 0 {
+			t.Errorf("Bad output: %q, %q", output.GetStdOut(), output.GetStdErr())
+		}
+		if len(output.GetRedactions()) != 1 || output.GetRedactions()[0] != "secret:pg-password" {
+			t.Errorf("Bad redactions: %v", output.GetRedactions())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Output of another command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getUnredactedOutputQuery).WithArgs(2).WillReturnRows(
+			sqlmock.NewRows([]string{"std_out", "std_err", "redactions"}).AddRow(sealedOut, sealedErr, nil),
+		)
+
+		s := &Server{DB: db, Sealer: sealer}
+		_, err = s.GetUnredactedOutput(contextWithSubject("users", "alice"), &pb.GetUnredactedOutputRequest{Name: "commands/2"})
+		if status.Convert(err).Code() != codes.Internal {
+			t.Errorf("Expected grpc status %v; got %v", codes.Internal, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Nothing retained", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getUnredactedOutputQuery).WithArgs(1).WillReturnError(sql.ErrNoRows)
+
+		s := &Server{DB: db, Sealer: sealer}
+		_, err = s.GetUnredactedOutput(contextWithSubject("users", "alice"), &pb.GetUnredactedOutputRequest{Name: "commands/1"})
+		if status.Convert(err).Code() != codes.NotFound {
+			t.Errorf("Expected grpc status %v; got %v", codes.NotFound, status.Convert(err).Code())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Not configured", func(t *testing.T) {
+		s := &Server{}
+		_, err := s.GetUnredactedOutput(contextWithSubject("users", "alice"), &pb.GetUnredactedOutputRequest{Name: "commands/1"})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+	})
+}
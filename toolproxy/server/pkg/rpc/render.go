@@ -0,0 +1,295 @@
+package rpc
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+var (
+	toolIDPattern         = regexp.MustCompile(`^[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	parameterNamePattern  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	resourceSegment       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	resourceVariableRegex = regexp.MustCompile(`^\{[a-z][a-z0-9_]*\}$`)
+)
+
+// segment is a piece of an element of an argv template: either literal text
+// or a reference to a parameter.
+type segment struct {
+	literal string
+	param   string
+}
+
+// parseTemplate splits an element of an argv template into segments.
+func parseTemplate(elem string) ([]segment, error) {
+	var segments []segment
+	var literal strings.Builder
+	for i := 0; i < len(elem); i++ {
+		switch c := elem[i]; {
+		case c == '{' && i+1 < len(elem) && elem[i+1] == '{':
+			literal.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(elem) && elem[i+1] == '}':
+			literal.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(elem[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated parameter reference in %q", elem)
+			}
+			name := elem[i+1 : i+end]
+			if !parameterNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid parameter reference %q in %q", name, elem)
+			}
+			if literal.Len() > 0 {
+				segments = append(segments, segment{literal: literal.String()})
+				literal.Reset()
+			}
+			segments = append(segments, segment{param: name})
+			i += end
+		case c == '}':
+			return nil, fmt.Errorf("unmatched `}` in %q; use `}}` for a literal brace", elem)
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	if literal.Len() > 0 {
+		segments = append(segments, segment{literal: literal.String()})
+	}
+	return segments, nil
+}
+
+// validateTool returns an error describing the first problem with the argv
+// template or parameters of t, if any.
+func validateTool(t *pb.Tool) error {
+	argv := t.GetArgv()
+	if len(argv) == 0 {
+		return fmt.Errorf("argv template is empty")
+	}
+	if strings.ContainsAny(argv[0], "{}") || !filepath.IsAbs(argv[0]) {
+		return fmt.Errorf("the first element of argv must be an absolute path without parameters")
+	}
+
+	params := make(map[string]*pb.Parameter)
+	for _, p := range t.GetParameters() {
+		if !parameterNamePattern.MatchString(p.GetName()) {
+			return fmt.Errorf("invalid parameter name %q", p.GetName())
+		}
+		if _, ok := params[p.GetName()]; ok {
+			return fmt.Errorf("duplicate parameter %q", p.GetName())
+		}
+		if err := validateParameter(p); err != nil {
+			return fmt.Errorf("parameter %q: %v", p.GetName(), err)
+		}
+		params[p.GetName()] = p
+	}
+
+	used := make(map[string]struct{})
+	for _, elem := range argv[1:] {
+		segments, err := parseTemplate(elem)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segments {
+			if seg.param == "" {
+				continue
+			}
+			if _, ok := params[seg.param]; !ok {
+				return fmt.Errorf("argv references undefined parameter %q", seg.param)
+			}
+			used[seg.param] = struct{}{}
+		}
+	}
+
+	for name := range params {
+		if _, ok := used[name]; !ok {
+			return fmt.Errorf("parameter %q is not referenced by argv", name)
+		}
+	}
+
+	if t.GetRequiredApprovals() != nil && t.GetRequiredApprovals().GetValue() < 0 {
+		return fmt.Errorf("required approvals may not be negative")
+	}
+
+	return nil
+}
+
+// validateParameter checks that the constraints of p are consistent with
+// its type and that its default value, if any, satisfies them.
+func validateParameter(p *pb.Parameter) error {
+	switch p.GetType() {
+	case pb.ParameterType_STRING:
+		if p.GetPattern() != "" {
+			if _, err := regexp.Compile(p.GetPattern()); err != nil {
+				return err
+			}
+		}
+	case pb.ParameterType_ENUM:
+		if len(p.GetAllowedValues()) == 0 {
+			return fmt.Errorf("enum parameters must have allowed values")
+		}
+	case pb.ParameterType_INT:
+		if p.GetMinValue() != nil && p.GetMaxValue() != nil && p.GetMinValue().GetValue() > p.GetMaxValue().GetValue() {
+			return fmt.Errorf("minimum value exceeds maximum value")
+		}
+	case pb.ParameterType_RESOURCE_NAME:
+		if p.GetResourcePattern() == "" {
+			return fmt.Errorf("resource name parameters must have a resource pattern")
+		}
+		for _, s := range strings.Split(p.GetResourcePattern(), "/") {
+			if !resourceVariableRegex.MatchString(s) && !resourceSegment.MatchString(s) {
+				return fmt.Errorf("invalid resource pattern segment %q", s)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown parameter type %v", p.GetType())
+	}
+
+	if p.GetDefaultValue() != "" {
+		if _, err := parameterValue(p, p.GetDefaultValue()); err != nil {
+			return fmt.Errorf("default value: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// parameterValue checks value against the type and constraints of p and
+// returns it as it should be rendered into argv.
+func parameterValue(p *pb.Parameter, value string) (string, error) {
+	if strings.ContainsRune(value, 0) {
+		return "", fmt.Errorf("value contains a NUL byte")
+	}
+
+	switch p.GetType() {
+	case pb.ParameterType_STRING:
+		if p.GetPattern() == "" {
+			// Without a pattern, we cannot know whether a value beginning
+			// with `-` would be interpreted as a flag.
+			if strings.HasPrefix(value, "-") {
+				return "", fmt.Errorf("value %q may not begin with `-`", value)
+			}
+			return value, nil
+		}
+		re, err := regexp.Compile("^(?:" + p.GetPattern() + ")$")
+		if err != nil {
+			return "", err
+		}
+		if !re.MatchString(value) {
+			return "", fmt.Errorf("value %q does not match %q", value, p.GetPattern())
+		}
+		return value, nil
+
+	case pb.ParameterType_ENUM:
+		for _, v := range p.GetAllowedValues() {
+			if v == value {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("value %q is not one of %q", value, p.GetAllowedValues())
+
+	case pb.ParameterType_INT:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not an integer", value)
+		}
+		if p.GetMinValue() != nil && n < p.GetMinValue().GetValue() {
+			return "", fmt.Errorf("value %d is less than %d", n, p.GetMinValue().GetValue())
+		}
+		if p.GetMaxValue() != nil && n > p.GetMaxValue().GetValue() {
+			return "", fmt.Errorf("value %d is greater than %d", n, p.GetMaxValue().GetValue())
+		}
+		// Render the canonical form so that, e.g., `+1` and `01` are not
+		// passed through to the tool.
+		return strconv.FormatInt(n, 10), nil
+
+	case pb.ParameterType_RESOURCE_NAME:
+		want := strings.Split(p.GetResourcePattern(), "/")
+		got := strings.Split(value, "/")
+		if len(got) != len(want) {
+			return "", fmt.Errorf("value %q does not match %q", value, p.GetResourcePattern())
+		}
+		for i := range want {
+			if resourceVariableRegex.MatchString(want[i]) {
+				if !resourceSegment.MatchString(got[i]) {
+					return "", fmt.Errorf("value %q does not match %q", value, p.GetResourcePattern())
+				}
+			} else if got[i] != want[i] {
+				return "", fmt.Errorf("value %q does not match %q", value, p.GetResourcePattern())
+			}
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown parameter type %v", p.GetType())
+}
+
+// renderArgv renders the argv template of t with the given parameter values.
+//
+// Each element of the template renders to at most one element of argv, so
+// no value can introduce additional arguments. Elements referencing optional
+// parameters with no value are omitted.
+func renderArgv(t *pb.Tool, values map[string]string) ([]string, error) {
+	params := make(map[string]*pb.Parameter)
+	for _, p := range t.GetParameters() {
+		params[p.GetName()] = p
+	}
+
+	for name := range values {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("%s has no parameter %q", t.GetName(), name)
+		}
+	}
+
+	rendered := make(map[string]string)
+	for name, p := range params {
+		value, ok := values[name]
+		if !ok && p.GetDefaultValue() != "" {
+			value, ok = p.GetDefaultValue(), true
+		}
+		if !ok {
+			if p.GetRequired() {
+				return nil, fmt.Errorf("parameter %q is required", name)
+			}
+			continue
+		}
+
+		v, err := parameterValue(p, value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %v", name, err)
+		}
+		rendered[name] = v
+	}
+
+	argv := []string{t.GetArgv()[0]}
+	for _, elem := range t.GetArgv()[1:] {
+		segments, err := parseTemplate(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		var b strings.Builder
+		omit := false
+		for _, seg := range segments {
+			if seg.param == "" {
+				b.WriteString(seg.literal)
+				continue
+			}
+			v, ok := rendered[seg.param]
+			if !ok {
+				omit = true
+				break
+			}
+			b.WriteString(v)
+		}
+		if !omit {
+			argv = append(argv, b.String())
+		}
+	}
+
+	return argv, nil
+}
@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func restartDeployment() *pb.Tool {
+	return &pb.Tool{
+		Name: "tools/restart-deployment",
+		Argv: []string{
+			"/usr/bin/kubectl",
+			"--namespace={namespace}",
+			"rollout",
+			"restart",
+			"{deployment}",
+			"--timeout={timeout}s",
+			"--context={{{cluster}}}",
+		},
+		Parameters: []*pb.Parameter{
+			{
+				Name:          "namespace",
+				Type:          pb.ParameterType_ENUM,
+				AllowedValues: []string{"default", "prod"},
+				DefaultValue:  "default",
+			},
+			{
+				Name:            "deployment",
+				Type:            pb.ParameterType_RESOURCE_NAME,
+				ResourcePattern: "deployment/{deployment}",
+				Required:        true,
+			},
+			{
+				Name:     "timeout",
+				Type:     pb.ParameterType_INT,
+				MinValue: wrapperspb.Int64(1),
+				MaxValue: wrapperspb.Int64(600),
+			},
+			{
+				Name:    "cluster",
+				Type:    pb.ParameterType_STRING,
+				Pattern: "[a-z]+",
+			},
+		},
+	}
+}
+
+func TestRenderArgv(t *testing.T) {
+	testCases := []struct {
+		name   string
+		values map[string]string
+		argv   []string
+		err    string
+	}{
+		{
+			name:   "Defaults and omitted optional parameters",
+			values: map[string]string{"deployment": "deployment/web"},
+			argv: []string{
+				"/usr/bin/kubectl", "--namespace=default", "rollout", "restart", "deployment/web",
+			},
+		},
+		{
+			name: "All parameters",
+			values: map[string]string{
+				"namespace":  "prod",
+				"deployment": "deployment/web",
+				"timeout":    "+030",
+				"cluster":    "east",
+			},
+			argv: []string{
+				"/usr/bin/kubectl", "--namespace=prod", "rollout", "restart", "deployment/web",
+				"--timeout=30s", "--context={east}",
+			},
+		},
+		{
+			name:   "Missing required parameter",
+			values: map[string]string{},
+			err:    `parameter "deployment" is required`,
+		},
+		{
+			name:   "Unknown parameter",
+			values: map[string]string{"deployment": "deployment/web", "force": "true"},
+			err:    `has no parameter "force"`,
+		},
+		{
+			name:   "Value not in enum",
+			values: map[string]string{"deployment": "deployment/web", "namespace": "kube-system"},
+			err:    `value "kube-system" is not one of`,
+		},
+		{
+			name:   "Integer out of range",
+			values: map[string]string{"deployment": "deployment/web", "timeout": "0"},
+			err:    "value 0 is less than 1",
+		},
+		{
+			name:   "Resource name with extra segments",
+			values: map[string]string{"deployment": "deployment/web/../x"},
+			err:    `does not match "deployment/{deployment}"`,
+		},
+		{
+			name:   "Resource name injecting a flag",
+			values: map[string]string{"deployment": "deployment/--all"},
+			err:    `does not match "deployment/{deployment}"`,
+		},
+		{
+			name:   "Shell metacharacters do not match pattern",
+			values: map[string]string{"deployment": "deployment/web", "cluster": "east; rm -rf /"},
+			err:    `does not match "[a-z]+"`,
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			argv, err := renderArgv(restartDeployment(), v.values)
+			if v.err != "" {
+				if err == nil || !strings.Contains(err.Error(), v.err) {
+					t.Errorf("Expected error containing %q; got %v", v.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			if !reflect.DeepEqual(argv, v.argv) {
+				t.Errorf("Expected argv %q; got %q", v.argv, argv)
+			}
+		})
+	}
+}
+
+func TestRenderArgvOneElementPerParameter(t *testing.T) {
+	tool := &pb.Tool{
+		Name:       "tools/echo",
+		Argv:       []string{"/bin/echo", "{message}"},
+		Parameters: []*pb.Parameter{{Name: "message", Type: pb.ParameterType_STRING, Required: true}},
+	}
+
+	argv, err := renderArgv(tool, map[string]string{"message": "hello world; rm -rf / $(id)"})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	expect := []string{"/bin/echo", "hello world; rm -rf / $(id)"}
+	if !reflect.DeepEqual(argv, expect) {
+		t.Errorf("Expected argv %q; got %q", expect, argv)
+	}
+
+	_, err = renderArgv(tool, map[string]string{"message": "--help"})
+	if err == nil {
+		t.Errorf("Expected error for value beginning with `-`; got nil")
+	}
+}
+
+func TestValidateTool(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*pb.Tool)
+		err    string
+	}{
+		{
+			name:   "Valid tool",
+			modify: func(*pb.Tool) {},
+		},
+		{
+			name:   "Relative binary",
+			modify: func(t *pb.Tool) { t.Argv[0] = "kubectl" },
+			err:    "absolute path",
+		},
+		{
+			name:   "Parameterized binary",
+			modify: func(t *pb.Tool) { t.Argv[0] = "/usr/bin/{binary}" },
+			err:    "absolute path",
+		},
+		{
+			name:   "Undefined parameter",
+			modify: func(t *pb.Tool) { t.Argv = append(t.Argv, "{force}") },
+			err:    `undefined parameter "force"`,
+		},
+		{
+			name:   "Unreferenced parameter",
+			modify: func(t *pb.Tool) { t.Argv = t.Argv[:len(t.Argv)-1] },
+			err:    `parameter "cluster" is not referenced`,
+		},
+		{
+			name:   "Unmatched brace",
+			modify: func(t *pb.Tool) { t.Argv = append(t.Argv, "}") },
+			err:    "unmatched",
+		},
+		{
+			name:   "Invalid default value",
+			modify: func(t *pb.Tool) { t.Parameters[0].DefaultValue = "staging" },
+			err:    "default value",
+		},
+		{
+			name:   "Enum without values",
+			modify: func(t *pb.Tool) { t.Parameters[0].AllowedValues = nil },
+			err:    "must have allowed values",
+		},
+		{
+			name:   "Undefined type",
+			modify: func(t *pb.Tool) { t.Parameters[3].Type = pb.ParameterType_PARAMETER_TYPE_UNDEFINED },
+			err:    "unknown parameter type",
+		},
+		{
+			name:   "Negative approvals",
+			modify: func(t *pb.Tool) { t.RequiredApprovals = wrapperspb.Int32(-1) },
+			err:    "may not be negative",
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			tool := restartDeployment()
+			v.modify(tool)
+
+			err := validateTool(tool)
+			if v.err == "" {
+				if err != nil {
+					t.Errorf("Expected success; got error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("Expected error containing %q; got %v", v.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// reviewableStatuses are the statuses of commands which ran and have
+// finished, and so may be reviewed.
+var reviewableStatuses = []pb.Status{
+	pb.Status_SUCCESS,
+	pb.Status_ERROR,
+	pb.Status_CANCELED,
+	pb.Status_TIMED_OUT,
+	pb.Status_LOST,
+}
+
+// reviewable returns whether a command with the given status and start time
+// ran and has finished. Commands canceled before they started never ran.
+func reviewable(s pb.Status, startTime sql.NullTime) bool {
+	for _, r := range reviewableStatuses {
+		if s == r {
+			return startTime.Valid
+		}
+	}
+	return false
+}
+
+const getReviewedCommandQuery = `
+	SELECT issuer, status, start_time
+	FROM commands
+	WHERE id = $1
+	FOR SHARE;
+`
+
+const insertReviewQuery = `
+	INSERT INTO reviews ("command_id", "reviewer", "reviewer_display_name", "verdict", "notes", "create_time")
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING reviews.id;
+`
+
+// CreateReview implements ToolProxy for Server.
+func (s *Server) CreateReview(ctx context.Context, r *pb.CreateReviewRequest) (*pb.Review, error) {
+	var id int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	verdict := r.GetReview().GetVerdict()
+	if _, ok := pb.Verdict_name[int32(verdict)]; !ok || verdict == pb.Verdict_VERDICT_UNDEFINED {
+		return nil, status.Errorf(codes.InvalidArgument, "A verdict is required.")
+	}
+	notes := r.GetReview().GetNotes()
+
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reviewer := caller.String()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	var issuer string
+	var statusID int32
+	var startTime sql.NullTime
+	err = tx.QueryRowContext(ctx, getReviewedCommandQuery, id).Scan(&issuer, &statusID, &startTime)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Command not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting command from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if issuer == reviewer {
+		return nil, status.Errorf(codes.PermissionDenied, "The issuer of a command may not review it.")
+	}
+	if !reviewable(pb.Status(statusID), startTime) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Only commands which ran and have finished may be reviewed.")
+	}
+
+	createTime := time.Now()
+	var reviewID int64
+	err = tx.QueryRowContext(
+		ctx,
+		insertReviewQuery,
+		id,
+		reviewer,
+		caller.DisplayName,
+		verdict,
+		notes,
+		createTime,
+	).Scan(&reviewID)
+	if err != nil {
+		log.WithError(err).Errorln("Error saving review to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	detail := verdict.String()
+	if notes != "" {
+		detail += ": " + notes
+	}
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_REVIEW, caller, createTime, detail); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing review.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.Review{
+		Name:                fmt.Sprintf("commands/%d/reviews/%d", id, reviewID),
+		Reviewer:            reviewer,
+		ReviewerDisplayName: caller.DisplayName,
+		Verdict:             verdict,
+		Notes:               notes,
+		CreateTime:          timestamppb.New(createTime),
+	}, nil
+}
+
+const listReviewsQuery = `
+	SELECT id, reviewer, reviewer_display_name, verdict, notes, create_time
+	FROM reviews
+	WHERE command_id = $1 AND id > $2
+	ORDER BY id
+	LIMIT $3;
+`
+
+// ListReviews implements ToolProxy for Server.
+func (s *Server) ListReviews(ctx context.Context, r *pb.ListReviewsRequest) (*pb.ListReviewsResponse, error) {
+	var commandID int64
+	err := urn.Parse(r.GetParent()).Scan(nil, &commandID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
+	}
+
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	var after int64
+	if r.GetPageToken() != "" {
+		after, err = strconv.ParseInt(r.GetPageToken(), 10, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+		}
+	}
+
+	// One more review than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listReviewsQuery, commandID, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing reviews.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var reviews []*pb.Review
+	for rows.Next() {
+		if len(reviews) == limit {
+			more = true
+			break
+		}
+
+		var reviewer string
+		var verdict int32
+		var reviewerDisplayName, notes sql.NullString
+		var createTime sql.NullTime
+		err = rows.Scan(&after, &reviewer, &reviewerDisplayName, &verdict, &notes, &createTime)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		reviews = append(reviews, &pb.Review{
+			Name:                fmt.Sprintf("commands/%d/reviews/%d", commandID, after),
+			Reviewer:            reviewer,
+			ReviewerDisplayName: unwrapstring(reviewerDisplayName),
+			Verdict:             pb.Verdict(verdict),
+			Notes:               unwrapstring(notes),
+			CreateTime:          timestamp(createTime),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing reviews.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = strconv.FormatInt(after, 10)
+	}
+
+	return &pb.ListReviewsResponse{
+		Reviews:       reviews,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// reviewSampling returns the fraction of finished commands of each status
+// which are sampled for review.
+func (s *Server) reviewSampling() map[pb.Status]float64 {
+	if s.ReviewSampling != nil {
+		return s.ReviewSampling
+	}
+	sampling := make(map[pb.Status]float64, len(reviewableStatuses))
+	for _, st := range reviewableStatuses {
+		sampling[st] = 1
+	}
+	return sampling
+}
+
+// reviewQueueBinding returns the binding of page tokens of the review queue
+// with the given filter. The queue also depends on the sampling policy, so
+// tokens issued before the policy changes are not accepted afterwards.
+func (s *Server) reviewQueueBinding(filter string) []byte {
+	sampling := s.reviewSampling()
+	statuses := make([]pb.Status, 0, len(sampling))
+	for st := range sampling {
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i] < statuses[j] })
+
+	params := []string{"reviewQueue", filter}
+	for _, st := range statuses {
+		params = append(params, st.String(), strconv.FormatFloat(sampling[st], 'g', -1, 64))
+	}
+	return pageTokenBinding(params...)
+}
+
+// reviewQueueConditions returns the SQL conditions selecting the commands
+// which await review under the sampling policy, whose parameters are
+// numbered from first.
+func (s *Server) reviewQueueConditions(first int) ([]string, []interface{}) {
+	sampling := s.reviewSampling()
+	statuses := make([]pb.Status, 0, len(sampling))
+	for st, fraction := range sampling {
+		if fraction > 0 {
+			statuses = append(statuses, st)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i] < statuses[j] })
+
+	var sampled []string
+	var args []interface{}
+	for _, st := range statuses {
+		sampled = append(sampled, fmt.Sprintf("status = $%d AND review_sample < $%d", first+len(args), first+len(args)+1))
+		args = append(args, st, sampling[st])
+	}
+	if len(sampled) == 0 {
+		sampled = []string{"FALSE"}
+	}
+
+	return []string{
+		"start_time IS NOT NULL",
+		"(" + strings.Join(sampled, " OR ") + ")",
+		"NOT EXISTS (SELECT 1 FROM reviews WHERE reviews.command_id = commands.id)",
+	}, args
+}
+
+// ListReviewQueue implements ToolProxy for Server.
+func (s *Server) ListReviewQueue(ctx context.Context, r *pb.ListReviewQueueRequest) (*pb.ListReviewQueueResponse, error) {
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+	conditions, args, err := compileFilter(r.GetFilter(), 1)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v.", err)
+	}
+	queued, queuedArgs := s.reviewQueueConditions(len(args) + 1)
+	conditions = append(conditions, queued...)
+	args = append(args, queuedArgs...)
+
+	order, err := parseCommandOrder("")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	binding := s.reviewQueueBinding(r.GetFilter())
+	commands, nextPageToken, err := s.listCommands(ctx, conditions, args, order, false, binding, r.GetPageToken(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListReviewQueueResponse{
+		Commands:      commands,
+		NextPageToken: nextPageToken,
+	}, nil
+}
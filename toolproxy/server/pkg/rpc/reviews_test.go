@@ -0,0 +1,251 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCreateReview(t *testing.T) {
+	reviewedColumns := []string{"issuer", "status", "start_time"}
+
+	t.Run("Reviewer records verdict", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(getReviewedCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(reviewedColumns).AddRow("users:alice", pb.Status_ERROR, time.Now()),
+		)
+		mock.ExpectQuery(insertReviewQuery).WithArgs(
+			1,
+			"users:bob",
+			"bob",
+			pb.Verdict_CONCERNING,
+			"restarted the wrong deployment",
+			sqlmock.AnyArg(),
+		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_REVIEW,
+			"users",
+			"bob",
+			"bob",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db}
+		review, err := s.CreateReview(contextWithSubject("users", "bob"), &pb.CreateReviewRequest{
+			Parent: "commands/1",
+			Review: &pb.Review{
+				Verdict: pb.Verdict_CONCERNING,
+				Notes:   "restarted the wrong deployment",
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if review.GetName() != "commands/1/reviews/3" || review.GetReviewer() != "users:bob" {
+			t.Errorf("Expected commands/1/reviews/3 by users:bob; got %v", review)
+		}
+	})
+
+	t.Run("Verdict is required", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db}
+		_, err = s.CreateReview(contextWithSubject("users", "bob"), &pb.CreateReviewRequest{
+			Parent: "commands/1",
+			Review: &pb.Review{Notes: "looks fine"},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument; got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	testCases := []struct {
+		name      string
+		caller    string
+		status    pb.Status
+		startTime interface{}
+		code      codes.Code
+	}{
+		{
+			name:      "Issuer may not review own command",
+			caller:    "alice",
+			status:    pb.Status_SUCCESS,
+			startTime: time.Now(),
+			code:      codes.PermissionDenied,
+		},
+		{
+			name:      "Running command may not be reviewed",
+			caller:    "bob",
+			status:    pb.Status_RUNNING,
+			startTime: time.Now(),
+			code:      codes.FailedPrecondition,
+		},
+		{
+			name:   "Command canceled before it ran may not be reviewed",
+			caller: "bob",
+			status: pb.Status_CANCELED,
+			code:   codes.FailedPrecondition,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(getReviewedCommandQuery).WithArgs(1).WillReturnRows(
+				sqlmock.NewRows(reviewedColumns).AddRow("users:alice", tc.status, tc.startTime),
+			)
+			mock.ExpectRollback()
+
+			s := &Server{DB: db}
+			_, err = s.CreateReview(contextWithSubject("users", tc.caller), &pb.CreateReviewRequest{
+				Parent: "commands/1",
+				Review: &pb.Review{Verdict: pb.Verdict_OK},
+			})
+			if status.Code(err) != tc.code {
+				t.Errorf("Expected %v; got %v", tc.code, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
+
+func TestListReviews(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	mock.ExpectQuery(listReviewsQuery).WithArgs(1, 0, 3).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "reviewer", "reviewer_display_name", "verdict", "notes", "create_time"}).
+			AddRow(3, "users:bob", "bob", pb.Verdict_OK, "", time.Now()).
+			AddRow(5, "users:carol", "carol", pb.Verdict_INCIDENT, "caused an outage", time.Now()).
+			AddRow(8, "users:dave", "dave", pb.Verdict_OK, "", time.Now()),
+	)
+
+	s := &Server{DB: db}
+	res, err := s.ListReviews(context.Background(), &pb.ListReviewsRequest{Parent: "commands/1", PageSize: 2})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+
+	if len(res.GetReviews()) != 2 || res.GetReviews()[1].GetName() != "commands/1/reviews/5" || res.GetReviews()[1].GetVerdict() != pb.Verdict_INCIDENT {
+		t.Errorf("Expected two reviews ending with an incident; got %v", res.GetReviews())
+	}
+	if res.GetNextPageToken() != "5" {
+		t.Errorf("Expected next page token 5; got %q", res.GetNextPageToken())
+	}
+}
+
+func TestListReviewQueue(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	// Statuses which are never sampled are left out of the query.
+	mock.ExpectQuery(fmt.Sprintf(
+		listCommandsQuery,
+		viewColumns(false),
+		"tool = $1 AND start_time IS NOT NULL AND "+
+			"(status = $2 AND review_sample < $3 OR status = $4 AND review_sample < $5) AND "+
+			"NOT EXISTS (SELECT 1 FROM reviews WHERE reviews.command_id = commands.id)",
+		"create_time ASC, id ASC",
+		6,
+	)).WithArgs(
+		"tools/restart-deployment",
+		pb.Status_SUCCESS,
+		0.1,
+		pb.Status_ERROR,
+		1.0,
+		defaultPageSize+1,
+	).WillReturnRows(
+		sqlmock.NewRows(append([]string{"id"}, commandColumns...)).AddRow(listedCommand(1, time.Time{})...),
+	)
+
+	s := &Server{
+		DB: db,
+		ReviewSampling: map[pb.Status]float64{
+			pb.Status_SUCCESS: 0.1,
+			pb.Status_ERROR:   1,
+			pb.Status_LOST:    0,
+		},
+	}
+	res, err := s.ListReviewQueue(context.Background(), &pb.ListReviewQueueRequest{
+		Filter: `tool = "tools/restart-deployment"`,
+	})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+
+	if len(res.GetCommands()) != 1 || res.GetCommands()[0].GetName() != "commands/1" {
+		t.Errorf("Expected commands/1 in the queue; got %v", res.GetCommands())
+	}
+}
+
+func TestListReviewQueueSamplingChange(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	key := []byte("key")
+	before := &Server{PageTokenKey: key, ReviewSampling: map[pb.Status]float64{pb.Status_ERROR: 1}}
+	token, err := encodePageToken(key, &pageToken{Binding: before.reviewQueueBinding(""), Time: 42, ID: 7})
+	if err != nil {
+		t.Fatalf("Error encoding page token: %v", err)
+	}
+
+	after := &Server{DB: db, PageTokenKey: key, ReviewSampling: map[pb.Status]float64{pb.Status_ERROR: 0.5}}
+	_, err = after.ListReviewQueue(context.Background(), &pb.ListReviewQueueRequest{PageToken: token})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected page token issued under other sampling to be rejected; got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultScheduleTolerance is used when Server.ScheduleTolerance is zero.
+const defaultScheduleTolerance = 15 * time.Minute
+
+func (s *Server) scheduleTolerance() time.Duration {
+	if s.ScheduleTolerance > 0 {
+		return s.ScheduleTolerance
+	}
+	return defaultScheduleTolerance
+}
+
+// schedule returns the time at which a command is scheduled to run and the
+// time after which it expires, given its requested schedule time and the
+// resource name of its maintenance window, if any. Neither is valid if the
+// command is not scheduled.
+func (s *Server) schedule(ctx context.Context, scheduleTime *timestamppb.Timestamp, window string, now time.Time) (sql.NullTime, sql.NullTime, error) {
+	if scheduleTime == nil && window == "" {
+		return sql.NullTime{}, sql.NullTime{}, nil
+	}
+
+	at := now
+	if scheduleTime != nil {
+		if err := scheduleTime.CheckValid(); err != nil {
+			return sql.NullTime{}, sql.NullTime{}, status.Errorf(codes.InvalidArgument, "Invalid schedule time.")
+		}
+		at = scheduleTime.AsTime()
+	}
+
+	var expire time.Time
+	if window == "" {
+		expire = at.Add(s.scheduleTolerance())
+	} else {
+		id, err := parseWindowName(window)
+		if err != nil {
+			return sql.NullTime{}, sql.NullTime{}, status.Errorf(codes.InvalidArgument, "Malformed maintenance window name.")
+		}
+
+		w, err := s.getWindow(ctx, s.DB, id)
+		if status.Code(err) == codes.NotFound {
+			return sql.NullTime{}, sql.NullTime{}, status.Errorf(codes.InvalidArgument, "Maintenance window not found.")
+		} else if err != nil {
+			return sql.NullTime{}, sql.NullTime{}, err
+		}
+
+		// A command scheduled in the past runs in the next opening.
+		if at.Before(now) {
+			at = now
+		}
+		at, expire, err = nextOpening(w, at)
+		if err != nil {
+			return sql.NullTime{}, sql.NullTime{}, status.Errorf(codes.InvalidArgument, "Invalid maintenance window: %v.", err)
+		}
+	}
+
+	if !expire.After(now) {
+		return sql.NullTime{}, sql.NullTime{}, status.Errorf(codes.InvalidArgument, "Schedule time has passed.")
+	}
+
+	return sql.NullTime{Time: at, Valid: true}, sql.NullTime{Time: expire, Valid: true}, nil
+}
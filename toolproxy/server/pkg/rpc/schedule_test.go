@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2023-01-03 was a Tuesday.
+	now := time.Date(2023, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Unscheduled", func(t *testing.T) {
+		s := &Server{}
+		at, expire, err := s.schedule(context.Background(), nil, "", now)
+		if err != nil || at.Valid || expire.Valid {
+			t.Errorf("Expected no schedule; got %v, %v, %v", at, expire, err)
+		}
+	})
+
+	t.Run("Schedule time", func(t *testing.T) {
+		s := &Server{ScheduleTolerance: time.Minute}
+		at, expire, err := s.schedule(context.Background(), timestamppb.New(now.Add(time.Hour)), "", now)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if !at.Time.Equal(now.Add(time.Hour)) || !expire.Time.Equal(now.Add(time.Hour+time.Minute)) {
+			t.Errorf("Bad schedule: %v to %v", at.Time, expire.Time)
+		}
+	})
+
+	t.Run("Schedule time has passed", func(t *testing.T) {
+		s := &Server{ScheduleTolerance: time.Minute}
+		_, _, err := s.schedule(context.Background(), timestamppb.New(now.Add(-time.Hour)), "", now)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Code(err))
+		}
+	})
+
+	t.Run("Maintenance window", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getWindowQuery).WithArgs("weekly-database").WillReturnRows(
+			sqlmock.NewRows([]string{"description", "days", "open_time", "duration_ms", "time_zone", "create_time", "update_time"}).
+				AddRow(nil, pq.Array([]int64{2}), "02:00", 7200000, "", nil, nil),
+		)
+
+		s := &Server{DB: db}
+		at, expire, err := s.schedule(context.Background(), nil, "maintenanceWindows/weekly-database", now)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if !at.Time.Equal(now.Add(2*time.Hour)) || !expire.Time.Equal(now.Add(4*time.Hour)) {
+			t.Errorf("Bad schedule: %v to %v", at.Time, expire.Time)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Unknown maintenance window", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(getWindowQuery).WithArgs("weekly-database").WillReturnRows(
+			sqlmock.NewRows([]string{"description", "days", "open_time", "duration_ms", "time_zone", "create_time", "update_time"}),
+		)
+
+		s := &Server{DB: db}
+		_, _, err = s.schedule(context.Background(), nil, "maintenanceWindows/weekly-database", now)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Code(err))
+		}
+	})
+}
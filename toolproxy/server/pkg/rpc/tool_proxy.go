@@ -1,21 +1,24 @@
 package rpc
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/hxtk/yggdrasil/common/urn"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
@@ -33,8 +36,35 @@ func unwrapstring(s sql.NullString) string {
 	return s.String
 }
 
+// resourceUsage returns the resource usage recorded for a command, if any.
+func resourceUsage(userCPU, systemCPU, maxRSS sql.NullInt64) *pb.ResourceUsage {
+	if !userCPU.Valid && !systemCPU.Valid && !maxRSS.Valid {
+		return nil
+	}
+	return &pb.ResourceUsage{
+		UserCpuTime:   durationpb.New(time.Duration(userCPU.Int64) * time.Microsecond),
+		SystemCpuTime: durationpb.New(time.Duration(systemCPU.Int64) * time.Microsecond),
+		MaxRssBytes:   maxRSS.Int64,
+	}
+}
+
+// exitCode returns the exit code recorded for a command, if any.
+func exitCode(code sql.NullInt32) *wrapperspb.Int32Value {
+	if !code.Valid {
+		return nil
+	}
+	return wrapperspb.Int32(code.Int32)
+}
+
 const getCommandQuery = `
-	SELECT issuer, argv, description, status, std_out, std_err, create_time, update_time, delete_time, start_time, end_time
+	SELECT issuer, argv, description, status, std_out, std_err, create_time, update_time, delete_time, start_time, end_time, issuer_display_name, catalog_entry,
+		tool, parameters, required_approvals, execution_profile, timeout_ms, canceller, canceller_display_name, cancel_time,
+		exit_code, signal, start_error, user_cpu_us, system_cpu_us, max_rss_bytes, executor, heartbeat_time, status_message,
+		schedule_time, maintenance_window, expire_time, target, targets, parallelism, failure_threshold, inputs, artifact_paths,
+		env, secret_env, redactions, break_glass_user, break_glass_user_display_name, break_glass_justification, break_glass_time,
+		break_glass_reviewer, break_glass_reviewer_display_name, break_glass_review_comment, break_glass_review_time,
+		preview_argv, preview_state, preview_std_out, preview_std_err, preview_exit_code, preview_error, preview_start_time,
+		preview_end_time, preview_overrider, preview_overrider_display_name, preview_override_time
 	FROM commands
 	WHERE id = $1;
 `
@@ -51,11 +81,15 @@ func (s *Server) GetCommand(ctx context.Context, r *pb.GetCommandRequest) (*pb.C
 	row := s.DB.QueryRowContext(ctx, getCommandQuery, id)
 
 	var issuer string
-	var argv []string
-	var description sql.NullString
+	var argv, targets, artifactPaths, redactions []string
+	var description, issuerDisplayName, catalogEntry, tool, profile, canceller, cancellerDisplayName, signal, startError, executorID, statusMessage, window, target sql.NullString
 	var statusID int32
-	var stdOut, stdErr []byte
-	var createTime, updateTime, deleteTime, startTime, endTime sql.NullTime
+	var stdOut, stdErr, params, inputsJSON, envJSON, secretEnvJSON []byte
+	var requiredApprovals, exitCodeValue, parallelism, failureThreshold sql.NullInt32
+	var timeout, userCPU, systemCPU, maxRSS sql.NullInt64
+	var createTime, updateTime, deleteTime, startTime, endTime, cancelTime, heartbeatTime, scheduleTime, expireTime sql.NullTime
+	var bg breakGlassColumns
+	var pv previewColumns
 	err = row.Scan(
 		&issuer,
 		pq.Array(&argv),
@@ -68,6 +102,56 @@ func (s *Server) GetCommand(ctx context.Context, r *pb.GetCommandRequest) (*pb.C
 		&deleteTime,
 		&startTime,
 		&endTime,
+		&issuerDisplayName,
+		&catalogEntry,
+		&tool,
+		&params,
+		&requiredApprovals,
+		&profile,
+		&timeout,
+		&canceller,
+		&cancellerDisplayName,
+		&cancelTime,
+		&exitCodeValue,
+		&signal,
+		&startError,
+		&userCPU,
+		&systemCPU,
+		&maxRSS,
+		&executorID,
+		&heartbeatTime,
+		&statusMessage,
+		&scheduleTime,
+		&window,
+		&expireTime,
+		&target,
+		pq.Array(&targets),
+		&parallelism,
+		&failureThreshold,
+		&inputsJSON,
+		pq.Array(&artifactPaths),
+		&envJSON,
+		&secretEnvJSON,
+		pq.Array(&redactions),
+		&bg.user,
+		&bg.userDisplayName,
+		&bg.justification,
+		&bg.createTime,
+		&bg.reviewer,
+		&bg.reviewerDisplayName,
+		&bg.reviewComment,
+		&bg.reviewTime,
+		pq.Array(&pv.argv),
+		&pv.state,
+		&pv.stdOut,
+		&pv.stdErr,
+		&pv.exitCode,
+		&pv.failure,
+		&pv.startTime,
+		&pv.endTime,
+		&pv.overrider,
+		&pv.overriderDisplayName,
+		&pv.overrideTime,
 	)
 	if err == sql.ErrNoRows {
 		return nil, status.Errorf(codes.NotFound, "Command not found.")
@@ -76,29 +160,82 @@ func (s *Server) GetCommand(ctx context.Context, r *pb.GetCommandRequest) (*pb.C
 		return nil, status.Errorf(codes.Unavailable, "error getting command")
 	}
 
+	parameters, err := unmarshalValues(params)
+	if err != nil {
+		log.WithError(err).WithField("name", r.GetName()).Errorln("Error decoding command parameters.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	in, err := unmarshalInputs(inputsJSON)
+	if err != nil {
+		log.WithError(err).WithField("name", r.GetName()).Errorln("Error decoding command inputs.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	env, secretEnv, err := unmarshalEnv(envJSON, secretEnvJSON)
+	if err != nil {
+		log.WithError(err).WithField("name", r.GetName()).Errorln("Error decoding command environment.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
 	return &pb.Command{
-		Name:        r.GetName(),
-		Issuer:      issuer,
-		Argv:        argv,
-		Description: unwrapstring(description),
-		Status:      pb.Status(statusID),
-		StdOut:      stdOut,
-		StdErr:      stdErr,
-		CreateTime:  timestamp(createTime),
-		UpdateTime:  timestamp(updateTime),
-		DeleteTime:  timestamp(deleteTime),
-		StartTime:   timestamp(startTime),
-		EndTime:     timestamp(endTime),
+		Name:                 r.GetName(),
+		Issuer:               issuer,
+		IssuerDisplayName:    unwrapstring(issuerDisplayName),
+		Argv:                 argv,
+		Description:          unwrapstring(description),
+		CatalogEntry:         unwrapstring(catalogEntry),
+		Tool:                 unwrapstring(tool),
+		Parameters:           parameters,
+		RequiredApprovals:    int32(s.requiredApprovals(requiredApprovals)),
+		ExecutionProfile:     unwrapstring(profile),
+		Timeout:              duration(timeout),
+		Status:               pb.Status(statusID),
+		StdOut:               stdOut,
+		StdErr:               stdErr,
+		CreateTime:           timestamp(createTime),
+		UpdateTime:           timestamp(updateTime),
+		DeleteTime:           timestamp(deleteTime),
+		StartTime:            timestamp(startTime),
+		EndTime:              timestamp(endTime),
+		Canceller:            unwrapstring(canceller),
+		CancellerDisplayName: unwrapstring(cancellerDisplayName),
+		CancelTime:           timestamp(cancelTime),
+		ExitCode:             exitCode(exitCodeValue),
+		Signal:               unwrapstring(signal),
+		StartError:           unwrapstring(startError),
+		ResourceUsage:        resourceUsage(userCPU, systemCPU, maxRSS),
+		Executor:             unwrapstring(executorID),
+		HeartbeatTime:        timestamp(heartbeatTime),
+		StatusMessage:        unwrapstring(statusMessage),
+		ScheduleTime:         timestamp(scheduleTime),
+		MaintenanceWindow:    unwrapstring(window),
+		ExpireTime:           timestamp(expireTime),
+		Target:               unwrapstring(target),
+		Targets:              targets,
+		Parallelism:          parallelism.Int32,
+		FailureThreshold:     failureThreshold.Int32,
+		Inputs:               in,
+		ArtifactPaths:        artifactPaths,
+		Env:                  env,
+		SecretEnv:            secretEnv,
+		Redactions:           redactions,
+		BreakGlass:           bg.proto(),
+		Preview:              pv.proto(),
 	}, nil
 }
 
-const finishCommandQuery = `
-	UPDATE Commands
-	SET (status, end_time, std_out, std_err) = ($2, $3, $4, $5)
-	WHERE id = $1;
+const requestRunQuery = `
+	UPDATE commands
+	SET run_request_time = $2
+	WHERE id = $1 AND status = $3 AND run_request_time IS NULL AND schedule_time IS NULL
+		AND (preview_state IS NULL OR preview_state = $4 OR preview_override_time IS NOT NULL OR break_glass_time IS NOT NULL);
 `
 
 // RunCommand implements ToolProxy for Server.
+//
+// The command is queued to be run by an executor, and RunCommand waits for
+// it to finish.
 func (s *Server) RunCommand(ctx context.Context, r *pb.RunCommandRequest) (*pb.Command, error) {
 	var id int64
 	name := urn.Parse(r.GetName())
@@ -108,35 +245,80 @@ func (s *Server) RunCommand(ctx context.Context, r *pb.RunCommandRequest) (*pb.C
 		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
 	}
 
-	startTime := time.Now()
-	res, err := s.DB.Exec(`
-		UPDATE Commands
-		SET (status, start_time) = ($2, $3)
-		WHERE id = $1 AND status = $4;`,
+	// Wait for the command to finish from before it is queued, so that the
+	// notification cannot be missed.
+	done, unsubscribe := s.subscribe(id)
+	defer unsubscribe()
+
+	command, err := s.startCommand(ctx, id, r.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return s.awaitCommand(ctx, r.GetName(), command, done)
+}
+
+// startCommand queues the command with the given ID and name to be run by an
+// executor, unless it has been already, and returns its current state.
+func (s *Server) startCommand(ctx context.Context, id int64, name string) (*pb.Command, error) {
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requestTime := time.Now()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(
+		ctx,
+		requestRunQuery,
 		id,
-		pb.Status_RUNNING,
-		startTime,
+		requestTime,
 		pb.Status_READY,
+		pb.PreviewState_PREVIEW_SUCCEEDED,
 	)
 	if err != nil {
-		log.WithError(err).Println("Error setting command to running in database.")
+		log.WithError(err).Println("Error queueing command in database.")
 		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
 	}
 
-	command, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+	rows, err := res.RowsAffected()
 	if err != nil {
-		log.WithError(err).Println("Error retrieving command from database.")
-		return nil, err
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
 	}
 
-	rows, err := res.RowsAffected()
+	if rows > 0 {
+		if err = recordEvent(ctx, tx, id, pb.Action_ACTION_RUN, caller, requestTime, ""); err != nil {
+			log.WithError(err).Errorln("Error recording event.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+
+		// The notification is delivered when the transaction commits.
+		_, err = tx.ExecContext(ctx, notifyQuery, executor.RunChannel, strconv.FormatInt(id, 10))
+		if err != nil {
+			log.WithError(err).Errorln("Error notifying executors.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing run request.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	command, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: name})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Internal server error.")
+		log.WithError(err).Println("Error retrieving command from database.")
+		return nil, err
 	}
 	// If this operation did not change any rows, there are four major possibilities:
-	// - The command was not yet in READY state, in which case we indicate bad precondition.
+	// - The command was not yet in READY state, or its preview has not succeeded, in which case we indicate bad precondition.
 	// - The command was already done, in which case we return the result.
-	// - The command had already started running, in which case we poll for it to complete.
+	// - The command had already been queued or started running, in which case its caller waits for it to complete.
 	if rows == 0 {
 		switch command.Status {
 		// If the command is not ready to run then it is a failed precondition.
@@ -147,145 +329,368 @@ func (s *Server) RunCommand(ctx context.Context, r *pb.RunCommandRequest) (*pb.C
 				codes.FailedPrecondition,
 				"Command is not ready to run.",
 			)
+		case pb.Status_READY:
+			if err = checkPreview(command); err != nil {
+				return nil, err
+			}
 		case pb.Status_DELETED:
 			return nil, status.Errorf(
 				codes.FailedPrecondition,
 				"Command was canceled.",
 			)
+		case pb.Status_EXPIRED:
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"Command expired before it was run.",
+			)
+		case pb.Status_CANCELED:
+			if command.GetStartTime() == nil {
+				return nil, status.Errorf(
+					codes.FailedPrecondition,
+					"Command was canceled.",
+				)
+			}
+			return command, nil
 
 		// If the command has already completed then return the result.
 		case pb.Status_SUCCESS:
 			fallthrough
 		case pb.Status_ERROR:
+			fallthrough
+		case pb.Status_TIMED_OUT:
+			fallthrough
+		case pb.Status_LOST:
 			return command, nil
-
-		// If the command is already being run then wait for it to complete
-		// and then return it.
-		case pb.Status_RUNNING:
-			return s.awaitCommand(ctx, r.GetName())
 		}
 	}
 
-	// Run the command in a separate thread so that even if the request is canceled,
-	// the command will continue to run.
-	errChan := make(chan error)
-	doneChan := make(chan struct{})
-	go func() {
-		argv := command.GetArgv()
-
-		// #nosec G204 The purpose of this program is to launch arbitrary processes
-		// in a way that can be monitored and audited more easily than an interactive
-		// shell.
-		cmd := exec.Command(argv[0], argv[1:]...)
-
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		cmdStatus := pb.Status_SUCCESS
-		err := cmd.Start()
-		if err != nil {
-			cmdStatus = pb.Status_ERROR
-		} else {
-			err = cmd.Wait()
-		}
-
-		if err != nil {
-			cmdStatus = pb.Status_ERROR
-		}
-
-		endTime := time.Now()
-		_, err = s.DB.Exec(
-			finishCommandQuery,
-			id,
-			cmdStatus,
-			endTime,
-			stdout.Bytes(),
-			stderr.Bytes(),
-		)
-		if err != nil {
-			errChan <- err
-		}
-		close(doneChan)
-	}()
-
-	select {
-	case <-errChan:
-		return nil, status.Errorf(codes.Internal, "Error while running command.")
-	case <-doneChan:
-		return s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
-	case <-ctx.Done():
-		return nil, status.Errorf(codes.Canceled, "Request canceled.")
-	}
+	return command, nil
 }
 
-func (s *Server) awaitCommand(ctx context.Context, name string) (*pb.Command, error) {
-	cmd, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: name})
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: This should be some configurable, truncated exponential backoff.
-	for cmd.Status != pb.Status_SUCCESS && cmd.Status != pb.Status_ERROR && err == nil {
-		timer := time.NewTimer(time.Second)
+// awaitCommand waits for a command to finish, given its current state and a
+// channel which receives a value when it may have finished.
+func (s *Server) awaitCommand(ctx context.Context, name string, cmd *pb.Command, done <-chan struct{}) (*pb.Command, error) {
+	var err error
+	for !isTerminal(cmd.Status) && err == nil {
+		// Notifications should always arrive, but we check periodically in
+		// case the executor could not send one.
+		timer := time.NewTimer(awaitPollInterval)
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return nil, status.Errorf(codes.Canceled, "Request canceled.")
+		case <-done:
+			timer.Stop()
 		case <-timer.C:
-			cmd, err = s.GetCommand(ctx, &pb.GetCommandRequest{Name: name})
 		}
+		cmd, err = s.GetCommand(ctx, &pb.GetCommandRequest{Name: name})
 	}
 
 	return cmd, err
 }
 
 const createCommandQuery = `
-	INSERT INTO commands ("issuer", "argv", "description", "status", "create_time", "update_time") 
-	VALUES ($1, $2, $3, $4, $5, $5)
+	INSERT INTO commands ("issuer", "issuer_type", "issuer_id", "issuer_display_name", "argv", "description", "status", "create_time", "update_time", "catalog_entry", "tool", "parameters", "required_approvals", "timeout_ms", "schedule_time", "maintenance_window", "expire_time", "target", "target_agent", "target_selector", "targets", "target_agents", "target_selectors", "parallelism", "failure_threshold", "inputs", "artifact_paths", "env", "secret_env", "preview_argv", "preview_state")
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30)
 	RETURNING commands.id;
 `
 
 // CreateCommand implements ToolProxy for Server.
 func (s *Server) CreateCommand(ctx context.Context, r *pb.CreateCommandRequest) (*pb.Command, error) {
-	issuer := "hxtk"
+	issuer, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tool := r.GetCommand().GetTool()
+	params := r.GetCommand().GetParameters()
+	argv, requiredApprovals, err := s.resolveArgv(ctx, tool, params, r.GetCommand().GetArgv())
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := s.checkCatalog(argv)
+	if err != nil {
+		return nil, err
+	}
+
+	paramsJSON, err := marshalValues(tool, params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters.")
+	}
+
+	in, err := checkInputs(argv, r.GetCommand().GetInputs())
+	if err != nil {
+		return nil, err
+	}
+	inputsJSON, err := marshalInputs(in)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	timeout, err := s.commandTimeout(r.GetCommand().GetTimeout())
+	if err != nil {
+		return nil, err
+	}
+
 	createTime := time.Now()
-	cmdStatus := r.GetCommand().GetStatus()
-	if cmdStatus != pb.Status_SUBMITTED && cmdStatus != pb.Status_READY {
-		cmdStatus = pb.Status_SUBMITTED
+	window := r.GetCommand().GetMaintenanceWindow()
+	scheduleTime, expireTime, err := s.schedule(ctx, r.GetCommand().GetScheduleTime(), window, createTime)
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.GetCommand().GetTarget()
+	targetAgent, targetSelector, err := s.resolveTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := r.GetCommand().GetTargets()
+	parallelism := r.GetCommand().GetParallelism()
+	failureThreshold := r.GetCommand().GetFailureThreshold()
+	if err = validateRollout(target, targets, parallelism, failureThreshold); err != nil {
+		return nil, err
+	}
+	targetAgents, targetSelectors, err := s.resolveTargets(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	artifactPaths := r.GetCommand().GetArtifactPaths()
+	if err = validateArtifactPaths(artifactPaths, target, targets); err != nil {
+		return nil, err
 	}
-	row := s.DB.QueryRowContext(
+
+	env := r.GetCommand().GetEnv()
+	secretEnv := r.GetCommand().GetSecretEnv()
+	if err = validateEnv(env, secretEnv, target, targets, s.envPermitted(entry)); err != nil {
+		return nil, err
+	}
+	envJSON, secretEnvJSON, err := marshalEnv(env, secretEnv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	required := s.requiredApprovals(requiredApprovals)
+	cmdStatus := initialStatus(r.GetCommand().GetStatus(), required)
+
+	previewArgv := s.previewArgv(entry, argv, target, targets)
+	previewArgvValue, previewState := pendingPreview(previewArgv)
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error")
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
 		ctx,
 		createCommandQuery,
-		issuer,
-		pq.Array(r.GetCommand().GetArgv()),
+		issuer.String(),
+		issuer.Type,
+		issuer.ID,
+		issuer.DisplayName,
+		pq.Array(argv),
 		r.GetCommand().GetDescription(),
 		cmdStatus,
 		createTime,
+		sql.NullString{String: entry, Valid: entry != ""},
+		sql.NullString{String: tool, Valid: tool != ""},
+		paramsJSON,
+		requiredApprovals,
+		timeout,
+		scheduleTime,
+		sql.NullString{String: window, Valid: window != ""},
+		expireTime,
+		sql.NullString{String: target, Valid: target != ""},
+		targetAgent,
+		targetSelector,
+		nullTargets(targets),
+		targetAgents,
+		targetSelectors,
+		sql.NullInt32{Int32: parallelism, Valid: parallelism != 0},
+		sql.NullInt32{Int32: failureThreshold, Valid: failureThreshold != 0},
+		inputsJSON,
+		nullArtifactPaths(artifactPaths),
+		envJSON,
+		secretEnvJSON,
+		previewArgvValue,
+		previewState,
 	)
 
 	var id int64
-	err := row.Scan(&id)
+	err = row.Scan(&id)
 	if err != nil {
 		log.WithError(err).Println("Error saving command to database")
 		return nil, status.Errorf(codes.Unavailable, "Internal server error")
 	}
 
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_CREATE, issuer, createTime, argvDetail(argv)); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error")
+	}
+
+	// The notification is delivered when the transaction commits.
+	if previewArgv != nil {
+		_, err = tx.ExecContext(ctx, notifyQuery, executor.RunChannel, strconv.FormatInt(id, 10))
+		if err != nil {
+			log.WithError(err).Errorln("Error notifying executors.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing command.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error")
+	}
+
 	return &pb.Command{
-		Name:        fmt.Sprintf("commands/%d", id),
-		Issuer:      issuer,
-		Argv:        r.GetCommand().GetArgv(),
-		Description: r.GetCommand().GetDescription(),
-		Status:      cmdStatus,
-		CreateTime:  timestamppb.New(createTime),
-		UpdateTime:  timestamppb.New(createTime),
+		Name:              fmt.Sprintf("commands/%d", id),
+		Issuer:            issuer.String(),
+		IssuerDisplayName: issuer.DisplayName,
+		Argv:              argv,
+		Description:       r.GetCommand().GetDescription(),
+		CatalogEntry:      entry,
+		Tool:              tool,
+		Parameters:        params,
+		RequiredApprovals: int32(required),
+		Timeout:           duration(timeout),
+		ScheduleTime:      timestamp(scheduleTime),
+		MaintenanceWindow: window,
+		ExpireTime:        timestamp(expireTime),
+		Target:            target,
+		Targets:           targets,
+		Parallelism:       parallelism,
+		FailureThreshold:  failureThreshold,
+		Inputs:            in,
+		ArtifactPaths:     artifactPaths,
+		Env:               env,
+		SecretEnv:         secretEnv,
+		Status:            cmdStatus,
+		CreateTime:        timestamppb.New(createTime),
+		UpdateTime:        timestamppb.New(createTime),
+		Preview:           newPreview(previewArgv),
 	}, nil
 }
 
+// initialStatus returns the status of a newly created or edited command
+// given the status requested by the client and the number of approvals the
+// command requires.
+//
+// Commands may only be marked as ready by their issuer if no approvals
+// are required; otherwise they must be approved.
+func initialStatus(requested pb.Status, requiredApprovals int) pb.Status {
+	if requested == pb.Status_READY && requiredApprovals == 0 {
+		return pb.Status_READY
+	}
+	return pb.Status_SUBMITTED
+}
+
+// requiredApprovals returns the number of approvals required by a command
+// given the number recorded on it, if any.
+func (s *Server) requiredApprovals(recorded sql.NullInt32) int {
+	if recorded.Valid {
+		return int(recorded.Int32)
+	}
+	return s.RequiredApprovals
+}
+
+// resolveArgv returns the argv of a command and the number of approvals it
+// requires, if that differs from the server's default.
+//
+// If tool is empty, argv is returned unchanged and no parameters may be given.
+// Otherwise argv must be empty and is rendered from the tool.
+func (s *Server) resolveArgv(ctx context.Context, tool string, params map[string]string, argv []string) ([]string, sql.NullInt32, error) {
+	if tool == "" {
+		if len(params) > 0 {
+			return nil, sql.NullInt32{}, status.Errorf(
+				codes.InvalidArgument,
+				"Parameters may only be given for commands created from a tool.",
+			)
+		}
+		return argv, sql.NullInt32{}, nil
+	}
+
+	if len(argv) > 0 {
+		return nil, sql.NullInt32{}, status.Errorf(
+			codes.InvalidArgument,
+			"Argv may not be given for commands created from a tool.",
+		)
+	}
+
+	id, err := parseToolName(tool)
+	if err != nil {
+		return nil, sql.NullInt32{}, status.Errorf(codes.InvalidArgument, "Malformed tool name.")
+	}
+
+	t, err := s.getTool(ctx, s.DB, id)
+	if err != nil {
+		return nil, sql.NullInt32{}, err
+	}
+
+	argv, err = renderArgv(t, params)
+	if err != nil {
+		return nil, sql.NullInt32{}, status.Errorf(codes.InvalidArgument, "Invalid parameters: %v.", err)
+	}
+
+	return argv, nullInt32(t.GetRequiredApprovals()), nil
+}
+
+// marshalValues encodes the parameter values of a command for storage.
+// Commands which were not created from a tool have no parameters.
+func marshalValues(tool string, params map[string]string) (interface{}, error) {
+	if tool == "" {
+		return nil, nil
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	return json.Marshal(params)
+}
+
+// unmarshalValues decodes parameter values stored by marshalValues.
+func unmarshalValues(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var params map[string]string
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// checkCatalog returns the name of the catalog entry which permits argv.
+//
+// If the server does not enforce a tool catalog, any argv is permitted and
+// the empty string is returned.
+func (s *Server) checkCatalog(argv []string) (string, error) {
+	if s.Catalog == nil {
+		return "", nil
+	}
+
+	entry, err := s.Catalog.Match(argv)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Command not permitted by tool catalog: %v.", err)
+	}
+	return entry.Name, nil
+}
+
+// updateCommandQuery edits a command which has not been started. The preview
+// and any request to run the command were of the command as it was, so the
+// preview is run again and the command must be run again once it is ready.
 const updateCommandQuery = `
 	UPDATE Commands
-	SET (argv, description, status, update_time) = ($2, $3, $4, $5)
-	WHERE $1 = id
-	RETURNING issuer, status, std_out, std_err, create_time, delete_time, start_time, end_time;
+	SET (argv, description, status, update_time, catalog_entry, parameters, required_approvals, timeout_ms, schedule_time, maintenance_window, expire_time, target, target_agent, target_selector,
+		targets, target_agents, target_selectors, parallelism, failure_threshold, inputs, artifact_paths, env, secret_env,
+		preview_argv, preview_state, preview_std_out, preview_std_err, preview_exit_code, preview_error, preview_start_time,
+		preview_end_time, preview_executor, preview_overrider, preview_overrider_display_name, preview_override_time, run_request_time) =
+		($2, $3, $4, $5, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27,
+		$28, $29, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL)
+	WHERE $1 = id AND status IN ($6, $7, $8) AND break_glass_time IS NULL
+	RETURNING issuer, issuer_display_name, status, std_out, std_err, create_time, delete_time, start_time, end_time;
 `
 
 // UpdateCommand implements ToolProxy for Server.
@@ -297,11 +702,27 @@ func (s *Server) UpdateCommand(ctx context.Context, r *pb.UpdateCommandRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
 	}
 
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	command, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
 	if err != nil {
 		return nil, err
 	}
 
+	if err = s.checkIssuerOrOverride(ctx, caller, r.GetName(), command.GetIssuer()); err != nil {
+		return nil, err
+	}
+
+	// Break-glass bypasses approval and preview for the command as it was
+	// when glass was broken, and its review is of that command, so it may
+	// not be edited afterwards.
+	if command.GetBreakGlass() != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "A command cannot be edited after it has been run by break-glass.")
+	}
+
 	updateTime := time.Now()
 
 	mask := make(map[string]struct{})
@@ -312,6 +733,19 @@ func (s *Server) UpdateCommand(ctx context.Context, r *pb.UpdateCommandRequest)
 	argv := r.GetCommand().GetArgv()
 	description := r.GetCommand().GetDescription()
 	cmdStatus := r.GetCommand().GetStatus()
+	params := r.GetCommand().GetParameters()
+	tool := r.GetCommand().GetTool()
+	timeoutpb := r.GetCommand().GetTimeout()
+	schedulepb := r.GetCommand().GetScheduleTime()
+	window := r.GetCommand().GetMaintenanceWindow()
+	target := r.GetCommand().GetTarget()
+	targets := r.GetCommand().GetTargets()
+	parallelism := r.GetCommand().GetParallelism()
+	failureThreshold := r.GetCommand().GetFailureThreshold()
+	commandInputs := r.GetCommand().GetInputs()
+	artifactPaths := r.GetCommand().GetArtifactPaths()
+	env := r.GetCommand().GetEnv()
+	secretEnv := r.GetCommand().GetSecretEnv()
 
 	if len(mask) > 0 {
 		if _, ok := mask["argv"]; !ok {
@@ -323,9 +757,140 @@ func (s *Server) UpdateCommand(ctx context.Context, r *pb.UpdateCommandRequest)
 		if _, ok := mask["status"]; !ok {
 			cmdStatus = command.GetStatus()
 		}
+		if _, ok := mask["parameters"]; !ok {
+			params = command.GetParameters()
+		}
+		if _, ok := mask["tool"]; !ok {
+			tool = command.GetTool()
+		}
+		if _, ok := mask["timeout"]; !ok {
+			timeoutpb = command.GetTimeout()
+		}
+		if _, ok := mask["schedule_time"]; !ok {
+			schedulepb = command.GetScheduleTime()
+		}
+		if _, ok := mask["maintenance_window"]; !ok {
+			window = command.GetMaintenanceWindow()
+		}
+		if _, ok := mask["target"]; !ok {
+			target = command.GetTarget()
+		}
+		if _, ok := mask["targets"]; !ok {
+			targets = command.GetTargets()
+		}
+		if _, ok := mask["parallelism"]; !ok {
+			parallelism = command.GetParallelism()
+		}
+		if _, ok := mask["failure_threshold"]; !ok {
+			failureThreshold = command.GetFailureThreshold()
+		}
+		if _, ok := mask["inputs"]; !ok {
+			commandInputs = command.GetInputs()
+		}
+		if _, ok := mask["artifact_paths"]; !ok {
+			artifactPaths = command.GetArtifactPaths()
+		}
+		if _, ok := mask["env"]; !ok {
+			env = command.GetEnv()
+		}
+		if _, ok := mask["secret_env"]; !ok {
+			secretEnv = command.GetSecretEnv()
+		}
+	} else if tool == "" {
+		tool = command.GetTool()
+	}
+
+	if tool != command.GetTool() {
+		return nil, status.Errorf(codes.InvalidArgument, "The tool of a command cannot be changed.")
+	}
+
+	// The argv of a command created from a tool is always rendered again
+	// from the current version of the tool.
+	if tool != "" {
+		if _, ok := mask["argv"]; ok || (len(mask) == 0 && len(argv) > 0) {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"Argv may not be given for commands created from a tool.",
+			)
+		}
+		argv = nil
+	}
+
+	argv, requiredApprovals, err := s.resolveArgv(ctx, tool, params, argv)
+	if err != nil {
+		return nil, err
+	}
+
+	required := s.requiredApprovals(requiredApprovals)
+	cmdStatus = initialStatus(cmdStatus, required)
+
+	entry, err := s.checkCatalog(argv)
+	if err != nil {
+		return nil, err
+	}
+
+	paramsJSON, err := marshalValues(tool, params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid parameters.")
+	}
+
+	in, err := checkInputs(argv, commandInputs)
+	if err != nil {
+		return nil, err
+	}
+	inputsJSON, err := marshalInputs(in)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	timeout, err := s.commandTimeout(timeoutpb)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduleTime, expireTime, err := s.schedule(ctx, schedulepb, window, updateTime)
+	if err != nil {
+		return nil, err
+	}
+
+	targetAgent, targetSelector, err := s.resolveTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateRollout(target, targets, parallelism, failureThreshold); err != nil {
+		return nil, err
+	}
+	targetAgents, targetSelectors, err := s.resolveTargets(ctx, targets)
+	if err != nil {
+		return nil, err
 	}
 
-	row := s.DB.QueryRowContext(
+	if err = validateArtifactPaths(artifactPaths, target, targets); err != nil {
+		return nil, err
+	}
+
+	if err = validateEnv(env, secretEnv, target, targets, s.envPermitted(entry)); err != nil {
+		return nil, err
+	}
+	envJSON, secretEnvJSON, err := marshalEnv(env, secretEnv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	// Like approvals, the preview is of the command as it was, so any edit
+	// runs it again and clears any override.
+	previewArgv := s.previewArgv(entry, argv, target, targets)
+	previewArgvValue, previewState := pendingPreview(previewArgv)
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
 		ctx,
 		updateCommandQuery,
 		id,
@@ -333,14 +898,40 @@ func (s *Server) UpdateCommand(ctx context.Context, r *pb.UpdateCommandRequest)
 		description,
 		cmdStatus,
 		updateTime,
+		pb.Status_UNDEFINED,
+		pb.Status_SUBMITTED,
+		pb.Status_READY,
+		sql.NullString{String: entry, Valid: entry != ""},
+		paramsJSON,
+		requiredApprovals,
+		timeout,
+		scheduleTime,
+		sql.NullString{String: window, Valid: window != ""},
+		expireTime,
+		sql.NullString{String: target, Valid: target != ""},
+		targetAgent,
+		targetSelector,
+		nullTargets(targets),
+		targetAgents,
+		targetSelectors,
+		sql.NullInt32{Int32: parallelism, Valid: parallelism != 0},
+		sql.NullInt32{Int32: failureThreshold, Valid: failureThreshold != 0},
+		inputsJSON,
+		nullArtifactPaths(artifactPaths),
+		envJSON,
+		secretEnvJSON,
+		previewArgvValue,
+		previewState,
 	)
 
 	var issuer string
+	var issuerDisplayName sql.NullString
 	var statusID int32
 	var stdOut, stdErr []byte
 	var createTime, deleteTime, startTime, endTime sql.NullTime
 	err = row.Scan(
 		&issuer,
+		&issuerDisplayName,
 		&statusID,
 		&stdOut,
 		&stdErr,
@@ -350,30 +941,78 @@ func (s *Server) UpdateCommand(ctx context.Context, r *pb.UpdateCommandRequest)
 		&endTime,
 	)
 	if err == sql.ErrNoRows {
-		return nil, status.Errorf(codes.NotFound, "Command not found.")
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"A command cannot be edited after it has been started, deleted or run by break-glass.",
+		)
 	} else if err != nil {
 		return nil, status.Errorf(codes.Unavailable, "Error getting command.")
 	}
 
+	// Approvals are given for the command as it was when it was approved,
+	// so any edit invalidates them.
+	_, err = tx.ExecContext(ctx, clearApprovalsQuery, id)
+	if err != nil {
+		log.WithError(err).Errorln("Error clearing approvals.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = recordEvent(ctx, tx, id, pb.Action_ACTION_UPDATE, caller, updateTime, argvDetail(argv)); err != nil {
+		log.WithError(err).Errorln("Error recording event.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	// The notification is delivered when the transaction commits.
+	if previewArgv != nil {
+		_, err = tx.ExecContext(ctx, notifyQuery, executor.RunChannel, strconv.FormatInt(id, 10))
+		if err != nil {
+			log.WithError(err).Errorln("Error notifying executors.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing update.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
 	return &pb.Command{
-		Name:        r.GetName(),
-		Issuer:      issuer,
-		Argv:        argv,
-		Description: description,
-		Status:      pb.Status(statusID),
-		StdOut:      stdOut,
-		StdErr:      stdErr,
-		CreateTime:  timestamp(createTime),
-		UpdateTime:  timestamppb.New(updateTime),
-		DeleteTime:  timestamp(deleteTime),
-		StartTime:   timestamp(startTime),
-		EndTime:     timestamp(endTime),
+		Name:              r.GetName(),
+		Issuer:            issuer,
+		IssuerDisplayName: unwrapstring(issuerDisplayName),
+		Argv:              argv,
+		Description:       description,
+		CatalogEntry:      entry,
+		Tool:              tool,
+		Parameters:        params,
+		RequiredApprovals: int32(required),
+		Timeout:           duration(timeout),
+		ScheduleTime:      timestamp(scheduleTime),
+		MaintenanceWindow: window,
+		ExpireTime:        timestamp(expireTime),
+		Target:            target,
+		Targets:           targets,
+		Parallelism:       parallelism,
+		FailureThreshold:  failureThreshold,
+		Inputs:            in,
+		ArtifactPaths:     artifactPaths,
+		Env:               env,
+		SecretEnv:         secretEnv,
+		Status:            pb.Status(statusID),
+		StdOut:            stdOut,
+		StdErr:            stdErr,
+		CreateTime:        timestamp(createTime),
+		UpdateTime:        timestamppb.New(updateTime),
+		DeleteTime:        timestamp(deleteTime),
+		StartTime:         timestamp(startTime),
+		EndTime:           timestamp(endTime),
+		Preview:           newPreview(previewArgv),
 	}, nil
 }
 
 const deleteQuery = `
 	UPDATE Commands
-	SET (status, deleted_time) = ($2, $3)
+	SET (status, delete_time) = ($2, $3)
 	WHERE id = $1 AND status IN ($4, $5, $6);`
 
 // DeleteCommand implements ToolProxy for Server.
@@ -385,8 +1024,30 @@ func (s *Server) DeleteCommand(ctx context.Context, r *pb.DeleteCommandRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "Malformed command name.")
 	}
 
+	caller, err := principalFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note error checking this request handles the "command did not exist" case.
+	command, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.checkIssuerOrOverride(ctx, caller, r.GetName(), command.GetIssuer()); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
 	deletedTime := time.Now()
-	_, err = s.DB.Exec(deleteQuery,
+	res, err := tx.ExecContext(ctx, deleteQuery,
 		id,
 		pb.Status_DELETED,
 		deletedTime,
@@ -398,8 +1059,24 @@ func (s *Server) DeleteCommand(ctx context.Context, r *pb.DeleteCommandRequest)
 		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
 	}
 
-	// Note error checking this request handles the "command did not exist" case.
-	command, err := s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	if rows > 0 {
+		if err = recordEvent(ctx, tx, id, pb.Action_ACTION_DELETE, caller, deletedTime, ""); err != nil {
+			log.WithError(err).Errorln("Error recording event.")
+			return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing deletion.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	command, err = s.GetCommand(ctx, &pb.GetCommandRequest{Name: r.GetName()})
 	if err != nil {
 		return nil, err
 	}
@@ -414,11 +1091,25 @@ func (s *Server) DeleteCommand(ctx context.Context, r *pb.DeleteCommandRequest)
 		fallthrough
 	case pb.Status_ERROR:
 		fallthrough
+	case pb.Status_TIMED_OUT:
+		fallthrough
+	case pb.Status_LOST:
+		fallthrough
 	case pb.Status_RUNNING:
 		return nil, status.Errorf(
 			codes.FailedPrecondition,
 			"A command cannot be deleted after it has been started.",
 		)
+	case pb.Status_CANCELED:
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"A command cannot be deleted after it has been canceled.",
+		)
+	case pb.Status_EXPIRED:
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"A command cannot be deleted after it has expired.",
+		)
 	}
 
 	// This should be unreachable, because if it had any other status
@@ -428,79 +1119,301 @@ func (s *Server) DeleteCommand(ctx context.Context, r *pb.DeleteCommandRequest)
 	return nil, status.Errorf(codes.Internal, "Internal server error.")
 }
 
-const listCommandQuery = `
-	SELECT id, issuer, argv, description, status, std_out, std_err, create_time, update_time, delete_time, start_time, end_time
-	FROM Commands
-	LIMIT $1 OFFSET $2;
+// listedCommandColumns are the columns of a listed command, which are read by
+// scanListedCommand. It is completed with the columns returned by viewColumns.
+const listedCommandColumns = `id, issuer, argv, description, status, %s, create_time, update_time, delete_time, start_time, end_time, issuer_display_name, catalog_entry,
+		tool, parameters, required_approvals, execution_profile, timeout_ms, canceller, canceller_display_name, cancel_time,
+		exit_code, signal, start_error, user_cpu_us, system_cpu_us, max_rss_bytes, executor, heartbeat_time, status_message,
+		schedule_time, maintenance_window, expire_time, target, targets, parallelism, failure_threshold, artifact_paths,
+		env, secret_env, redactions, break_glass_user, break_glass_user_display_name, break_glass_justification, break_glass_time,
+		break_glass_reviewer, break_glass_reviewer_display_name, break_glass_review_comment, break_glass_review_time,
+		preview_argv, preview_state, preview_exit_code, preview_error, preview_start_time,
+		preview_end_time, preview_overrider, preview_overrider_display_name, preview_override_time`
+
+// basicInputs selects the inputs of a command without their content, leaving
+// the names and digests of its standard input and input files.
+const basicInputs = `jsonb_set(inputs - 'stdin', '{files}',
+		COALESCE((SELECT jsonb_agg(f - 'content') FROM jsonb_array_elements(inputs->'files') f), '[]'))`
+
+// viewColumns returns the columns which complete listedCommandColumns in the
+// given view. The basic view leaves out the output of commands and of their
+// previews and the content of their inputs, any of which may be large.
+func viewColumns(full bool) string {
+	if full {
+		return "std_out, std_err, inputs, preview_std_out, preview_std_err"
+	}
+	return "NULL, NULL, " + basicInputs + ", NULL, NULL"
+}
+
+// listCommandsQuery lists commands. It is completed with the columns returned
+// by viewColumns, the conditions selecting commands, the ordering, and the
+// parameter number of the limit.
+const listCommandsQuery = `
+	SELECT ` + listedCommandColumns + `
+	FROM commands
+	WHERE %s
+	ORDER BY %s
+	LIMIT $%d;
 `
 
 // ListCommands implements ToolProxy for server.
+//
+// Commands are paged by keyset rather than offset, so that pages are stable
+// while commands are created and deleted.
 func (s *Server) ListCommands(ctx context.Context, r *pb.ListCommandsRequest) (*pb.ListCommandsResponse, error) {
-	offset, err := strconv.ParseInt(r.GetPageToken(), 10, 0)
+	limit, err := pageSize(r.GetPageSize())
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+	conditions, args, err := compileFilter(r.GetFilter(), 1)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v.", err)
+	}
+	order, err := parseCommandOrder(r.GetOrderBy())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid order_by: %v.", err)
+	}
+
+	if !r.GetShowDeleted() {
+		conditions = append(conditions, "delete_time IS NULL")
 	}
 
-	rows, err := s.DB.QueryContext(
+	binding := pageTokenBinding(r.GetFilter(), order.String(), strconv.FormatBool(r.GetShowDeleted()))
+	commands, nextPageToken, err := s.listCommands(
 		ctx,
-		listCommandQuery,
-		r.GetPageSize(),
-		offset,
+		conditions,
+		args,
+		order,
+		r.GetView() == pb.CommandView_COMMAND_VIEW_FULL,
+		binding,
+		r.GetPageToken(),
+		limit,
 	)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+		return nil, err
+	}
+
+	return &pb.ListCommandsResponse{
+		Commands:      commands,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// listCommands returns a page of at most limit of the commands which satisfy
+// conditions, after the position of token if it is not empty, and the
+// token of the next page. Page tokens are bound to binding, which must
+// identify the conditions and order.
+func (s *Server) listCommands(ctx context.Context, conditions []string, args []interface{}, order commandOrder, full bool, binding []byte, token string, limit int) ([]*pb.Command, string, error) {
+	if token != "" {
+		p, err := decodePageToken(s.pageTokenKey(), token, binding)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid page token: %v.", err)
+		}
+		cond, after := order.after(p, len(args)+1)
+		conditions = append(conditions, cond)
+		args = append(args, after...)
 	}
 
+	where := "TRUE"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+	// One more command than the page size is requested to learn whether
+	// there is another page.
+	query := fmt.Sprintf(listCommandsQuery, viewColumns(full), where, order.orderBy(), len(args)+1)
+	rows, err := s.DB.QueryContext(ctx, query, append(args, limit+1)...)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing commands.")
+		return nil, "", status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var last pageToken
+	var more bool
 	var commands []*pb.Command
 	for rows.Next() {
-		var id int64
-		var issuer string
-		var argv []string
-		var description string
-		var statusID int32
-		var stdOut, stdErr []byte
-		var createTime, updateTime, deleteTime, startTime, endTime sql.NullTime
-		err = rows.Scan(
-			&id,
-			&issuer,
-			pq.Array(&argv),
-			&description,
-			&statusID,
-			&stdOut,
-			&stdErr,
-			&createTime,
-			&updateTime,
-			&deleteTime,
-			&startTime,
-			&endTime,
-		)
+		if len(commands) == limit {
+			more = true
+			break
+		}
+
+		id, command, err := s.scanListedCommand(rows)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Internal server error.")
+			return nil, "", status.Errorf(codes.Internal, "Internal server error.")
 		}
 
-		commands = append(commands, &pb.Command{
-			Name:        fmt.Sprintf("commands/%d", id),
-			Issuer:      issuer,
-			Argv:        argv,
-			Description: description,
-			Status:      pb.Status(statusID),
-			StdOut:      stdOut,
-			StdErr:      stdErr,
-			CreateTime:  timestamp(createTime),
-			UpdateTime:  timestamp(createTime),
-			DeleteTime:  timestamp(createTime),
-			StartTime:   timestamp(createTime),
-			EndTime:     timestamp(createTime),
-		})
+		last.ID = id
+		switch order.field {
+		case "create_time":
+			last.Time = command.GetCreateTime().AsTime().UnixMicro()
+		case "update_time":
+			last.Time = command.GetCreateTime().AsTime().UnixMicro()
+			if command.GetUpdateTime() != nil {
+				last.Time = command.GetUpdateTime().AsTime().UnixMicro()
+			}
+		}
+		commands = append(commands, command)
 	}
 
-	nextPageToken := fmt.Sprintf("%d", offset+int64(len(commands)))
-	if len(commands) < int(r.GetPageSize()) {
-		nextPageToken = ""
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing commands.")
+		return nil, "", status.Errorf(codes.Unavailable, "Internal server error.")
 	}
 
-	return &pb.ListCommandsResponse{
-		Commands:      commands,
-		NextPageToken: nextPageToken,
+	var nextPageToken string
+	if more {
+		last.Binding = binding
+		nextPageToken, err = encodePageToken(s.pageTokenKey(), &last)
+		if err != nil {
+			return nil, "", status.Errorf(codes.Internal, "Internal server error.")
+		}
+	}
+
+	return commands, nextPageToken, nil
+}
+
+// scanListedCommand reads the ID and state of a command from a row whose
+// columns are dest followed by listedCommandColumns.
+func (s *Server) scanListedCommand(row scanner, dest ...interface{}) (int64, *pb.Command, error) {
+	var id int64
+	var issuer string
+	var argv, targets, artifactPaths, redactions []string
+	var description string
+	var issuerDisplayName, catalogEntry, tool, profile, canceller, cancellerDisplayName, signal, startError, executorID, statusMessage, window, target sql.NullString
+	var statusID int32
+	var stdOut, stdErr, params, inputsJSON, envJSON, secretEnvJSON []byte
+	var requiredApprovals, exitCodeValue, parallelism, failureThreshold sql.NullInt32
+	var timeout, userCPU, systemCPU, maxRSS sql.NullInt64
+	var createTime, updateTime, deleteTime, startTime, endTime, cancelTime, heartbeatTime, scheduleTime, expireTime sql.NullTime
+	var bg breakGlassColumns
+	var pv previewColumns
+	err := row.Scan(append(
+		dest,
+		&id,
+		&issuer,
+		pq.Array(&argv),
+		&description,
+		&statusID,
+		&stdOut,
+		&stdErr,
+		&inputsJSON,
+		&pv.stdOut,
+		&pv.stdErr,
+		&createTime,
+		&updateTime,
+		&deleteTime,
+		&startTime,
+		&endTime,
+		&issuerDisplayName,
+		&catalogEntry,
+		&tool,
+		&params,
+		&requiredApprovals,
+		&profile,
+		&timeout,
+		&canceller,
+		&cancellerDisplayName,
+		&cancelTime,
+		&exitCodeValue,
+		&signal,
+		&startError,
+		&userCPU,
+		&systemCPU,
+		&maxRSS,
+		&executorID,
+		&heartbeatTime,
+		&statusMessage,
+		&scheduleTime,
+		&window,
+		&expireTime,
+		&target,
+		pq.Array(&targets),
+		&parallelism,
+		&failureThreshold,
+		pq.Array(&artifactPaths),
+		&envJSON,
+		&secretEnvJSON,
+		pq.Array(&redactions),
+		&bg.user,
+		&bg.userDisplayName,
+		&bg.justification,
+		&bg.createTime,
+		&bg.reviewer,
+		&bg.reviewerDisplayName,
+		&bg.reviewComment,
+		&bg.reviewTime,
+		pq.Array(&pv.argv),
+		&pv.state,
+		&pv.exitCode,
+		&pv.failure,
+		&pv.startTime,
+		&pv.endTime,
+		&pv.overrider,
+		&pv.overriderDisplayName,
+		&pv.overrideTime,
+	)...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	parameters, err := unmarshalValues(params)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	in, err := unmarshalInputs(inputsJSON)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	env, secretEnv, err := unmarshalEnv(envJSON, secretEnvJSON)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, &pb.Command{
+		Name:                 fmt.Sprintf("commands/%d", id),
+		Issuer:               issuer,
+		IssuerDisplayName:    unwrapstring(issuerDisplayName),
+		Argv:                 argv,
+		Description:          description,
+		CatalogEntry:         unwrapstring(catalogEntry),
+		Tool:                 unwrapstring(tool),
+		Parameters:           parameters,
+		RequiredApprovals:    int32(s.requiredApprovals(requiredApprovals)),
+		ExecutionProfile:     unwrapstring(profile),
+		Timeout:              duration(timeout),
+		Status:               pb.Status(statusID),
+		StdOut:               stdOut,
+		StdErr:               stdErr,
+		CreateTime:           timestamp(createTime),
+		UpdateTime:           timestamp(updateTime),
+		DeleteTime:           timestamp(deleteTime),
+		StartTime:            timestamp(startTime),
+		EndTime:              timestamp(endTime),
+		Canceller:            unwrapstring(canceller),
+		CancellerDisplayName: unwrapstring(cancellerDisplayName),
+		CancelTime:           timestamp(cancelTime),
+		ExitCode:             exitCode(exitCodeValue),
+		Signal:               unwrapstring(signal),
+		StartError:           unwrapstring(startError),
+		ResourceUsage:        resourceUsage(userCPU, systemCPU, maxRSS),
+		Executor:             unwrapstring(executorID),
+		HeartbeatTime:        timestamp(heartbeatTime),
+		StatusMessage:        unwrapstring(statusMessage),
+		ScheduleTime:         timestamp(scheduleTime),
+		MaintenanceWindow:    unwrapstring(window),
+		ExpireTime:           timestamp(expireTime),
+		Target:               unwrapstring(target),
+		Targets:              targets,
+		Parallelism:          parallelism.Int32,
+		FailureThreshold:     failureThreshold.Int32,
+		Inputs:               in,
+		ArtifactPaths:        artifactPaths,
+		Env:                  env,
+		SecretEnv:            secretEnv,
+		Redactions:           redactions,
+		BreakGlass:           bg.proto(),
+		Preview:              pv.proto(),
 	}, nil
 }
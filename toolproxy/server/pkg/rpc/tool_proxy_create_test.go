@@ -2,8 +2,10 @@ package rpc
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +14,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
@@ -23,17 +27,53 @@ func TestCreateCommand(t *testing.T) {
 		}
 
 		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectBegin()
 		mock.ExpectQuery(createCommandQuery).WithArgs(
-			sqlmock.AnyArg(), // Issuer field is currently not well-defined.
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
 			pq.Array(argv),
 			"",
 			pb.Status_READY,
 			sqlmock.AnyArg(), // Creation timestamp can't be matched statically.
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
 		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
-		s := &Server{db}
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_CREATE,
+			"users",
+			"alice",
+			"alice",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db}
 		start := time.Now()
-		cmd, err := s.CreateCommand(context.Background(), &pb.CreateCommandRequest{
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
 			Command: &pb.Command{
 				Argv:        argv,
 				Description: "",
@@ -54,6 +94,10 @@ func TestCreateCommand(t *testing.T) {
 			t.Errorf("Expected commands/1; got %v", cmd.GetName())
 		}
 
+		if cmd.GetIssuer() != "users:alice" {
+			t.Errorf("Expected issuer users:alice; got %v", cmd.GetIssuer())
+		}
+
 		if !reflect.DeepEqual(cmd.GetArgv(), argv) {
 			t.Errorf("Expected args: %v; got %v", argv, cmd.GetArgv())
 		}
@@ -98,17 +142,53 @@ func TestCreateCommand(t *testing.T) {
 		}
 
 		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectBegin()
 		mock.ExpectQuery(createCommandQuery).WithArgs(
-			sqlmock.AnyArg(), // Issuer field is currently not well-defined.
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
 			pq.Array(argv),
 			"",
 			pb.Status_SUBMITTED,
 			sqlmock.AnyArg(), // Creation timestamp can't be matched statically.
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
 		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
-		s := &Server{db}
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_CREATE,
+			"users",
+			"alice",
+			"alice",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db}
 		start := time.Now()
-		cmd, err := s.CreateCommand(context.Background(), &pb.CreateCommandRequest{
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
 			Command: &pb.Command{
 				Argv: argv,
 			},
@@ -171,16 +251,43 @@ func TestCreateCommand(t *testing.T) {
 		}
 
 		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectBegin()
 		mock.ExpectQuery(createCommandQuery).WithArgs(
-			sqlmock.AnyArg(), // Issuer field is currently not well-defined.
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
 			pq.Array(argv),
 			"",
 			pb.Status_READY,
 			sqlmock.AnyArg(), // Creation timestamp can't be matched statically.
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
 		).WillReturnError(errors.New("database internal error"))
+		mock.ExpectRollback()
 
-		s := &Server{db}
-		cmd, err := s.CreateCommand(context.Background(), &pb.CreateCommandRequest{
+		s := &Server{DB: db}
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
 			Command: &pb.Command{
 				Argv:        argv,
 				Description: "",
@@ -200,4 +307,318 @@ func TestCreateCommand(t *testing.T) {
 		}
 
 	})
+	t.Run("Ready status requires approval", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(createCommandQuery).WithArgs(
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
+			pq.Array(argv),
+			"",
+			pb.Status_SUBMITTED,
+			sqlmock.AnyArg(),
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, RequiredApprovals: 1}
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Argv:   argv,
+				Status: pb.Status_READY,
+			},
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if cmd.GetStatus() != pb.Status_SUBMITTED {
+			t.Errorf("Expected %v; got %v", pb.Status_SUBMITTED, cmd.GetStatus())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Fail to create command without identity", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db}
+		cmd, err := s.CreateCommand(context.Background(), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Argv: []string{"true"},
+			},
+		})
+		if status.Convert(err).Code() != codes.Unauthenticated {
+			t.Errorf("Expected grpc status %v; got %v", codes.Unauthenticated, status.Convert(err).Code())
+		}
+
+		if cmd != nil {
+			t.Errorf("Command should be nil on error.")
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Record permitting catalog entry", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		c, err := catalog.New([]catalog.Entry{{
+			Name:        "helm-install",
+			Path:        "/usr/bin/helm",
+			Subcommands: [][]string{{"install"}},
+			Args:        []string{"[a-z0-9-]+", "bitnami/[a-z0-9-]+"},
+		}})
+		if err != nil {
+			t.Fatalf("Error creating catalog: %v", err)
+		}
+
+		argv := []string{"/usr/bin/helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(createCommandQuery).WithArgs(
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
+			pq.Array(argv),
+			"",
+			pb.Status_SUBMITTED,
+			sqlmock.AnyArg(),
+			"helm-install",
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db, Catalog: c}
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Argv: argv,
+			},
+		})
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if cmd.GetCatalogEntry() != "helm-install" {
+			t.Errorf("Expected catalog entry helm-install; got %q", cmd.GetCatalogEntry())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject command not in catalog", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		c, err := catalog.New([]catalog.Entry{{
+			Name:        "helm-install",
+			Path:        "/usr/bin/helm",
+			Subcommands: [][]string{{"install"}},
+			Args:        []string{"[a-z0-9-]+", "bitnami/[a-z0-9-]+"},
+		}})
+		if err != nil {
+			t.Fatalf("Error creating catalog: %v", err)
+		}
+
+		s := &Server{DB: db, Catalog: c}
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Argv: []string{"/usr/bin/helm", "uninstall", "postgres"},
+			},
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+
+		if !strings.Contains(status.Convert(err).Message(), `subcommand "uninstall" is not allowed`) {
+			t.Errorf("Expected reason in error message; got %q", status.Convert(err).Message())
+		}
+
+		if cmd != nil {
+			t.Errorf("Command should be nil on error.")
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Render command from tool", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		tool := restartDeployment()
+		params, err := marshalParameters(tool.GetParameters())
+		if err != nil {
+			t.Fatalf("Error encoding parameters: %v", err)
+		}
+
+		mock.ExpectQuery(getToolQuery).WithArgs("restart-deployment").WillReturnRows(
+			sqlmock.NewRows([]string{
+				"description", "argv", "parameters",
+				"required_approvals", "create_time", "update_time",
+			}).AddRow(
+				nil, pq.Array(tool.GetArgv()), params,
+				2, time.Time{}, time.Time{},
+			),
+		)
+
+		argv := []string{"/usr/bin/kubectl", "--namespace=prod", "rollout", "restart", "deployment/web"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(createCommandQuery).WithArgs(
+			"users:alice",
+			"users",
+			"alice",
+			"alice",
+			pq.Array(argv),
+			"",
+			pb.Status_SUBMITTED,
+			sqlmock.AnyArg(),
+			nil,
+			"tools/restart-deployment",
+			sqlmock.AnyArg(), // Parameters are encoded as JSON.
+			sql.NullInt32{Int32: 2, Valid: true},
+			sql.NullInt64{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullTime{},
+			sql.NullString{},
+			sql.NullString{},
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+			sql.NullInt32{},
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+			sql.NullInt32{},
+		).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectExec(insertEventQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		s := &Server{DB: db}
+		cmd, err := s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Tool: "tools/restart-deployment",
+				Parameters: map[string]string{
+					"namespace":  "prod",
+					"deployment": "deployment/web",
+				},
+				Status: pb.Status_READY,
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if !reflect.DeepEqual(cmd.GetArgv(), argv) {
+			t.Errorf("Expected args: %v; got %v", argv, cmd.GetArgv())
+		}
+
+		if cmd.GetStatus() != pb.Status_SUBMITTED {
+			t.Errorf("Expected %v; got %v", pb.Status_SUBMITTED, cmd.GetStatus())
+		}
+
+		if cmd.GetRequiredApprovals() != 2 {
+			t.Errorf("Expected 2 required approvals; got %v", cmd.GetRequiredApprovals())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject argv with tool", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db}
+		_, err = s.CreateCommand(contextWithSubject("users", "alice"), &pb.CreateCommandRequest{
+			Command: &pb.Command{
+				Tool: "tools/restart-deployment",
+				Argv: []string{"/bin/sh", "-c", "id"},
+			},
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
 }
@@ -1,7 +1,6 @@
 package rpc
 
 import (
-	"context"
 	"reflect"
 	"testing"
 	"time"
@@ -11,6 +10,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
@@ -21,6 +21,31 @@ func TestDeleteCommand(t *testing.T) {
 			t.Fatalf("Error opening mock db: %v", err)
 		}
 
+		start := time.Now()
+		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(commandColumns).AddRow(
+				"users:alice", pq.Array(argv), "description of the command",
+				pb.Status_SUBMITTED, nil, nil,
+				time.Time{}, time.Time{}, nil,
+				nil, nil, "alice",
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
+			),
+		)
+		mock.ExpectBegin()
 		mock.ExpectExec(deleteQuery).WithArgs(
 			1,
 			pb.Status_DELETED,
@@ -29,25 +54,41 @@ func TestDeleteCommand(t *testing.T) {
 			pb.Status_SUBMITTED,
 			pb.Status_READY,
 		).WillReturnResult(sqlmock.NewResult(0, 1)).WillDelayFor(time.Millisecond)
-
-		start := time.Now()
-		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		mock.ExpectExec(insertEventQuery).WithArgs(
+			1,
+			pb.Action_ACTION_DELETE,
+			"users",
+			"alice",
+			"alice",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(audit.AppendQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
 		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(
-			sqlmock.NewRows([]string{
-				"issuer", "argv", "description",
-				"status", "std_out", "std_err",
-				"create_time", "update_time", "delete_time",
-				"start_time", "end_time",
-			}).AddRow(
-				"unknown", pq.Array(argv), "description of the command",
+			sqlmock.NewRows(commandColumns).AddRow(
+				"users:alice", pq.Array(argv), "description of the command",
 				pb.Status_DELETED, nil, nil,
 				time.Time{}, time.Time{}, start.Add(time.Microsecond),
-				nil, nil,
+				nil, nil, "alice",
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
 			),
 		)
 
-		s := &Server{db}
-		cmd, err := s.DeleteCommand(context.Background(), &pb.DeleteCommandRequest{
+		s := &Server{DB: db}
+		cmd, err := s.DeleteCommand(contextWithSubject("users", "alice"), &pb.DeleteCommandRequest{
 			Name: "commands/1",
 		})
 		end := time.Now()
@@ -103,6 +144,31 @@ func TestDeleteCommand(t *testing.T) {
 			t.Fatalf("Error opening mock db: %v", err)
 		}
 
+		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
+		completed := func() *sqlmock.Rows {
+			return sqlmock.NewRows(commandColumns).AddRow(
+				"users:alice", pq.Array(argv), "description of the command",
+				pb.Status_SUCCESS, nil, nil,
+				time.Time{}, time.Time{}, nil,
+				time.Time{}, time.Time{}, "alice",
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
+			)
+		}
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(completed())
+		mock.ExpectBegin()
 		mock.ExpectExec(deleteQuery).WithArgs(
 			1,
 			pb.Status_DELETED,
@@ -111,28 +177,62 @@ func TestDeleteCommand(t *testing.T) {
 			pb.Status_SUBMITTED,
 			pb.Status_READY,
 		).WillReturnResult(sqlmock.NewResult(0, 0)).WillDelayFor(time.Millisecond)
+		mock.ExpectCommit()
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(completed())
+
+		s := &Server{DB: db}
+		cmd, err := s.DeleteCommand(contextWithSubject("users", "alice"), &pb.DeleteCommandRequest{
+			Name: "commands/1",
+		})
+		if status.Convert(err).Code() != codes.FailedPrecondition {
+			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		}
+
+		if cmd != nil {
+			t.Errorf("Command should be nil on error.")
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+	})
+	t.Run("Fail to delete command issued by another user", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
 
 		argv := []string{"helm", "install", "postgres", "bitnami/postgres"}
 		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(
-			sqlmock.NewRows([]string{
-				"issuer", "argv", "description",
-				"status", "std_out", "std_err",
-				"create_time", "update_time", "delete_time",
-				"start_time", "end_time",
-			}).AddRow(
-				"unknown", pq.Array(argv), "description of the command",
-				pb.Status_SUCCESS, nil, nil,
+			sqlmock.NewRows(commandColumns).AddRow(
+				"users:alice", pq.Array(argv), "description of the command",
+				pb.Status_SUBMITTED, nil, nil,
 				time.Time{}, time.Time{}, nil,
-				time.Time{}, time.Time{},
+				nil, nil, "alice",
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
 			),
 		)
 
-		s := &Server{db}
-		cmd, err := s.DeleteCommand(context.Background(), &pb.DeleteCommandRequest{
+		s := &Server{DB: db}
+		cmd, err := s.DeleteCommand(contextWithSubject("users", "mallory"), &pb.DeleteCommandRequest{
 			Name: "commands/1",
 		})
-		if status.Convert(err).Code() != codes.FailedPrecondition {
-			t.Errorf("Expected grpc status %v; got %v", codes.FailedPrecondition, status.Convert(err).Code())
+		if status.Convert(err).Code() != codes.PermissionDenied {
+			t.Errorf("Expected grpc status %v; got %v", codes.PermissionDenied, status.Convert(err).Code())
 		}
 
 		if cmd != nil {
@@ -142,6 +242,5 @@ func TestDeleteCommand(t *testing.T) {
 		if err = mock.ExpectationsWereMet(); err != nil {
 			t.Errorf("Failed expectation: %v", err)
 		}
-
 	})
 }
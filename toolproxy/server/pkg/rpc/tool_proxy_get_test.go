@@ -12,6 +12,7 @@ import (
 	"github.com/lib/pq"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
@@ -30,26 +31,57 @@ func TestGetCommand(t *testing.T) {
 				"issuer", "argv", "description",
 				"status", "std_out", "std_err",
 				"create_time", "update_time", "delete_time",
-				"start_time", "end_time",
+				"start_time", "end_time", "issuer_display_name",
+				"catalog_entry", "tool", "parameters",
+				"required_approvals", "execution_profile", "timeout_ms",
+				"canceller", "canceller_display_name", "cancel_time",
+				"exit_code", "signal", "start_error",
+				"user_cpu_us", "system_cpu_us", "max_rss_bytes",
+				"executor", "heartbeat_time", "status_message",
+				"schedule_time", "maintenance_window", "expire_time",
+				"target", "targets", "parallelism",
+				"failure_threshold", "inputs", "artifact_paths", "env", "secret_env", "redactions",
+				"break_glass_user", "break_glass_user_display_name", "break_glass_justification", "break_glass_time",
+				"break_glass_reviewer", "break_glass_reviewer_display_name", "break_glass_review_comment", "break_glass_review_time",
+				"preview_argv", "preview_state", "preview_std_out", "preview_std_err", "preview_exit_code", "preview_error", "preview_start_time",
+				"preview_end_time", "preview_overrider", "preview_overrider_display_name", "preview_override_time",
 			}).AddRow(
-				"unknown", pq.Array(argv), "description of the command",
+				"users:unknown", pq.Array(argv), "description of the command",
 				pb.Status_READY, nil, nil,
 				time.Time{}, time.Time{}, nil,
-				nil, nil,
+				nil, nil, "Unknown User",
+				"helm-install", nil, nil,
+				nil, "restricted", 30000,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
 			),
 		)
 
-		s := &Server{db}
+		s := &Server{DB: db}
 		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
 
 		expect := &pb.Command{
-			Name:        "commands/1",
-			Description: "description of the command",
-			Issuer:      "unknown",
-			Argv:        argv,
-			Status:      pb.Status_READY,
-			CreateTime:  timestamppb.New(time.Time{}),
-			UpdateTime:  timestamppb.New(time.Time{}),
+			Name:              "commands/1",
+			Description:       "description of the command",
+			Issuer:            "users:unknown",
+			IssuerDisplayName: "Unknown User",
+			CatalogEntry:      "helm-install",
+			ExecutionProfile:  "restricted",
+			Timeout:           durationpb.New(30 * time.Second),
+			Argv:              argv,
+			Status:            pb.Status_READY,
+			CreateTime:        timestamppb.New(time.Time{}),
+			UpdateTime:        timestamppb.New(time.Time{}),
 		}
 		if err != nil {
 			t.Errorf("Expected success; got error: %v", err)
@@ -75,21 +107,48 @@ func TestGetCommand(t *testing.T) {
 				"issuer", "argv", "description",
 				"status", "std_out", "std_err",
 				"create_time", "update_time", "delete_time",
-				"start_time", "end_time",
+				"start_time", "end_time", "issuer_display_name",
+				"catalog_entry", "tool", "parameters",
+				"required_approvals", "execution_profile", "timeout_ms",
+				"canceller", "canceller_display_name", "cancel_time",
+				"exit_code", "signal", "start_error",
+				"user_cpu_us", "system_cpu_us", "max_rss_bytes",
+				"executor", "heartbeat_time", "status_message",
+				"schedule_time", "maintenance_window", "expire_time",
+				"target", "targets", "parallelism",
+				"failure_threshold", "inputs", "artifact_paths", "env", "secret_env", "redactions",
+				"break_glass_user", "break_glass_user_display_name", "break_glass_justification", "break_glass_time",
+				"break_glass_reviewer", "break_glass_reviewer_display_name", "break_glass_review_comment", "break_glass_review_time",
+				"preview_argv", "preview_state", "preview_std_out", "preview_std_err", "preview_exit_code", "preview_error", "preview_start_time",
+				"preview_end_time", "preview_overrider", "preview_overrider_display_name", "preview_override_time",
 			}).AddRow(
-				"unknown", pq.Array(argv), nil,
+				"users:unknown", pq.Array(argv), nil,
 				pb.Status_READY, nil, nil,
 				time.Time{}, time.Time{}, nil,
-				nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
 			),
 		)
 
-		s := &Server{db}
+		s := &Server{DB: db}
 		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
 
 		expect := &pb.Command{
 			Name:       "commands/1",
-			Issuer:     "unknown",
+			Issuer:     "users:unknown",
 			Argv:       argv,
 			Status:     pb.Status_READY,
 			CreateTime: timestamppb.New(time.Time{}),
@@ -107,6 +166,125 @@ func TestGetCommand(t *testing.T) {
 			t.Errorf("Bad result. Expected:\n%v; got:\n%v", expect, cmd)
 		}
 	})
+	t.Run("Get killed command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		argv := []string{"/usr/bin/make", "-j8"}
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(commandColumns).AddRow(
+				"users:unknown", pq.Array(argv), nil,
+				pb.Status_ERROR, nil, nil,
+				time.Time{}, time.Time{}, nil,
+				time.Time{}, time.Time{}, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, "SIGKILL", nil,
+				1500000, 250000, 2147483648,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
+			),
+		)
+
+		s := &Server{DB: db}
+		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
+
+		expect := &pb.Command{
+			Name:       "commands/1",
+			Issuer:     "users:unknown",
+			Argv:       argv,
+			Status:     pb.Status_ERROR,
+			CreateTime: timestamppb.New(time.Time{}),
+			UpdateTime: timestamppb.New(time.Time{}),
+			StartTime:  timestamppb.New(time.Time{}),
+			EndTime:    timestamppb.New(time.Time{}),
+			Signal:     "SIGKILL",
+			ResourceUsage: &pb.ResourceUsage{
+				UserCpuTime:   durationpb.New(1500 * time.Millisecond),
+				SystemCpuTime: durationpb.New(250 * time.Millisecond),
+				MaxRssBytes:   2147483648,
+			},
+		}
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if !reflect.DeepEqual(expect, cmd) {
+			t.Errorf("Bad result. Expected:\n%v; got:\n%v", expect, cmd)
+		}
+	})
+	t.Run("Get lost command", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		argv := []string{"/usr/bin/make", "-j8"}
+		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(commandColumns).AddRow(
+				"users:unknown", pq.Array(argv), nil,
+				pb.Status_LOST, nil, nil,
+				time.Time{}, time.Time{}, nil,
+				time.Time{}, time.Time{}, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				"executor-1", time.Time{}, "Executor stopped responding.",
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil,
+				nil, nil, nil, nil, nil, nil, nil,
+				nil, nil, nil, nil,
+			),
+		)
+
+		s := &Server{DB: db}
+		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
+
+		expect := &pb.Command{
+			Name:          "commands/1",
+			Issuer:        "users:unknown",
+			Argv:          argv,
+			Status:        pb.Status_LOST,
+			CreateTime:    timestamppb.New(time.Time{}),
+			UpdateTime:    timestamppb.New(time.Time{}),
+			StartTime:     timestamppb.New(time.Time{}),
+			EndTime:       timestamppb.New(time.Time{}),
+			Executor:      "executor-1",
+			HeartbeatTime: timestamppb.New(time.Time{}),
+			StatusMessage: "Executor stopped responding.",
+		}
+		if err != nil {
+			t.Errorf("Expected success; got error: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+
+		if !reflect.DeepEqual(expect, cmd) {
+			t.Errorf("Bad result. Expected:\n%v; got:\n%v", expect, cmd)
+		}
+	})
 	t.Run("Not found command", func(t *testing.T) {
 		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 		if err != nil {
@@ -115,7 +293,7 @@ func TestGetCommand(t *testing.T) {
 
 		mock.ExpectQuery(getCommandQuery).WithArgs(1).WillReturnError(sql.ErrNoRows)
 
-		s := &Server{db}
+		s := &Server{DB: db}
 		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
 		if status.Convert(err).Code() != codes.NotFound {
 			t.Errorf("Expected grpc status %v; got %v", codes.NotFound, status.Convert(err).Code())
@@ -141,7 +319,7 @@ func TestGetCommand(t *testing.T) {
 			errors.New("database internal error"),
 		)
 
-		s := &Server{db}
+		s := &Server{DB: db}
 		cmd, err := s.GetCommand(context.Background(), &pb.GetCommandRequest{Name: "commands/1"})
 		if status.Convert(err).Code() != codes.Unavailable {
 			t.Errorf("Expected grpc status %v; got %v", codes.Unavailable, status.Convert(err).Code())
@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCompileFilter(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name       string
+		filter     string
+		conditions []string
+		args       []interface{}
+		ok         bool
+	}{
+		{
+			name: "Empty filter",
+			ok:   true,
+		},
+		{
+			name:       "Conjunction of comparisons",
+			filter:     `issuer = "users:alice" AND status != SUCCESS AND argv[0]="/usr/bin/kubectl" AND create_time >= "2024-01-01T00:00:00Z"`,
+			conditions: []string{"issuer = $2", "status IS DISTINCT FROM $3", "argv[1] = $4", "create_time >= $5"},
+			args:       []interface{}{"users:alice", int32(pb.Status_SUCCESS), "/usr/bin/kubectl", since},
+			ok:         true,
+		},
+		{
+			name:       "Escaped quote",
+			filter:     `tool = "a \"b\""`,
+			conditions: []string{"tool = $2"},
+			args:       []interface{}{`a "b"`},
+			ok:         true,
+		},
+		{
+			name:   "Break-glass review state",
+			filter: `break_glass = true AND break_glass.review_state = REVIEW_OPEN`,
+			conditions: []string{
+				"(break_glass_time IS NOT NULL) = $2",
+				"(CASE WHEN break_glass_time IS NULL THEN 0 WHEN break_glass_review_time IS NULL THEN 1 ELSE 2 END) = $3",
+			},
+			args: []interface{}{true, int32(pb.BreakGlassReviewState_REVIEW_OPEN)},
+			ok:   true,
+		},
+		{
+			name:   "Malformed boolean",
+			filter: `break_glass = yes`,
+		},
+		{
+			name:   "Unknown field",
+			filter: `std_out = "secret"`,
+		},
+		{
+			name:   "Unordered comparison",
+			filter: `issuer > "users:a"`,
+		},
+		{
+			name:   "Unknown status",
+			filter: `status = FINISHED`,
+		},
+		{
+			name:   "Disjunction",
+			filter: `status = SUCCESS OR status = ERROR`,
+		},
+		{
+			name:   "Unterminated string",
+			filter: `issuer = "users:alice`,
+		},
+		{
+			name:   "Malformed timestamp",
+			filter: `create_time > yesterday`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conditions, args, err := compileFilter(tc.filter, 2)
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("Expected error; got %v", conditions)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			if !reflect.DeepEqual(conditions, tc.conditions) || !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("Expected %v with %v; got %v with %v", tc.conditions, tc.args, conditions, args)
+			}
+		})
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	key := []byte("key")
+	binding := pageTokenBinding("status = RUNNING", "create_time", "false")
+	token, err := encodePageToken(key, &pageToken{Binding: binding, Time: 42, ID: 7})
+	if err != nil {
+		t.Fatalf("Error encoding page token: %v", err)
+	}
+
+	p, err := decodePageToken(key, token, binding)
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+	if p.Time != 42 || p.ID != 7 {
+		t.Errorf("Bad page token: %+v", p)
+	}
+
+	if _, err := decodePageToken([]byte("other key"), token, binding); err == nil {
+		t.Errorf("Expected forged page token to be rejected")
+	}
+	if _, err := decodePageToken(key, token, pageTokenBinding("", "create_time", "false")); err == nil {
+		t.Errorf("Expected page token of a different filter to be rejected")
+	}
+	if _, err := decodePageToken(key, "7", binding); err == nil {
+		t.Errorf("Expected offset page token to be rejected")
+	}
+}
+
+// listedCommand returns a row of listCommandsQuery, whose columns are those of
+// getCommandQuery in a different order.
+func listedCommand(id int64, createTime time.Time) []driver.Value {
+	row := []driver.Value{id, "users:alice", pq.Array([]string{"/usr/bin/uptime"}), "", pb.Status_SUCCESS, nil, nil, nil, nil, nil, createTime}
+	for len(row) < len(commandColumns)+1 {
+		row = append(row, nil)
+	}
+	return row
+}
+
+func TestListCommands(t *testing.T) {
+	t.Run("Page through commands", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		t1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		t2 := t1.Add(time.Hour)
+		columns := append([]string{"id"}, commandColumns...)
+		mock.ExpectQuery(fmt.Sprintf(
+			listCommandsQuery,
+			viewColumns(false),
+			"issuer = $1 AND delete_time IS NULL",
+			"create_time DESC, id DESC",
+			2,
+		)).WithArgs("users:alice", 2).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(listedCommand(3, t2)...).AddRow(listedCommand(2, t1)...),
+		)
+		mock.ExpectQuery(fmt.Sprintf(
+			listCommandsQuery,
+			viewColumns(false),
+			"issuer = $1 AND delete_time IS NULL AND (create_time, id) < ($2, $3)",
+			"create_time DESC, id DESC",
+			4,
+		)).WithArgs("users:alice", t2, 3, 2).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(listedCommand(2, t1)...),
+		)
+
+		s := &Server{DB: db}
+		req := &pb.ListCommandsRequest{PageSize: 1, Filter: `issuer = "users:alice"`, OrderBy: "create_time desc"}
+		res, err := s.ListCommands(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(res.GetCommands()) != 1 || res.GetCommands()[0].GetName() != "commands/3" || res.GetNextPageToken() == "" {
+			t.Fatalf("Expected commands/3 and a next page; got %v", res)
+		}
+		if !res.GetCommands()[0].GetCreateTime().AsTime().Equal(t2) || res.GetCommands()[0].GetEndTime() != nil {
+			t.Errorf("Bad timestamps: %v", res.GetCommands()[0])
+		}
+
+		req.PageToken = res.GetNextPageToken()
+		res, err = s.ListCommands(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(res.GetCommands()) != 1 || res.GetCommands()[0].GetName() != "commands/2" || res.GetNextPageToken() != "" {
+			t.Errorf("Expected commands/2 on the last page; got %v", res)
+		}
+
+		// The page token is bound to the filter.
+		req.Filter = `issuer = "users:bob"`
+		_, err = s.ListCommands(context.Background(), req)
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Return output in full view", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		row := listedCommand(1, time.Time{})
+		row[5] = []byte("output")
+		row[7] = []byte(`{"files":[{"name":"patch.yaml","content":"a2luZDogUG9k","sha256":"abc"}]}`)
+		mock.ExpectQuery(fmt.Sprintf(listCommandsQuery, viewColumns(true), "TRUE", "id ASC", 1)).
+			WithArgs(defaultPageSize + 1).
+			WillReturnRows(sqlmock.NewRows(append([]string{"id"}, commandColumns...)).AddRow(row...))
+
+		s := &Server{DB: db}
+		res, err := s.ListCommands(context.Background(), &pb.ListCommandsRequest{
+			OrderBy:     "name",
+			ShowDeleted: true,
+			View:        pb.CommandView_COMMAND_VIEW_FULL,
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+		if len(res.GetCommands()) != 1 || string(res.GetCommands()[0].GetStdOut()) != "output" {
+			t.Errorf("Expected output of commands/1; got %v", res)
+		}
+		if files := res.GetCommands()[0].GetInputs().GetFiles(); len(files) != 1 || string(files[0].GetContent()) != "kind: Pod" {
+			t.Errorf("Expected input files of commands/1; got %v", files)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject invalid requests", func(t *testing.T) {
+		s := &Server{}
+		for _, r := range []*pb.ListCommandsRequest{
+			{PageSize: maxPageSize + 1},
+			{OrderBy: "argv"},
+			{OrderBy: "create_time, name"},
+			{Filter: "status ="},
+			{PageToken: "10"},
+		} {
+			_, err := s.ListCommands(context.Background(), r)
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %v; got %v", codes.InvalidArgument, r, status.Convert(err).Code())
+			}
+		}
+	})
+}
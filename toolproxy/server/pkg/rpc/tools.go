@@ -0,0 +1,395 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// uniqueViolation is the PostgreSQL error code for a violated unique constraint.
+const uniqueViolation = "23505"
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// parseToolName returns the tool ID from a tool resource name.
+func parseToolName(name string) (string, error) {
+	var collection, id string
+	u := urn.Parse(name)
+	if len(u.Parts) != 2 {
+		return "", fmt.Errorf("malformed tool name %q", name)
+	}
+	if err := u.Scan(&collection, &id); err != nil {
+		return "", err
+	}
+	if collection != "tools" || !toolIDPattern.MatchString(id) {
+		return "", fmt.Errorf("malformed tool name %q", name)
+	}
+	return id, nil
+}
+
+// marshalParameters encodes parameters for storage as a JSON array.
+func marshalParameters(params []*pb.Parameter) ([]byte, error) {
+	raw := make([]json.RawMessage, 0, len(params))
+	for _, p := range params {
+		b, err := protojson.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, b)
+	}
+	return json.Marshal(raw)
+}
+
+// unmarshalParameters decodes parameters stored by marshalParameters.
+func unmarshalParameters(data []byte) ([]*pb.Parameter, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	params := make([]*pb.Parameter, 0, len(raw))
+	for _, b := range raw {
+		p := new(pb.Parameter)
+		if err := protojson.Unmarshal(b, p); err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+func int32Value(v sql.NullInt32) *wrapperspb.Int32Value {
+	if !v.Valid {
+		return nil
+	}
+	return wrapperspb.Int32(v.Int32)
+}
+
+func nullInt32(v *wrapperspb.Int32Value) sql.NullInt32 {
+	if v == nil {
+		return sql.NullInt32{}
+	}
+	return sql.NullInt32{Int32: v.GetValue(), Valid: true}
+}
+
+const getToolQuery = `
+	SELECT description, argv, parameters, required_approvals, create_time, update_time
+	FROM tools
+	WHERE tool_id = $1;
+`
+
+// GetTool implements ToolProxy for Server.
+func (s *Server) GetTool(ctx context.Context, r *pb.GetToolRequest) (*pb.Tool, error) {
+	id, err := parseToolName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed tool name.")
+	}
+
+	return s.getTool(ctx, s.DB, id)
+}
+
+// getTool reads the tool with the given ID using q.
+func (s *Server) getTool(ctx context.Context, q queryer, id string) (*pb.Tool, error) {
+	var description sql.NullString
+	var argv []string
+	var params []byte
+	var requiredApprovals sql.NullInt32
+	var createTime, updateTime sql.NullTime
+	err := q.QueryRowContext(ctx, getToolQuery, id).Scan(
+		&description,
+		pq.Array(&argv),
+		&params,
+		&requiredApprovals,
+		&createTime,
+		&updateTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Tool not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting tool from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	parameters, err := unmarshalParameters(params)
+	if err != nil {
+		log.WithError(err).WithField("tool", id).Errorln("Error decoding tool parameters.")
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+
+	return &pb.Tool{
+		Name:              "tools/" + id,
+		Description:       unwrapstring(description),
+		Argv:              argv,
+		Parameters:        parameters,
+		RequiredApprovals: int32Value(requiredApprovals),
+		CreateTime:        timestamp(createTime),
+		UpdateTime:        timestamp(updateTime),
+	}, nil
+}
+
+const createToolQuery = `
+	INSERT INTO tools ("tool_id", "description", "argv", "parameters", "required_approvals", "create_time", "update_time")
+	VALUES ($1, $2, $3, $4, $5, $6, $6);
+`
+
+// CreateTool implements ToolProxy for Server.
+func (s *Server) CreateTool(ctx context.Context, r *pb.CreateToolRequest) (*pb.Tool, error) {
+	if !toolIDPattern.MatchString(r.GetToolId()) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed tool ID.")
+	}
+
+	tool := r.GetTool()
+	if err := validateTool(tool); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid tool: %v.", err)
+	}
+
+	params, err := marshalParameters(tool.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid tool parameters.")
+	}
+
+	createTime := time.Now()
+	_, err = s.DB.ExecContext(
+		ctx,
+		createToolQuery,
+		r.GetToolId(),
+		tool.GetDescription(),
+		pq.Array(tool.GetArgv()),
+		params,
+		nullInt32(tool.GetRequiredApprovals()),
+		createTime,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return nil, status.Errorf(codes.AlreadyExists, "Tool already exists.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error saving tool to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.Tool{
+		Name:              "tools/" + r.GetToolId(),
+		Description:       tool.GetDescription(),
+		Argv:              tool.GetArgv(),
+		Parameters:        tool.GetParameters(),
+		RequiredApprovals: tool.GetRequiredApprovals(),
+		CreateTime:        timestamppb.New(createTime),
+		UpdateTime:        timestamppb.New(createTime),
+	}, nil
+}
+
+const updateToolQuery = `
+	UPDATE tools
+	SET (description, argv, parameters, required_approvals, update_time) = ($2, $3, $4, $5, $6)
+	WHERE tool_id = $1
+	RETURNING create_time;
+`
+
+// UpdateTool implements ToolProxy for Server.
+func (s *Server) UpdateTool(ctx context.Context, r *pb.UpdateToolRequest) (*pb.Tool, error) {
+	id, err := parseToolName(r.GetTool().GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed tool name.")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	tool, err := s.getTool(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := r.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"description", "argv", "parameters", "required_approvals"}
+	}
+	for _, v := range paths {
+		switch v {
+		case "description":
+			tool.Description = r.GetTool().GetDescription()
+		case "argv":
+			tool.Argv = r.GetTool().GetArgv()
+		case "parameters":
+			tool.Parameters = r.GetTool().GetParameters()
+		case "required_approvals":
+			tool.RequiredApprovals = r.GetTool().GetRequiredApprovals()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Field %q cannot be updated.", v)
+		}
+	}
+
+	if err = validateTool(tool); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid tool: %v.", err)
+	}
+
+	params, err := marshalParameters(tool.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid tool parameters.")
+	}
+
+	updateTime := time.Now()
+	var createTime sql.NullTime
+	err = tx.QueryRowContext(
+		ctx,
+		updateToolQuery,
+		id,
+		tool.GetDescription(),
+		pq.Array(tool.GetArgv()),
+		params,
+		nullInt32(tool.GetRequiredApprovals()),
+		updateTime,
+	).Scan(&createTime)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Tool not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error updating tool.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing tool update.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	tool.CreateTime = timestamp(createTime)
+	tool.UpdateTime = timestamppb.New(updateTime)
+	return tool, nil
+}
+
+const deleteToolQuery = `
+	DELETE FROM tools
+	WHERE tool_id = $1;
+`
+
+// DeleteTool implements ToolProxy for Server.
+func (s *Server) DeleteTool(ctx context.Context, r *pb.DeleteToolRequest) (*emptypb.Empty, error) {
+	id, err := parseToolName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed tool name.")
+	}
+
+	res, err := s.DB.ExecContext(ctx, deleteToolQuery, id)
+	if err != nil {
+		log.WithError(err).Errorln("Error deleting tool.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+	if rows == 0 {
+		return nil, status.Errorf(codes.NotFound, "Tool not found.")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+const listToolsQuery = `
+	SELECT tool_id, description, argv, parameters, required_approvals, create_time, update_time
+	FROM tools
+	WHERE tool_id > $1
+	ORDER BY tool_id
+	LIMIT $2;
+`
+
+// ListTools implements ToolProxy for Server.
+func (s *Server) ListTools(ctx context.Context, r *pb.ListToolsRequest) (*pb.ListToolsResponse, error) {
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	after := r.GetPageToken()
+	if after != "" && !toolIDPattern.MatchString(after) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+	}
+
+	// One more tool than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listToolsQuery, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing tools.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var tools []*pb.Tool
+	for rows.Next() {
+		if len(tools) == limit {
+			more = true
+			break
+		}
+
+		var description sql.NullString
+		var argv []string
+		var params []byte
+		var requiredApprovals sql.NullInt32
+		var createTime, updateTime sql.NullTime
+		err = rows.Scan(
+			&after,
+			&description,
+			pq.Array(&argv),
+			&params,
+			&requiredApprovals,
+			&createTime,
+			&updateTime,
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		parameters, err := unmarshalParameters(params)
+		if err != nil {
+			log.WithError(err).WithField("tool", after).Errorln("Error decoding tool parameters.")
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		tools = append(tools, &pb.Tool{
+			Name:              "tools/" + after,
+			Description:       unwrapstring(description),
+			Argv:              argv,
+			Parameters:        parameters,
+			RequiredApprovals: int32Value(requiredApprovals),
+			CreateTime:        timestamp(createTime),
+			UpdateTime:        timestamp(updateTime),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing tools.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = after
+	}
+
+	return &pb.ListToolsResponse{
+		Tools:         tools,
+		NextPageToken: nextPageToken,
+	}, nil
+}
@@ -0,0 +1,229 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+func TestCreateTool(t *testing.T) {
+	t.Run("Successfully create tool", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		tool := restartDeployment()
+		mock.ExpectExec(createToolQuery).WithArgs(
+			"restart-deployment",
+			"",
+			pq.Array(tool.GetArgv()),
+			sqlmock.AnyArg(), // Parameters are encoded as JSON.
+			nil,
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		s := &Server{DB: db}
+		res, err := s.CreateTool(context.Background(), &pb.CreateToolRequest{
+			Tool:   tool,
+			ToolId: "restart-deployment",
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if res.GetName() != "tools/restart-deployment" {
+			t.Errorf("Expected tools/restart-deployment; got %v", res.GetName())
+		}
+
+		if res.GetCreateTime() == nil {
+			t.Errorf("Expected create timestamp; got nil")
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Tool already exists", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectExec(createToolQuery).WillReturnError(&pq.Error{Code: uniqueViolation})
+
+		s := &Server{DB: db}
+		_, err = s.CreateTool(context.Background(), &pb.CreateToolRequest{
+			Tool:   restartDeployment(),
+			ToolId: "restart-deployment",
+		})
+		if status.Convert(err).Code() != codes.AlreadyExists {
+			t.Errorf("Expected grpc status %v; got %v", codes.AlreadyExists, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject invalid tool", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		tool := restartDeployment()
+		tool.Argv[0] = "kubectl"
+
+		s := &Server{DB: db}
+		_, err = s.CreateTool(context.Background(), &pb.CreateToolRequest{
+			Tool:   tool,
+			ToolId: "restart-deployment",
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject malformed tool ID", func(t *testing.T) {
+		db, _, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		s := &Server{DB: db}
+		_, err = s.CreateTool(context.Background(), &pb.CreateToolRequest{
+			Tool:   restartDeployment(),
+			ToolId: "Restart_Deployment",
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+	})
+}
+
+func TestGetTool(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("Error opening mock db: %v", err)
+	}
+
+	tool := restartDeployment()
+	params, err := marshalParameters(tool.GetParameters())
+	if err != nil {
+		t.Fatalf("Error encoding parameters: %v", err)
+	}
+
+	mock.ExpectQuery(getToolQuery).WithArgs("restart-deployment").WillReturnRows(
+		sqlmock.NewRows([]string{
+			"description", "argv", "parameters",
+			"required_approvals", "create_time", "update_time",
+		}).AddRow(
+			nil, pq.Array(tool.GetArgv()), params,
+			2, time.Time{}, time.Time{},
+		),
+	)
+
+	s := &Server{DB: db}
+	res, err := s.GetTool(context.Background(), &pb.GetToolRequest{Name: "tools/restart-deployment"})
+	if err != nil {
+		t.Fatalf("Expected success; got error: %v", err)
+	}
+
+	if len(res.GetParameters()) != len(tool.GetParameters()) {
+		t.Fatalf("Expected %d parameters; got %d", len(tool.GetParameters()), len(res.GetParameters()))
+	}
+	for i := range tool.GetParameters() {
+		if !proto.Equal(res.GetParameters()[i], tool.GetParameters()[i]) {
+			t.Errorf("Expected parameter %v; got %v", tool.GetParameters()[i], res.GetParameters()[i])
+		}
+	}
+
+	if res.GetRequiredApprovals().GetValue() != 2 {
+		t.Errorf("Expected 2 required approvals; got %v", res.GetRequiredApprovals())
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Failed expectation: %v", err)
+	}
+}
+
+func TestListTools(t *testing.T) {
+	columns := []string{"tool_id", "description", "argv", "parameters", "required_approvals", "create_time", "update_time"}
+	testCases := []struct {
+		name      string
+		pageSize  int32
+		limit     int
+		ids       []string
+		code      codes.Code
+		tools     int
+		nextToken string
+	}{
+		{
+			name:  "Default page size",
+			limit: defaultPageSize + 1,
+			ids:   []string{"restart-deployment"},
+			tools: 1,
+		},
+		{
+			name:      "Another page follows",
+			pageSize:  1,
+			limit:     2,
+			ids:       []string{"restart-deployment", "scale-deployment"},
+			tools:     1,
+			nextToken: "restart-deployment",
+		},
+		{
+			name:     "Negative page size",
+			pageSize: -1,
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.code == codes.OK {
+				rows := sqlmock.NewRows(columns)
+				for _, id := range tc.ids {
+					rows.AddRow(id, nil, pq.Array([]string{"/usr/bin/kubectl"}), []byte("[]"), nil, nil, nil)
+				}
+				mock.ExpectQuery(listToolsQuery).WithArgs("", tc.limit).WillReturnRows(rows)
+			}
+
+			s := &Server{DB: db}
+			res, err := s.ListTools(context.Background(), &pb.ListToolsRequest{PageSize: tc.pageSize})
+			if status.Code(err) != tc.code {
+				t.Fatalf("Expected %v; got %v", tc.code, err)
+			}
+
+			if len(res.GetTools()) != tc.tools {
+				t.Errorf("Expected %d tools; got %d", tc.tools, len(res.GetTools()))
+			}
+			if res.GetNextPageToken() != tc.nextToken {
+				t.Errorf("Expected next page token %q; got %q", tc.nextToken, res.GetNextPageToken())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
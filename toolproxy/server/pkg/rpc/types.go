@@ -1,18 +1,86 @@
 package rpc
 
 import (
+	"crypto/ed25519"
 	"database/sql"
+	"sync"
+	"time"
 
+	authzed "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc"
 
 	"github.com/hxtk/yggdrasil/common/authz"
 	"github.com/hxtk/yggdrasil/common/server"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/catalog"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/executor"
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/redact"
 	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
 )
 
 // Server is a gRPC server for the Tool Proxy API family.
 type Server struct {
 	DB *sql.DB
+
+	// RequiredApprovals is the number of distinct users other than the issuer
+	// who must approve a command before it may be run, unless the command was
+	// created from a tool which overrides it. If it is zero, commands may be
+	// marked as ready by their issuer.
+	RequiredApprovals int
+
+	// Authz is used for authorization decisions which depend on the state of
+	// a command. If it is nil, such decisions are made as though the caller
+	// had no permissions beyond those checked by the interceptor.
+	Authz authzed.PermissionsServiceClient
+
+	// Catalog is the allowlist of tools which commands may run. If it is nil,
+	// any argv is permitted.
+	Catalog *catalog.Catalog
+
+	// MaxTimeout is the longest a command may run before it is terminated,
+	// and the timeout of commands which do not specify one. If it is zero,
+	// commands without a timeout may run indefinitely.
+	MaxTimeout time.Duration
+
+	// ScheduleTolerance is how long after its schedule time a command which
+	// is not scheduled within a maintenance window may still be started. If
+	// it is zero, a default of fifteen minutes is used.
+	ScheduleTolerance time.Duration
+
+	// Executor dispatches commands to the agents which connect to this
+	// server. If it is nil, agents may not connect.
+	Executor *executor.Executor
+
+	// AuditKey verifies the checkpoints of the audit log. If it is nil, the
+	// audit log may not be verified through the API.
+	AuditKey ed25519.PublicKey
+
+	// PageTokenKey authenticates page tokens, so that they cannot be forged.
+	// Every replica must share it for a page token issued by one to be
+	// accepted by another. If it is empty, a random key is generated.
+	PageTokenKey []byte
+
+	// Sealer decrypts the original output of commands, which executors
+	// retain when anything is redacted from it. If it is nil, the original
+	// output may not be read.
+	Sealer *redact.Sealer
+
+	// Exporter delivers audit events to the configured sinks. It is woken
+	// when glass is broken so that the sinks are notified at once. If it is
+	// nil, the use of break-glass is exported when the outbox is next
+	// polled.
+	Exporter *audit.Exporter
+
+	// ReviewSampling is the fraction, from 0 to 1, of finished commands of
+	// each status which are queued for review. Commands whose status is not
+	// given are not queued. If it is nil, every finished command is queued.
+	ReviewSampling map[pb.Status]float64
+
+	mu                 sync.Mutex
+	waiters            map[int64]map[chan struct{}]struct{}
+	watchers           map[chan struct{}]struct{}
+	randomPageTokenKey []byte
 }
 
 func New(db *sql.DB) *Server {
@@ -24,10 +92,15 @@ func New(db *sql.DB) *Server {
 func (s *Server) Register(g *grpc.Server, az authz.Registrar) {
 	pb.RegisterToolProxyServer(g, s)
 	pb.RegisterToolProxyPermissions(az)
+	longrunning.RegisterOperationsServer(g, s)
+	registerOperationsPermissions(az)
 }
 
 // Type assertion that Server must implement ToolProxyServer.
 var _ pb.ToolProxyServer = new(Server)
 
+// Type assertion that Server must implement longrunning.OperationsServer.
+var _ longrunning.OperationsServer = new(Server)
+
 // Type assertion that Server must implement server.Registrar.
 var _ server.Registrar = new(Server)
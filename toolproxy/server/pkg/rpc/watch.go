@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// watchBatchSize is the greatest number of changes read from the audit log at
+// once by WatchCommands.
+const watchBatchSize = 100
+
+const auditHeadQuery = `SELECT seq FROM audit_head;`
+
+// listChangesQuery lists the changes to commands recorded in the audit log,
+// with the commands they were made to. It is completed with the columns
+// returned by viewColumns, the conditions selecting changes, and the
+// parameter number of the limit.
+const listChangesQuery = `
+	SELECT e.seq, e.action, e.actor_type, e.actor_id, e.actor_display_name, e.event_time,
+		` + listedCommandColumns + `
+	FROM audit_events e JOIN commands ON commands.id = e.command_id
+	WHERE %s
+	ORDER BY e.seq
+	LIMIT $%d;
+`
+
+// WatchCommands implements ToolProxy for Server.
+//
+// Changes are read from the audit log, in which each event has a sequence
+// number in the order in which it was committed. The resume token of a change
+// is its sequence number, so a client which resumes is sent every change it
+// has not yet seen, no matter which replica it reconnects to.
+func (s *Server) WatchCommands(r *pb.WatchCommandsRequest, stream pb.ToolProxy_WatchCommandsServer) error {
+	ctx := stream.Context()
+	conditions, args, err := compileFilter(r.GetFilter(), 1)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid filter: %v.", err)
+	}
+
+	// Watch before reading the head of the audit log so that no change
+	// after it goes unnoticed.
+	changed, unwatch := s.watch()
+	defer unwatch()
+
+	binding := pageTokenBinding("watch", r.GetFilter())
+	var cursor int64
+	if r.GetResumeToken() != "" {
+		p, err := decodePageToken(s.pageTokenKey(), r.GetResumeToken(), binding)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid resume token: %v.", err)
+		}
+		cursor = p.ID
+	} else {
+		cursor, err = s.auditHead(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	full := r.GetView() == pb.CommandView_COMMAND_VIEW_FULL
+	for {
+		head, err := s.auditHead(ctx)
+		if err != nil {
+			return err
+		}
+
+		for cursor < head {
+			var changes []*pb.CommandChange
+			changes, cursor, err = s.listChanges(ctx, conditions, args, full, binding, cursor, head)
+			if err != nil {
+				return err
+			}
+			for _, c := range changes {
+				if err := stream.Send(c); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Notifications should always arrive, but we check periodically in
+		// case one was lost.
+		timer := time.NewTimer(awaitPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.Errorf(codes.Canceled, "Request canceled.")
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// auditHead returns the sequence number of the last event committed to the
+// audit log.
+func (s *Server) auditHead(ctx context.Context) (int64, error) {
+	var seq int64
+	err := s.DB.QueryRowContext(ctx, auditHeadQuery).Scan(&seq)
+	if err != nil {
+		log.WithError(err).Errorln("Error reading head of audit log.")
+		return 0, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	return seq, nil
+}
+
+// listChanges returns the changes to commands matching conditions after the
+// event with sequence number after, up to and including the event with
+// sequence number head, and the sequence number up to which they were read.
+func (s *Server) listChanges(ctx context.Context, conditions []string, args []interface{}, full bool, binding []byte, after, head int64) ([]*pb.CommandChange, int64, error) {
+	conditions = append(
+		conditions,
+		fmt.Sprintf("e.seq > $%d", len(args)+1),
+		fmt.Sprintf("e.seq <= $%d", len(args)+2),
+	)
+	args = append(args, after, head)
+
+	query := fmt.Sprintf(listChangesQuery, viewColumns(full), strings.Join(conditions, " AND "), len(args)+1)
+	rows, err := s.DB.QueryContext(ctx, query, append(args, watchBatchSize)...)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing changes.")
+		return nil, 0, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var changes []*pb.CommandChange
+	for rows.Next() {
+		var seq int64
+		var action int32
+		var actor principal
+		var displayName sql.NullString
+		var eventTime sql.NullTime
+		_, command, err := s.scanListedCommand(rows, &seq, &action, &actor.Type, &actor.ID, &displayName, &eventTime)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		resumeToken, err := encodePageToken(s.pageTokenKey(), &pageToken{Binding: binding, ID: seq})
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		after = seq
+		changes = append(changes, &pb.CommandChange{
+			Action:           pb.Action(action),
+			Actor:            actor.String(),
+			ActorDisplayName: unwrapstring(displayName),
+			ChangeTime:       timestamp(eventTime),
+			Command:          command,
+			ResumeToken:      resumeToken,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing changes.")
+		return nil, 0, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	// Every change up to the head has been read unless the batch was full.
+	if len(changes) < watchBatchSize {
+		after = head
+	}
+
+	return changes, after, nil
+}
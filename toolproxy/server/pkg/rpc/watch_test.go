@@ -0,0 +1,122 @@
+package rpc
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hxtk/yggdrasil/toolproxy/server/pkg/audit"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// fakeWatchStream records the changes sent to it, and cancels its context
+// once it has received want of them.
+type fakeWatchStream struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	cancel  func()
+	want    int
+	changes []*pb.CommandChange
+}
+
+func (f *fakeWatchStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeWatchStream) Send(change *pb.CommandChange) error {
+	f.changes = append(f.changes, change)
+	if len(f.changes) == f.want {
+		f.cancel()
+	}
+	return nil
+}
+
+func newFakeWatchStream(want int) *fakeWatchStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeWatchStream{ctx: ctx, cancel: cancel, want: want}
+}
+
+// changedCommand returns a row of listChangesQuery.
+func changedCommand(seq int64, action pb.Action, id int64) []driver.Value {
+	return append(
+		[]driver.Value{seq, action, audit.SystemActorType, audit.SystemActorID, "", time.Time{}},
+		listedCommand(id, time.Time{})...,
+	)
+}
+
+func TestWatchCommands(t *testing.T) {
+	columns := append([]string{"seq", "action", "actor_type", "actor_id", "actor_display_name", "event_time", "id"}, commandColumns...)
+
+	t.Run("Resume after last change", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectQuery(auditHeadQuery).WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(7))
+		mock.ExpectQuery(fmt.Sprintf(
+			listChangesQuery,
+			viewColumns(false),
+			"status = $1 AND e.seq > $2 AND e.seq <= $3",
+			4,
+		)).WithArgs(int32(pb.Status_SUCCESS), 5, 7, watchBatchSize).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(changedCommand(6, pb.Action_ACTION_FINISH, 1)...),
+		)
+
+		s := &Server{DB: db}
+		binding := pageTokenBinding("watch", "status = SUCCESS")
+		token, err := encodePageToken(s.pageTokenKey(), &pageToken{Binding: binding, ID: 5})
+		if err != nil {
+			t.Fatalf("Error encoding resume token: %v", err)
+		}
+
+		stream := newFakeWatchStream(1)
+		err = s.WatchCommands(&pb.WatchCommandsRequest{Filter: "status = SUCCESS", ResumeToken: token}, stream)
+		if status.Convert(err).Code() != codes.Canceled {
+			t.Errorf("Expected grpc status %v; got %v", codes.Canceled, status.Convert(err).Code())
+		}
+
+		if len(stream.changes) != 1 {
+			t.Fatalf("Expected 1 change; got %d", len(stream.changes))
+		}
+		change := stream.changes[0]
+		if change.GetAction() != pb.Action_ACTION_FINISH || change.GetActor() != "system:toolproxy" || change.GetCommand().GetName() != "commands/1" {
+			t.Errorf("Bad change: %v", change)
+		}
+		p, err := decodePageToken(s.pageTokenKey(), change.GetResumeToken(), binding)
+		if err != nil || p.ID != 6 {
+			t.Errorf("Expected resume token after event 6; got %+v, %v", p, err)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject invalid requests", func(t *testing.T) {
+		s := &Server{}
+		token, err := encodePageToken(s.pageTokenKey(), &pageToken{Binding: pageTokenBinding("watch", ""), ID: 5})
+		if err != nil {
+			t.Fatalf("Error encoding resume token: %v", err)
+		}
+
+		for _, r := range []*pb.WatchCommandsRequest{
+			{Filter: "status ="},
+			{ResumeToken: "5"},
+			{Filter: "status = SUCCESS", ResumeToken: token},
+		} {
+			err := s.WatchCommands(r, newFakeWatchStream(0))
+			if status.Convert(err).Code() != codes.InvalidArgument {
+				t.Errorf("Expected grpc status %v for %v; got %v", codes.InvalidArgument, r, status.Convert(err).Code())
+			}
+		}
+	})
+}
@@ -0,0 +1,419 @@
+package rpc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/hxtk/yggdrasil/common/urn"
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// openTimeLayout is the layout of the time of day at which a maintenance
+// window opens.
+const openTimeLayout = "15:04"
+
+// parseWindowName returns the window ID from a maintenance window resource
+// name.
+func parseWindowName(name string) (string, error) {
+	var collection, id string
+	u := urn.Parse(name)
+	if len(u.Parts) != 2 {
+		return "", fmt.Errorf("malformed maintenance window name %q", name)
+	}
+	if err := u.Scan(&collection, &id); err != nil {
+		return "", err
+	}
+	if collection != "maintenanceWindows" || !toolIDPattern.MatchString(id) {
+		return "", fmt.Errorf("malformed maintenance window name %q", name)
+	}
+	return id, nil
+}
+
+// validateWindow checks that a maintenance window opens at a valid time of
+// day in a known time zone for a valid duration.
+func validateWindow(w *pb.MaintenanceWindow) error {
+	seen := make(map[pb.DayOfWeek]bool)
+	for _, d := range w.GetDays() {
+		if d < pb.DayOfWeek_MONDAY || d > pb.DayOfWeek_SUNDAY {
+			return fmt.Errorf("invalid day of week %v", d)
+		}
+		if seen[d] {
+			return fmt.Errorf("duplicate day of week %v", d)
+		}
+		seen[d] = true
+	}
+
+	if _, err := time.Parse(openTimeLayout, w.GetOpenTime()); err != nil {
+		return errors.New("open time must be HH:MM")
+	}
+
+	if err := w.GetDuration().CheckValid(); err != nil {
+		return errors.New("duration is required")
+	}
+	d := w.GetDuration().AsDuration()
+	if d <= 0 || d > 24*time.Hour {
+		return errors.New("duration must be positive and at most 24 hours")
+	}
+
+	if _, err := time.LoadLocation(w.GetTimeZone()); err != nil {
+		return fmt.Errorf("unknown time zone %q", w.GetTimeZone())
+	}
+	return nil
+}
+
+// nextOpening returns the start and end of the first opening of w which
+// ends after t. If w is open at t, start is t.
+func nextOpening(w *pb.MaintenanceWindow, t time.Time) (start, end time.Time, err error) {
+	if err = validateWindow(w); err != nil {
+		return start, end, err
+	}
+
+	// The time zone is validated above, and the empty string is UTC.
+	loc, _ := time.LoadLocation(w.GetTimeZone())
+	open, _ := time.Parse(openTimeLayout, w.GetOpenTime())
+	days := make(map[time.Weekday]bool)
+	for _, d := range w.GetDays() {
+		days[time.Weekday(d%7)] = true
+	}
+
+	// An opening on the previous day may still be open at t, and the window
+	// opens at least once in any seven consecutive days.
+	local := t.In(loc)
+	for i := -1; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+
+		start = time.Date(day.Year(), day.Month(), day.Day(), open.Hour(), open.Minute(), 0, 0, loc)
+		end = start.Add(w.GetDuration().AsDuration())
+		if end.After(t) {
+			if start.Before(t) {
+				start = t
+			}
+			return start, end, nil
+		}
+	}
+
+	// This should be unreachable for valid windows.
+	return start, end, errors.New("maintenance window never opens")
+}
+
+const getWindowQuery = `
+	SELECT description, days, open_time, duration_ms, time_zone, create_time, update_time
+	FROM maintenance_windows
+	WHERE window_id = $1;
+`
+
+// GetMaintenanceWindow implements ToolProxy for Server.
+func (s *Server) GetMaintenanceWindow(ctx context.Context, r *pb.GetMaintenanceWindowRequest) (*pb.MaintenanceWindow, error) {
+	id, err := parseWindowName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed maintenance window name.")
+	}
+
+	return s.getWindow(ctx, s.DB, id)
+}
+
+// getWindow reads the maintenance window with the given ID using q.
+func (s *Server) getWindow(ctx context.Context, q queryer, id string) (*pb.MaintenanceWindow, error) {
+	var description sql.NullString
+	var days []int64
+	var openTime, timeZone string
+	var durationMS int64
+	var createTime, updateTime sql.NullTime
+	err := q.QueryRowContext(ctx, getWindowQuery, id).Scan(
+		&description,
+		pq.Array(&days),
+		&openTime,
+		&durationMS,
+		&timeZone,
+		&createTime,
+		&updateTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "Maintenance window not found.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error getting maintenance window from database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.MaintenanceWindow{
+		Name:        "maintenanceWindows/" + id,
+		Description: unwrapstring(description),
+		Days:        daysOfWeek(days),
+		OpenTime:    openTime,
+		Duration:    durationpb.New(time.Duration(durationMS) * time.Millisecond),
+		TimeZone:    timeZone,
+		CreateTime:  timestamp(createTime),
+		UpdateTime:  timestamp(updateTime),
+	}, nil
+}
+
+// daysOfWeek converts stored days of the week to their enum values.
+func daysOfWeek(days []int64) []pb.DayOfWeek {
+	if len(days) == 0 {
+		return nil
+	}
+	out := make([]pb.DayOfWeek, 0, len(days))
+	for _, d := range days {
+		out = append(out, pb.DayOfWeek(d))
+	}
+	return out
+}
+
+// storedDays converts days of the week for storage.
+func storedDays(days []pb.DayOfWeek) []int64 {
+	out := make([]int64, 0, len(days))
+	for _, d := range days {
+		out = append(out, int64(d))
+	}
+	return out
+}
+
+const createWindowQuery = `
+	INSERT INTO maintenance_windows ("window_id", "description", "days", "open_time", "duration_ms", "time_zone", "create_time", "update_time")
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $7);
+`
+
+// CreateMaintenanceWindow implements ToolProxy for Server.
+func (s *Server) CreateMaintenanceWindow(ctx context.Context, r *pb.CreateMaintenanceWindowRequest) (*pb.MaintenanceWindow, error) {
+	if !toolIDPattern.MatchString(r.GetMaintenanceWindowId()) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed maintenance window ID.")
+	}
+
+	w := r.GetMaintenanceWindow()
+	if err := validateWindow(w); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid maintenance window: %v.", err)
+	}
+
+	createTime := time.Now()
+	_, err := s.DB.ExecContext(
+		ctx,
+		createWindowQuery,
+		r.GetMaintenanceWindowId(),
+		w.GetDescription(),
+		pq.Array(storedDays(w.GetDays())),
+		w.GetOpenTime(),
+		w.GetDuration().AsDuration().Milliseconds(),
+		w.GetTimeZone(),
+		createTime,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return nil, status.Errorf(codes.AlreadyExists, "Maintenance window already exists.")
+	} else if err != nil {
+		log.WithError(err).Errorln("Error saving maintenance window to database.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	return &pb.MaintenanceWindow{
+		Name:        "maintenanceWindows/" + r.GetMaintenanceWindowId(),
+		Description: w.GetDescription(),
+		Days:        w.GetDays(),
+		OpenTime:    w.GetOpenTime(),
+		Duration:    w.GetDuration(),
+		TimeZone:    w.GetTimeZone(),
+		CreateTime:  timestamppb.New(createTime),
+		UpdateTime:  timestamppb.New(createTime),
+	}, nil
+}
+
+const updateWindowQuery = `
+	UPDATE maintenance_windows
+	SET (description, days, open_time, duration_ms, time_zone, update_time) = ($2, $3, $4, $5, $6, $7)
+	WHERE window_id = $1;
+`
+
+// UpdateMaintenanceWindow implements ToolProxy for Server.
+func (s *Server) UpdateMaintenanceWindow(ctx context.Context, r *pb.UpdateMaintenanceWindowRequest) (*pb.MaintenanceWindow, error) {
+	id, err := parseWindowName(r.GetMaintenanceWindow().GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed maintenance window name.")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Errorln("Error beginning transaction.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer tx.Rollback()
+
+	w, err := s.getWindow(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := r.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"description", "days", "open_time", "duration", "time_zone"}
+	}
+	for _, v := range paths {
+		switch v {
+		case "description":
+			w.Description = r.GetMaintenanceWindow().GetDescription()
+		case "days":
+			w.Days = r.GetMaintenanceWindow().GetDays()
+		case "open_time":
+			w.OpenTime = r.GetMaintenanceWindow().GetOpenTime()
+		case "duration":
+			w.Duration = r.GetMaintenanceWindow().GetDuration()
+		case "time_zone":
+			w.TimeZone = r.GetMaintenanceWindow().GetTimeZone()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Field %q cannot be updated.", v)
+		}
+	}
+
+	if err = validateWindow(w); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid maintenance window: %v.", err)
+	}
+
+	updateTime := time.Now()
+	_, err = tx.ExecContext(
+		ctx,
+		updateWindowQuery,
+		id,
+		w.GetDescription(),
+		pq.Array(storedDays(w.GetDays())),
+		w.GetOpenTime(),
+		w.GetDuration().AsDuration().Milliseconds(),
+		w.GetTimeZone(),
+		updateTime,
+	)
+	if err != nil {
+		log.WithError(err).Errorln("Error updating maintenance window.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Errorln("Error committing maintenance window update.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	w.UpdateTime = timestamppb.New(updateTime)
+	return w, nil
+}
+
+const deleteWindowQuery = `
+	DELETE FROM maintenance_windows
+	WHERE window_id = $1;
+`
+
+// DeleteMaintenanceWindow implements ToolProxy for Server.
+func (s *Server) DeleteMaintenanceWindow(ctx context.Context, r *pb.DeleteMaintenanceWindowRequest) (*emptypb.Empty, error) {
+	id, err := parseWindowName(r.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed maintenance window name.")
+	}
+
+	res, err := s.DB.ExecContext(ctx, deleteWindowQuery, id)
+	if err != nil {
+		log.WithError(err).Errorln("Error deleting maintenance window.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Internal server error.")
+	}
+	if rows == 0 {
+		return nil, status.Errorf(codes.NotFound, "Maintenance window not found.")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+const listWindowsQuery = `
+	SELECT window_id, description, days, open_time, duration_ms, time_zone, create_time, update_time
+	FROM maintenance_windows
+	WHERE window_id > $1
+	ORDER BY window_id
+	LIMIT $2;
+`
+
+// ListMaintenanceWindows implements ToolProxy for Server.
+func (s *Server) ListMaintenanceWindows(ctx context.Context, r *pb.ListMaintenanceWindowsRequest) (*pb.ListMaintenanceWindowsResponse, error) {
+	limit, err := pageSize(r.GetPageSize())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page size: %v.", err)
+	}
+
+	after := r.GetPageToken()
+	if after != "" && !toolIDPattern.MatchString(after) {
+		return nil, status.Errorf(codes.InvalidArgument, "Malformed page token.")
+	}
+
+	// One more maintenance window than the page size is requested to learn whether
+	// there is another page.
+	rows, err := s.DB.QueryContext(ctx, listWindowsQuery, after, limit+1)
+	if err != nil {
+		log.WithError(err).Errorln("Error listing maintenance windows.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+	defer rows.Close()
+
+	var more bool
+	var windows []*pb.MaintenanceWindow
+	for rows.Next() {
+		if len(windows) == limit {
+			more = true
+			break
+		}
+
+		var description sql.NullString
+		var days []int64
+		var openTime, timeZone string
+		var durationMS int64
+		var createTime, updateTime sql.NullTime
+		err = rows.Scan(
+			&after,
+			&description,
+			pq.Array(&days),
+			&openTime,
+			&durationMS,
+			&timeZone,
+			&createTime,
+			&updateTime,
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Internal server error.")
+		}
+
+		windows = append(windows, &pb.MaintenanceWindow{
+			Name:        "maintenanceWindows/" + after,
+			Description: unwrapstring(description),
+			Days:        daysOfWeek(days),
+			OpenTime:    openTime,
+			Duration:    durationpb.New(time.Duration(durationMS) * time.Millisecond),
+			TimeZone:    timeZone,
+			CreateTime:  timestamp(createTime),
+			UpdateTime:  timestamp(updateTime),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		log.WithError(err).Errorln("Error listing maintenance windows.")
+		return nil, status.Errorf(codes.Unavailable, "Internal server error.")
+	}
+
+	var nextPageToken string
+	if more {
+		nextPageToken = after
+	}
+
+	return &pb.ListMaintenanceWindowsResponse{
+		MaintenanceWindows: windows,
+		NextPageToken:      nextPageToken,
+	}, nil
+}
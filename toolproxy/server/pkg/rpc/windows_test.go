@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/hxtk/yggdrasil/toolproxy/v1"
+)
+
+// tuesdayNights returns a maintenance window open on Tuesdays from 02:00 to
+// 04:00 UTC.
+func tuesdayNights() *pb.MaintenanceWindow {
+	return &pb.MaintenanceWindow{
+		Days:     []pb.DayOfWeek{pb.DayOfWeek_TUESDAY},
+		OpenTime: "02:00",
+		Duration: durationpb.New(2 * time.Hour),
+	}
+}
+
+func TestNextOpening(t *testing.T) {
+	// 2023-01-03 was a Tuesday.
+	tuesday := time.Date(2023, time.January, 3, 0, 0, 0, 0, time.UTC)
+	daily := &pb.MaintenanceWindow{
+		OpenTime: "23:00",
+		Duration: durationpb.New(2 * time.Hour),
+	}
+
+	tests := []struct {
+		name      string
+		window    *pb.MaintenanceWindow
+		t         time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			"Before opening",
+			tuesdayNights(),
+			tuesday,
+			tuesday.Add(2 * time.Hour),
+			tuesday.Add(4 * time.Hour),
+		},
+		{
+			"While open",
+			tuesdayNights(),
+			tuesday.Add(3 * time.Hour),
+			tuesday.Add(3 * time.Hour),
+			tuesday.Add(4 * time.Hour),
+		},
+		{
+			"After closing",
+			tuesdayNights(),
+			tuesday.Add(4 * time.Hour),
+			tuesday.AddDate(0, 0, 7).Add(2 * time.Hour),
+			tuesday.AddDate(0, 0, 7).Add(4 * time.Hour),
+		},
+		{
+			"Open across midnight",
+			daily,
+			tuesday.Add(30 * time.Minute),
+			tuesday.Add(30 * time.Minute),
+			tuesday.Add(time.Hour),
+		},
+		{
+			"In time zone",
+			&pb.MaintenanceWindow{
+				OpenTime: "02:00",
+				Duration: durationpb.New(time.Hour),
+				TimeZone: "Etc/GMT+5",
+			},
+			tuesday,
+			tuesday.Add(7 * time.Hour),
+			tuesday.Add(8 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := nextOpening(tt.window, tt.t)
+			if err != nil {
+				t.Fatalf("Expected success; got error: %v", err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("Expected %v to %v; got %v to %v", tt.wantStart, tt.wantEnd, start, end)
+			}
+		})
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*pb.MaintenanceWindow)
+	}{
+		{"Malformed open time", func(w *pb.MaintenanceWindow) { w.OpenTime = "2am" }},
+		{"Missing duration", func(w *pb.MaintenanceWindow) { w.Duration = nil }},
+		{"Duration over a day", func(w *pb.MaintenanceWindow) { w.Duration = durationpb.New(25 * time.Hour) }},
+		{"Unknown time zone", func(w *pb.MaintenanceWindow) { w.TimeZone = "Mars/Olympus_Mons" }},
+		{"Duplicate day", func(w *pb.MaintenanceWindow) { w.Days = append(w.Days, pb.DayOfWeek_TUESDAY) }},
+		{"Unspecified day", func(w *pb.MaintenanceWindow) { w.Days = []pb.DayOfWeek{pb.DayOfWeek_DAY_OF_WEEK_UNSPECIFIED} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tuesdayNights()
+			tt.modify(w)
+			if err := validateWindow(w); err == nil {
+				t.Errorf("Expected error; got nil")
+			}
+		})
+	}
+}
+
+func TestCreateMaintenanceWindow(t *testing.T) {
+	t.Run("Successfully create window", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		mock.ExpectExec(createWindowQuery).WithArgs(
+			"weekly-database",
+			"",
+			pq.Array([]int64{2}),
+			"02:00",
+			int64(7200000),
+			"",
+			sqlmock.AnyArg(),
+		).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		s := &Server{DB: db}
+		res, err := s.CreateMaintenanceWindow(context.Background(), &pb.CreateMaintenanceWindowRequest{
+			MaintenanceWindow:   tuesdayNights(),
+			MaintenanceWindowId: "weekly-database",
+		})
+		if err != nil {
+			t.Fatalf("Expected success; got error: %v", err)
+		}
+
+		if res.GetName() != "maintenanceWindows/weekly-database" {
+			t.Errorf("Expected maintenanceWindows/weekly-database; got %v", res.GetName())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+
+	t.Run("Reject invalid window", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		if err != nil {
+			t.Fatalf("Error opening mock db: %v", err)
+		}
+
+		w := tuesdayNights()
+		w.OpenTime = "25:00"
+
+		s := &Server{DB: db}
+		_, err = s.CreateMaintenanceWindow(context.Background(), &pb.CreateMaintenanceWindowRequest{
+			MaintenanceWindow:   w,
+			MaintenanceWindowId: "weekly-database",
+		})
+		if status.Convert(err).Code() != codes.InvalidArgument {
+			t.Errorf("Expected grpc status %v; got %v", codes.InvalidArgument, status.Convert(err).Code())
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Failed expectation: %v", err)
+		}
+	})
+}
+
+func TestListMaintenanceWindows(t *testing.T) {
+	columns := []string{"window_id", "description", "days", "open_time", "duration_ms", "time_zone", "create_time", "update_time"}
+	testCases := []struct {
+		name      string
+		pageSize  int32
+		limit     int
+		ids       []string
+		code      codes.Code
+		windows   int
+		nextToken string
+	}{
+		{
+			name:    "Default page size",
+			limit:   defaultPageSize + 1,
+			ids:     []string{"weekend"},
+			windows: 1,
+		},
+		{
+			name:      "Another page follows",
+			pageSize:  1,
+			limit:     2,
+			ids:       []string{"nightly", "weekend"},
+			windows:   1,
+			nextToken: "nightly",
+		},
+		{
+			name:     "Negative page size",
+			pageSize: -1,
+			code:     codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("Error opening mock db: %v", err)
+			}
+
+			if tc.code == codes.OK {
+				rows := sqlmock.NewRows(columns)
+				for _, id := range tc.ids {
+					rows.AddRow(id, nil, pq.Array([]int64{6}), "22:00", 3600000, "UTC", nil, nil)
+				}
+				mock.ExpectQuery(listWindowsQuery).WithArgs("", tc.limit).WillReturnRows(rows)
+			}
+
+			s := &Server{DB: db}
+			res, err := s.ListMaintenanceWindows(context.Background(), &pb.ListMaintenanceWindowsRequest{PageSize: tc.pageSize})
+			if status.Code(err) != tc.code {
+				t.Fatalf("Expected %v; got %v", tc.code, err)
+			}
+
+			if len(res.GetMaintenanceWindows()) != tc.windows {
+				t.Errorf("Expected %d windows; got %d", tc.windows, len(res.GetMaintenanceWindows()))
+			}
+			if res.GetNextPageToken() != tc.nextToken {
+				t.Errorf("Expected next page token %q; got %q", tc.nextToken, res.GetNextPageToken())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Failed expectation: %v", err)
+			}
+		})
+	}
+}
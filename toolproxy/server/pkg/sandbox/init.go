@@ -0,0 +1,57 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// initArg0 is the argv[0] with which the server re-executes itself
+	// to run a command in a sandbox.
+	initArg0 = "toolproxy-sandbox-init"
+
+	// specEnv is the environment variable through which the initSpec is
+	// passed to the init process. It is removed before the command is run.
+	specEnv = "TOOLPROXY_SANDBOX_SPEC"
+
+	// errFD is the file descriptor of the init process to which it writes
+	// the reason the command could not be executed. It is the first of
+	// exec.Cmd.ExtraFiles.
+	errFD = 3
+
+	// initFailureCode is the exit code of the init process if the profile
+	// could not be applied or the command could not be executed, following
+	// the convention of POSIX shells for commands which cannot be executed.
+	initFailureCode = 126
+)
+
+// beforeExec, if it is set, is called by the init process after the profile
+// is applied, just before the command is executed. It is set by tests.
+var beforeExec func()
+
+// initSpec is passed from the server to the init process.
+type initSpec struct {
+	Profile Profile  `json:"profile"`
+	Argv    []string `json:"argv"`
+}
+
+// IsInit reports whether the current process was started by Profile.Command
+// and should call Init.
+func IsInit() bool {
+	return len(os.Args) > 0 && os.Args[0] == initArg0
+}
+
+// Init applies the profile passed by Profile.Command to the current process
+// and executes the command in its place. It does not return.
+//
+// Init must be called at the start of main if IsInit returns true, before
+// any other initialization.
+func Init() {
+	err := initialize()
+
+	// initialize only returns if the command could not be executed.
+	if _, werr := fmt.Fprint(os.NewFile(errFD, "errors"), err); werr != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	}
+	os.Exit(initFailureCode)
+}
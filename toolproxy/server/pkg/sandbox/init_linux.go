@@ -0,0 +1,106 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// initialize applies the profile to the current process and executes the
+// command. It returns only if that fails.
+func initialize() error {
+	// no_new_privs applies only to the thread which sets it, so the
+	// command must be executed by the same thread. The thread is never
+	// unlocked, since the process either becomes the command or exits.
+	runtime.LockOSThread()
+
+	// The server learns that the command was executed when this is closed.
+	unix.CloseOnExec(errFD)
+
+	var spec initSpec
+	if err := json.Unmarshal([]byte(os.Getenv(specEnv)), &spec); err != nil {
+		return fmt.Errorf("reading profile: %v", err)
+	}
+	p := &spec.Profile
+
+	// The cgroup must be joined before dropping privileges, since only the
+	// server's user may be able to write to it.
+	if p.Cgroup != "" {
+		procs := p.cgroupPath() + "/cgroup.procs"
+		err := os.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0)
+		if err != nil {
+			return fmt.Errorf("joining cgroup: %v", err)
+		}
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, p.Limits.CPUSeconds},
+		{unix.RLIMIT_AS, p.Limits.MemoryBytes},
+		{unix.RLIMIT_NOFILE, p.Limits.OpenFiles},
+		{unix.RLIMIT_NPROC, p.Limits.Processes},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		err := unix.Setrlimit(l.resource, &unix.Rlimit{Cur: l.value, Max: l.value})
+		if err != nil {
+			return fmt.Errorf("setting resource limit %d: %v", l.resource, err)
+		}
+	}
+
+	if p.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %v", err)
+		}
+	}
+
+	// The group must be changed while we still have the privileges to do so,
+	// i.e., before the user. Unlike unix.Setgroups, syscall.Setgroups
+	// applies to every thread of the process.
+	if p.UID != nil || p.GID != nil || len(p.Groups) > 0 {
+		groups := make([]int, 0, len(p.Groups))
+		for _, g := range p.Groups {
+			groups = append(groups, int(g))
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setting supplementary groups: %v", err)
+		}
+	}
+	if p.GID != nil {
+		gid := int(*p.GID)
+		if err := unix.Setresgid(gid, gid, gid); err != nil {
+			return fmt.Errorf("setting group: %v", err)
+		}
+	}
+	if p.UID != nil {
+		uid := int(*p.UID)
+		if err := unix.Setresuid(uid, uid, uid); err != nil {
+			return fmt.Errorf("setting user: %v", err)
+		}
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, specEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if beforeExec != nil {
+		beforeExec()
+	}
+	err := unix.Exec(spec.Argv[0], spec.Argv, env)
+	return fmt.Errorf("executing %s: %v", spec.Argv[0], err)
+}
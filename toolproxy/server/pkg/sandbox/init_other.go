@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func initialize() error {
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
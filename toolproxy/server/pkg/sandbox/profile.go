@@ -0,0 +1,284 @@
+// Package sandbox runs commands with restricted privileges and resources.
+//
+// An execution profile describes the user, environment, working directory,
+// resource limits, and cgroup with which a command is run. Because not all of
+// these can be applied by os/exec, commands are started by re-executing the
+// current binary in an init mode (see Init) which applies the profile to itself
+// and then executes the command in its place.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Limits are resource limits applied to a command. Zero values leave the
+// corresponding limit unchanged from that of the server.
+type Limits struct {
+	// CPUSeconds limits the CPU time of each process (RLIMIT_CPU).
+	CPUSeconds uint64 `mapstructure:"cpu_seconds" json:"cpu_seconds,omitempty"`
+
+	// MemoryBytes limits the address space of each process (RLIMIT_AS).
+	MemoryBytes uint64 `mapstructure:"memory_bytes" json:"memory_bytes,omitempty"`
+
+	// OpenFiles limits the number of open file descriptors (RLIMIT_NOFILE).
+	OpenFiles uint64 `mapstructure:"open_files" json:"open_files,omitempty"`
+
+	// Processes limits the number of processes of the user (RLIMIT_NPROC).
+	Processes uint64 `mapstructure:"processes" json:"processes,omitempty"`
+}
+
+// Profile is a set of restrictions with which a command is run.
+type Profile struct {
+	// Name uniquely identifies the profile. It is recorded on each command
+	// run with this profile.
+	Name string `mapstructure:"name" json:"name"`
+
+	// UID and GID are the user and group as which the command is run. If
+	// they are nil, the command runs as the server's user or group.
+	UID *uint32 `mapstructure:"uid" json:"uid,omitempty"`
+	GID *uint32 `mapstructure:"gid" json:"gid,omitempty"`
+
+	// Groups are the supplementary groups of the command. If UID or GID is
+	// set, the supplementary groups of the server are always dropped.
+	Groups []uint32 `mapstructure:"groups" json:"groups,omitempty"`
+
+	// Env is the environment of the command. The environment of the server
+	// is never inherited except for the variables named in PassEnv.
+	Env map[string]string `mapstructure:"env" json:"env,omitempty"`
+
+	// PassEnv are the names of variables copied from the server's environment
+	// if they are set. Variables in Env take precedence.
+	PassEnv []string `mapstructure:"pass_env" json:"pass_env,omitempty"`
+
+	// Dir is the absolute path of the working directory of the command. If it
+	// is empty, the command runs in the root directory.
+	Dir string `mapstructure:"dir" json:"dir,omitempty"`
+
+	// Limits are the resource limits of the command.
+	Limits Limits `mapstructure:"limits" json:"limits"`
+
+	// NewProcessGroup runs the command in a new process group, so that it and
+	// its children may be signalled together.
+	NewProcessGroup bool `mapstructure:"new_process_group" json:"new_process_group,omitempty"`
+
+	// NoNewPrivileges prevents the command and its children from gaining
+	// privileges, e.g., through setuid binaries or file capabilities.
+	NoNewPrivileges bool `mapstructure:"no_new_privileges" json:"no_new_privileges,omitempty"`
+
+	// Cgroup is the path of a cgroup v2 directory, either absolute or
+	// relative to /sys/fs/cgroup, into which the command is placed. The
+	// cgroup must already exist and be writable by the server.
+	Cgroup string `mapstructure:"cgroup" json:"cgroup,omitempty"`
+}
+
+// cgroupRoot is the mount point of the cgroup v2 hierarchy.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// validate returns an error if p is malformed.
+func (p *Profile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile has no name")
+	}
+	if p.Dir != "" && !filepath.IsAbs(p.Dir) {
+		return fmt.Errorf("profile %q: dir %q is not absolute", p.Name, p.Dir)
+	}
+	for k := range p.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("profile %q: invalid environment variable %q", p.Name, k)
+		}
+	}
+	if p.Cgroup != "" {
+		if rel, err := filepath.Rel(cgroupRoot, p.cgroupPath()); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("profile %q: cgroup %q is not within %s", p.Name, p.Cgroup, cgroupRoot)
+		}
+	}
+	return nil
+}
+
+// cgroupPath returns the absolute path of the profile's cgroup.
+func (p *Profile) cgroupPath() string {
+	if filepath.IsAbs(p.Cgroup) {
+		return filepath.Clean(p.Cgroup)
+	}
+	return filepath.Join(cgroupRoot, p.Cgroup)
+}
+
+// environ returns the environment of commands run with p, sorted by name.
+func (p *Profile) environ() []string {
+	env := make(map[string]string)
+	for _, k := range p.PassEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+		}
+	}
+	for k, v := range p.Env {
+		env[k] = v
+	}
+
+	res := make([]string, 0, len(env))
+	for k, v := range env {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// JSON returns the profile encoded as JSON, for recording which restrictions
+// were applied to a command.
+func (p *Profile) JSON() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// Cmd is a command which may be run with the restrictions of a profile.
+//
+// A Cmd with no profile, i.e., one not returned by Profile.Command, runs its
+// command without restrictions.
+type Cmd struct {
+	*exec.Cmd
+
+	// errPipe receives the reason the profile could not be applied or the
+	// command could not be executed, if any. errWriter is its other end,
+	// which is passed to the init process.
+	errPipe   *os.File
+	errWriter *os.File
+}
+
+// Start starts the command.
+//
+// Unlike exec.Cmd.Start, Start does not return until the command has been
+// executed, and it returns an error if the profile could not be applied or
+// the command could not be executed. In that case the init process has
+// already exited, and Wait must not be called.
+func (c *Cmd) Start() error {
+	if c.errPipe == nil {
+		return c.Cmd.Start()
+	}
+	defer c.errPipe.Close()
+
+	err := c.Cmd.Start()
+	c.errWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	// The pipe is closed without being written to once the command has
+	// been executed, since the init process sets it to close on exec.
+	reason, err := io.ReadAll(c.errPipe)
+	if err != nil {
+		return err
+	}
+	if len(reason) > 0 {
+		_ = c.Cmd.Wait()
+		return fmt.Errorf("sandbox: %s", reason)
+	}
+	return nil
+}
+
+// Run starts the command and waits for it to complete.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Command returns a command which runs argv with the restrictions of p.
+//
+// The first element of argv must be an absolute path. The Path, Args, and
+// ExtraFiles of the returned command must not be modified, and variables may
+// be added to its Env but none removed.
+func (p *Profile) Command(argv []string) (*Cmd, error) {
+	if len(argv) == 0 || !filepath.IsAbs(argv[0]) {
+		return nil, fmt.Errorf("sandbox: command must be given by absolute path")
+	}
+
+	spec, err := json.Marshal(&initSpec{Profile: *p, Argv: argv})
+	if err != nil {
+		return nil, err
+	}
+
+	dir := p.Dir
+	if dir == "" {
+		dir = "/"
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{initArg0},
+		Env:        append(p.environ(), specEnv+"="+string(spec)),
+		Dir:        dir,
+		ExtraFiles: []*os.File{w},
+		SysProcAttr: &syscall.SysProcAttr{
+			Setpgid: p.NewProcessGroup,
+		},
+	}
+	return &Cmd{Cmd: cmd, errPipe: r, errWriter: w}, nil
+}
+
+// Profiles is a set of profiles, one of which is the default.
+type Profiles struct {
+	defaultName string
+	profiles    map[string]*Profile
+}
+
+// NewProfiles returns a set of the given profiles.
+//
+// If defaultName is not empty, it must be the name of one of the profiles.
+func NewProfiles(defaultName string, profiles []Profile) (*Profiles, error) {
+	ps := &Profiles{
+		defaultName: defaultName,
+		profiles:    make(map[string]*Profile),
+	}
+	for i := range profiles {
+		p := profiles[i]
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("sandbox: %v", err)
+		}
+		if _, ok := ps.profiles[p.Name]; ok {
+			return nil, fmt.Errorf("sandbox: duplicate profile %q", p.Name)
+		}
+		ps.profiles[p.Name] = &p
+	}
+
+	if defaultName != "" {
+		if _, ok := ps.profiles[defaultName]; !ok {
+			return nil, fmt.Errorf("sandbox: default profile %q is not defined", defaultName)
+		}
+	}
+
+	return ps, nil
+}
+
+// Get returns the profile with the given name, or the default profile if
+// name is empty. If name is empty and there is no default profile, or if ps
+// is nil, Get returns nil and commands should be run without restrictions.
+func (ps *Profiles) Get(name string) (*Profile, error) {
+	if ps == nil {
+		return nil, nil
+	}
+	if name == "" {
+		name = ps.defaultName
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	p, ok := ps.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("sandbox: profile %q is not defined", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,208 @@
+package sandbox
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if IsInit() {
+		beforeExec = switchThread
+		Init()
+	}
+	os.Exit(m.Run())
+}
+
+// switchThread moves the calling goroutine to another thread unless it is
+// locked to its thread, so that per-thread attributes which the init
+// process sets on a thread other than the one executing the command are
+// detected. With one P, the new goroutine runs on the thread the caller
+// parks on and locks it, and the caller must resume on another.
+func switchThread() {
+	runtime.GOMAXPROCS(1)
+	locked := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		close(locked)
+		select {}
+	}()
+	<-locked
+}
+
+func TestNewProfiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		def      string
+		profiles []Profile
+		err      string
+	}{
+		{
+			name:     "Valid profiles",
+			def:      "restricted",
+			profiles: []Profile{{Name: "restricted", Dir: "/tmp", Cgroup: "toolproxy"}},
+		},
+		{
+			name:     "Missing name",
+			profiles: []Profile{{}},
+			err:      "has no name",
+		},
+		{
+			name:     "Duplicate name",
+			profiles: []Profile{{Name: "a"}, {Name: "a"}},
+			err:      "duplicate profile",
+		},
+		{
+			name:     "Undefined default",
+			def:      "b",
+			profiles: []Profile{{Name: "a"}},
+			err:      "is not defined",
+		},
+		{
+			name:     "Relative directory",
+			profiles: []Profile{{Name: "a", Dir: "tmp"}},
+			err:      "is not absolute",
+		},
+		{
+			name:     "Cgroup outside hierarchy",
+			profiles: []Profile{{Name: "a", Cgroup: "../../etc"}},
+			err:      "is not within",
+		},
+		{
+			name:     "Malformed environment",
+			profiles: []Profile{{Name: "a", Env: map[string]string{"A=B": "C"}}},
+			err:      "invalid environment variable",
+		},
+	}
+
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			_, err := NewProfiles(v.def, v.profiles)
+			if v.err == "" {
+				if err != nil {
+					t.Errorf("Expected success; got error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("Expected error containing %q; got %v", v.err, err)
+			}
+		})
+	}
+}
+
+func TestProfilesGet(t *testing.T) {
+	ps, err := NewProfiles("restricted", []Profile{{Name: "restricted"}, {Name: "admin"}})
+	if err != nil {
+		t.Fatalf("Error creating profiles: %v", err)
+	}
+
+	if p, _ := ps.Get(""); p.Name != "restricted" {
+		t.Errorf("Expected default profile; got %v", p.Name)
+	}
+	if p, _ := ps.Get("admin"); p.Name != "admin" {
+		t.Errorf("Expected admin profile; got %v", p.Name)
+	}
+	if _, err := ps.Get("root"); err == nil {
+		t.Errorf("Expected error for undefined profile; got nil")
+	}
+
+	var none *Profiles
+	if p, err := none.Get(""); p != nil || err != nil {
+		t.Errorf("Expected no profile from nil set; got %v, %v", p, err)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("TOOLPROXY_TEST_PASSED", "passed")
+	t.Setenv("TOOLPROXY_TEST_SECRET", "secret")
+
+	p := &Profile{
+		Name:    "test",
+		Env:     map[string]string{"PATH": "/usr/bin:/bin"},
+		PassEnv: []string{"TOOLPROXY_TEST_PASSED", "TOOLPROXY_TEST_UNSET"},
+	}
+
+	expect := []string{"PATH=/usr/bin:/bin", "TOOLPROXY_TEST_PASSED=passed"}
+	if env := p.environ(); !reflect.DeepEqual(env, expect) {
+		t.Errorf("Expected environment %q; got %q", expect, env)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh is not available")
+	}
+	t.Setenv("TOOLPROXY_TEST_SECRET", "secret")
+
+	p := &Profile{
+		Name:            "test",
+		Env:             map[string]string{"GREETING": "hello"},
+		Dir:             os.TempDir(),
+		Limits:          Limits{OpenFiles: 64},
+		NewProcessGroup: true,
+		NoNewPrivileges: true,
+	}
+
+	cmd, err := p.Command([]string{
+		"/bin/sh", "-c",
+		`echo "$GREETING"; echo "$TOOLPROXY_TEST_SECRET$` + specEnv + `"; ulimit -n; pwd; grep NoNewPrivs /proc/self/status`,
+	})
+	if err != nil {
+		t.Fatalf("Error creating command: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatalf("Error running command: %v; stderr: %s", err, stderr.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 lines of output; got %q", stdout.String())
+	}
+	if lines[0] != "hello" {
+		t.Errorf("Expected configured environment variable; got %q", lines[0])
+	}
+	if lines[1] != "" {
+		t.Errorf("Expected server environment to be scrubbed; got %q", lines[1])
+	}
+	if lines[2] != "64" {
+		t.Errorf("Expected open file limit 64; got %q", lines[2])
+	}
+	if lines[3] != os.TempDir() {
+		t.Errorf("Expected working directory %q; got %q", os.TempDir(), lines[3])
+	}
+	if strings.Fields(lines[4])[1] != "1" {
+		t.Errorf("Expected no_new_privs; got %q", lines[4])
+	}
+}
+
+func TestCommandFailure(t *testing.T) {
+	p := &Profile{Name: "test"}
+
+	cmd, err := p.Command([]string{"/nonexistent/binary"})
+	if err != nil {
+		t.Fatalf("Error creating command: %v", err)
+	}
+
+	err = cmd.Start()
+	if err == nil || !strings.Contains(err.Error(), "executing /nonexistent/binary") {
+		t.Errorf("Expected start error with reason; got %v", err)
+	}
+	if cmd.ProcessState == nil || cmd.ProcessState.ExitCode() != initFailureCode {
+		t.Errorf("Expected init process to exit with code %d; got %v", initFailureCode, cmd.ProcessState)
+	}
+}
+
+func TestCommandRelativePath(t *testing.T) {
+	p := &Profile{Name: "test"}
+	if _, err := p.Command([]string{"sh"}); err == nil {
+		t.Errorf("Expected error for relative path; got nil")
+	}
+}
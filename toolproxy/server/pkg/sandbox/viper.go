@@ -0,0 +1,15 @@
+package sandbox
+
+import (
+	"github.com/spf13/viper"
+)
+
+// FromViper loads profiles from the `profiles` key of v. The default profile
+// is named by the `default` key.
+func FromViper(v *viper.Viper) (*Profiles, error) {
+	var profiles []Profile
+	if err := v.UnmarshalKey("profiles", &profiles); err != nil {
+		return nil, err
+	}
+	return NewProfiles(v.GetString("default"), profiles)
+}
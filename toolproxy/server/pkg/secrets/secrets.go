@@ -0,0 +1,72 @@
+// Package secrets resolves references to secrets held by the tool proxy.
+//
+// Secrets are files: either named explicitly in the configuration, or any
+// regular file in a configured secret directory, named by its file name.
+// Commands refer to secrets only by name, so their values are read just
+// before a command runs and are never stored with it.
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidName reports whether name may name a secret.
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Store is a set of secrets.
+type Store struct {
+	// Dir is a directory in which each regular file is a secret named by
+	// its file name. It may be empty.
+	Dir string
+
+	// Files are the paths of the files holding secrets, by name. They take
+	// precedence over files in Dir.
+	Files map[string]string
+}
+
+// Get returns the value of the secret with the given name: the content of its
+// file, without a single trailing newline if it has one.
+//
+// Errors never include the value of a secret.
+func (s *Store) Get(name string) ([]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("secret %q: no secrets are configured", name)
+	}
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+
+	path, ok := s.Files[name]
+	if !ok {
+		if s.Dir == "" {
+			return nil, fmt.Errorf("secret %q not found", name)
+		}
+		path = filepath.Join(s.Dir, name)
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("secret %q not found", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("secret %q: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("secret %q is not a regular file", name)
+	}
+
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("secret %q: %v", name, err)
+	}
+	value = bytes.TrimSuffix(value, []byte("\n"))
+	value = bytes.TrimSuffix(value, []byte("\r"))
+	return value, nil
+}
@@ -0,0 +1,42 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pg-password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0700); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("s.token"), 0600); err != nil {
+		t.Fatalf("Error writing secret: %v", err)
+	}
+
+	s := &Store{Dir: dir, Files: map[string]string{"vault-token": token}}
+	for name, want := range map[string]string{"pg-password": "hunter2", "vault-token": "s.token"} {
+		value, err := s.Get(name)
+		if err != nil {
+			t.Errorf("Expected success for %q; got error: %v", name, err)
+		} else if string(value) != want {
+			t.Errorf("Expected %q for %q; got %q", want, name, value)
+		}
+	}
+
+	for _, name := range []string{"missing", "nested", "../pg-password", ".hidden"} {
+		if _, err := s.Get(name); err == nil {
+			t.Errorf("Expected error for %q", name)
+		}
+	}
+
+	if _, err := (*Store)(nil).Get("pg-password"); err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected error without value; got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// file is a secret named explicitly in the configuration. Secrets are given
+// as a list rather than a map because viper folds the case of map keys.
+type file struct {
+	Name string `mapstructure:"name"`
+	Path string `mapstructure:"path"`
+}
+
+// FromViper loads a store from the `dir` and `files` keys of v. Each of the
+// files has a `name` and a `path`.
+func FromViper(v *viper.Viper) (*Store, error) {
+	var files []file
+	if err := v.UnmarshalKey("files", &files); err != nil {
+		return nil, err
+	}
+
+	s := &Store{Dir: v.GetString("dir"), Files: make(map[string]string)}
+	for _, f := range files {
+		if !ValidName(f.Name) {
+			return nil, fmt.Errorf("invalid secret name %q", f.Name)
+		}
+		s.Files[f.Name] = f.Path
+	}
+	return s, nil
+}
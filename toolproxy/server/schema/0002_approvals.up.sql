@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS approvals(
+	id serial PRIMARY KEY,
+	command_id integer NOT NULL REFERENCES commands(id),
+	approver text NOT NULL,
+	decision integer NOT NULL,
+	comment text,
+	create_time timestamp with time zone,
+	UNIQUE (command_id, approver)
+);
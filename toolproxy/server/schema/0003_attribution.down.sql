@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS command_events;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS issuer_type,
+	DROP COLUMN IF EXISTS issuer_id,
+	DROP COLUMN IF EXISTS issuer_display_name;
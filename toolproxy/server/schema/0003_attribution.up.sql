@@ -0,0 +1,14 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS issuer_type text,
+	ADD COLUMN IF NOT EXISTS issuer_id text,
+	ADD COLUMN IF NOT EXISTS issuer_display_name text;
+
+CREATE TABLE IF NOT EXISTS command_events(
+	id bigserial PRIMARY KEY,
+	command_id integer NOT NULL REFERENCES commands(id),
+	action integer NOT NULL,
+	actor_type text NOT NULL,
+	actor_id text NOT NULL,
+	actor_display_name text,
+	event_time timestamp with time zone
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS output_chunks;
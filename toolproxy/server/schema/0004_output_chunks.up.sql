@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS output_chunks(
+	id bigserial PRIMARY KEY,
+	command_id integer NOT NULL REFERENCES commands(id),
+	stream integer NOT NULL,
+	data bytea NOT NULL,
+	write_time timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS output_chunks_command_id ON output_chunks (command_id, id);
@@ -0,0 +1,6 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS tool,
+	DROP COLUMN IF EXISTS parameters,
+	DROP COLUMN IF EXISTS required_approvals;
+
+DROP TABLE IF EXISTS tools;
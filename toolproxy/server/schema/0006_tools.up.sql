@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS tools(
+	tool_id text PRIMARY KEY,
+	description text,
+	argv text[] NOT NULL,
+	parameters jsonb NOT NULL,
+	required_approvals integer,
+	create_time timestamp with time zone,
+	update_time timestamp with time zone
+);
+
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS tool text,
+	ADD COLUMN IF NOT EXISTS parameters jsonb,
+	ADD COLUMN IF NOT EXISTS required_approvals integer;
@@ -0,0 +1,3 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS execution_profile,
+	DROP COLUMN IF EXISTS execution_profile_spec;
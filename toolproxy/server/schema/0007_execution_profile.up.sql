@@ -0,0 +1,3 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS execution_profile text,
+	ADD COLUMN IF NOT EXISTS execution_profile_spec jsonb;
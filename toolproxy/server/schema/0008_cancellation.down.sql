@@ -0,0 +1,5 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS timeout_ms,
+	DROP COLUMN IF EXISTS canceller,
+	DROP COLUMN IF EXISTS canceller_display_name,
+	DROP COLUMN IF EXISTS cancel_time;
@@ -0,0 +1,5 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS timeout_ms bigint,
+	ADD COLUMN IF NOT EXISTS canceller text,
+	ADD COLUMN IF NOT EXISTS canceller_display_name text,
+	ADD COLUMN IF NOT EXISTS cancel_time timestamp with time zone;
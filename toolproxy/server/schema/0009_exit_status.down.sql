@@ -0,0 +1,7 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS exit_code,
+	DROP COLUMN IF EXISTS signal,
+	DROP COLUMN IF EXISTS start_error,
+	DROP COLUMN IF EXISTS user_cpu_us,
+	DROP COLUMN IF EXISTS system_cpu_us,
+	DROP COLUMN IF EXISTS max_rss_bytes;
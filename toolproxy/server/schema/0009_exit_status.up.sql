@@ -0,0 +1,7 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS exit_code integer,
+	ADD COLUMN IF NOT EXISTS signal text,
+	ADD COLUMN IF NOT EXISTS start_error text,
+	ADD COLUMN IF NOT EXISTS user_cpu_us bigint,
+	ADD COLUMN IF NOT EXISTS system_cpu_us bigint,
+	ADD COLUMN IF NOT EXISTS max_rss_bytes bigint;
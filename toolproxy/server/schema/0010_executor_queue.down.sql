@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS commands_run_queue;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS run_request_time,
+	DROP COLUMN IF EXISTS executor,
+	DROP COLUMN IF EXISTS heartbeat_time;
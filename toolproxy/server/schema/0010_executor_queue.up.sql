@@ -0,0 +1,8 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS run_request_time timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS executor text,
+	ADD COLUMN IF NOT EXISTS heartbeat_time timestamp with time zone;
+
+-- Executors claim the oldest ready command which has been requested to run.
+CREATE INDEX IF NOT EXISTS commands_run_queue ON commands (run_request_time)
+	WHERE status = 2 AND run_request_time IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS commands_running;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS status_message;
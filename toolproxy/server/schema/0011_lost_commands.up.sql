@@ -0,0 +1,7 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS status_message text;
+
+-- The reconciler finds running commands whose executor has stopped recording
+-- heartbeats.
+CREATE INDEX IF NOT EXISTS commands_running ON commands (heartbeat_time)
+	WHERE status = 3;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS commands_expiry;
+DROP INDEX IF EXISTS commands_schedule;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS schedule_time,
+	DROP COLUMN IF EXISTS maintenance_window,
+	DROP COLUMN IF EXISTS expire_time;
+
+DROP TABLE IF EXISTS maintenance_windows;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS maintenance_windows(
+	window_id text PRIMARY KEY,
+	description text,
+	days integer[] NOT NULL,
+	open_time text NOT NULL,
+	duration_ms bigint NOT NULL,
+	time_zone text NOT NULL,
+	create_time timestamp with time zone,
+	update_time timestamp with time zone
+);
+
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS schedule_time timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS maintenance_window text,
+	ADD COLUMN IF NOT EXISTS expire_time timestamp with time zone;
+
+-- Executors claim ready commands whose schedule time has passed.
+CREATE INDEX IF NOT EXISTS commands_schedule ON commands (schedule_time)
+	WHERE status = 2 AND schedule_time IS NOT NULL;
+
+-- The reconciler expires submitted and ready commands which were not started
+-- in time.
+CREATE INDEX IF NOT EXISTS commands_expiry ON commands (expire_time)
+	WHERE status IN (1, 2) AND expire_time IS NOT NULL;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS commands_target_selector;
+DROP INDEX IF EXISTS commands_target_agent;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS target,
+	DROP COLUMN IF EXISTS target_agent,
+	DROP COLUMN IF EXISTS target_selector;
+
+DROP TABLE IF EXISTS agents;
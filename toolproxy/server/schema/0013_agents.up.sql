@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS agents(
+	agent_id text PRIMARY KEY,
+	description text,
+	labels jsonb NOT NULL DEFAULT '{}',
+	principal text NOT NULL,
+	create_time timestamp with time zone,
+	update_time timestamp with time zone,
+	last_seen_time timestamp with time zone
+);
+
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS target text,
+	ADD COLUMN IF NOT EXISTS target_agent text,
+	ADD COLUMN IF NOT EXISTS target_selector jsonb;
+
+-- Agents claim ready commands targeted at them by name or by label.
+CREATE INDEX IF NOT EXISTS commands_target_agent ON commands (target_agent)
+	WHERE status = 2 AND target_agent IS NOT NULL;
+CREATE INDEX IF NOT EXISTS commands_target_selector ON commands USING gin (target_selector)
+	WHERE status = 2 AND target_selector IS NOT NULL;
@@ -0,0 +1,11 @@
+ALTER TABLE output_chunks
+	DROP COLUMN IF EXISTS agent_id;
+
+DROP TABLE IF EXISTS executions;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS targets,
+	DROP COLUMN IF EXISTS target_agents,
+	DROP COLUMN IF EXISTS target_selectors,
+	DROP COLUMN IF EXISTS parallelism,
+	DROP COLUMN IF EXISTS failure_threshold;
@@ -0,0 +1,40 @@
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS targets text[],
+	ADD COLUMN IF NOT EXISTS target_agents text[],
+	ADD COLUMN IF NOT EXISTS target_selectors jsonb,
+	ADD COLUMN IF NOT EXISTS parallelism integer,
+	ADD COLUMN IF NOT EXISTS failure_threshold integer;
+
+CREATE TABLE IF NOT EXISTS executions(
+	command_id integer NOT NULL REFERENCES commands(id),
+	agent_id text NOT NULL,
+	status integer NOT NULL,
+	std_out bytea,
+	std_err bytea,
+	create_time timestamp with time zone,
+	start_time timestamp with time zone,
+	end_time timestamp with time zone,
+	heartbeat_time timestamp with time zone,
+	exit_code integer,
+	signal text,
+	start_error text,
+	user_cpu_us bigint,
+	system_cpu_us bigint,
+	max_rss_bytes bigint,
+	status_message text,
+	PRIMARY KEY (command_id, agent_id)
+);
+
+-- Agents claim the ready executions assigned to them.
+CREATE INDEX IF NOT EXISTS executions_ready ON executions (agent_id)
+	WHERE status = 2;
+
+-- The reconciler finds running executions whose agent has stopped recording
+-- heartbeats.
+CREATE INDEX IF NOT EXISTS executions_running ON executions (heartbeat_time)
+	WHERE status = 3;
+
+-- Output written by an execution of a rollout is recorded against the
+-- command with the ID of the agent which ran it.
+ALTER TABLE output_chunks
+	ADD COLUMN IF NOT EXISTS agent_id text;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS audit_head;
+DROP TABLE IF EXISTS audit_checkpoints;
+DROP TABLE IF EXISTS audit_events;
+DROP FUNCTION IF EXISTS audit_log_append_only();
@@ -0,0 +1,53 @@
+-- Each event is chained to the one before it by its hash, which covers the
+-- previous event's hash, its own sequence number and its content.
+CREATE TABLE IF NOT EXISTS audit_events(
+	seq bigint PRIMARY KEY,
+	command_id integer NOT NULL,
+	action integer NOT NULL,
+	actor_type text NOT NULL,
+	actor_id text NOT NULL,
+	actor_display_name text NOT NULL,
+	detail text NOT NULL,
+	event_time timestamp with time zone NOT NULL,
+	hash bytea NOT NULL
+);
+
+-- A checkpoint is a signature over the hash of the event with the given
+-- sequence number, which anchors every event before it.
+CREATE TABLE IF NOT EXISTS audit_checkpoints(
+	seq bigint PRIMARY KEY,
+	hash bytea NOT NULL,
+	signature bytea NOT NULL,
+	create_time timestamp with time zone NOT NULL
+);
+
+-- The head of the chain. Appending an event locks its only row, so events
+-- are appended one at a time in the order in which their transactions
+-- commit.
+CREATE TABLE IF NOT EXISTS audit_head(
+	id boolean PRIMARY KEY DEFAULT true CHECK (id),
+	seq bigint NOT NULL,
+	hash bytea NOT NULL
+);
+
+INSERT INTO audit_head (seq, hash)
+	VALUES (0, decode(repeat('00', 32), 'hex'))
+	ON CONFLICT DO NOTHING;
+
+-- The audit log is append-only. This does not stop a database superuser
+-- from rewriting it, but any such rewrite is detected by verification.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only
+	BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_checkpoints_append_only ON audit_checkpoints;
+CREATE TRIGGER audit_checkpoints_append_only
+	BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_checkpoints
+	FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
@@ -0,0 +1,7 @@
+-- Every event appended to the audit log is queued in the outbox in the same
+-- transaction, and removed only once it has been delivered to every sink.
+CREATE TABLE IF NOT EXISTS audit_outbox(
+	seq bigint PRIMARY KEY REFERENCES audit_events(seq),
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text
+);
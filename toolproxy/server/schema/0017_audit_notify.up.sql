@@ -0,0 +1,14 @@
+-- The sequence number and command ID of every event appended to the audit
+-- log are published when its transaction commits, so that every replica
+-- learns of every change to a command.
+CREATE OR REPLACE FUNCTION audit_events_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('toolproxy_audit', NEW.seq || ' ' || NEW.command_id);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_notify ON audit_events;
+CREATE TRIGGER audit_events_notify
+	AFTER INSERT ON audit_events
+	FOR EACH ROW EXECUTE PROCEDURE audit_events_notify();
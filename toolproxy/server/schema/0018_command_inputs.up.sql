@@ -0,0 +1,4 @@
+-- The standard input and input files of a command, with their digests, as
+-- a JSON-encoded CommandInputs message.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS inputs jsonb;
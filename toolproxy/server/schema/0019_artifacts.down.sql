@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS artifacts;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS artifact_paths;
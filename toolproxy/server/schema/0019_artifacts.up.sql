@@ -0,0 +1,16 @@
+-- The paths of files collected as artifacts once the command exits.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS artifact_paths text[];
+
+CREATE TABLE IF NOT EXISTS artifacts(
+	command_id integer NOT NULL REFERENCES commands(id),
+	artifact_id text NOT NULL,
+	path text NOT NULL,
+	content bytea,
+	size_bytes bigint NOT NULL DEFAULT 0,
+	sha256 text,
+	content_type text,
+	error text,
+	create_time timestamp with time zone,
+	PRIMARY KEY (command_id, artifact_id)
+);
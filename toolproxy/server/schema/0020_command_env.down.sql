@@ -0,0 +1,3 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS secret_env,
+	DROP COLUMN IF EXISTS env;
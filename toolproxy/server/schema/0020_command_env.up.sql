@@ -0,0 +1,6 @@
+-- The environment variables of a command as a JSON object, and references to
+-- the secrets set as environment variables as a JSON array of objects with
+-- `name` and `secret` keys. Secret values are never stored.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS env jsonb,
+	ADD COLUMN IF NOT EXISTS secret_env jsonb;
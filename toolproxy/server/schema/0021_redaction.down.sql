@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS unredacted_output;
+
+ALTER TABLE executions
+	DROP COLUMN IF EXISTS redactions;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS redactions;
@@ -0,0 +1,17 @@
+-- The names of the redaction rules which matched the output of a command or
+-- execution. Matches are replaced before the output is stored.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS redactions text[];
+
+ALTER TABLE executions
+	ADD COLUMN IF NOT EXISTS redactions text[];
+
+-- The output of commands from which anything was redacted, as it was written,
+-- encrypted with a key held only by the tool proxy. Each stream is bound to
+-- the command and stream from which it came.
+CREATE TABLE IF NOT EXISTS unredacted_output(
+	command_id integer PRIMARY KEY REFERENCES commands(id),
+	std_out bytea,
+	std_err bytea,
+	create_time timestamp with time zone
+);
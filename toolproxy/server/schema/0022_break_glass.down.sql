@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS commands_break_glass_review_open;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS break_glass_review_time,
+	DROP COLUMN IF EXISTS break_glass_review_comment,
+	DROP COLUMN IF EXISTS break_glass_reviewer_display_name,
+	DROP COLUMN IF EXISTS break_glass_reviewer,
+	DROP COLUMN IF EXISTS break_glass_time,
+	DROP COLUMN IF EXISTS break_glass_justification,
+	DROP COLUMN IF EXISTS break_glass_user_display_name,
+	DROP COLUMN IF EXISTS break_glass_user;
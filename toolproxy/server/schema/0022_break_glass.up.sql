@@ -0,0 +1,16 @@
+-- The use of break-glass to run a command without the approvals it required,
+-- and the post-incident review which it makes mandatory. A review is open
+-- while break_glass_time is set and break_glass_review_time is not.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS break_glass_user text,
+	ADD COLUMN IF NOT EXISTS break_glass_user_display_name text,
+	ADD COLUMN IF NOT EXISTS break_glass_justification text,
+	ADD COLUMN IF NOT EXISTS break_glass_time timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS break_glass_reviewer text,
+	ADD COLUMN IF NOT EXISTS break_glass_reviewer_display_name text,
+	ADD COLUMN IF NOT EXISTS break_glass_review_comment text,
+	ADD COLUMN IF NOT EXISTS break_glass_review_time timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS commands_break_glass_review_open
+	ON commands (break_glass_time)
+	WHERE break_glass_time IS NOT NULL AND break_glass_review_time IS NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS review_sample;
+
+DROP TABLE IF EXISTS reviews;
@@ -0,0 +1,19 @@
+-- Reviews of commands after they ran.
+CREATE TABLE IF NOT EXISTS reviews(
+	id serial PRIMARY KEY,
+	command_id integer NOT NULL REFERENCES commands(id),
+	reviewer text NOT NULL,
+	reviewer_display_name text,
+	verdict integer NOT NULL,
+	notes text,
+	create_time timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS reviews_command_id ON reviews (command_id, id);
+
+-- A number drawn uniformly from [0, 1) when a command is created. A command
+-- is sampled for review if it is less than the fraction of commands with its
+-- status which the sampling policy selects. Existing commands each draw one
+-- when the column is added.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS review_sample double precision NOT NULL DEFAULT random();
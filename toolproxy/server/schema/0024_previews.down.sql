@@ -0,0 +1,18 @@
+ALTER TABLE approvals
+	DROP COLUMN IF EXISTS override_preview;
+
+DROP INDEX IF EXISTS commands_preview_pending;
+
+ALTER TABLE commands
+	DROP COLUMN IF EXISTS preview_override_time,
+	DROP COLUMN IF EXISTS preview_overrider_display_name,
+	DROP COLUMN IF EXISTS preview_overrider,
+	DROP COLUMN IF EXISTS preview_executor,
+	DROP COLUMN IF EXISTS preview_end_time,
+	DROP COLUMN IF EXISTS preview_start_time,
+	DROP COLUMN IF EXISTS preview_error,
+	DROP COLUMN IF EXISTS preview_exit_code,
+	DROP COLUMN IF EXISTS preview_std_err,
+	DROP COLUMN IF EXISTS preview_std_out,
+	DROP COLUMN IF EXISTS preview_state,
+	DROP COLUMN IF EXISTS preview_argv;
@@ -0,0 +1,23 @@
+-- The dry run of a command, which approvers see before it runs. A command
+-- whose preview_state is set may only run once its preview has succeeded,
+-- unless the preview was overridden or the command was run by break-glass.
+ALTER TABLE commands
+	ADD COLUMN IF NOT EXISTS preview_argv text[],
+	ADD COLUMN IF NOT EXISTS preview_state integer,
+	ADD COLUMN IF NOT EXISTS preview_std_out bytea,
+	ADD COLUMN IF NOT EXISTS preview_std_err bytea,
+	ADD COLUMN IF NOT EXISTS preview_exit_code integer,
+	ADD COLUMN IF NOT EXISTS preview_error text,
+	ADD COLUMN IF NOT EXISTS preview_start_time timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS preview_end_time timestamp with time zone,
+	ADD COLUMN IF NOT EXISTS preview_executor text,
+	ADD COLUMN IF NOT EXISTS preview_overrider text,
+	ADD COLUMN IF NOT EXISTS preview_overrider_display_name text,
+	ADD COLUMN IF NOT EXISTS preview_override_time timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS commands_preview_pending
+	ON commands (create_time)
+	WHERE preview_state = 1;
+
+ALTER TABLE approvals
+	ADD COLUMN IF NOT EXISTS override_preview boolean NOT NULL DEFAULT false;